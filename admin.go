@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/qaisjp/go-discord-irc/bridge"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminCookie holds the admin token once it has been given in the URL
+const adminCookie = "admin_token"
+
+// adminHandler serves the admin dashboard, which is only available with the admin token
+type adminHandler struct {
+	token    string
+	networks []*network
+}
+
+// authorized returns true if the request has the admin token, as a bearer token or cookie
+func (a *adminHandler) authorized(r *http.Request) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if c, err := r.Cookie(adminCookie); err == nil && given == "" {
+		given = c.Value
+	}
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) == 1
+}
+
+func (a *adminHandler) network(name string) (*network, bool) {
+	for _, n := range a.networks {
+		if n.name == name {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// ServeDashboard shows the state of every network.
+// Visiting it with ?token= stores the token in a cookie, so it isn't left in the address bar.
+func (a *adminHandler) ServeDashboard(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     adminCookie,
+			Value:    token,
+			Path:     "/admin",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+		return
+	}
+
+	if !a.authorized(r) {
+		http.Error(w, "Visit /admin?token=<http_admin_token> to log in.", http.StatusUnauthorized)
+		return
+	}
+
+	type networkView struct {
+		Name         string
+		Health       bridge.Health
+		Mappings     []bridge.Mapping
+		Mirrors      map[string][]string
+		Puppets      []bridge.PuppetStatus
+		RelayErrors  []bridge.RelayError
+		ShowJoinQuit bool
+	}
+
+	var views []networkView
+	for _, n := range a.networks {
+		view := networkView{
+			Name:         n.name,
+			Health:       n.dib.Health(),
+			Mappings:     n.dib.Mappings(),
+			Mirrors:      make(map[string][]string),
+			Puppets:      n.dib.Puppets(),
+			RelayErrors:  n.dib.RelayErrors(),
+			ShowJoinQuit: n.dib.Config().ShowJoinQuit,
+		}
+		for _, m := range view.Mappings {
+			view.Mirrors[m.IRCChannel] = n.dib.DiscordMirrors(m.IRCChannel)
+		}
+		views = append(views, view)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, map[string]interface{}{
+		"Message":  r.URL.Query().Get("msg"),
+		"Networks": views,
+	})
+	if err != nil {
+		log.WithField("error", err).Warnln("could not render admin dashboard")
+	}
+}
+
+// ServeAction runs an action from the dashboard, then goes back to it
+func (a *adminHandler) ServeAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	n, ok := a.network(r.FormValue("network"))
+	if !ok {
+		http.Error(w, "Unknown network", http.StatusBadRequest)
+		return
+	}
+
+	msg := a.runAction(n, r.FormValue("action"), r)
+	log.WithField("network", n.name).WithField("action", r.FormValue("action")).Infoln("Admin action:", msg)
+	http.Redirect(w, r, "/admin?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+// runAction runs a dashboard action on a network, returning a message for the admin
+func (a *adminHandler) runAction(n *network, action string, r *http.Request) string {
+	ircChannel := r.FormValue("irc_channel")
+	switch action {
+	case "map":
+		if _, err := n.dib.MapChannel(ircChannel, r.FormValue("discord_channel"), r.FormValue("direction")); err != nil {
+			return fmt.Sprintf("Could not map %s: %s", ircChannel, err)
+		}
+		return fmt.Sprintf("Mapped %s.", ircChannel)
+	case "unmap":
+		if err := n.dib.UnmapChannel(ircChannel); err != nil {
+			return fmt.Sprintf("Could not unmap %s: %s", ircChannel, err)
+		}
+		return fmt.Sprintf("Unmapped %s.", ircChannel)
+	case "reconnect":
+		if err := n.dib.ReconnectIRC(); err != nil {
+			return fmt.Sprintf("Could not reconnect to IRC: %s", err)
+		}
+		return "Reconnecting to IRC."
+	case "restart":
+		n.dib.RestartIRC()
+		return "Restarting IRC connections with the current settings."
+	case "refresh_webhooks":
+		if err := n.dib.RefreshWebhooks(); err != nil {
+			return fmt.Sprintf("Could not refresh webhooks: %s", err)
+		}
+		return "Refreshed webhooks."
+	case "joinquit":
+		show := r.FormValue("show") == "true"
+		n.dib.SetShowJoinQuit(show)
+		if show {
+			return "Joins and quits are now shown on Discord."
+		}
+		return "Joins and quits are no longer shown on Discord."
+	}
+	return "Unknown action " + action
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>go-discord-irc</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+form { display: inline; }
+.bad { color: #b00; }
+</style>
+</head>
+<body>
+<h1>go-discord-irc</h1>
+{{with .Message}}<p><strong>{{.}}</strong></p>{{end}}
+{{range .Networks}}
+{{$network := .Name}}
+{{$view := .}}
+<h2>Network {{if .Name}}{{.Name}}{{else}}(default){{end}}</h2>
+<p>
+Discord: {{if .Health.DiscordConnected}}connected{{else}}<span class="bad">disconnected</span>{{end}},
+IRC: {{if .Health.IRCRegistered}}connected{{else}}<span class="bad">disconnected</span>{{end}}
+<form method="post" action="/admin/action">
+<input type="hidden" name="network" value="{{$network}}">
+<button name="action" value="reconnect">Reconnect IRC</button>
+<button name="action" value="restart">Restart IRC with new settings</button>
+<button name="action" value="refresh_webhooks">Refresh webhooks</button>
+</form>
+<form method="post" action="/admin/action">
+<input type="hidden" name="network" value="{{$network}}">
+<input type="hidden" name="action" value="joinquit">
+{{if .ShowJoinQuit}}
+<button name="show" value="false">Hide joins and quits</button>
+{{else}}
+<button name="show" value="true">Show joins and quits</button>
+{{end}}
+</form>
+</p>
+
+<h3>Mappings</h3>
+<table>
+<tr><th>IRC</th><th>Discord</th><th>Mirrors</th><th>Direction</th><th>Joined</th><th></th></tr>
+{{range .Mappings}}
+<tr>
+<td>{{.IRCChannel}}</td>
+<td>{{.DiscordChannel}}</td>
+<td>{{range index $view.Mirrors .IRCChannel}}{{.}} {{end}}</td>
+<td>{{if .Direction}}{{.Direction}}{{else}}both{{end}}</td>
+<td>{{if index $view.Health.Channels .IRCChannel}}yes{{else}}<span class="bad">no</span>{{end}}</td>
+<td><form method="post" action="/admin/action">
+<input type="hidden" name="network" value="{{$network}}">
+<input type="hidden" name="irc_channel" value="{{.IRCChannel}}">
+<button name="action" value="unmap">Unmap</button>
+</form></td>
+</tr>
+{{end}}
+</table>
+<form method="post" action="/admin/action">
+<input type="hidden" name="network" value="{{$network}}">
+<input name="irc_channel" placeholder="#irc-channel" required>
+<input name="discord_channel" placeholder="discord channel or ID" required>
+<select name="direction">
+<option value="">both ways</option>
+<option value="irc_to_discord">IRC to Discord only</option>
+<option value="discord_to_irc">Discord to IRC only</option>
+</select>
+<button name="action" value="map">Map</button>
+</form>
+
+<h3>Puppets ({{len .Puppets}})</h3>
+<table>
+<tr><th>Nick</th><th>Discord ID</th><th>Connected</th><th>Away</th></tr>
+{{range .Puppets}}
+<tr><td>{{.Nick}}</td><td>{{.DiscordID}}</td><td>{{if .Connected}}yes{{else}}no{{end}}</td><td>{{.Away}}</td></tr>
+{{end}}
+</table>
+
+<h3>Recent relay errors</h3>
+{{if .RelayErrors}}
+<table>
+{{range .RelayErrors}}
+<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Message}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>None</p>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/qaisjp/go-discord-irc/bridge"
+)
+
+// apiHandler serves the JSON admin API, for tools that manage the bridge.
+// Requests need the admin token as a bearer token, and can pick a
+// network with ?network=name (the default network otherwise).
+type apiHandler struct {
+	*adminHandler
+}
+
+// apiMapping is a channel mapping in API requests and responses
+type apiMapping struct {
+	IRCChannel     string   `json:"irc_channel"`
+	DiscordChannel string   `json:"discord_channel"`
+	Mirrors        []string `json:"mirrors,omitempty"`
+	Direction      string   `json:"direction,omitempty"`
+}
+
+// apiStatus is the state of a network
+type apiStatus struct {
+	Health       bridge.Health                  `json:"health"`
+	Queues       map[string]bridge.ChannelDepth `json:"queues"`
+	ShowJoinQuit bool                           `json:"show_joinquit"`
+	Puppets      []bridge.PuppetStatus          `json:"puppets"`
+	RelayErrors  []bridge.RelayError            `json:"relay_errors"`
+}
+
+// apiPause is the body of POST /api/pause and /api/resume, both empty to mean both directions
+// and queueing messages
+type apiPause struct {
+	Direction string `json:"direction,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func (a *apiHandler) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/status", a.handle(http.MethodGet, a.status))
+	mux.HandleFunc("/api/mappings", a.handle("", a.mappings))
+	mux.HandleFunc("/api/reconnect/irc", a.handle(http.MethodPost, a.reconnectIRC))
+	mux.HandleFunc("/api/restart/irc", a.handle(http.MethodPost, a.restartIRC))
+	mux.HandleFunc("/api/pause", a.handle(http.MethodPost, a.pause))
+	mux.HandleFunc("/api/resume", a.handle(http.MethodPost, a.pause))
+}
+
+// handle checks the request is authorized, allowed, and for a known network, before calling fn
+func (a *apiHandler) handle(method string, fn func(http.ResponseWriter, *http.Request, *network)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			writeJSON(w, http.StatusUnauthorized, apiError{"missing or wrong admin token"})
+			return
+		}
+		if method != "" && r.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+
+		n, ok := a.network(r.URL.Query().Get("network"))
+		if !ok {
+			writeJSON(w, http.StatusNotFound, apiError{"unknown network"})
+			return
+		}
+		fn(w, r, n)
+	}
+}
+
+// status handles GET /api/status
+func (a *apiHandler) status(w http.ResponseWriter, r *http.Request, n *network) {
+	writeJSON(w, http.StatusOK, apiStatus{
+		Health:       n.dib.Health(),
+		Queues:       n.dib.RelayQueues(),
+		ShowJoinQuit: n.dib.Config().ShowJoinQuit,
+		Puppets:      n.dib.Puppets(),
+		RelayErrors:  n.dib.RelayErrors(),
+	})
+}
+
+// mappings handles GET /api/mappings to list mappings, POST to add or change one,
+// and DELETE ?irc_channel=#channel to remove one.
+func (a *apiHandler) mappings(w http.ResponseWriter, r *http.Request, n *network) {
+	switch r.Method {
+	case http.MethodGet:
+		mappings := []apiMapping{}
+		for _, m := range n.dib.Mappings() {
+			mappings = append(mappings, apiMapping{
+				IRCChannel:     m.IRCChannel,
+				DiscordChannel: m.DiscordChannel,
+				Mirrors:        n.dib.DiscordMirrors(m.IRCChannel),
+				Direction:      m.Direction,
+			})
+		}
+		writeJSON(w, http.StatusOK, mappings)
+
+	case http.MethodPost:
+		var m apiMapping
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m.IRCChannel == "" || m.DiscordChannel == "" {
+			writeJSON(w, http.StatusBadRequest, apiError{"expected a JSON object with irc_channel and discord_channel"})
+			return
+		}
+
+		discordChannel, err := n.dib.MapChannel(m.IRCChannel, m.DiscordChannel, m.Direction)
+		if err != nil {
+			writeJSON(w, mappingErrorStatus(err), apiError{err.Error()})
+			return
+		}
+		m.DiscordChannel = discordChannel
+		writeJSON(w, http.StatusOK, m)
+
+	case http.MethodDelete:
+		if err := n.dib.UnmapChannel(r.URL.Query().Get("irc_channel")); err != nil {
+			writeJSON(w, mappingErrorStatus(err), apiError{err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+	}
+}
+
+// mappingErrorStatus returns the status code for an error from changing a mapping
+func mappingErrorStatus(err error) int {
+	if err == bridge.ErrMappingNotSaved {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// reconnectIRC handles POST /api/reconnect/irc
+func (a *apiHandler) reconnectIRC(w http.ResponseWriter, r *http.Request, n *network) {
+	if err := n.dib.ReconnectIRC(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// restartIRC handles POST /api/restart/irc
+func (a *apiHandler) restartIRC(w http.ResponseWriter, r *http.Request, n *network) {
+	n.dib.RestartIRC()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// pause handles POST /api/pause and /api/resume
+func (a *apiHandler) pause(w http.ResponseWriter, r *http.Request, n *network) {
+	var p apiPause
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{"expected a JSON object with direction and mode"})
+			return
+		}
+	}
+
+	var err error
+	if r.URL.Path == "/api/resume" {
+		err = n.dib.ResumeRelay(p.Direction)
+	} else {
+		err = n.dib.PauseRelay(p.Direction, p.Mode)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, n.dib.RelayPauses())
+}
@@ -0,0 +1,147 @@
+package bridge
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// relayErrorsKept is how many recent relay errors are kept for admins to see
+const relayErrorsKept = 50
+
+// RelayError is a message that could not be relayed
+type RelayError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// relayErrors keeps the most recent relay errors
+type relayErrors struct {
+	sync.Mutex
+	errors []RelayError
+}
+
+func (r *relayErrors) Add(format string, args ...interface{}) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.errors = append(r.errors, RelayError{Time: time.Now(), Message: fmt.Sprintf(format, args...)})
+	if len(r.errors) > relayErrorsKept {
+		r.errors = r.errors[len(r.errors)-relayErrorsKept:]
+	}
+}
+
+// List returns the relay errors, newest first
+func (r *relayErrors) List() []RelayError {
+	r.Lock()
+	defer r.Unlock()
+
+	list := make([]RelayError, len(r.errors))
+	for i, e := range r.errors {
+		list[len(list)-1-i] = e
+	}
+	return list
+}
+
+// RelayErrors returns the most recent messages that could not be relayed, newest first
+func (b *Bridge) RelayErrors() []RelayError {
+	return b.relayErrors.List()
+}
+
+// PuppetStatus describes a puppet for admins
+type PuppetStatus struct {
+	DiscordID string `json:"discord_id"`
+	Nick      string `json:"nick"`
+	Connected bool   `json:"connected"`
+	Away      string `json:"away,omitempty"`
+}
+
+// Puppets returns the puppets, sorted by nick
+func (b *Bridge) Puppets() []PuppetStatus {
+	var puppets []PuppetStatus
+	for _, con := range b.ircManager.connections() {
+		puppets = append(puppets, PuppetStatus{
+			DiscordID: con.discord.ID,
+			Nick:      con.nick,
+			Connected: con.Connected(),
+			Away:      con.away,
+		})
+	}
+
+	sort.Slice(puppets, func(i, j int) bool {
+		return puppets[i].Nick < puppets[j].Nick
+	})
+	return puppets
+}
+
+// Mappings returns the channel mappings in use
+func (b *Bridge) Mappings() []Mapping {
+	current := b.mappingTable().mappings
+	mappings := make([]Mapping, len(current))
+	copy(mappings, current)
+	return mappings
+}
+
+// DiscordMirrors returns the Discord channels that IRC messages for a channel are also sent to
+func (b *Bridge) DiscordMirrors(ircChannel string) []string {
+	return b.mappingTable().discordMirrors[ircChannel]
+}
+
+// ReconnectIRC reconnects the IRC listener
+func (b *Bridge) ReconnectIRC() error {
+	return b.ircListener.Reconnect()
+}
+
+// RestartIRC reconnects the IRC listener and puppets with the current config, for example after
+// changing the server or passwords. The Discord session and webhooks are left alone.
+func (b *Bridge) RestartIRC() {
+	select {
+	case b.restartIRCChan <- struct{}{}:
+	default:
+		// a restart is already queued
+	}
+}
+
+// RefreshWebhooks forgets the webhooks used to relay IRC messages, and finds them again
+func (b *Bridge) RefreshWebhooks() error {
+	return b.discord.transmitter.RefreshGuildWebhooks(nil)
+}
+
+// SetWebhookRotation changes how many webhooks take turns relaying IRC messages in each channel
+func (b *Bridge) SetWebhookRotation(n int) {
+	b.applyConfig(func(conf *Config) {
+		conf.WebhookRotation = n
+	}, func() {
+		if b.discord.transmitter != nil {
+			b.discord.transmitter.SetRotate(n)
+		}
+	})
+}
+
+// SetChannelWebhooks changes the webhook URLs used to relay to some Discord channels, by channel ID
+func (b *Bridge) SetChannelWebhooks(urls map[string]string) {
+	b.applyConfig(func(conf *Config) {
+		conf.ChannelWebhooks = urls
+	}, func() {
+		if b.discord.transmitter != nil {
+			b.discord.transmitter.SetWebhooks(parseChannelWebhooks(urls))
+		}
+	})
+}
+
+// SetShowJoinQuit changes whether IRC joins, parts, quits and kicks are shown on Discord
+func (b *Bridge) SetShowJoinQuit(show bool) {
+	b.applyConfig(func(conf *Config) {
+		conf.ShowJoinQuit = show
+	}, b.ircListener.OnJoinQuitSettingChange)
+}
+
+// SetJoinQuitEvents changes the kinds of join and quit event shown on Discord,
+// see Config.JoinQuitEvents and Config.JoinQuitChannelEvents
+func (b *Bridge) SetJoinQuitEvents(events map[string]struct{}, channelEvents map[string]map[string]struct{}) {
+	b.applyConfig(func(conf *Config) {
+		conf.JoinQuitEvents = events
+		conf.JoinQuitChannelEvents = channelEvents
+	}, b.ircListener.OnJoinQuitSettingChange)
+}
@@ -0,0 +1,170 @@
+package bridge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// adminCommandsHelp lists the commands adminReply understands
+const adminCommandsHelp = "status, reload, join <#channel>, part <#channel>, who <discord user>, puppets, " +
+	"pause [discord_to_irc|irc_to_discord] [queue|drop], resume [discord_to_irc|irc_to_discord]"
+
+// SetReload sets what the "reload" admin command runs, which should reload the config.
+// Without it, "reload" is not available. It must be set before Open.
+func (b *Bridge) SetReload(reload func() error) {
+	b.reload = reload
+}
+
+// adminReply runs an admin command (see adminCommandsHelp) sent to the listener by an admin,
+// returning a reply for them. Returns false if message is not one of these commands, or if they
+// aren't an admin, so that other people can still PM Discord users with these words.
+func (b *Bridge) adminReply(admin bool, message string) (string, bool) {
+	fields := strings.Fields(message)
+	if !admin || len(fields) == 0 {
+		return "", false
+	}
+
+	switch fields[0] {
+	case "status", "reload", "join", "part", "who", "puppets", "pause", "resume", "help":
+	default:
+		return "", false
+	}
+
+	arg := strings.Join(fields[1:], " ")
+	switch {
+	case fields[0] == "status" && arg == "":
+		return b.statusReply(), true
+	case fields[0] == "reload" && arg == "":
+		if b.reload == nil {
+			return "The config can't be reloaded from here.", true
+		}
+		if err := b.reload(); err != nil {
+			return fmt.Sprintf("Could not reload the config: %s.", err), true
+		}
+		return "Reloaded the config.", true
+	case fields[0] == "join" && len(fields) == 2:
+		if !b.ircListener.isupport.IsChannel(arg) {
+			return fmt.Sprintf("%s is not an IRC channel.", arg), true
+		}
+		b.ircListener.Join(b.channelWithKey(arg))
+		return fmt.Sprintf("Joining %s.", arg), true
+	case fields[0] == "part" && len(fields) == 2:
+		if !b.ircListener.isupport.IsChannel(arg) {
+			return fmt.Sprintf("%s is not an IRC channel.", arg), true
+		}
+		b.ircListener.Part(arg)
+		return fmt.Sprintf("Leaving %s. It will be joined again on reconnect if it is mapped.", arg), true
+	case fields[0] == "who" && arg != "":
+		return b.whoReply(arg), true
+	case fields[0] == "puppets" && arg == "":
+		return b.puppetsReply(), true
+	case (fields[0] == "pause" && len(fields) <= 3) || (fields[0] == "resume" && len(fields) <= 2):
+		return b.pauseCommandReply(fields[0], fields[1:]), true
+	default:
+		return "Admin commands: " + adminCommandsHelp, true
+	}
+}
+
+// channelWithKey returns channel with its key from the channel mappings, if it has one, for JOIN
+func (b *Bridge) channelWithKey(channel string) string {
+	for c, key := range b.mappingTable().ircChannelKeys {
+		if b.IRCEqualFold(c, channel) {
+			return channel + " " + key
+		}
+	}
+	return channel
+}
+
+// statusReply describes the bridge's connections and channels on one line
+func (b *Bridge) statusReply() string {
+	h := b.Health()
+
+	var channels []string
+	for channel, joined := range h.Channels {
+		if !joined {
+			channel += " (not joined)"
+		}
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	queues := b.RelayQueues()
+	var paused string
+	for _, direction := range []string{DirectionDiscordToIRC, DirectionIRCToDiscord} {
+		if mode, ok := h.Paused[direction]; ok {
+			paused += fmt.Sprintf(" Paused %s (%s).", pauseDescription(direction), mode)
+		}
+	}
+	return fmt.Sprintf("Discord connected: %t. IRC registered: %t. IRC lag: %dms. Discord lag: %dms. Puppets: %d. Queued: %d to Discord, %d to IRC. Channels: %s.%s",
+		h.DiscordConnected, h.IRCRegistered, h.IRCLag, h.DiscordLag, b.ircManager.connectionCount(),
+		queues[queueIRCToDiscord].Len, queues[queueDiscordToIRC].Len, strings.Join(channels, ", "), paused)
+}
+
+// puppetsReply lists the puppets on one line
+func (b *Bridge) puppetsReply() string {
+	puppets := b.Puppets()
+	if len(puppets) == 0 {
+		return "There are no puppets."
+	}
+
+	var nicks []string
+	for _, p := range puppets {
+		nick := p.Nick
+		if !p.Connected {
+			nick += " (connecting)"
+		} else if p.Away != "" {
+			nick += " (away)"
+		}
+		nicks = append(nicks, nick)
+	}
+	return fmt.Sprintf("%d puppets: %s", len(puppets), strings.Join(nicks, ", "))
+}
+
+// whoReply describes a Discord member (by mention, ID, username or nickname) and their puppet
+func (b *Bridge) whoReply(name string) string {
+	member, ok := b.discord.findMember(name)
+	if !ok {
+		return fmt.Sprintf("Could not find the Discord user %s.", name)
+	}
+
+	user := member.User
+	reply := fmt.Sprintf("%s (%s, ID %s)", user.Username, member.Nick, user.ID)
+	if member.Nick == "" {
+		reply = fmt.Sprintf("%s (ID %s)", user.Username, user.ID)
+	}
+
+	if con, ok := b.ircManager.connection(user.ID); ok {
+		reply += fmt.Sprintf(" has the puppet %s!%s@%s", con.nick, b.ircManager.generateUsername(con.discord), b.WebIRCHostname(con.discord))
+		if !con.Connected() {
+			reply += " (connecting)"
+		} else if con.away != "" {
+			reply += " (away: " + con.away + ")"
+		}
+	} else {
+		reply += " has no puppet"
+	}
+
+	if nick, ok := b.LinkedNick(user.ID); ok {
+		reply += ", and is linked to " + nick
+	}
+	return reply + "."
+}
+
+// findMember finds a member of a bridged guild by mention (<@id>), ID, username or nickname
+func (d *discordBot) findMember(name string) (*discordgo.Member, bool) {
+	name = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(name, "<@"), "!"), ">")
+
+	if member, _, err := d.member(name); err == nil {
+		return member, true
+	}
+
+	for _, member := range d.members() {
+		if strings.EqualFold(member.User.Username, name) || strings.EqualFold(member.Nick, name) {
+			return member, true
+		}
+	}
+	return nil, false
+}
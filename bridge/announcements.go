@@ -0,0 +1,73 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Discord only allows announcementLimit messages to be published in each channel every announcementPeriod
+const (
+	announcementLimit  = 10
+	announcementPeriod = time.Hour
+)
+
+// isCrosspost returns true if a message was published in an announcement channel in another
+// server, and posted here because the channel follows it. Discord posts these with a webhook
+// named after the server and channel they came from, which is who they are relayed as.
+func isCrosspost(m *discordgo.Message) bool {
+	return m.WebhookID != "" && m.MessageReference != nil &&
+		m.MessageReference.GuildID != "" && m.MessageReference.GuildID != m.GuildID
+}
+
+// announcements remembers when messages were published in each channel, so that messages over
+// Discord's limit are left unpublished rather than holding up the channel until it allows more
+type announcements struct {
+	sync.Mutex
+	published map[string][]time.Time // Discord channel ID to times in the last announcementPeriod
+}
+
+func newAnnouncements() *announcements {
+	return &announcements{published: make(map[string][]time.Time)}
+}
+
+// allow returns true, and records it, if a message can be published in channel now
+func (a *announcements) allow(channel string, now time.Time) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	var recent []time.Time
+	for _, t := range a.published[channel] {
+		if now.Sub(t) < announcementPeriod {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= announcementLimit {
+		a.published[channel] = recent
+		return false
+	}
+	a.published[channel] = append(recent, now)
+	return true
+}
+
+// publishAnnouncement publishes a message relayed from IRC to an announcement channel, so that it
+// reaches the channels following it, if Config.PublishAnnouncements is set
+func (b *Bridge) publishAnnouncement(sent *discordgo.Message) {
+	if !b.Config().PublishAnnouncements {
+		return
+	}
+
+	channel, err := b.discord.Session.State.Channel(sent.ChannelID)
+	if err != nil || channel.Type != discordgo.ChannelTypeGuildNews {
+		return
+	}
+
+	if !b.announcements.allow(sent.ChannelID, time.Now()) {
+		discordLog.WithField("channel", sent.ChannelID).Warnln("not publishing announcement, too many were published in the last hour")
+		return
+	}
+	if _, err := b.discord.Session.ChannelMessageCrosspost(sent.ChannelID, sent.ID); err != nil {
+		discordLog.WithField("error", err).WithField("channel", sent.ChannelID).Warnln("could not publish announcement")
+	}
+}
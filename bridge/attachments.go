@@ -0,0 +1,23 @@
+package bridge
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/qaisjp/go-discord-irc/rehost"
+)
+
+// attachmentURL returns the URL of a Discord attachment to relay to IRC. With Config.Rehost,
+// this is a copy of the attachment, as Discord's URLs expire and some networks block them.
+// The Discord URL is used if the attachment is too large or can't be copied.
+func (b *Bridge) attachmentURL(a *discordgo.MessageAttachment) string {
+	conf := b.Config()
+	if conf.Rehost == nil || int64(a.Size) > conf.RehostMaxSize {
+		return a.URL
+	}
+
+	link, err := conf.Rehost.Rehost(a.URL, rehost.Name(a.ID, a.Filename), conf.RehostMaxSize)
+	if err != nil {
+		discordLog.WithError(err).WithField("attachment", a.ID).Warnln("Could not rehost attachment, relaying the Discord URL")
+		return a.URL
+	}
+	return link
+}
@@ -0,0 +1,138 @@
+package bridge
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// autoMapInterval is how often Discord channels are re-scanned for automatic mappings
+const autoMapInterval = time.Minute
+
+// autoMapTopicRegex finds "irc:#channel" in a Discord channel topic
+var autoMapTopicRegex = regexp.MustCompile(`(?:^|\s)irc:([#&]\S+)`)
+
+// autoMappings returns the channel mappings found by naming convention, from IRC channel to Discord channel.
+// Discord channels are mapped if their topic contains "irc:#channel",
+// or if their name starts with Config.AutoMapNamePrefix.
+func (d *discordBot) autoMappings() map[string]string {
+	mappings := make(map[string]string)
+	if !d.bridge.Config().AutoMap {
+		return mappings
+	}
+
+	prefix := d.bridge.Config().AutoMapNamePrefix
+	for _, c := range d.channels() {
+		if c.Type != discordgo.ChannelTypeGuildText {
+			continue
+		}
+
+		var ircChannel string
+		if match := autoMapTopicRegex.FindStringSubmatch(c.Topic); match != nil {
+			ircChannel = match[1]
+		} else if prefix != "" && strings.HasPrefix(c.Name, prefix) && len(c.Name) > len(prefix) {
+			ircChannel = "#" + strings.TrimPrefix(c.Name, prefix)
+		} else {
+			continue
+		}
+
+		if other, ok := mappings[ircChannel]; ok {
+			discordLog.WithField("irc", ircChannel).WithField("discord", c.ID).WithField("other", other).
+				Warnln("More than one Discord channel is automatically mapped to the same IRC channel. Ignoring.")
+			continue
+		}
+		mappings[ircChannel] = c.ID
+	}
+	return mappings
+}
+
+// withAutoMappings returns the config mappings with the automatic mappings added,
+// except for channels the config already maps.
+func (b *Bridge) withAutoMappings(config map[string]string, auto map[string]string) map[string]string {
+	mappings := make(map[string]string, len(config)+len(auto))
+	discordChannels := make(map[string]struct{})
+	for irc, discord := range config {
+		mappings[irc] = discord
+		if fields := strings.Fields(discord); len(fields) > 0 {
+			for _, channel := range strings.Split(fields[0], ",") {
+				discordChannels[strings.TrimSpace(channel)] = struct{}{}
+			}
+		}
+	}
+
+	for ircChannel, discord := range auto {
+		if _, ok := discordChannels[discord]; ok {
+			continue
+		}
+
+		mapped := false
+		for irc := range config {
+			if fields := strings.Fields(irc); len(fields) > 0 && b.IRCEqualFold(fields[0], ircChannel) {
+				mapped = true
+				break
+			}
+		}
+		if !mapped {
+			mappings[ircChannel] = discord
+		}
+	}
+	return mappings
+}
+
+// effectiveMappings returns the channel mappings to use: the config mappings,
+// with automatic mappings added, and the mappings changed by admins applied on top.
+func (b *Bridge) effectiveMappings(config map[string]string, stored map[string]string) map[string]string {
+	return b.withStoredMappings(b.withAutoMappings(config, b.autoMappings), stored)
+}
+
+// rescanAutoMappings applies any changes to the automatic channel mappings
+func (b *Bridge) rescanAutoMappings() {
+	auto := b.discord.autoMappings()
+
+	b.mappingsMu.Lock()
+	defer b.mappingsMu.Unlock()
+	if (len(auto) == 0 && len(b.autoMappings) == 0) || reflect.DeepEqual(auto, b.autoMappings) {
+		return
+	}
+
+	old := b.autoMappings
+	b.autoMappings = auto
+	if err := b.setChannelMappings(b.effectiveMappings(b.configMappings, b.storedMappings())); err != nil {
+		b.autoMappings = old
+		discordLog.WithField("error", err).Errorln("could not apply automatic channel mappings")
+		return
+	}
+	discordLog.Println("Automatic channel mappings updated!")
+}
+
+// queueAutoMapScan asks the bridge loop to re-scan for automatic mappings soon
+func (d *discordBot) queueAutoMapScan(guildID string) {
+	if !d.bridge.Config().AutoMap || !d.bridgesGuild(guildID) {
+		return
+	}
+
+	select {
+	case d.bridge.autoMapChan <- struct{}{}:
+	default:
+		// a scan is already queued
+	}
+}
+
+func (d *discordBot) onGuildCreate(s *discordgo.Session, e *discordgo.GuildCreate) {
+	d.queueAutoMapScan(e.ID)
+}
+
+func (d *discordBot) onChannelCreate(s *discordgo.Session, e *discordgo.ChannelCreate) {
+	d.queueAutoMapScan(e.GuildID)
+}
+
+func (d *discordBot) onChannelUpdate(s *discordgo.Session, e *discordgo.ChannelUpdate) {
+	d.queueAutoMapScan(e.GuildID)
+}
+
+func (d *discordBot) onChannelDelete(s *discordgo.Session, e *discordgo.ChannelDelete) {
+	d.queueAutoMapScan(e.GuildID)
+}
@@ -0,0 +1,191 @@
+package bridge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/qaisjp/go-discord-irc/unfurl"
+)
+
+// Values for Config.AvatarCommand, whether IRC users can choose their avatar on Discord with avatarCommand
+const (
+	AvatarCommandOff = "off"
+	AvatarCommandOn  = "on"
+	// AvatarCommandReview only uses an avatar once a moderator approves it in Config.ModChannel
+	AvatarCommandReview = "review"
+)
+
+// Store buckets for avatars chosen with avatarCommand, by folded IRC account
+const (
+	chosenAvatarsBucket  = "avatars_chosen"  // avatar URLs
+	pendingAvatarsBucket = "avatars_pending" // "<nick> <avatar url>", waiting to be reviewed
+)
+
+// avatarCommand, sent to the listener in a PM, sets the avatar an IRC user has on Discord
+const avatarCommand = "setavatar"
+
+// avatarReviewPrefix starts the custom ID of the buttons on an avatar review, followed by
+// approve or reject, avatarReviewHash of the avatar and the user's key, separated by colons
+const avatarReviewPrefix = "review_avatar"
+
+// chosenAvatar returns the avatar an IRC user chose with avatarCommand. Only users logged in
+// to an account can have one, as anyone could take a nick to choose the avatar of whoever uses it next.
+func (b *Bridge) chosenAvatar(account string) (string, bool) {
+	if account == "" || b.Config().AvatarCommand == AvatarCommandOff {
+		return "", false
+	}
+	return b.store.Get(chosenAvatarsBucket, b.ircListener.isupport.Fold(account))
+}
+
+// avatarReply runs avatarCommand for an IRC user, returning a reply for them.
+// Returns false if message is not avatarCommand.
+func (b *Bridge) avatarReply(account, nick, message string) (string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], avatarCommand) {
+		return "", false
+	}
+
+	conf := b.Config()
+	if conf.AvatarCommand == AvatarCommandOff {
+		return "Avatars can't be changed on this bridge.", true
+	}
+	if len(fields) != 2 {
+		return fmt.Sprintf("Usage: %s <image url>|clear", avatarCommand), true
+	}
+
+	if account == "" {
+		return "You need to be logged in to an account to choose your avatar.", true
+	}
+	key := b.ircListener.isupport.Fold(account)
+
+	if fields[1] == "clear" {
+		err := b.store.Delete(chosenAvatarsBucket, key)
+		if err == nil {
+			err = b.store.Delete(pendingAvatarsBucket, key)
+		}
+		if err != nil {
+			listenerLog.WithError(err).WithField("key", key).Errorln("could not clear chosen avatar")
+			return "Sorry, your avatar could not be cleared.", true
+		}
+		return "Your avatar on Discord is back to the default.", true
+	}
+
+	avatar := fields[1]
+	if !unfurl.IsImageURL(avatar) {
+		return "That isn't a link to an image, it should end in .png, .jpg, .gif or .webp.", true
+	}
+
+	if conf.AvatarCommand != AvatarCommandReview {
+		if err := b.store.Set(chosenAvatarsBucket, key, avatar); err != nil {
+			listenerLog.WithError(err).WithField("key", key).Errorln("could not save chosen avatar")
+			return "Sorry, your avatar could not be saved.", true
+		}
+		return "Your avatar on Discord has been changed.", true
+	}
+
+	if conf.ModChannel == "" {
+		return "Avatars have to be approved by a moderator here, but there is nowhere to ask them.", true
+	}
+	if err := b.store.Set(pendingAvatarsBucket, key, nick+" "+avatar); err != nil {
+		listenerLog.WithError(err).WithField("key", key).Errorln("could not save avatar for review")
+		return "Sorry, your avatar could not be saved.", true
+	}
+	go b.requestAvatarReview(conf.ModChannel, key, nick, avatar)
+	return "Your new avatar will be used once a moderator approves it.", true
+}
+
+// avatarReviewHash identifies an avatar URL in the custom ID of a review button, which is too short for the URL
+func avatarReviewHash(avatar string) string {
+	sum := sha256.Sum256([]byte(avatar))
+	return hex.EncodeToString(sum[:4])
+}
+
+// requestAvatarReview asks the moderators in channel to approve or reject an avatar
+func (b *Bridge) requestAvatarReview(channel, key, nick, avatar string) {
+	customID := func(action string) string {
+		return strings.Join([]string{avatarReviewPrefix, action, avatarReviewHash(avatar), key}, ":")
+	}
+
+	_, err := b.discord.Session.ChannelMessageSendComplex(channel, &discordgo.MessageSend{
+		Content:         fmt.Sprintf("IRC user `%s` wants to use this avatar on Discord: %s", nick, avatar),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: "Approve", Style: discordgo.SuccessButton, CustomID: customID("approve")},
+				discordgo.Button{Label: "Reject", Style: discordgo.DangerButton, CustomID: customID("reject")},
+			},
+		}},
+	})
+	if err != nil {
+		discordLog.WithError(err).Errorln("could not ask for an avatar to be reviewed")
+	}
+}
+
+// onAvatarReview uses or forgets an avatar when a moderator clicks Approve or Reject on its review,
+// telling the IRC user which it was
+func (d *discordBot) onAvatarReview(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	parts := strings.SplitN(i.MessageComponentData().CustomID, ":", 4)
+	if len(parts) != 4 || parts[0] != avatarReviewPrefix {
+		return
+	}
+	action, hash, key := parts[1], parts[2], parts[3]
+
+	user := i.User
+	if i.Member != nil {
+		user = i.Member.User
+	}
+	if user == nil {
+		return
+	}
+
+	b := d.bridge
+	pending, ok := b.store.Get(pendingAvatarsBucket, key)
+	fields := strings.SplitN(pending, " ", 2)
+	if !ok || len(fields) != 2 || avatarReviewHash(fields[1]) != hash {
+		d.updateAvatarReview(i, "This avatar was replaced or cleared before it was reviewed.")
+		return
+	}
+	nick, avatar := fields[0], fields[1]
+
+	var err error
+	if action == "approve" {
+		err = b.store.Set(chosenAvatarsBucket, key, avatar)
+	}
+	if err == nil {
+		err = b.store.Delete(pendingAvatarsBucket, key)
+	}
+	if err != nil {
+		discordLog.WithError(err).WithField("key", key).Errorln("could not save reviewed avatar")
+		d.respond(i.Interaction, "Sorry, the avatar could not be saved.")
+		return
+	}
+
+	if action == "approve" {
+		b.ircListener.Notice(nick, "Your new avatar on Discord has been approved.")
+		d.updateAvatarReview(i, "Approved by "+user.Username+".")
+	} else {
+		b.ircListener.Notice(nick, "Your new avatar on Discord was not approved.")
+		d.updateAvatarReview(i, "Rejected by "+user.Username+".")
+	}
+}
+
+// updateAvatarReview adds outcome to a review and removes its buttons
+func (d *discordBot) updateAvatarReview(i *discordgo.InteractionCreate, outcome string) {
+	err := d.Session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:         i.Message.Content + "\n" + outcome,
+			Components:      []discordgo.MessageComponent{},
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		},
+	})
+	if err != nil {
+		discordLog.WithError(err).Warnln("Could not respond to avatar review button")
+	}
+}
@@ -0,0 +1,150 @@
+package bridge
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	irctags "github.com/qaisjp/go-discord-irc/irc/tags"
+	"github.com/qaisjp/go-discord-irc/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// ircAvatar returns the avatar to relay an IRC message with. This is the one in AvatarOverrides
+// for their account or nick, that of the Discord member with the same name, the Gravatar of
+// their account's email (with AvatarGravatar), or otherwise AvatarURL.
+func (b *Bridge) ircAvatar(msg IRCMessage) string {
+	conf := b.Config()
+	account := irctags.Account(msg.Tags)
+
+	for _, name := range []string{account, msg.Nick} {
+		if name == "" {
+			continue
+		}
+		for override, avatar := range conf.AvatarOverrides {
+			if b.IRCEqualFold(override, name) {
+				return avatar
+			}
+		}
+	}
+
+	if avatar, ok := b.chosenAvatar(account); ok {
+		return avatar
+	}
+
+	if avatar := b.discord.GetAvatar(msg.Username); avatar != "" {
+		return avatar
+	}
+
+	// If we don't have a Discord avatar, generate an adorable avatar
+	hash := emailHash(msg.Nick)
+	if account != "" {
+		hash = emailHash(account)
+	}
+	fallback := strings.NewReplacer(
+		"${USERNAME}", msg.Username,
+		"${ACCOUNT}", account,
+		"${HASH}", hash,
+	).Replace(conf.AvatarURL)
+
+	if conf.AvatarGravatar && account != "" {
+		if avatar, ok := b.gravatar(account, fallback); ok {
+			return avatar
+		}
+	}
+	return fallback
+}
+
+// avatarsBucket keeps the avatars found for IRC nicks, as "<discord user id> <avatar url>",
+// so the avatar cache is warm after a restart
+const avatarsBucket = "avatars"
+
+type cachedAvatar struct {
+	// userID is the Discord member the avatar belongs to, empty if no member matched
+	userID string
+	url    string
+	found  time.Time
+}
+
+// avatarCache remembers the avatar GetAvatar found for each IRC nick, so busy channels
+// don't search every guild member for every message. Entries for a member are
+// forgotten when the member changes, as their name or avatar may have changed.
+type avatarCache struct {
+	sync.Mutex
+	avatars map[string]cachedAvatar
+	store   *store.Store
+}
+
+// newAvatarCache returns a cache warmed with the avatars saved in s
+func newAvatarCache(s *store.Store) *avatarCache {
+	c := &avatarCache{avatars: make(map[string]cachedAvatar), store: s}
+
+	now := time.Now()
+	for _, nick := range s.Keys(avatarsBucket) {
+		value, _ := s.Get(avatarsBucket, nick)
+		parts := strings.SplitN(value, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		c.avatars[nick] = cachedAvatar{userID: parts[0], url: parts[1], found: now}
+	}
+	return c
+}
+
+// Get returns the avatar cached for nick, if it was found less than ttl ago
+func (c *avatarCache) Get(nick string, ttl time.Duration) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	avatar, ok := c.avatars[nick]
+	if !ok || time.Since(avatar.found) >= ttl {
+		return "", false
+	}
+	return avatar.url, true
+}
+
+// Set caches the avatar of the member with userID as the avatar for nick.
+// userID and url are empty if nick doesn't match a member.
+func (c *avatarCache) Set(nick, userID, url string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.avatars[nick] = cachedAvatar{userID: userID, url: url, found: time.Now()}
+
+	// Only members are saved, so the store doesn't fill up with every nick seen on IRC
+	saved, ok := c.store.Get(avatarsBucket, nick)
+	var err error
+	if userID == "" {
+		if ok {
+			err = c.store.Delete(avatarsBucket, nick)
+		}
+	} else if value := userID + " " + url; saved != value {
+		err = c.store.Set(avatarsBucket, nick, value)
+	}
+	if err != nil {
+		log.WithError(err).Errorln("could not save cached avatar")
+	}
+}
+
+// Forget removes the avatars that belonged to a member, and those of nicks that might now match them
+func (c *avatarCache) Forget(member *discordgo.Member) {
+	if member == nil || member.User == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for nick, avatar := range c.avatars {
+		if avatar.userID == member.User.ID ||
+			strings.EqualFold(nick, member.Nick) || strings.EqualFold(nick, member.User.Username) {
+			delete(c.avatars, nick)
+			if c.store.Has(avatarsBucket, nick) {
+				if err := c.store.Delete(avatarsBucket, nick); err != nil {
+					log.WithError(err).Errorln("could not forget cached avatar")
+				}
+			}
+		}
+	}
+}
@@ -5,20 +5,47 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/gobwas/glob"
 	"github.com/pkg/errors"
+	ircidentd "github.com/qaisjp/go-discord-irc/irc/identd"
 	"github.com/qaisjp/go-discord-irc/irc/varys"
+	"github.com/qaisjp/go-discord-irc/rehost"
+	"github.com/qaisjp/go-discord-irc/schedule"
+	"github.com/qaisjp/go-discord-irc/store"
+	"github.com/qaisjp/go-discord-irc/unfurl"
 	irc "github.com/qaisjp/go-ircevent"
 	log "github.com/sirupsen/logrus"
 )
 
 // Config to be passed to New
 type Config struct {
-	AvatarURL                string
-	DiscordBotToken, GuildID string
+	AvatarURL       string
+	DiscordBotToken string
+
+	// GuildIDs are the Discord guilds bridged by the bot. Channels in any of them can be mapped,
+	// and their members are all puppeted, with the same puppet for someone in more than one.
+	GuildIDs []string
+
+	// AvatarOverrides are avatar URLs for IRC accounts or nicks, used before anything else.
+	// AvatarGravatar uses the Gravatar of an IRC account's email, if NickServ will say what it is.
+	AvatarOverrides map[string]string
+	AvatarGravatar  bool
+
+	// AvatarCommand is whether IRC users can choose their own avatar by messaging the listener,
+	// see AvatarCommandOn (the default). Chosen avatars come after AvatarOverrides.
+	AvatarCommand string
+
+	// WebhookRotation is how many webhooks take turns relaying IRC messages in each channel,
+	// so that a message from a different nick is never shown as part of the last one's
+	WebhookRotation int
+	// ChannelWebhooks are webhook URLs to relay to some Discord channels with, by channel ID,
+	// for when the bot isn't allowed to manage webhooks
+	ChannelWebhooks map[string]string
 
 	// Map from Discord to IRC
 	ChannelMappings map[string]string
@@ -28,18 +55,65 @@ type Config struct {
 	IRCServerPass   string
 	IRCListenerName string // i.e, "DiscordBot", required to listen for messages in all cases
 	WebIRCPass      string
-	PuppetUsername  string // Username to connect to IRC with
+	WebIRCGateway   string // Gateway name sent in the WEBIRC command
+	WebIRCHostname  string // Hostname template for puppets, supports ${ID} and ${KIND}
+	PuppetUsername  string // Username (ident) template for puppets, supports ${USERNAME}, ${DISPLAYNAME} and ${ID}
+	PuppetRealName  string // Real name template for puppets, supports the same as PuppetUsername
 	IRCIgnores      []glob.Glob
 	DiscordIgnores  map[string]struct{} // Discord user IDs to not bridge
 	DiscordAllowed  map[string]struct{} // Discord user IDs to only bridge
 	ConnectionLimit int                 // number of IRC connections we can spawn
+	MaxPuppets      int                 // number of puppets before the least recently active one is evicted
+
+	// IRCListenerUsername and IRCListenerRealName are the listener's ident and real name
+	IRCListenerUsername string
+	IRCListenerRealName string
+
+	// PuppetAccounts maps Discord user IDs to the services accounts their puppets log in to
+	PuppetAccounts map[string]PuppetAccount
+
+	// PuppetNickSource is what puppet nicks are generated from,
+	// either PuppetNickSourceNickname (the default) or PuppetNickSourceUsername.
+	PuppetNickSource string
+
+	// NickScriptPolicies maps Unicode script names (like "Han" or "Cyrillic") to how
+	// characters from them are made ASCII in puppet nicks, see NickPolicyUnidecode.
+	NickScriptPolicies map[string]string
+
+	// NickOverrides maps Discord user IDs to the IRC nicks their puppets should use
+	NickOverrides map[string]string
+	// DisplayNameOverrides maps IRC accounts to the names they should appear as on Discord
+	DisplayNameOverrides map[string]string
 
 	IRCPuppetPrejoinCommands   []string
 	IRCListenerPrejoinCommands []string
 
+	// IRCListenerAltNick is the nick the listener uses while its own is taken, until it can take it back.
+	// Without it, underscores are added to the listener's nick.
+	IRCListenerAltNick string
+
+	// IRCListenerAccount and IRCListenerPassword are what the listener logs in to services with,
+	// using Services.Identify. The account defaults to the listener's nick.
+	IRCListenerAccount  string
+	IRCListenerPassword string
+	// Services are the commands sent to services, and ServicesRequestOp asks services to make
+	// the listener an operator in each mapped channel it joins
+	Services          ServicesCommands
+	ServicesRequestOp bool
+
+	// JoinAfterAuth makes the listener wait until it has logged in to services (900) before
+	// joining channels, for channels that only let registered users in. It joins anyway after
+	// joinAfterAuthTimeout.
+	JoinAfterAuth bool
+
 	// filters
-	IRCFilteredMessages     []glob.Glob
-	DiscordFilteredMessages []glob.Glob
+	IRCFilteredMessages     []MessageFilter
+	DiscordFilteredMessages []MessageFilter
+	// FilterChannel is the Discord channel messages held back by FilterActionFlag filters are sent to
+	FilterChannel string
+
+	// Rewrites change the content of relayed messages, in order
+	Rewrites []Rewrite
 
 	// NoTLS constrols whether to use TLS at all when connecting to the IRC server
 	NoTLS bool
@@ -62,39 +136,375 @@ type Config struct {
 	// CooldownDuration is the duration in seconds for an IRC puppet to stay online before being disconnected
 	CooldownDuration time.Duration
 
+	// PuppetIdleTimeout is how long a puppet can go without its user talking before it is disconnected.
+	// It reconnects when the user next talks. Zero disables this.
+	PuppetIdleTimeout time.Duration
+
 	// ShowJoinQuit determines whether or not to show JOIN, QUIT, KICK messages on Discord
 	ShowJoinQuit bool
+	// JoinQuitEvents are the kinds of event (JoinQuitEventJoin and so on) shown if ShowJoinQuit is set.
+	// Nil shows all of them but mode changes.
+	JoinQuitEvents map[string]struct{}
+	// JoinQuitChannelEvents are the kinds of event shown for some IRC channels, whether or not ShowJoinQuit is set
+	JoinQuitChannelEvents map[string]map[string]struct{}
+	// JoinQuitBatchDelay is how long to collect joins and quits for before showing them,
+	// summarised as one message if there are several. Zero shows each one straight away.
+	JoinQuitBatchDelay time.Duration
+	// JoinQuitSpokeWithin only shows joins, parts, quits and nick changes for people who spoke
+	// in the channel this recently, if set. Kicks are always shown.
+	JoinQuitSpokeWithin time.Duration
+
+	// AwayStatusChannel is the Discord channel to post IRC away status changes to, if set
+	AwayStatusChannel string
+
+	// IRCMonitorNicks are IRC nicks to MONITOR, with changes posted to IRCMonitorChannel
+	IRCMonitorNicks   []string
+	IRCMonitorChannel string
+
+	// IRCChathistoryLimit is how many missed messages to request per channel
+	// using CHATHISTORY after (re)joining. Zero disables backfilling.
+	IRCChathistoryLimit int
+
+	// IRCOfflineBuffer is how many Discord messages to keep while IRC is disconnected,
+	// to send once it's back. Zero disables this, so those messages are lost.
+	IRCOfflineBuffer int
+
+	// DiscordOfflineBuffer is how many IRC messages to keep while Discord is unavailable,
+	// to send once it's back. Zero disables this, so those messages are lost.
+	DiscordOfflineBuffer int
+	// DiscordOfflineBatch collapses the messages kept for each channel into as few messages as possible
+	DiscordOfflineBatch bool
+
+	// IRCDownNotice is how long the IRC connection can be down before mapped
+	// Discord channels are told about it. Zero disables this.
+	IRCDownNotice time.Duration
+
+	// IRCDeliveryTimeout is how long to wait for the IRC server to echo a relayed
+	// line before marking the Discord message as undelivered. Zero disables this.
+	IRCDeliveryTimeout time.Duration
+
+	// IRCPingInterval is how often the listener sends a PING to measure the lag, zero to not.
+	// IRCPingTimeout is how long a PING can go unanswered before the listener reconnects,
+	// as the connection may have stopped working without being closed. Zero to never.
+	IRCPingInterval time.Duration
+	IRCPingTimeout  time.Duration
+
+	// RelayWindows limits when some mappings relay messages, by IRC channel. Outside its windows,
+	// a mapping's messages are kept until they open if RelayWindowAction is PauseQueue (up to
+	// IRCOfflineBuffer and DiscordOfflineBuffer), or dropped if it is PauseDrop.
+	RelayWindows      map[string]schedule.Schedule
+	RelayWindowAction string
+
+	// DiscordZombieTimeout is how long the Discord gateway can go without acknowledging a heartbeat
+	// before the session is reopened and mapped IRC channels are told about the gap. Zero to never.
+	DiscordZombieTimeout time.Duration
+
+	// DeliveryFailedEmoji is reacted onto Discord messages that weren't relayed to IRC,
+	// because of a timeout, an error from the server, or the bridge not being connected
+	// or in the channel. Empty disables the reaction.
+	DeliveryFailedEmoji string
+	// DeliveryFailedDM also tells the author of the message in a DM, with a button
+	// to send it again
+	DeliveryFailedDM bool
+
+	// LogDir is where traffic in IRC channels is written, one file per channel per day, in
+	// LogDirFormat (chanlog.FormatZNC or chanlog.FormatJSONL). Only relayed messages are
+	// written unless LogDirUnrelayed is set, and only the IRC channels in LogDirChannels
+	// if it isn't empty (otherwise every mapped channel). Empty disables this.
+	LogDir          string
+	LogDirFormat    string
+	LogDirUnrelayed bool
+	LogDirChannels  []string
 
 	// Maximum Nicklength for irc server
 	MaxNickLength int
 
+	// ModerationAction is what happens to the Discord user of a puppet that is kicked or banned
+	// on IRC, see ModerationActionTimeout and so on. Empty or ModerationActionNone does nothing.
+	ModerationAction string
+	// ModerationTimeout is how long ModerationActionTimeout times Discord users out for
+	ModerationTimeout time.Duration
+	// ModerationRole is the Discord role ModerationActionRole gives, in the guild it belongs to
+	ModerationRole string
+	// DiscordBansToIRC bans the puppets of banned Discord members from mapped IRC channels.
+	// The listener must be a channel operator.
+	DiscordBansToIRC bool
+
+	// RelayRoles, if set, are the Discord roles a member needs one of for their messages to be relayed to IRC.
+	// RelayChannelRoles replaces RelayRoles for some Discord channels. Members with a role in
+	// RelayExcludedRoles are never relayed. Members who can't speak on IRC can still read it.
+	RelayRoles         map[string]struct{}
+	RelayChannelRoles  map[string]map[string]struct{}
+	RelayExcludedRoles map[string]struct{}
+
+	// ThrottleMessages is how many messages each person can have relayed in ThrottleInterval, and
+	// ThrottleRepeats how many times in a row they can send the same one. Zero disables either limit.
+	ThrottleMessages int
+	ThrottleRepeats  int
+	ThrottleInterval time.Duration
+	// ThrottleAction is what happens to messages over the limits, see ThrottleActionDrop (the default)
+	ThrottleAction string
+	// ThrottleMuteDuration is how long ThrottleActionMute stops relaying someone for
+	ThrottleMuteDuration time.Duration
+	// ThrottleChannel is the Discord channel to announce throttled people in, if set
+	ThrottleChannel string
+
+	// IRCInviteRequest is how to ask for an invite to invite only channels, one of the InviteRequest values.
+	// ModChannel is a Discord channel for moderators, told when the bridge can't join an IRC channel.
+	IRCInviteRequest string
+	ModChannel       string
+
+	// StatsInterval is how often to show how many people are on each side, zero to not.
+	// StatsTemplate is what is shown, with ${IRC} and ${DISCORD} replaced by the counts.
+	StatsInterval time.Duration
+	StatsTemplate string
+	// StatsDiscordChannel is a Discord channel to rename to the stats, if set, and StatsIRCTopics
+	// puts them at the end of the topics of mapped IRC channels
+	StatsDiscordChannel string
+	StatsIRCTopics      bool
+
+	// ResyncInterval is how often to check who is in the mapped IRC channels with WHO,
+	// rejoining any the listener or puppets have been removed from, zero to not
+	ResyncInterval time.Duration
+
+	// StatusChannel is a Discord channel to keep a pinned embed in, showing the state of the bridge,
+	// edited every StatusInterval. Zero StatusInterval or an empty StatusChannel disables it.
+	StatusChannel  string
+	StatusInterval time.Duration
+
+	// RelayDiscordBots and RelayDiscordWebhooks relay messages from other Discord bots and webhooks to IRC.
+	// Bots and webhooks (by application or webhook ID) in DiscordBotsAllowed are relayed either way,
+	// and those in DiscordBotsDenied never are.
+	RelayDiscordBots     bool
+	RelayDiscordWebhooks bool
+	DiscordBotsAllowed   map[string]struct{}
+	DiscordBotsDenied    map[string]struct{}
+	// RelayDiscordCrossposts relays messages posted in mapped channels because they follow an
+	// announcement channel in another server, whatever RelayDiscordWebhooks is
+	RelayDiscordCrossposts bool
+	// PublishAnnouncements publishes messages relayed from IRC to announcement channels
+	PublishAnnouncements bool
+
+	// DiscordLinkQuotes relays a one line quote of each Discord message linked to in a message,
+	// after the message, so IRC users can see what was linked
+	DiscordLinkQuotes bool
+
+	// URLTitles are the directions (DirectionDiscordToIRC and DirectionIRCToDiscord) in which
+	// the titles of web pages linked to are added to relayed messages. Only pages on hosts
+	// matching URLTitlesAllowed (any if empty) and not URLTitlesDenied have their titles fetched.
+	URLTitles        map[string]struct{}
+	URLTitlesAllowed []glob.Glob
+	URLTitlesDenied  []glob.Glob
+
+	// Rehost copies Discord attachments up to RehostMaxSize bytes, relaying the URL of the copy
+	// to IRC instead of Discord's. Nil to relay Discord's URLs.
+	Rehost        *rehost.Rehoster
+	RehostMaxSize int64
+
+	// IRCImageUploads sends IRC messages that are only a link to an image (up to IRCImageMaxSize bytes)
+	// to Discord as the image, so that it is shown inline
+	IRCImageUploads bool
+	IRCImageMaxSize int64
+
+	// StatusMsgRoles are the Discord roles allowed to message IRC channel operators
+	// only (i.e. "@#channel") by starting their message with "!ops ".
+	StatusMsgRoles map[string]struct{}
+
+	// CTCPVersion is the reply to CTCP VERSION queries, supports ${NICK}.
+	// Queries are not answered if this is empty.
+	CTCPVersion string
+
+	// IRCSendRate is how many lines a second each IRC connection sends after IRCSendBurst lines,
+	// queueing the rest so the server doesn't disconnect it for flooding. Zero disables this.
+	IRCSendRate  float64
+	IRCSendBurst int
+
+	// RelayQueueSize is how many messages can wait to be relayed in each direction,
+	// and to be sent to each channel
+	RelayQueueSize int
+	// RelayOverflowPolicy is what to do when a relay queue is full, see OverflowBlock (the default)
+	RelayOverflowPolicy string
+
+	// ShutdownTimeout is how long Close waits for queued messages to be sent before
+	// disconnecting anyway. defaultShutdownTimeout is used if this is zero.
+	ShutdownTimeout time.Duration
+	// IRCQuitMessage is the QUIT message sent by the listener and puppets when the bridge closes
+	IRCQuitMessage string
+
+	// DeadLetterPath is a file to append messages that could not be sent to Discord to, as JSON lines.
+	// They are only logged if this is empty.
+	DeadLetterPath string
+
+	// DryRun logs the messages that would be relayed, instead of sending them,
+	// and does not connect puppets.
+	DryRun bool
+
+	// AvatarCacheTTL is how long the avatar found for an IRC nick is reused for. Zero disables caching.
+	AvatarCacheTTL time.Duration
+
+	// StoragePath is the file bridge state (like relay preferences) is saved to.
+	// State is kept in memory if this is empty.
+	StoragePath string
+
+	// AutoMap maps Discord channels with "irc:#channel" in their topic, or
+	// whose name starts with AutoMapNamePrefix (if set), to IRC channels.
+	AutoMap           bool
+	AutoMapNamePrefix string
+
+	// SlashCommands registers the /bridge command in the guild, for admins
+	SlashCommands bool
+
+	// AdminDiscordIDs, members with AdminDiscordRoles and AdminIRCHostmasks can change
+	// channel mappings with "!bridge map", and ignores and filters with "!bridge ignore" and "!bridge filter"
+	AdminDiscordIDs   map[string]struct{}
+	AdminDiscordRoles map[string]struct{}
+	AdminIRCHostmasks []glob.Glob
+
 	Debug         bool
 	DebugPresence bool
 }
 
-// A Bridge represents a bridging between an IRC server and channels in a Discord server
-type Bridge struct {
-	Config *Config
+// Kinds of event for Config.JoinQuitEvents
+const (
+	JoinQuitEventJoin = "join"
+	JoinQuitEventPart = "part"
+	JoinQuitEventQuit = "quit"
+	JoinQuitEventKick = "kick"
+	JoinQuitEventNick = "nick"
+	JoinQuitEventMode = "mode"
+)
 
-	discord     *discordBot
-	ircListener *ircListener
-	ircManager  *IRCManager
+// Values for Config.PuppetNickSource
+const (
+	PuppetNickSourceNickname = "nickname" // guild nickname, falling back to username
+	PuppetNickSourceUsername = "username"
+)
 
-	mappings       []Mapping
-	ircChannelKeys map[string]string // From "#test" to "password"
+// A Bridge represents a bridging between an IRC server and channels in a Discord server
+type Bridge struct {
+	// config holds the *Config in use, see Config
+	config   atomic.Value
+	configMu sync.Mutex
+
+	discord       *discordBot
+	ircListener   *ircListener
+	ircManager    *IRCManager
+	delivery      *deliveryTracker
+	pmReplies     *pmReplies
+	linker        *linker
+	echoes        *echoGuard
+	throttle      *throttler
+	announcements *announcements
+	gravatars     *gravatarCache
+	relayErrors   *relayErrors
+	deadLetters   *deadLetters
+	store         *store.Store
+
+	// lists are the ignores and filters added with "!bridge ignore" and "!bridge filter"
+	lists storedLists
+
+	// mappings holds the *mappingTable in use, see mappingTable
+	mappings atomic.Value
+
+	// mappingsMu is held while channel mappings are worked out and applied, so that changes
+	// made at the same time from commands, the API and config reloads don't undo each other.
+	// It guards configMappings and autoMappings.
+	mappingsMu sync.Mutex
+	// configMappings are the channel mappings from the config, before stored mappings are applied
+	configMappings map[string]string
+	// autoMappings are the channel mappings found by naming convention
+	autoMappings map[string]string
+	autoMapChan  chan struct{}
+
+	// reload reloads the config, see SetReload
+	reload func() error
+
+	// identd answers ident queries about puppet connections, see SetIdentd
+	identd *ircidentd.Server
+
+	// restartIRCChan asks the loop to restart the IRC connections, see RestartIRC
+	restartIRCChan chan struct{}
+	// resyncChan gives the loop who is in each IRC channel, so that missing puppets rejoin, see resync
+	resyncChan chan map[string]map[string]struct{}
+
+	// offline keeps Discord messages while IRC is disconnected, until ircWelcomeChan says it's back
+	offline        offlineBuffer
+	ircWelcomeChan chan struct{}
+	// discordOffline keeps IRC messages while Discord is unavailable, until discordBackChan says it's back
+	discordOffline  discordOfflineBuffer
+	discordBackChan chan struct{}
+
+	// pauses is how relaying is paused each way, see PauseRelay
+	pauses relayPauses
+	// windowHeld keeps messages sent outside relay windows, until relayWindowChan says they may have opened
+	windowHeld      relayWindowHeld
+	relayWindowChan chan struct{}
+
+	// channelLogs writes channel traffic to Config.LogDir, see logChannel
+	channelLogs channelLogs
+	// recentMessages keeps the last messages relayed each way, for lastCommand
+	recentMessages *recentMessages
+	// unfurler fetches the titles of URLs in messages, see urlTitles
+	unfurler *unfurl.Unfurler
+
+	// startedAt is when the bridge was opened, for the status embed
+	startedAt time.Time
 
 	done chan bool
+	// stop is closed when the bridge is closing, to stop background goroutines
+	stop chan struct{}
+	// closing is 1 once Close has been called, see isClosing
+	closing int32
 
 	discordMessagesChan      chan IRCMessage
 	discordMessageEventsChan chan *DiscordMessage
 	updateUserChan           chan DiscordUser
 	removeUserChan           chan string // user id
+	idleExpiredChan          chan idleExpiry
+
+	// drops counts messages dropped from full relay queues
+	drops queueDrops
+	// workers send relayed messages, in order for each channel
+	workers *channelWorkers
+
+	// loopActivity is what the loop is doing, for DebugState
+	loopActivity loopActivity
+}
+
+// Config returns the config in use, which must not be changed (use UpdateConfig instead).
+// It is safe to call from any goroutine, as updates replace the config rather than change it.
+func (b *Bridge) Config() *Config {
+	return b.config.Load().(*Config)
+}
+
+// UpdateConfig changes the config in use. update is given a copy of the config to change,
+// which is swapped in once it returns, so readers never see half of an update.
+// Maps and slices must be replaced rather than changed, as they are shared with the old config.
+func (b *Bridge) UpdateConfig(update func(conf *Config)) {
+	b.applyConfig(update, nil)
+}
 
-	emoji map[string]*discordgo.Emoji
+// applyConfig changes the config like UpdateConfig, then calls apply (if not nil) before anything else
+// can change it. Settings copied out of the config, like the transmitter's, are set in apply so that
+// they are left matching the config when two changes are made at once. apply must not change the config.
+func (b *Bridge) applyConfig(update func(conf *Config), apply func()) {
+	b.configMu.Lock()
+	defer b.configMu.Unlock()
+
+	conf := *b.Config()
+	update(&conf)
+	b.config.Store(&conf)
+	if apply != nil {
+		apply()
+	}
 }
 
-// Close the Bridge
+// Close the Bridge.
+//
+// New messages are no longer relayed, and messages that are already queued are
+// sent before disconnecting, waiting for at most Config.ShutdownTimeout.
 func (b *Bridge) Close() {
+	atomic.StoreInt32(&b.closing, 1)
 	b.done <- true
 	<-b.done
 }
@@ -110,7 +520,9 @@ func (b *Bridge) load(opts *Config) error {
 	}
 
 	// This should not be used anymore!
-	opts.ChannelMappings = nil
+	b.UpdateConfig(func(conf *Config) {
+		conf.ChannelMappings = nil
+	})
 
 	return nil
 }
@@ -120,9 +532,26 @@ func (b *Bridge) load(opts *Config) error {
 //
 // Calling this function whilst the bot is running will
 // add or remove IRC bots accordingly.
+//
+// Automatic mappings (see Config.AutoMap) are added, and mappings
+// changed with "!bridge map" and "!bridge unmap" take precedence.
 func (b *Bridge) SetChannelMappings(inMappings map[string]string) error {
+	b.mappingsMu.Lock()
+	defer b.mappingsMu.Unlock()
+
+	if err := b.setChannelMappings(b.effectiveMappings(inMappings, b.storedMappings())); err != nil {
+		return err
+	}
+	b.configMappings = inMappings
+	return nil
+}
+
+// setChannelMappings applies inMappings, joining and parting IRC channels as needed.
+// It must be called with mappingsMu held.
+func (b *Bridge) setChannelMappings(inMappings map[string]string) error {
 	var mappings []Mapping
 	ircChannelKeys := make(map[string]string, len(mappings))
+	discordMirrors := make(map[string][]string)
 	for irc, discord := range inMappings {
 		ircParts := strings.Split(irc, " ")
 		ircChannel := ircParts[0]
@@ -133,9 +562,35 @@ func (b *Bridge) SetChannelMappings(inMappings map[string]string) error {
 			ircChannelKeys[ircChannel] = ircParts[1]
 		}
 
+		// "#irc": "discord irc_to_discord" only relays one way
+		discordParts := strings.Fields(discord)
+		if len(discordParts) == 0 || len(discordParts) > 2 {
+			log.Errorf("Discord channel %+v (to irc %+v) is invalid. Expected 0 or 1 spaces in the string. Ignoring.", discord, irc)
+			continue
+		}
+		var direction string
+		if len(discordParts) == 2 {
+			direction = discordParts[1]
+			if direction != DirectionIRCToDiscord && direction != DirectionDiscordToIRC {
+				log.Errorf("Discord channel %+v (to irc %+v) has an unknown direction. Expected %s or %s. Ignoring.", discord, irc, DirectionIRCToDiscord, DirectionDiscordToIRC)
+				continue
+			}
+		}
+
+		// "#irc": "primary,mirror1,mirror2" relays to several Discord channels,
+		// but only the first one is relayed back to IRC.
+		discordChannels := strings.Split(discordParts[0], ",")
+		for i := range discordChannels {
+			discordChannels[i] = b.replacedThread(strings.TrimSpace(discordChannels[i]))
+		}
+		if len(discordChannels) > 1 {
+			discordMirrors[ircChannel] = discordChannels[1:]
+		}
+
 		mappings = append(mappings, Mapping{
-			DiscordChannel: discord,
+			DiscordChannel: discordChannels[0],
 			IRCChannel:     ircChannel,
+			Direction:      direction,
 		})
 	}
 
@@ -150,9 +605,19 @@ func (b *Bridge) SetChannelMappings(inMappings map[string]string) error {
 		}
 	}
 
-	oldMappings := b.mappings
-	b.mappings = mappings
-	b.ircChannelKeys = ircChannelKeys
+	// Each Discord channel can only be mapped or mirrored once
+	discordChannels := make(map[string]struct{})
+	for _, mapping := range mappings {
+		for _, channel := range append([]string{mapping.DiscordChannel}, discordMirrors[mapping.IRCChannel]...) {
+			if _, ok := discordChannels[channel]; ok {
+				return errors.New("channel_mappings contains duplicate entries")
+			}
+			discordChannels[channel] = struct{}{}
+		}
+	}
+
+	oldMappings := b.mappingTable().mappings
+	b.mappings.Store(newMappingTable(mappings, ircChannelKeys, discordMirrors))
 
 	// If doing some changes mid-bot
 	if oldMappings != nil {
@@ -212,16 +677,21 @@ func (b *Bridge) SetChannelMappings(inMappings map[string]string) error {
 			}
 		}
 
-		b.ircListener.SendRaw("PART " + strings.Join(rmChannels, ","))
-		if err := b.ircManager.varys.SendRaw("", varys.InterpolationParams{}, "PART "+strings.Join(rmChannels, ",")); err != nil {
-			panic(err.Error())
+		var partErr error
+		if len(rmChannels) > 0 {
+			part := "PART " + strings.Join(rmChannels, ",")
+			b.ircListener.SendRaw(part)
+			if err := b.ircManager.varys.SendRaw("", varys.InterpolationParams{}, part); err != nil {
+				partErr = fmt.Errorf("could not part puppets from removed channels: %w", err)
+			}
 		}
 
 		// The bots needs to join the new mappings
 		b.ircListener.JoinChannels()
-		for _, conn := range b.ircManager.ircConnections {
+		for _, conn := range b.ircManager.connections() {
 			conn.JoinChannels()
 		}
+		return partErr
 	}
 
 	return nil
@@ -230,24 +700,54 @@ func (b *Bridge) SetChannelMappings(inMappings map[string]string) error {
 // New Bridge
 func New(conf *Config) (*Bridge, error) {
 	dib := &Bridge{
-		Config: conf,
-		done:   make(chan bool),
+		done: make(chan bool),
+		stop: make(chan struct{}),
+
+		updateUserChan:  make(chan DiscordUser),
+		removeUserChan:  make(chan string),
+		idleExpiredChan: make(chan idleExpiry),
+		autoMapChan:     make(chan struct{}, 1),
+		ircWelcomeChan:  make(chan struct{}, 1),
+		restartIRCChan:  make(chan struct{}, 1),
+		resyncChan:      make(chan map[string]map[string]struct{}),
+		relayWindowChan: make(chan struct{}, 1),
+
+		discordBackChan: make(chan struct{}, 1),
+	}
 
-		discordMessagesChan:      make(chan IRCMessage),
-		discordMessageEventsChan: make(chan *DiscordMessage),
-		updateUserChan:           make(chan DiscordUser),
-		removeUserChan:           make(chan string),
+	// The bridge keeps its own copy, so conf can't be changed from under it
+	own := *conf
+	dib.config.Store(&own)
+
+	queueSize := dib.relayQueueSize()
+	dib.discordMessagesChan = make(chan IRCMessage, queueSize)
+	dib.discordMessageEventsChan = make(chan *DiscordMessage, queueSize)
+	dib.workers = newChannelWorkers(queueSize)
+
+	dib.delivery = newDeliveryTracker(dib)
+	dib.pmReplies = newPMReplies()
+	dib.recentMessages = newRecentMessages()
+	dib.unfurler = unfurl.New()
+	dib.linker = newLinker()
+	dib.echoes = newEchoGuard()
+	dib.throttle = newThrottler(dib)
+	dib.announcements = newAnnouncements()
+	dib.gravatars = newGravatarCache()
+	dib.relayErrors = &relayErrors{}
+	dib.deadLetters = &deadLetters{path: conf.DeadLetterPath}
 
-		emoji: make(map[string]*discordgo.Emoji),
+	var err error
+	if dib.store, err = store.Open(conf.StoragePath); err != nil {
+		return nil, errors.Wrap(err, "could not open storage")
 	}
 
+	dib.loadStoredLists()
+
 	if err := dib.load(conf); err != nil {
 		return nil, errors.Wrap(err, "configuration invalid")
 	}
 
-	var err error
-
-	dib.discord, err = newDiscord(dib, conf.DiscordBotToken, conf.GuildID)
+	dib.discord, err = newDiscord(dib, conf.DiscordBotToken, conf.GuildIDs)
 	if err != nil {
 		return nil, errors.Wrap(err, "Could not create discord bot")
 	}
@@ -264,14 +764,25 @@ func New(conf *Config) (*Bridge, error) {
 
 // SetIRCListenerName changes the username of the listener bot.
 func (b *Bridge) SetIRCListenerName(name string) {
-	b.Config.IRCListenerName = name
-	b.ircListener.Nick(name)
+	b.applyConfig(func(conf *Config) {
+		conf.IRCListenerName = name
+	}, func() {
+		b.ircListener.Nick(name)
+	})
+}
+
+// SetIRCMonitorNicks changes the IRC nicks we MONITOR.
+func (b *Bridge) SetIRCMonitorNicks(nicks []string) {
+	b.ircListener.monitor.SetNicks(nicks)
 }
 
 // SetDebugMode allows you to control debug logging.
 func (b *Bridge) SetDebugMode(debug bool) {
-	b.Config.Debug = debug
-	b.ircListener.SetDebugMode(debug)
+	b.applyConfig(func(conf *Config) {
+		conf.Debug = debug
+	}, func() {
+		b.ircListener.SetDebugMode(debug)
+	})
 }
 
 // Open all the connections required to run the bridge
@@ -283,13 +794,19 @@ func (b *Bridge) Open() (err error) {
 		return errors.Wrap(err, "can't open discord")
 	}
 
-	err = b.ircListener.Connect(b.Config.IRCServer)
-	if err != nil {
-		return errors.Wrap(err, "can't open irc connection")
-	}
+	b.startedAt = time.Now()
 
-	// run listener loop
-	go b.ircListener.Loop()
+	// Connect to IRC in the background, as it may take a few tries
+	go b.connectIRC()
+	go b.watchIRCOutage()
+	go b.watchDiscordOffline()
+	go b.watchStats()
+	go b.watchResync()
+	go b.watchListenerNick()
+	go b.watchStatusEmbed()
+	go b.watchLag()
+	go b.watchDiscordGateway()
+	go b.watchRelayWindows()
 
 	return
 }
@@ -297,34 +814,53 @@ func (b *Bridge) Open() (err error) {
 // SetupIRCConnection sets up an IRC connection with config settings like
 // UseTLS, InsecureSkipVerify, and WebIRCPass.
 func (b *Bridge) SetupIRCConnection(con *irc.Connection, hostname, ip string) {
-	if !b.Config.NoTLS {
-		con.UseTLS = true
+	b.setupCTCP(con)
+
+	b.applyIRCServerConfig(con, hostname, ip)
+}
+
+// applyIRCServerConfig sets up how a connection logs in to the IRC server.
+// Changes apply when the connection next connects.
+func (b *Bridge) applyIRCServerConfig(con *irc.Connection, hostname, ip string) {
+	con.UseTLS = !b.Config().NoTLS
+	con.TLSConfig = nil
+	if con.UseTLS {
 		con.TLSConfig = &tls.Config{
-			InsecureSkipVerify: b.Config.InsecureSkipVerify,
+			InsecureSkipVerify: b.Config().InsecureSkipVerify,
 		}
 	}
 
-	// On kick, rejoin the channel
-	con.AddCallback("KICK", func(e *irc.Event) {
-		if e.Arguments[1] == con.GetNick() {
-			con.Join(e.Arguments[0])
-		}
-	})
+	con.Password = b.Config().IRCServerPass
 
-	con.Password = b.Config.IRCServerPass
+	con.WebIRC = ""
+	if b.Config().WebIRCPass != "" {
+		con.WebIRC = fmt.Sprintf("%s %s %s %s", b.Config().WebIRCPass, b.Config().WebIRCGateway, hostname, ip)
+	}
+}
 
-	if b.Config.WebIRCPass != "" {
-		con.WebIRC = fmt.Sprintf("%s discord %s %s", b.Config.WebIRCPass, hostname, ip)
+// WebIRCHostname returns the hostname a puppet presents over WEBIRC.
+// It is derived from the Discord user ID so that IRC bans against
+// a Discord user keep working across nick changes.
+func (b *Bridge) WebIRCHostname(user DiscordUser) string {
+	kind := "user"
+	if user.Bot {
+		kind = "bot"
 	}
+
+	return strings.NewReplacer(
+		"${ID}", user.ID,
+		"${KIND}", kind,
+	).Replace(b.Config().WebIRCHostname)
 }
 
 // GetJoinCommand produces a JOIN command based on the provided mappings
 func (b *Bridge) GetJoinCommand(mappings []Mapping) string {
 	var channels, keyedChannels, keys []string
 
+	ircChannelKeys := b.mappingTable().ircChannelKeys
 	for _, mapping := range mappings {
 		channel := mapping.IRCChannel
-		key, keyed := b.ircChannelKeys[channel]
+		key, keyed := ircChannelKeys[channel]
 
 		if keyed {
 			keyedChannels = append(keyedChannels, channel)
@@ -343,33 +879,162 @@ func (b *Bridge) GetJoinCommand(mappings []Mapping) string {
 // GetMappingByIRC returns a Mapping for a given IRC channel.
 // Returns nil if a Mapping does not exist.
 func (b *Bridge) GetMappingByIRC(channel string) (Mapping, bool) {
-	for _, mapping := range b.mappings {
-		if strings.EqualFold(mapping.IRCChannel, channel) {
+	for _, mapping := range b.mappingTable().byIRC[mappingKey(channel)] {
+		if b.IRCEqualFold(mapping.IRCChannel, channel) {
 			return mapping, true
 		}
 	}
 	return Mapping{}, false
 }
 
+// IRCEqualFold compares two IRC nicks or channel names using the server's casemapping.
+func (b *Bridge) IRCEqualFold(x, y string) bool {
+	if b.ircListener == nil {
+		return strings.EqualFold(x, y)
+	}
+	return b.ircListener.isupport.EqualFold(x, y)
+}
+
+// DisplayName returns the name an IRC user should appear as on Discord,
+// which is their nick unless their account has a DisplayNameOverrides entry.
+func (b *Bridge) DisplayName(nick string, account string) string {
+	if account == "" || account == "*" {
+		return nick
+	}
+	for overrideAccount, name := range b.Config().DisplayNameOverrides {
+		if b.IRCEqualFold(overrideAccount, account) {
+			return name
+		}
+	}
+	return nick
+}
+
+// MaxNickLength returns the maximum length of puppet nicks, which is the configured
+// MaxNickLength, or the server's NICKLEN if that is smaller.
+func (b *Bridge) MaxNickLength() int {
+	max := b.Config().MaxNickLength
+	if nicklen := b.ircListener.isupport.NickLen(); nicklen > 0 && (max <= 0 || nicklen < max) {
+		max = nicklen
+	}
+	return max
+}
+
 // GetMappingByDiscord returns a Mapping for a given Discord channel.
 // Returns nil if a Mapping does not exist.
 func (b *Bridge) GetMappingByDiscord(channel string) (Mapping, bool) {
-	for _, mapping := range b.mappings {
-		if mapping.DiscordChannel == channel {
-			return mapping, true
+	mapping, ok := b.mappingTable().byDiscord[channel]
+	return mapping, ok
+}
+
+var emojiRegex = regexp.MustCompile("(:[a-zA-Z_-]+:)")
+
+// delayedMessageThreshold is how old a message from IRC must be before we
+// show its original timestamp, e.g. when it is replayed by a bouncer.
+const delayedMessageThreshold = time.Minute
+
+// delayedForDiscord prefixes content with a Discord timestamp of when it was sent on IRC
+func delayedForDiscord(at time.Time, content string) string {
+	return fmt.Sprintf("<t:%d:f> %s", at.Unix(), content)
+}
+
+// discordTargets returns the Discord channels IRC messages are relayed to for a mapping,
+// which is the mapped channel followed by any mirrors.
+func (b *Bridge) discordTargets(mapping Mapping) []string {
+	return append([]string{mapping.DiscordChannel}, b.mappingTable().discordMirrors[mapping.IRCChannel]...)
+}
+
+// sendToDiscord sends a message to a Discord channel, as the bot if username is
+// empty, or otherwise through a webhook. It blocks until the message is sent,
+// retrying if Discord fails or rate limits us, so use the channel's worker to
+// keep messages in order without holding up the loop.
+func (b *Bridge) sendToDiscord(channel, username, avatar, content string) {
+	if b.Config().DryRun {
+		b.logDryRunDiscord(channel, username, content)
+		return
+	}
+
+	if _, err := b.trySendToDiscord(channel, username, avatar, content, nil); err != nil {
+		b.discordSendFailed(channel, username, content, err)
+	}
+}
+
+// trySendToDiscord is sendToDiscord, returning the sent message or the error
+// instead of keeping the message as a dead letter. If image is not nil, it is sent
+// instead of content, which should be the link to it (see imageLinkedBy).
+func (b *Bridge) trySendToDiscord(channel, username, avatar, content string, image *linkedImage) (sent *discordgo.Message, err error) {
+	if username == "" {
+		// System messages come straight from the bot
+		err = b.retryDiscord(channel, func() (err error) {
+			sent, err = b.discord.Session.ChannelMessageSend(channel, content)
+			return err
+		})
+	} else {
+		send := func() (err error) {
+			params := &discordgo.WebhookParams{
+				Username:  username,
+				AvatarURL: avatar,
+				Content:   content,
+				AllowedMentions: &discordgo.MessageAllowedMentions{
+					// Allow user and role mentions, but not everyone or here mentions
+					Parse: []discordgo.AllowedMentionType{
+						discordgo.AllowedMentionTypeRoles,
+						discordgo.AllowedMentionTypeUsers,
+					},
+				},
+			}
+			if image != nil {
+				params.Content = ""
+				params.Files = []*discordgo.File{image.file()}
+			}
+			sent, err = b.sendWithWebhook(channel, params)
+			return err
+		}
+
+		err = b.retryDiscord(channel, send)
+		// Discord may refuse the image, such as if it is too large for the server, so send the link instead
+		if _, outage := discordRetryDelay(err, 0); err != nil && image != nil && !outage {
+			image = nil
+			err = b.retryDiscord(channel, send)
+		}
+		if err == nil && sent != nil {
+			b.publishAnnouncement(sent)
 		}
 	}
-	return Mapping{}, false
+	return sent, err
 }
 
-var emojiRegex = regexp.MustCompile("(:[a-zA-Z_-]+:)")
+// discordSendFailed records a message that could not be sent to Discord
+func (b *Bridge) discordSendFailed(channel, username, content string, err error) {
+	b.deadLetters.Add(deadLetter{
+		Time:     time.Now(),
+		Channel:  channel,
+		Username: username,
+		Content:  content,
+		Error:    err.Error(),
+	})
+	if username == "" {
+		b.relayErrors.Add("could not send to Discord channel %s: %s", channel, err)
+	} else {
+		b.relayErrors.Add("could not send %s's message to Discord channel %s: %s", username, channel, err)
+	}
+}
 
 func (b *Bridge) loop() {
+	autoMapTicker := time.NewTicker(autoMapInterval)
+	defer autoMapTicker.Stop()
+
+	// While closing, drainTicker checks if everything has been sent, until drainTimeout
+	var drainTicker <-chan time.Time
+	var drainTimeout <-chan time.Time
+
 	for {
+		b.loopActivity.set("")
+
 		select {
 
 		// Messages from IRC to Discord
 		case msg := <-b.discordMessagesChan:
+			b.loopActivity.set("discordMessagesChan")
 			mapping, ok := b.GetMappingByIRC(msg.IRCChannel)
 
 			if !ok {
@@ -377,16 +1042,23 @@ func (b *Bridge) loop() {
 				continue
 			}
 
+			if !mapping.RelaysToDiscord() {
+				continue
+			}
+
+			// Linked users who are away are sent messages that mention them
+			b.notifyHighlights(msg, mapping.DiscordChannel)
+			b.logRelayedFromIRC(msg)
+			if msg.Username != "" {
+				b.recentMessages.FromIRC(b.ircListener.isupport.Fold(mapping.IRCChannel), msg.Username, msg.Message)
+			}
+
 			var avatar string
 			username := msg.Username
 
 			// System messages have no username
 			if username != "" {
-				avatar = b.discord.GetAvatar(b.Config.GuildID, msg.Username)
-				if avatar == "" {
-					// If we don't have a Discord avatar, generate an adorable avatar
-					avatar = strings.ReplaceAll(b.Config.AvatarURL, "${USERNAME}", msg.Username)
-				}
+				avatar = b.ircAvatar(msg)
 
 				if len(username) == 1 {
 					// Append usernames with 1 character
@@ -406,9 +1078,10 @@ func (b *Bridge) loop() {
 				content = "\u200B" + content + "\u200B"
 			}
 
-			// Convert any emoji ye?
+			// Convert any emoji ye? Only those of the guild being sent to are used.
+			guildID := b.discord.guildOf(mapping.DiscordChannel)
 			content = emojiRegex.ReplaceAllStringFunc(content, func(emoji string) string {
-				e, ok := b.emoji[strings.ToLower(emoji[1:len(emoji)-1])]
+				e, ok := b.discord.guildEmoji(guildID, emoji[1:len(emoji)-1])
 				if !ok {
 					return emoji
 				}
@@ -421,47 +1094,30 @@ func (b *Bridge) loop() {
 				return "<" + emoji + ">"
 			})
 
-			if username == "" {
-				// System messages come straight from the bot
-				if _, err := b.discord.Session.ChannelMessageSend(mapping.DiscordChannel, content); err != nil {
-					log.WithError(err).WithFields(log.Fields{
-						"msg.channel":  mapping.DiscordChannel,
-						"msg.username": username,
-						"msg.content":  content,
-					}).Errorln("could not transmit SYSTEM message to discord")
-				}
-			} else {
-				go func() {
-					_, err := b.discord.transmitter.Send(
-						mapping.DiscordChannel,
-						&discordgo.WebhookParams{
-							Username:  username,
-							AvatarURL: avatar,
-							Content:   content,
-							AllowedMentions: &discordgo.MessageAllowedMentions{
-								// Allow user and role mentions, but not everyone or here mentions
-								Parse: []discordgo.AllowedMentionType{
-									discordgo.AllowedMentionTypeRoles,
-									discordgo.AllowedMentionTypeUsers,
-								},
-							},
-						},
-					)
-
-					if err != nil {
-						log.WithFields(log.Fields{
-							"error":        err,
-							"msg.channel":  mapping.DiscordChannel,
-							"msg.username": username,
-							"msg.avatar":   avatar,
-							"msg.content":  content,
-						}).Errorln("could not transmit message to discord")
-					}
-				}()
+			// Messages replayed after a reconnect should not appear as new,
+			// so prefix them with a Discord timestamp of when they were sent.
+			if !msg.Timestamp.IsZero() && time.Since(msg.Timestamp) > delayedMessageThreshold {
+				content = delayedForDiscord(msg.Timestamp, content)
 			}
 
+			targets := b.discordTargets(mapping)
+			for _, channel := range targets {
+				b.echoes.Record(channel, msg.Message, msg.Nick, msg.Username)
+			}
+			b.workers.Do(toDiscordWorker(mapping.IRCChannel), func() {
+				// Fetching titles here keeps messages in order, without holding up the loop
+				content := content + b.urlTitles(DirectionIRCToDiscord, msg.Message)
+				// Messages that are only a link to an image are sent as the image, to show inline.
+				// It is downloaded once, for all the targets.
+				image := b.imageLinkedBy(content)
+				for _, channel := range targets {
+					b.sendToDiscordOrKeep(mapping.IRCChannel, msg.Tags["msgid"], channel, username, avatar, content, image)
+				}
+			})
+
 		// Messages from Discord to IRC
 		case msg := <-b.discordMessageEventsChan:
+			b.loopActivity.set("discordMessageEventsChan")
 			mapping, ok := b.GetMappingByDiscord(msg.ChannelID)
 
 			// Do not do anything if we do not have a mapping for the PUBLIC channel
@@ -470,28 +1126,108 @@ func (b *Bridge) loop() {
 				continue
 			}
 
+			// Read-only channels on Discord are not relayed to IRC
+			if msg.PmTarget == "" && !mapping.RelaysToIRC() {
+				continue
+			}
+
 			target := msg.PmTarget
 			if target == "" {
-				target = mapping.IRCChannel
+				target = msg.StatusMsg + mapping.IRCChannel
 			}
 
-			b.ircManager.SendMessage(target, msg)
+			// Outside the mapping's relay window, messages wait for it to open or aren't relayed
+			if msg.PmTarget == "" && !b.inRelayWindow(mapping.IRCChannel) {
+				if !b.holdForIRC(mapping.IRCChannel, target, msg) {
+					go b.deliveryFailed(msg.Message, mapping.IRCChannel+" is only relayed during its relay window")
+				}
+				continue
+			}
+
+			if msg.PmTarget == "" {
+				b.logRelayedFromDiscord(mapping.IRCChannel, msg)
+			}
+			// Messages only for channel operators aren't shown to everyone with lastCommand
+			if msg.PmTarget == "" && msg.StatusMsg == "" {
+				b.recentMessages.FromDiscord(b.ircListener.isupport.Fold(mapping.IRCChannel), msg.Author.Username, msg.Content)
+			}
+			b.sendToIRC(target, msg)
+
+			// Mirrors should see the whole conversation, not just the IRC side
+			if mirrors := b.mappingTable().discordMirrors[mapping.IRCChannel]; msg.PmTarget == "" && len(mirrors) > 0 {
+				b.workers.Do(toDiscordWorker(mapping.IRCChannel), func() {
+					for _, mirror := range mirrors {
+						b.sendToDiscord(mirror, msg.Author.Username, msg.Author.AvatarURL(""), msg.Content)
+					}
+				})
+			}
 
 		// Notification to potentially update, or create, a user
 		// We should not receive anything on this channel if we're in Simple Mode
 		case user := <-b.updateUserChan:
+			b.loopActivity.set("updateUserChan")
 			b.ircManager.HandleUser(user)
 
 		case userID := <-b.removeUserChan:
+			b.loopActivity.set("removeUserChan")
 			b.ircManager.DisconnectUser(userID)
 
-		// Done!
+		case expiry := <-b.idleExpiredChan:
+			b.loopActivity.set("idleExpiredChan")
+			b.ircManager.expireIdle(expiry)
+
+		// IRC is back, so send what was said on Discord while it was gone
+		case <-b.ircWelcomeChan:
+			b.loopActivity.set("ircWelcomeChan")
+			b.replayOffline()
+
+		case <-b.restartIRCChan:
+			b.loopActivity.set("restartIRCChan")
+			b.restartIRC()
+
+		// Relay windows may have opened, so send what was held for them
+		case <-b.relayWindowChan:
+			b.loopActivity.set("relayWindowChan")
+			b.releaseForIRC()
+
+		case members := <-b.resyncChan:
+			b.loopActivity.set("resyncChan")
+			b.ircManager.rejoinMissing(members)
+
+		// Discord channels may have changed, so look for automatic mappings again
+		case <-autoMapTicker.C:
+			b.loopActivity.set("autoMapTicker")
+			b.rescanAutoMappings()
+		case <-b.autoMapChan:
+			b.loopActivity.set("autoMapChan")
+			b.rescanAutoMappings()
+
+		// Closing, so keep going until what's queued has been sent
 		case <-b.done:
-			b.discord.Close()
-			b.ircListener.Quit()
-			b.ircManager.Close()
+			b.loopActivity.set("done")
+			log.Infoln("Sending queued messages before closing...")
+
+			ticker := time.NewTicker(drainCheckInterval)
+			defer ticker.Stop()
+			drainTicker = ticker.C
+			drainTimeout = time.After(b.shutdownTimeout())
+
+		case <-drainTicker:
+			b.loopActivity.set("drainTicker")
+			if !b.drained() {
+				continue
+			}
+
+			b.shutdown()
 			close(b.done)
+			return
 
+		case <-drainTimeout:
+			b.loopActivity.set("drainTimeout")
+			log.Warnln("Timed out sending queued messages, closing anyway.")
+
+			b.shutdown()
+			close(b.done)
 			return
 		}
 
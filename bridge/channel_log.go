@@ -0,0 +1,183 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qaisjp/go-discord-irc/chanlog"
+	irc "github.com/qaisjp/go-ircevent"
+	log "github.com/sirupsen/logrus"
+)
+
+// channelLogs holds the logger writing to Config.LogDir, opened when it is first needed
+type channelLogs struct {
+	sync.Mutex
+	logger *chanlog.Logger
+}
+
+// logsChannel returns true if traffic in an IRC channel is written to Config.LogDir.
+// Every mapped channel is logged if Config.LogDirChannels is empty.
+func (b *Bridge) logsChannel(channel string) bool {
+	conf := b.Config()
+	if conf.LogDir == "" {
+		return false
+	}
+	if len(conf.LogDirChannels) == 0 {
+		_, ok := b.GetMappingByIRC(channel)
+		return ok
+	}
+	for _, c := range conf.LogDirChannels {
+		if b.ircListener.isupport.EqualFold(c, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// logChannel writes an entry to its channel's log file, if the channel is logged
+func (b *Bridge) logChannel(e chanlog.Entry) {
+	if !b.logsChannel(e.Channel) {
+		return
+	}
+	conf := b.Config()
+
+	b.channelLogs.Lock()
+	defer b.channelLogs.Unlock()
+
+	// The directory or format may have been changed by a reload
+	logger := b.channelLogs.logger
+	if logger == nil || logger.Dir() != conf.LogDir || logger.Format() != conf.LogDirFormat {
+		if logger != nil {
+			logger.Close()
+		}
+
+		var err error
+		logger, err = chanlog.New(conf.LogDir, conf.LogDirFormat)
+		if err != nil {
+			log.WithError(err).Warnln("Could not log channel traffic")
+			b.channelLogs.logger = nil
+			return
+		}
+		b.channelLogs.logger = logger
+	}
+
+	if err := logger.Write(e); err != nil {
+		log.WithError(err).WithField("channel", e.Channel).Warnln("Could not write to channel log")
+	}
+}
+
+// closeChannelLogs closes the log files left open by logChannel
+func (b *Bridge) closeChannelLogs() {
+	b.channelLogs.Lock()
+	defer b.channelLogs.Unlock()
+
+	if b.channelLogs.logger != nil {
+		b.channelLogs.logger.Close()
+		b.channelLogs.logger = nil
+	}
+}
+
+// logRelayedFromIRC logs a chat message from IRC that is being relayed to Discord.
+// Nothing is logged if Config.LogDirUnrelayed is set, as onChannelLog has already logged it.
+func (b *Bridge) logRelayedFromIRC(msg IRCMessage) {
+	if msg.Username == "" || b.Config().LogDirUnrelayed {
+		return // system messages, such as joins, are logged with Config.LogDirUnrelayed
+	}
+
+	kind := chanlog.KindMessage
+	if msg.IsAction {
+		kind = chanlog.KindAction
+	}
+	b.logChannel(chanlog.Entry{
+		Time:    msg.Timestamp,
+		Channel: msg.IRCChannel,
+		Kind:    kind,
+		Nick:    msg.Nick,
+		Text:    msg.Message,
+		Source:  "irc",
+	})
+}
+
+// logRelayedFromDiscord logs a Discord message being relayed to an IRC channel
+func (b *Bridge) logRelayedFromDiscord(channel string, msg *DiscordMessage) {
+	kind := chanlog.KindMessage
+	if msg.IsAction {
+		kind = chanlog.KindAction
+	}
+	b.logChannel(chanlog.Entry{
+		Time:    time.Now(),
+		Channel: channel,
+		Kind:    kind,
+		Nick:    msg.Author.Username,
+		Text:    msg.Content,
+		Source:  "discord",
+	})
+}
+
+// onChannelLog logs everything that happens in IRC channels, whether or not it is relayed,
+// if Config.LogDirUnrelayed is set. Puppets and the listener aren't logged here, as what
+// they say is logged by logRelayedFromDiscord.
+func (i *ircListener) onChannelLog(e *irc.Event) {
+	if !i.bridge.Config().LogDirUnrelayed || i.isPuppetNick(e.Nick) {
+		return
+	}
+
+	entry := chanlog.Entry{Time: serverTime(e), Nick: e.Nick, Source: "irc"}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	switch e.Code {
+	case "PRIVMSG", "NOTICE", "CTCP_ACTION", "STJOIN", "STPART", "TOPIC":
+		if len(e.Arguments) == 0 {
+			return
+		}
+		entry.Channel = e.Arguments[0]
+		entry.Text = e.Message()
+		switch e.Code {
+		case "PRIVMSG":
+			entry.Kind = chanlog.KindMessage
+		case "NOTICE":
+			entry.Kind = chanlog.KindNotice
+		case "CTCP_ACTION":
+			entry.Kind = chanlog.KindAction
+		case "STJOIN":
+			entry.Kind, entry.Text = chanlog.KindJoin, ""
+		case "STPART":
+			entry.Kind, entry.Text = chanlog.KindPart, ""
+			if len(e.Arguments) > 1 {
+				entry.Text = e.Arguments[1]
+			}
+		case "TOPIC":
+			entry.Kind = chanlog.KindTopic
+		}
+		i.bridge.logChannel(entry)
+	case "KICK":
+		if len(e.Arguments) < 2 {
+			return
+		}
+		entry.Channel, entry.Kind, entry.Text = e.Arguments[0], chanlog.KindKick, e.Arguments[1]
+		if len(e.Arguments) > 2 {
+			entry.Text += " " + e.Arguments[2]
+		}
+		i.bridge.logChannel(entry)
+	case "STQUIT", "STNICK":
+		// These don't say which channels they happened in, so log them in every channel the user is in.
+		// The user is tracked under their new nick after STNICK, and still in their channels during STQUIT.
+		who := e.Nick
+		entry.Kind, entry.Text = chanlog.KindQuit, e.Message()
+		if e.Code == "STNICK" {
+			entry.Kind, who = chanlog.KindNick, e.Message()
+		}
+		for _, m := range i.bridge.mappingTable().mappings {
+			ch, ok := i.GetChannel(m.IRCChannel)
+			if !ok {
+				continue
+			}
+			if _, ok := ch.GetUser(who); ok {
+				entry.Channel = m.IRCChannel
+				i.bridge.logChannel(entry)
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package bridge
+
+import (
+	"strings"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// ctcpCallbacks returns callbacks that answer CTCP VERSION, PING and TIME
+// queries. They replace go-ircevent's defaults, so that the VERSION reply
+// can be configured.
+func (b *Bridge) ctcpCallbacks() map[string]func(*irc.Event) {
+	return map[string]func(*irc.Event){
+		"CTCP_VERSION": func(e *irc.Event) {
+			version := b.Config().CTCPVersion
+			if version == "" {
+				return
+			}
+			version = strings.ReplaceAll(version, "${NICK}", e.Connection.GetNick())
+			ctcpReply(e, "VERSION "+version)
+		},
+		"CTCP_PING": func(e *irc.Event) {
+			ctcpReply(e, "PING "+e.Message())
+		},
+		"CTCP_TIME": func(e *irc.Event) {
+			ctcpReply(e, "TIME "+time.Now().Format(time.RFC1123Z))
+		},
+	}
+}
+
+// setupCTCP replaces the default CTCP callbacks on a connection with our own
+func (b *Bridge) setupCTCP(con *irc.Connection) {
+	for code, callback := range b.ctcpCallbacks() {
+		con.ClearCallback(code)
+		con.AddCallback(code, callback)
+	}
+}
+
+func ctcpReply(e *irc.Event, reply string) {
+	e.Connection.SendRaw("NOTICE " + e.Nick + " :\x01" + reply + "\x01")
+}
@@ -0,0 +1,66 @@
+package bridge
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ChannelDepth is how full one of the bridge's internal channels is
+type ChannelDepth struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+
+	// Dropped is how many messages were dropped because the channel was full
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// LoopActivity is what the bridge's main loop is doing
+type LoopActivity struct {
+	// Handling is the channel whose message is being handled, or empty if the loop is waiting
+	Handling string `json:"handling,omitempty"`
+	// Since is when the loop started handling it, or started waiting
+	Since time.Time `json:"since"`
+}
+
+// DebugState is a snapshot of the bridge's internals, to find out where it is stuck
+type DebugState struct {
+	Loop     LoopActivity            `json:"loop"`
+	Channels map[string]ChannelDepth `json:"channels"`
+	// Workers are the messages waiting to be sent for each channel, by direction ("i2d:" or "d2i:") and IRC channel
+	Workers map[string]ChannelDepth `json:"workers"`
+}
+
+// loopActivity tracks the case the main loop is handling
+type loopActivity struct {
+	v atomic.Value
+}
+
+func (l *loopActivity) set(handling string) {
+	l.v.Store(LoopActivity{Handling: handling, Since: time.Now()})
+}
+
+func (l *loopActivity) get() LoopActivity {
+	a, _ := l.v.Load().(LoopActivity)
+	return a
+}
+
+// DebugState returns a snapshot of the bridge's internals.
+// It is safe to call from any goroutine.
+func (b *Bridge) DebugState() DebugState {
+	return DebugState{
+		Loop: b.loopActivity.get(),
+		Channels: map[string]ChannelDepth{
+			"discordMessagesChan":      b.RelayQueues()[queueIRCToDiscord],
+			"discordMessageEventsChan": b.RelayQueues()[queueDiscordToIRC],
+			"updateUserChan":           {Len: len(b.updateUserChan), Cap: cap(b.updateUserChan)},
+			"removeUserChan":           {Len: len(b.removeUserChan), Cap: cap(b.removeUserChan)},
+			"autoMapChan":              {Len: len(b.autoMapChan), Cap: cap(b.autoMapChan)},
+			"ircWelcomeChan":           {Len: len(b.ircWelcomeChan), Cap: cap(b.ircWelcomeChan)},
+			"restartIRCChan":           {Len: len(b.restartIRCChan), Cap: cap(b.restartIRCChan)},
+			"resyncChan":               {Len: len(b.resyncChan), Cap: cap(b.resyncChan)},
+			"relayWindowChan":          {Len: len(b.relayWindowChan), Cap: cap(b.relayWindowChan)},
+			"ircListener.sendQueue":    {Len: b.ircListener.sendQueue.Len()},
+		},
+		Workers: b.workers.Depths(),
+	}
+}
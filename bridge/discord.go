@@ -2,17 +2,20 @@ package bridge
 
 import (
 	"fmt"
+	"net/http"
 	"regexp"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/42wim/matterbridge/bridge/discord/transmitter"
 	"github.com/qaisjp/go-discord-irc/dstate"
 	ircnick "github.com/qaisjp/go-discord-irc/irc/nick"
+	"github.com/qaisjp/go-discord-irc/logging"
+	"github.com/qaisjp/go-discord-irc/transmitter"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -20,12 +23,18 @@ type discordBot struct {
 	Session *discordgo.Session
 	bridge  *Bridge
 
-	guildID string
+	// guildIDs are the guilds bridged, see Config.GuildIDs
+	guildIDs []string
 
 	transmitter *transmitter.Transmitter
+	avatars     *avatarCache
+
+	// emoji are the custom emoji of each guild, by lowercase name
+	emoji   map[string]map[string]*discordgo.Emoji
+	emojiMu sync.RWMutex
 }
 
-func newDiscord(bridge *Bridge, botToken, guildID string) (*discordBot, error) {
+func newDiscord(bridge *Bridge, botToken string, guildIDs []string) (*discordBot, error) {
 
 	// Create a new Discord session using the provided bot token.
 	session, err := discordgo.New("Bot " + botToken)
@@ -33,21 +42,35 @@ func newDiscord(bridge *Bridge, botToken, guildID string) (*discordBot, error) {
 		return nil, errors.Wrap(err, "discord, could not create new session")
 	}
 	session.StateEnabled = true
+	session.Client.Transport = &dryRunTransport{bridge: bridge, next: http.DefaultTransport}
 
 	discord := &discordBot{
 		Session: session,
 		bridge:  bridge,
 
-		guildID: guildID,
+		guildIDs: guildIDs,
+		avatars:  newAvatarCache(bridge.store),
+		emoji:    make(map[string]map[string]*discordgo.Emoji),
 	}
 
 	// These events are all fired in separate goroutines
 	discord.Session.AddHandler(discord.OnReady)
+	discord.Session.AddHandler(discord.onResumed)
 	discord.Session.AddHandler(discord.onMessageCreate)
 	discord.Session.AddHandler(discord.onMessageUpdate)
+	discord.Session.AddHandler(discord.onMessageDelete)
 	discord.Session.AddHandler(discord.onGuildEmojiUpdate)
-
-	if !bridge.Config.SimpleMode {
+	discord.Session.AddHandler(discord.onGuildCreate)
+	discord.Session.AddHandler(discord.onChannelCreate)
+	discord.Session.AddHandler(discord.onChannelUpdate)
+	discord.Session.AddHandler(discord.onChannelDelete)
+	discord.Session.AddHandler(discord.onMemberChangeAvatar)
+	discord.Session.AddHandler(discord.onGuildBan)
+	discord.Session.AddHandler(discord.onInteractionCreate)
+	discord.Session.AddHandler(discord.onRetryDelivery)
+	discord.Session.AddHandler(discord.onAvatarReview)
+
+	if !bridge.Config().SimpleMode {
 		discord.Session.AddHandler(discord.onMemberListChunk)
 		discord.Session.AddHandler(discord.onMemberUpdate)
 		discord.Session.AddHandler(discord.onMemberLeave)
@@ -61,10 +84,20 @@ func newDiscord(bridge *Bridge, botToken, guildID string) (*discordBot, error) {
 }
 
 func (d *discordBot) Open() error {
-	d.transmitter = transmitter.New(d.Session, d.guildID, "irc-bridge", true)
-	d.transmitter.Log = logrus.NewEntry(logrus.StandardLogger())
-	if err := d.transmitter.RefreshGuildWebhooks(nil); err != nil {
-		return fmt.Errorf("failed to refresh guild webhooks: %w", err)
+	d.transmitter = transmitter.New(d.Session, d.guildIDs, "irc-bridge", true)
+	d.transmitter.Log = logging.For(logging.Transmitter)
+	d.transmitter.Cache = d.bridge.store
+	d.transmitter.SetRotate(d.bridge.Config().WebhookRotation)
+	d.transmitter.SetWebhooks(parseChannelWebhooks(d.bridge.Config().ChannelWebhooks))
+	// Saved webhooks that have since been deleted are replaced when they are next used
+	if !d.transmitter.LoadCache() {
+		err := d.transmitter.RefreshGuildWebhooks(nil)
+		if err == transmitter.ErrPermissionDenied {
+			// Only channels with a webhook in ChannelWebhooks can be relayed to
+			discordLog.WithError(err).Warnln("could not look up webhooks")
+		} else if err != nil {
+			return fmt.Errorf("failed to refresh guild webhooks: %w", err)
+		}
 	}
 
 	d.Session.Identify.Intents = discordgo.MakeIntent(discordgo.IntentsAll)
@@ -76,6 +109,21 @@ func (d *discordBot) Open() error {
 	return nil
 }
 
+// parseChannelWebhooks parses Config.ChannelWebhooks, leaving out any that aren't webhook URLs
+func parseChannelWebhooks(urls map[string]string) map[string]*discordgo.Webhook {
+	webhooks := make(map[string]*discordgo.Webhook, len(urls))
+	for channel, webhookURL := range urls {
+		wh, err := transmitter.ParseWebhookURL(webhookURL)
+		if err != nil {
+			discordLog.WithError(err).WithField("channel", channel).Errorln("could not use webhook")
+			continue
+		}
+		wh.ChannelID = channel
+		webhooks[channel] = wh
+	}
+	return webhooks
+}
+
 func (d *discordBot) Close() error {
 	return errors.Wrap(d.Session.Close(), "closing discord session")
 }
@@ -105,21 +153,64 @@ func (d *discordBot) publishMessage(s *discordgo.Session, m *discordgo.Message,
 		return
 	}
 
+	// Ignore messages from other guilds the bot is in. DMs are always for this network,
+	// as each network has its own bot (see main), so nothing else gets them.
+	if m.GuildID != "" && !d.bridgesGuild(m.GuildID) {
+		return
+	}
+
 	// Ignore messages sent from our webhooks
 	if d.transmitter.HasWebhook(m.Author.ID) {
 		return
 	}
 
+	// Other bots and webhooks may not be relayed
+	if !d.relaysAuthor(m) {
+		return
+	}
+
+	// Ignore messages another bridge reflected back to us
+	if d.bridge.echoes.IsEcho(m.ChannelID, m.Author.Username, m.Author.Bot || m.WebhookID != "", m.Content) {
+		return
+	}
+
+	// Some members can only read IRC, not speak to it
+	if m.GuildID != "" && !d.canRelayToIRC(m) {
+		return
+	}
+
 	// If the message is "ping" reply with "Pong!"
 	if m.Content == "ping" {
 		_, err := s.ChannelMessageSend(m.ChannelID, "Pong!")
 		if err != nil {
-			log.Warningln("Could not respond to Discord ping message", err.Error())
+			discordLog.Warningln("Could not respond to Discord ping message", err.Error())
+		}
+	}
+
+	if m.GuildID != "" && !wasEdit && (d.handleNamesCommand(m) || d.handleLastCommand(m)) {
+		return
+	}
+
+	// Messages starting with "!ops " are only sent to channel operators,
+	// and are dropped rather than sent to the whole channel if they can't be
+	statusMsg := ""
+	if strings.HasPrefix(m.Content, statusMsgCommand) {
+		if problem := d.statusMsgProblem(m); problem != "" {
+			if !wasEdit {
+				d.replyNotRelayed(m, problem)
+			}
+			return
 		}
+		statusMsg = "@"
+		m.Content = strings.TrimPrefix(m.Content, statusMsgCommand)
 	}
 
 	// HACK: this is before d.ParseText so that the existing <@uid> translation logic can be used
+	var replyTo string
 	if m.MessageReference != nil && m.MessageReference.ChannelID == m.ChannelID {
+		// Replies to messages from IRC are sent as IRC replies too, for clients that show them
+		replyTo, _ = d.bridge.ircMessageID(m.MessageReference.MessageID)
+
 		prefix := "[reply]"
 		msg, err := dstate.ChannelMessage(d.Session, m.MessageReference.ChannelID, m.MessageReference.MessageID)
 		if err == nil {
@@ -132,6 +223,13 @@ func (d *discordBot) publishMessage(s *discordgo.Session, m *discordgo.Message,
 		m.Content = prefix + " " + m.Content
 	}
 
+	// Edits are replies to what they edit, for clients that show them
+	if wasEdit {
+		if _, _, msgids, ok := d.bridge.relayedMessageIDs(m.ID); ok {
+			replyTo = msgids[0]
+		}
+	}
+
 	content := d.ParseText(m)
 
 	// The content is an action if it matches "_(.+)_"
@@ -144,6 +242,8 @@ func (d *discordBot) publishMessage(s *discordgo.Session, m *discordgo.Message,
 		content = content[1 : len(m.Content)-1]
 	}
 
+	content = d.bridge.rewriteToIRC(content)
+
 	if wasEdit {
 		if isAction {
 			content = "/me " + content
@@ -159,7 +259,20 @@ func (d *discordBot) publishMessage(s *discordgo.Session, m *discordgo.Message,
 	pmTarget := ""
 	// Blank guild means that it's a PM
 	if m.GuildID == "" {
-		pmTarget, content = pmTargetFromContent(content, d.bridge.Config.Discriminator)
+		if d.handleMappingCommand(m) || d.handleListCommand(m) || d.handleDiscordOptOut(m) || d.handleLinkCommand(m) ||
+			d.handleHighlightCommand(m) {
+			return
+		}
+
+		target, targetContent := pmTargetFromContent(content, d.bridge.Config().Discriminator)
+
+		// Without an explicit target, reply to whoever last messaged them from IRC
+		if target == "" {
+			if last, ok := d.bridge.pmReplies.Get(m.Author.ID); ok {
+				target, targetContent = last, content
+			}
+		}
+		pmTarget, content = target, targetContent
 		// if the target could not be deduced. tell them this.
 		switch pmTarget {
 		case "":
@@ -167,7 +280,7 @@ func (d *discordBot) publishMessage(s *discordgo.Session, m *discordgo.Message,
 				m.ChannelID,
 				fmt.Sprintf(
 					"Don't know who that is. Can't PM. Try 'name@%s, message here'",
-					d.bridge.Config.Discriminator))
+					d.bridge.Config().Discriminator))
 			return
 		case "*UNKNOWN*":
 			return
@@ -176,20 +289,90 @@ func (d *discordBot) publishMessage(s *discordgo.Session, m *discordgo.Message,
 		}
 	}
 
-	d.bridge.discordMessageEventsChan <- &DiscordMessage{
-		Message:  m,
-		Content:  content,
-		IsAction: isAction,
-		PmTarget: pmTarget,
+	// People sending too much are held back, or not relayed at all
+	delay, ok := d.bridge.throttle.Allow(discordThrottleKey(m.Author.ID), m.Author.Username, m.Content)
+	if !ok {
+		return
 	}
 
-	for _, attachment := range m.Attachments {
-		d.bridge.discordMessageEventsChan <- &DiscordMessage{
-			Message:  m,
-			Content:  attachment.URL,
-			IsAction: isAction,
-			PmTarget: pmTarget,
+	// Links to other Discord messages are quoted after the message
+	var quotes []string
+	if !wasEdit {
+		quotes = d.linkQuotes(m)
+	}
+	content += d.bridge.urlTitles(DirectionDiscordToIRC, content)
+
+	// Attachments may be copied somewhere IRC users can reach, which can take a while
+	attachmentURLs := make([]string, len(m.Attachments))
+	for i, attachment := range m.Attachments {
+		attachmentURLs[i] = d.bridge.attachmentURL(attachment)
+	}
+
+	queue := func() {
+		d.bridge.queueDiscordMessage(&DiscordMessage{
+			Message:   m,
+			Content:   content,
+			IsAction:  isAction,
+			PmTarget:  pmTarget,
+			StatusMsg: statusMsg,
+			ReplyTo:   replyTo,
+		})
+
+		for _, quote := range quotes {
+			d.bridge.queueDiscordMessage(&DiscordMessage{
+				Message:   m,
+				Content:   quote,
+				PmTarget:  pmTarget,
+				StatusMsg: statusMsg,
+			})
 		}
+
+		for _, attachmentURL := range attachmentURLs {
+			d.bridge.queueDiscordMessage(&DiscordMessage{
+				Message:   m,
+				Content:   d.bridge.rewriteToIRC(attachmentURL),
+				IsAction:  isAction,
+				PmTarget:  pmTarget,
+				StatusMsg: statusMsg,
+			})
+		}
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, queue)
+	} else {
+		queue()
+	}
+}
+
+// statusMsgCommand is the prefix for Discord messages that should only be sent to IRC channel operators
+const statusMsgCommand = "!ops "
+
+// canMessageOps returns true if the author of a message has a role in StatusMsgRoles
+func (d *discordBot) canMessageOps(m *discordgo.Message) bool {
+	member, ok := d.messageMember(m)
+	return ok && hasAnyRole(member, d.bridge.Config().StatusMsgRoles)
+}
+
+// statusMsgProblem returns why a statusMsgCommand message can't be sent to channel operators, or "" if it can
+func (d *discordBot) statusMsgProblem(m *discordgo.Message) string {
+	if !d.canMessageOps(m) {
+		return "Only members with an ops role can message IRC channel operators."
+	}
+	if !strings.Contains(d.bridge.ircListener.isupport.StatusMsg(), "@") {
+		return "The IRC server doesn't support messaging only channel operators."
+	}
+	return ""
+}
+
+// replyNotRelayed tells the author of a message why it wasn't relayed to IRC
+func (d *discordBot) replyNotRelayed(m *discordgo.Message, reason string) {
+	_, err := d.Session.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Content:         reason + " Your message was not sent to IRC.",
+		Reference:       m.Reference(),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		discordLog.WithError(err).Warnln("could not say why a message was not relayed")
 	}
 }
 
@@ -200,7 +383,7 @@ func (d *discordBot) publishReaction(s *discordgo.Session, r *discordgo.MessageR
 
 	user, err := s.User(r.UserID)
 	if err != nil {
-		log.Errorln(err)
+		discordLog.Errorln(err)
 		return
 	}
 
@@ -210,6 +393,9 @@ func (d *discordBot) publishReaction(s *discordgo.Session, r *discordgo.MessageR
 		Author:    user,
 		GuildID:   r.GuildID,
 	}
+	if (m.GuildID != "" && !d.canRelayToIRC(m)) || !d.relaysAuthor(m) {
+		return
+	}
 
 	originalMessage, err := dstate.ChannelMessage(d.Session, r.ChannelID, r.MessageID)
 	reactionTarget := ""
@@ -243,12 +429,12 @@ func (d *discordBot) publishReaction(s *discordgo.Session, r *discordgo.MessageR
 	}
 	content := fmt.Sprint("reacted with ", emoji, reactionTarget)
 
-	d.bridge.discordMessageEventsChan <- &DiscordMessage{
+	d.bridge.queueDiscordMessage(&DiscordMessage{
 		Message:  m,
 		Content:  content,
 		IsAction: true,
 		PmTarget: "",
-	}
+	})
 }
 
 // Up to date as of https://git.io/v5kJg
@@ -266,20 +452,25 @@ func (d *discordBot) ParseText(m *discordgo.Message) string {
 	for _, user := range m.Mentions {
 		// Find the irc username with the discord ID in irc connections
 		username := ""
-		for _, u := range d.bridge.ircManager.ircConnections {
+		for _, u := range d.bridge.ircManager.connections() {
 			if u.discord.ID == user.ID {
 				username = u.nick
 			}
 		}
 
+		// Otherwise use the IRC nick they linked to
+		if username == "" {
+			username, _ = d.bridge.LinkedNick(user.ID)
+		}
+
 		if username == "" {
 			// Nickname is their username by default
 			nick := user.Username
 
 			// If we can get their member + nick, set nick to the real nick
-			member, err := d.Session.State.Member(d.guildID, user.ID)
-			if err == nil && member.Nick != "" {
-				nick = member.Nick
+			member, _, err := d.member(user.ID)
+			if err == nil {
+				nick = d.puppetNickSource(member)
 			}
 
 			username = d.bridge.ircManager.generateNickname(DiscordUser{
@@ -291,13 +482,13 @@ func (d *discordBot) ParseText(m *discordgo.Message) string {
 				Online:        false,
 			})
 
-			log.WithFields(log.Fields{
+			discordLog.WithFields(log.Fields{
 				"discord-username": user.Username,
 				"irc-username":     username,
 				"discord-id":       user.ID,
 			}).Infoln("Could not convert mention using existing IRC connection")
 		} else {
-			log.WithFields(log.Fields{
+			discordLog.WithFields(log.Fields{
 				"discord-username": user.Username,
 				"irc-username":     username,
 				"discord-id":       user.ID,
@@ -312,7 +503,7 @@ func (d *discordBot) ParseText(m *discordgo.Message) string {
 
 	// Copied from message.go ContentWithMoreMentionsReplaced(s)
 	for _, roleID := range m.MentionRoles {
-		role, err := d.Session.State.Role(d.guildID, roleID)
+		role, err := d.role(roleID)
 		if err != nil || !role.Mentionable {
 			continue
 		}
@@ -354,7 +545,7 @@ func (d *discordBot) ParseText(m *discordgo.Message) string {
 		// Strip enclosing identifiers
 		roleID := str[3 : len(str)-1]
 
-		role, err := d.Session.State.Role(d.bridge.Config.GuildID, roleID)
+		role, err := d.role(roleID)
 		if err == nil {
 			return "@" + role.Name
 		} else if err == discordgo.ErrStateNotFound {
@@ -373,8 +564,8 @@ func (d *discordBot) ParseText(m *discordgo.Message) string {
 func (d *discordBot) handlePresenceUpdate(uid string, status discordgo.Status, forceOnline bool) {
 	// If they are offline, just deliver a mostly empty struct with the ID and online state
 	if !forceOnline && !isStatusOnline(status) {
-		if d.bridge.Config.DebugPresence {
-			log.WithField("id", uid).Debugln("PRESENCE", status, "(handlePresenceUpdate - Online: false)")
+		if d.bridge.Config().DebugPresence {
+			discordLog.WithField("id", uid).Debugln("PRESENCE", status, "(handlePresenceUpdate - Online: false)")
 		}
 		d.sendUpdateUserChan(DiscordUser{
 			ID:     uid,
@@ -383,14 +574,14 @@ func (d *discordBot) handlePresenceUpdate(uid string, status discordgo.Status, f
 		return
 	}
 
-	if d.bridge.Config.DebugPresence {
-		log.WithField("id", uid).Debugln("PRESENCE", status, "(handlePresenceUpdate)")
+	if d.bridge.Config().DebugPresence {
+		discordLog.WithField("id", uid).Debugln("PRESENCE", status, "(handlePresenceUpdate)")
 	}
 
 	// Otherwise get their GuildMember object...
-	user, err := d.Session.State.Member(d.guildID, uid)
+	user, _, err := d.member(uid)
 	if err != nil {
-		log.Println(errors.Wrap(err, "get member from state in handlePresenceUpdate failed"))
+		discordLog.Println(errors.Wrap(err, "get member from state in handlePresenceUpdate failed"))
 		return
 	}
 
@@ -402,10 +593,21 @@ func isStatusOnline(status discordgo.Status) bool {
 	return status != discordgo.StatusOffline
 }
 
+// statusAwayMessage returns the IRC away message for an online Discord status
+func statusAwayMessage(status discordgo.Status) string {
+	switch status {
+	case discordgo.StatusIdle:
+		return "idle on discord"
+	case discordgo.StatusDoNotDisturb:
+		return "do not disturb on discord"
+	}
+	return ""
+}
+
 func (d *discordBot) sendUpdateUserChan(user DiscordUser) bool {
 	// Only log this for online events, because offline events won't have this
 	if (user.Username == "" || user.Discriminator == "") && user.Online {
-		log.WithFields(log.Fields{
+		discordLog.WithFields(log.Fields{
 			"err":                errors.WithStack(errors.New("Username or Discriminator is empty")).Error(),
 			"user.Username":      user.Username,
 			"user.Discriminator": user.Discriminator,
@@ -418,19 +620,33 @@ func (d *discordBot) sendUpdateUserChan(user DiscordUser) bool {
 	return true
 }
 
+// GetAvatar returns the avatar URL of the member of a bridged guild called username,
+// or an empty string if there isn't exactly one. Results are cached for Config.AvatarCacheTTL.
+func (d *discordBot) GetAvatar(username string) string {
+	ttl := d.bridge.Config().AvatarCacheTTL
+	if ttl <= 0 {
+		_, url := d.findAvatar(username)
+		return url
+	}
+
+	if url, ok := d.avatars.Get(username, ttl); ok {
+		return url
+	}
+	userID, url := d.findAvatar(username)
+	d.avatars.Set(username, userID, url)
+	return url
+}
+
 // See https://github.com/reactiflux/discord-irc/pull/230/files#diff-7202bb7fb017faefd425a2af32df2f9dR357
-func (d *discordBot) GetAvatar(guildID, username string) (_ string) {
+func (d *discordBot) findAvatar(username string) (userID, url string) {
 	// First get all members
-	guild, err := d.Session.State.Guild(guildID)
-	if err != nil {
-		panic(err)
-	}
+	members := d.members()
 
 	// Matching members
 	var foundMember *discordgo.Member
 
 	// Try and find an exact case-sensitive match
-	for _, member := range guild.Members {
+	for _, member := range members {
 		if (username != member.Nick) && (username != member.User.Username) {
 			continue
 		}
@@ -445,7 +661,7 @@ func (d *discordBot) GetAvatar(guildID, username string) (_ string) {
 
 	// If no member found, check case-insensitively
 	if foundMember == nil {
-		for _, member := range guild.Members {
+		for _, member := range members {
 			if !strings.EqualFold(username, member.Nick) && !strings.EqualFold(username, member.User.Username) {
 				continue
 			}
@@ -464,7 +680,7 @@ func (d *discordBot) GetAvatar(guildID, username string) (_ string) {
 		return
 	}
 
-	return discordgo.EndpointUserAvatar(foundMember.User.ID, foundMember.User.Avatar)
+	return foundMember.User.ID, discordgo.EndpointUserAvatar(foundMember.User.ID, foundMember.User.Avatar)
 }
 
 // GetMemberNick returns the real display name for a Discord GuildMember
@@ -476,6 +692,15 @@ func GetMemberNick(m *discordgo.Member) string {
 	return m.Nick
 }
 
+// puppetNickSource returns the name puppet nicks are generated from,
+// which is the guild nickname unless PuppetNickSource says otherwise.
+func (d *discordBot) puppetNickSource(m *discordgo.Member) string {
+	if d.bridge.Config().PuppetNickSource == PuppetNickSourceUsername {
+		return m.User.Username
+	}
+	return GetMemberNick(m)
+}
+
 // pmTargetFromContent returns an irc nick given a message sent to an IRC user via Discord
 //
 // Returns empty string if the nick could not be deduced.
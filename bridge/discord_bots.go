@@ -0,0 +1,34 @@
+package bridge
+
+import "github.com/bwmarrin/discordgo"
+
+// relaysAuthor returns true if the author of a message can be relayed to IRC.
+// Messages from people are always relayed.
+func (d *discordBot) relaysAuthor(m *discordgo.Message) bool {
+	if isCrosspost(m) {
+		return d.bridge.Config().RelayDiscordCrossposts
+	}
+
+	// Webhooks post as a user with the webhook's ID
+	if m.WebhookID != "" {
+		return d.bridge.relaysBot(m.WebhookID, true)
+	}
+	return !m.Author.Bot || d.bridge.relaysBot(m.Author.ID, false)
+}
+
+// relaysBot returns true if a Discord bot (by the ID of its application, which is also its
+// user ID) or webhook can be relayed to IRC, going by Config.RelayDiscordBots and
+// RelayDiscordWebhooks, and the allow and deny lists for them
+func (b *Bridge) relaysBot(id string, webhook bool) bool {
+	conf := b.Config()
+	if _, ok := conf.DiscordBotsDenied[id]; ok {
+		return false
+	}
+	if _, ok := conf.DiscordBotsAllowed[id]; ok {
+		return true
+	}
+	if webhook {
+		return conf.RelayDiscordWebhooks
+	}
+	return conf.RelayDiscordBots
+}
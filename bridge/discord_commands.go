@@ -0,0 +1,295 @@
+package bridge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// slashCommands are the guild slash commands registered if Config.SlashCommands is set
+var slashCommands = []*discordgo.ApplicationCommand{{
+	Name:        "bridge",
+	Description: "Manage the IRC bridge",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "status",
+			Description: "Show whether the bridge is connected, and to which channels",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "whois",
+			Description: "Look up an IRC nick with WHOIS, and show what the bridge knows about them",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "nick",
+				Description: "IRC nick",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "names",
+			Description: "List who is in the IRC channel bridged to this channel",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "reconnect",
+			Description: "Reconnect the bridge to IRC",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "pause",
+			Description: "Stop relaying messages, such as during IRC network maintenance",
+			Options:     []*discordgo.ApplicationCommandOption{pauseDirectionOption, pauseModeOption},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "resume",
+			Description: "Relay messages again, sending any that were queued",
+			Options:     []*discordgo.ApplicationCommandOption{pauseDirectionOption},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "search",
+			Description: "Search the logs of the IRC channel bridged to this channel",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "query",
+				Description: "Words the messages must contain",
+				Required:    true,
+			}},
+		},
+	},
+}}
+
+// pauseDirectionOption and pauseModeOption are the options of the pause and resume commands
+var (
+	pauseDirectionOption = &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "direction",
+		Description: "Which way to pause or resume, both if not given",
+		Choices: []*discordgo.ApplicationCommandOptionChoice{
+			{Name: "Discord to IRC", Value: DirectionDiscordToIRC},
+			{Name: "IRC to Discord", Value: DirectionIRCToDiscord},
+			{Name: "Both", Value: "both"},
+		},
+	}
+	pauseModeOption = &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "mode",
+		Description: "Whether to send messages once resumed, or drop them",
+		Choices: []*discordgo.ApplicationCommandOptionChoice{
+			{Name: "Queue", Value: PauseQueue},
+			{Name: "Drop", Value: PauseDrop},
+		},
+	}
+)
+
+// registerSlashCommands replaces the bot's commands in each bridged guild with slashCommands
+func (d *discordBot) registerSlashCommands() {
+	if d.Session.State.User == nil {
+		return
+	}
+	for _, guildID := range d.guildIDs {
+		if _, err := d.Session.ApplicationCommandBulkOverwrite(d.Session.State.User.ID, guildID, slashCommands); err != nil {
+			discordLog.WithError(err).WithField("guild", guildID).Warnln("Could not register slash commands")
+		}
+	}
+}
+
+// isAdminMember returns true if a guild member is a bridge admin, by ID or role
+func (d *discordBot) isAdminMember(member *discordgo.Member) bool {
+	if member == nil || member.User == nil {
+		return false
+	}
+	return d.bridge.IsAdminDiscord(member.User.ID) || hasAnyRole(member, d.bridge.Config().AdminDiscordRoles)
+}
+
+// onInteractionCreate runs the bridge's slash commands, which are for admins other than search
+func (d *discordBot) onInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if !d.bridge.Config().SlashCommands || i.Type != discordgo.InteractionApplicationCommand || !d.bridgesGuild(i.GuildID) {
+		return
+	}
+
+	data := i.ApplicationCommandData()
+	if data.Name != "bridge" || len(data.Options) == 0 {
+		return
+	}
+
+	sub := data.Options[0]
+	if sub.Name != "search" && !d.isAdminMember(i.Member) {
+		d.respond(i.Interaction, "Only bridge admins can do that.")
+		return
+	}
+
+	switch sub.Name {
+	case "status":
+		d.respond(i.Interaction, d.bridge.statusReply())
+	case "whois":
+		var nick string
+		if len(sub.Options) > 0 {
+			nick = sub.Options[0].StringValue()
+		}
+		d.respondLater(i.Interaction, func() *discordgo.WebhookParams {
+			return &discordgo.WebhookParams{Content: d.bridge.ircWhoisReply(nick) + "\n" + d.bridge.bridgeWhoisReply(nick)}
+		})
+	case "names":
+		mapping, ok := d.bridge.GetMappingByDiscord(i.ChannelID)
+		if !ok {
+			d.respond(i.Interaction, "This channel isn't bridged to IRC.")
+			return
+		}
+		// Asking the IRC server can take longer than Discord waits for a response
+		d.respondLater(i.Interaction, func() *discordgo.WebhookParams {
+			embeds, err := d.bridge.channelNamesEmbeds(mapping.IRCChannel)
+			if err != nil {
+				return &discordgo.WebhookParams{Content: fmt.Sprintf("Could not list %s: %s.", mapping.IRCChannel, err)}
+			}
+			return &discordgo.WebhookParams{Embeds: embeds}
+		})
+	case "reconnect":
+		if err := d.bridge.ReconnectIRC(); err != nil {
+			d.respond(i.Interaction, fmt.Sprintf("Could not reconnect: %s.", err))
+			return
+		}
+		d.respond(i.Interaction, "Reconnecting to IRC.")
+	case "pause", "resume":
+		var args []string
+		for _, option := range sub.Options {
+			args = append(args, option.StringValue())
+		}
+		d.respond(i.Interaction, d.bridge.pauseCommandReply(sub.Name, args))
+	case "search":
+		mapping, ok := d.bridge.GetMappingByDiscord(i.ChannelID)
+		if !ok {
+			d.respond(i.Interaction, "This channel isn't bridged to IRC.")
+			return
+		}
+		var query string
+		if len(sub.Options) > 0 {
+			query = sub.Options[0].StringValue()
+		}
+		d.respondLater(i.Interaction, func() *discordgo.WebhookParams {
+			// Lines are in a code block so that IRC formatting isn't taken as markdown
+			lines := d.bridge.searchReply(mapping.IRCChannel, query)
+			return &discordgo.WebhookParams{Content: "```\n" + strings.Join(lines, "\n") + "\n```"}
+		})
+	}
+}
+
+// respond answers an interaction with a message only its user can see
+func (d *discordBot) respond(i *discordgo.Interaction, content string) {
+	err := d.Session.InteractionRespond(i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content:         truncateMessage(content),
+			Flags:           discordgo.MessageFlagsEphemeral,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		},
+	})
+	if err != nil {
+		discordLog.WithError(err).Warnln("Could not respond to slash command")
+	}
+}
+
+// respondLater tells Discord an answer to an interaction is coming, and then sends it
+func (d *discordBot) respondLater(i *discordgo.Interaction, answer func() *discordgo.WebhookParams) {
+	err := d.Session.InteractionRespond(i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		discordLog.WithError(err).Warnln("Could not respond to slash command")
+		return
+	}
+
+	// The first follow-up replaces the deferred response
+	params := answer()
+	params.Content = truncateMessage(params.Content)
+	params.AllowedMentions = &discordgo.MessageAllowedMentions{}
+	_, err = d.Session.WebhookExecute(i.AppID, i.Token, false, params)
+	if err != nil {
+		discordLog.WithError(err).Warnln("Could not follow up slash command")
+	}
+}
+
+// truncateMessage cuts content short enough for a Discord message
+func truncateMessage(content string) string {
+	if len(content) <= discordMessageLimit {
+		return content
+	}
+	return truncateNick(content, discordMessageLimit-len("…")) + "…"
+}
+
+// ircWhoisReply describes an IRC nick from the server's answer to WHOIS
+func (b *Bridge) ircWhoisReply(nick string) string {
+	w, found, err := b.Whois(nick)
+	if err != nil {
+		return fmt.Sprintf("Could not look up %s: %s.", nick, err)
+	}
+	if !found {
+		return fmt.Sprintf("Nobody on IRC is using the nick %s.", nick)
+	}
+
+	lines := []string{fmt.Sprintf("**%s** is `%s@%s` (%s)", w.Nick, w.User, w.Host, w.RealName)}
+	if w.Server != "" {
+		lines = append(lines, "Server: "+w.Server)
+	}
+	if w.Account != "" {
+		lines = append(lines, "Account: "+w.Account)
+	}
+	if w.Operator {
+		lines = append(lines, "Is an IRC operator")
+	}
+	if len(w.Channels) > 0 {
+		lines = append(lines, "Channels: "+strings.Join(w.Channels, " "))
+	}
+	if w.Idle > 0 {
+		lines = append(lines, "Idle: "+w.Idle.String())
+	}
+	if w.Away != "" {
+		lines = append(lines, "Away: "+w.Away)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// bridgeWhoisReply describes what the bridge knows about an IRC nick
+func (b *Bridge) bridgeWhoisReply(nick string) string {
+	var facts []string
+
+	if con, ok := b.ircManager.puppetByNick(nick); ok {
+		facts = append(facts, fmt.Sprintf("is the puppet of <@%s>", con.discord.ID))
+	} else if discordID, ok := b.LinkedDiscordID(nick); ok {
+		facts = append(facts, fmt.Sprintf("is linked to <@%s>", discordID))
+	}
+
+	var channels []string
+	for _, mapping := range b.mappingTable().mappings {
+		if ch, ok := b.ircListener.GetChannel(mapping.IRCChannel); ok {
+			if _, ok := ch.GetUser(nick); ok {
+				channels = append(channels, mapping.IRCChannel)
+			}
+		}
+	}
+	if len(channels) > 0 {
+		sort.Strings(channels)
+		facts = append(facts, "is in "+strings.Join(channels, ", "))
+	}
+
+	if reason, ok := b.ircListener.away.Get(nick); ok {
+		facts = append(facts, "is away: "+reason)
+	}
+	if b.IRCOptedOut(nick) {
+		facts = append(facts, "has opted out of being relayed")
+	}
+
+	if len(facts) == 0 {
+		return fmt.Sprintf("The bridge doesn't know anything about %s.", nick)
+	}
+	return nick + " " + strings.Join(facts, ", ") + "."
+}
@@ -1,11 +1,8 @@
 package bridge
 
 import (
-	"strings"
-
 	"github.com/bwmarrin/discordgo"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
 )
 
 func (d *discordBot) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
@@ -17,22 +14,63 @@ func (d *discordBot) onMessageUpdate(s *discordgo.Session, m *discordgo.MessageU
 }
 
 func (d *discordBot) OnMessageReactionAdd(s *discordgo.Session, m *discordgo.MessageReactionAdd) {
+	if !d.bridgesGuild(m.GuildID) {
+		return
+	}
 	d.publishReaction(s, m.MessageReaction)
 }
 
 // onMemberListChunk is fired in response to our GuildMembers request in OnReady
 func (d *discordBot) onMemberListChunk(s *discordgo.Session, m *discordgo.GuildMembersChunk) {
+	if !d.bridgesGuild(m.GuildID) {
+		return
+	}
 	for _, m := range m.Members {
 		d.handleMemberUpdate(m, false)
 	}
 }
 
 func (d *discordBot) onMemberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	if !d.bridgesGuild(m.GuildID) {
+		return
+	}
 	d.handleMemberUpdate(m.Member, false)
 }
 
+// onMemberChangeAvatar forgets cached avatars that a member joining, changing or leaving may affect
+func (d *discordBot) onMemberChangeAvatar(s *discordgo.Session, e interface{}) {
+	switch m := e.(type) {
+	case *discordgo.GuildMemberAdd:
+		if d.bridgesGuild(m.GuildID) {
+			d.avatars.Forget(m.Member)
+		}
+	case *discordgo.GuildMemberUpdate:
+		if d.bridgesGuild(m.GuildID) {
+			d.avatars.Forget(m.Member)
+		}
+	case *discordgo.GuildMemberRemove:
+		if d.bridgesGuild(m.GuildID) {
+			d.avatars.Forget(m.Member)
+		}
+	case *discordgo.GuildMembersChunk:
+		if d.bridgesGuild(m.GuildID) {
+			for _, member := range m.Members {
+				d.avatars.Forget(member)
+			}
+		}
+	}
+}
+
 // onMemberLeave is triggered when a user is removed from a guild (leave/kick/ban).
 func (d *discordBot) onMemberLeave(s *discordgo.Session, m *discordgo.GuildMemberRemove) {
+	// The bot might be in other guilds, which might even be bridged by another network
+	if !d.bridgesGuild(m.GuildID) {
+		return
+	}
+	// They keep their puppet while they are still in another bridged guild
+	if _, _, err := d.member(m.User.ID); err == nil {
+		return
+	}
 	d.bridge.removeUserChan <- m.User.ID
 }
 
@@ -45,15 +83,23 @@ func (d *discordBot) OnPresencesReplace(s *discordgo.Session, m *discordgo.Prese
 
 // Handle when presence is updated
 func (d *discordBot) OnPresenceUpdate(s *discordgo.Session, m *discordgo.PresenceUpdate) {
+	if !d.bridgesGuild(m.GuildID) {
+		return
+	}
 	d.handlePresenceUpdate(m.Presence.User.ID, m.Presence.Status, false)
 }
 
 func (d *discordBot) OnTypingStart(s *discordgo.Session, m *discordgo.TypingStart) {
+	// Typing in a DM to this network's bot counts as activity too
+	if m.GuildID != "" && !d.bridgesGuild(m.GuildID) {
+		return
+	}
+
 	status := discordgo.StatusOffline
 
-	p, err := d.Session.State.Presence(d.guildID, m.UserID)
+	p, err := d.presence(m.UserID)
 	if err != nil {
-		log.Println(errors.Wrap(err, "get presence from in OnTypingStart failed"))
+		discordLog.Println(errors.Wrap(err, "get presence from in OnTypingStart failed"))
 		// return
 	} else {
 		status = p.Status
@@ -64,39 +110,47 @@ func (d *discordBot) OnTypingStart(s *discordgo.Session, m *discordgo.TypingStar
 }
 
 func (d *discordBot) OnReady(s *discordgo.Session, m *discordgo.Ready) {
-	// Fires a GuildMembersChunk event
-	err := d.Session.RequestGuildMembers(d.guildID, "", 0, "", true)
-	if err != nil {
-		log.Warningln(errors.Wrap(err, "could not request guild members").Error())
-		return
+	d.bridge.onDiscordConnect()
+
+	if d.bridge.Config().SlashCommands {
+		go d.registerSlashCommands()
 	}
 
-	emoji, err := d.Session.GuildEmojis(d.guildID)
-	if err == nil {
-		d.setGuildEmoji(d.guildID, emoji)
+	for _, guildID := range d.guildIDs {
+		// Fires a GuildMembersChunk event
+		err := d.Session.RequestGuildMembers(guildID, "", 0, "", true)
+		if err != nil {
+			discordLog.WithField("guild", guildID).Warningln(errors.Wrap(err, "could not request guild members").Error())
+			continue
+		}
+
+		emoji, err := d.Session.GuildEmojis(guildID)
+		if err == nil {
+			d.setGuildEmoji(guildID, emoji)
+		}
 	}
 }
 
-func (d *discordBot) onGuildEmojiUpdate(s *discordgo.Session, m *discordgo.GuildEmojisUpdate) {
-	d.setGuildEmoji(m.GuildID, m.Emojis)
+func (d *discordBot) onResumed(s *discordgo.Session, m *discordgo.Resumed) {
+	d.bridge.onDiscordConnect()
 }
 
-func (d *discordBot) setGuildEmoji(guild string, emoji []*discordgo.Emoji) {
-	d.bridge.emoji = make(map[string]*discordgo.Emoji)
-	for _, e := range emoji {
-		d.bridge.emoji[strings.ToLower(e.Name)] = e
+func (d *discordBot) onGuildEmojiUpdate(s *discordgo.Session, m *discordgo.GuildEmojisUpdate) {
+	if !d.bridgesGuild(m.GuildID) {
+		return
 	}
+	d.setGuildEmoji(m.GuildID, m.Emojis)
 }
 
 func (d *discordBot) handleMemberUpdate(m *discordgo.Member, forceOnline bool) {
 	status := discordgo.StatusOnline
 
 	if !forceOnline {
-		presence, err := d.Session.State.Presence(d.guildID, m.User.ID)
+		presence, err := d.presence(m.User.ID)
 		if err != nil {
 			// This error is usually triggered on first run because it represents offline
 			if err != discordgo.ErrStateNotFound {
-				log.WithField("error", err).Errorln("presence retrieval failed")
+				discordLog.WithField("error", err).Errorln("presence retrieval failed")
 			}
 			return
 		}
@@ -112,8 +166,9 @@ func (d *discordBot) handleMemberUpdate(m *discordgo.Member, forceOnline bool) {
 		ID:            m.User.ID,
 		Username:      m.User.Username,
 		Discriminator: m.User.Discriminator,
-		Nick:          GetMemberNick(m),
+		Nick:          d.puppetNickSource(m),
 		Bot:           m.User.Bot,
 		Online:        isStatusOnline(status),
+		Away:          statusAwayMessage(status),
 	})
 }
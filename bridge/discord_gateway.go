@@ -0,0 +1,82 @@
+package bridge
+
+import (
+	"fmt"
+	"time"
+)
+
+// discordGatewayCheckInterval is how often the Discord gateway is checked for having stopped answering heartbeats
+const discordGatewayCheckInterval = 15 * time.Second
+
+// watchDiscordGateway reopens the Discord session if the gateway hasn't acknowledged a heartbeat
+// for Config.DiscordZombieTimeout, as the websocket can stop working without being closed.
+// Mapped IRC channels are told about the gap, as messages sent on Discord during it may be missing.
+func (b *Bridge) watchDiscordGateway() {
+	ticker := time.NewTicker(discordGatewayCheckInterval)
+	defer ticker.Stop()
+
+	var zombieSince time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+
+		timeout := b.Config().DiscordZombieTimeout
+		if timeout <= 0 {
+			continue
+		}
+
+		if zombieSince.IsZero() {
+			lastAck, zombie := b.discord.zombied(timeout)
+			if !zombie {
+				continue
+			}
+			zombieSince = lastAck
+			discordLog.WithField("last_ack", lastAck).Warnln("Discord gateway stopped answering heartbeats, reconnecting")
+		}
+
+		if err := b.discord.reopen(); err != nil {
+			discordLog.WithError(err).Errorln("could not reconnect to Discord, trying again")
+			continue
+		}
+
+		gap := time.Since(zombieSince).Round(time.Second)
+		zombieSince = time.Time{}
+		b.relayErrors.Add("the Discord gateway stopped answering for %s, so the bridge reconnected", gap)
+		b.noticeDiscordGap(gap)
+	}
+}
+
+// zombied returns true if the gateway hasn't acknowledged a heartbeat within timeout
+// while connected, and when it last did
+func (d *discordBot) zombied(timeout time.Duration) (time.Time, bool) {
+	d.Session.RLock()
+	defer d.Session.RUnlock()
+
+	lastAck := d.Session.LastHeartbeatAck
+	if !d.Session.DataReady || lastAck.IsZero() {
+		return lastAck, false
+	}
+	return lastAck, time.Since(lastAck) > timeout
+}
+
+// reopen closes the Discord session and opens it again
+func (d *discordBot) reopen() error {
+	if err := d.Session.Close(); err != nil {
+		discordLog.WithError(err).Warnln("could not close Discord session")
+	}
+	return d.Session.Open()
+}
+
+// noticeDiscordGap tells mapped IRC channels that messages from Discord may have been missed
+func (b *Bridge) noticeDiscordGap(gap time.Duration) {
+	if !b.ircListener.Registered() {
+		return
+	}
+	message := fmt.Sprintf("The bridge lost its connection to Discord for %s, so messages sent on Discord in that time may be missing.", gap)
+	for _, mapping := range b.mappingTable().mappings {
+		b.ircListener.Notice(mapping.IRCChannel, message)
+	}
+}
@@ -0,0 +1,85 @@
+package bridge
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/qaisjp/go-discord-irc/dstate"
+)
+
+// messageLinkPattern matches links to Discord messages, capturing the guild, channel and message IDs
+var messageLinkPattern = regexp.MustCompile(`https?://(?:(?:ptb|canary)\.)?discord(?:app)?\.com/channels/(\d+|@me)/(\d+)/(\d+)`)
+
+// linkQuotesMax is how many linked messages in a Discord message are quoted on IRC,
+// and linkQuoteLength how long each quote can be
+const (
+	linkQuotesMax   = 3
+	linkQuoteLength = 200
+)
+
+// linkQuotes returns a one line quote of each Discord message linked to in m, for IRC users
+// who can't open the links. Messages are only quoted from bridged guilds, from channels the
+// author of m can read.
+func (d *discordBot) linkQuotes(m *discordgo.Message) []string {
+	if !d.bridge.Config().DiscordLinkQuotes || m.Author == nil {
+		return nil
+	}
+
+	var quotes []string
+	seen := make(map[string]struct{})
+	for _, link := range messageLinkPattern.FindAllStringSubmatch(m.Content, -1) {
+		guildID, channelID, messageID := link[1], link[2], link[3]
+		if _, ok := seen[messageID]; ok || !d.bridgesGuild(guildID) {
+			continue
+		}
+		seen[messageID] = struct{}{}
+		if len(quotes) == linkQuotesMax {
+			break
+		}
+
+		perms, err := d.Session.State.UserChannelPermissions(m.Author.ID, channelID)
+		if err != nil || perms&discordgo.PermissionViewChannel == 0 || perms&discordgo.PermissionReadMessageHistory == 0 {
+			continue
+		}
+
+		linked, err := dstate.ChannelMessage(d.Session, channelID, messageID)
+		if err != nil || linked.Author == nil {
+			continue
+		}
+		if quote := d.linkQuote(linked); quote != "" {
+			quotes = append(quotes, quote)
+		}
+	}
+	return quotes
+}
+
+// linkQuote formats a linked message as "[quote] nick: content" for IRC, on one line
+func (d *discordBot) linkQuote(linked *discordgo.Message) string {
+	content := linked.Content
+	if content == "" && len(linked.Attachments) > 0 {
+		content = linked.Attachments[0].URL
+	}
+	if content == "" && len(linked.Embeds) > 0 {
+		content = linked.Embeds[0].Title
+		if content == "" {
+			content = linked.Embeds[0].Description
+		}
+	}
+	if content == "" {
+		return ""
+	}
+
+	// The author is mentioned so that ParseText gives them the nick they have on IRC
+	quoted := *linked
+	quoted.Content = userToMention(linked.Author) + ": " + strings.Join(strings.Fields(content), " ")
+	if !linked.Author.Bot {
+		quoted.Mentions = append(append([]*discordgo.User(nil), linked.Mentions...), linked.Author)
+	}
+
+	text := d.bridge.rewriteToIRC(d.ParseText(&quoted))
+	if len(text) > linkQuoteLength {
+		text = truncateNick(text, linkQuoteLength-len("…")) + "…"
+	}
+	return "[quote] " + text
+}
@@ -0,0 +1,210 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// discordFlushInterval is how often kept messages are sent if Discord is reachable again,
+	// as the webhook API can come back without the websocket noticing
+	discordFlushInterval = 30 * time.Second
+
+	// discordMessageLimit is the most characters Discord allows in a message
+	discordMessageLimit = 2000
+)
+
+// discordPending is an IRC message that couldn't be sent to Discord yet
+type discordPending struct {
+	ircChannel string // for the worker that sends it
+	ircMsgID   string
+	channel    string
+	username   string
+	avatar     string
+	content    string
+	at         time.Time
+	// image is sent instead of content if it is not nil, see trySendToDiscord
+	image *linkedImage
+}
+
+// discordOfflineBuffer keeps IRC messages that couldn't be sent while Discord was unavailable
+type discordOfflineBuffer struct {
+	sync.Mutex
+	messages []discordPending
+	dropped  int
+}
+
+// discordAvailable returns true if we're connected to the Discord gateway
+func (b *Bridge) discordAvailable() bool {
+	b.discord.Session.RLock()
+	defer b.discord.Session.RUnlock()
+	return b.discord.Session.DataReady
+}
+
+// sendToDiscordOrKeep sends a message to Discord, keeping it to send later if Discord is unavailable
+// or relaying is paused.
+// Messages are also kept while older ones are waiting, so they stay in order.
+// The message is remembered as being the IRC message with ircMsgID, if it has one.
+// image is sent instead of content if it is not nil, and kept with the message.
+func (b *Bridge) sendToDiscordOrKeep(ircChannel, ircMsgID, channel, username, avatar, content string, image *linkedImage) {
+	keep := b.Config().DiscordOfflineBuffer > 0
+	paused := b.relayPause(DirectionIRCToDiscord)
+	if paused == PauseDrop || (paused != "" && !keep) {
+		return
+	}
+
+	p := discordPending{ircChannel, ircMsgID, channel, username, avatar, content, time.Now(), image}
+	// Outside the mapping's relay window, messages wait for it to open or aren't relayed
+	if !b.inRelayWindow(ircChannel) {
+		p.image = nil // the link is sent when the window opens
+		b.holdForDiscord(p)
+		return
+	}
+
+	if b.Config().DryRun && paused == "" {
+		b.sendToDiscord(channel, username, avatar, content)
+		return
+	}
+
+	if keep && (paused != "" || !b.discordAvailable() || b.discordOffline.waiting()) {
+		b.keepForDiscord(p)
+		return
+	}
+
+	sent, err := b.trySendToDiscord(channel, username, avatar, content, image)
+	if err == nil {
+		if sent != nil {
+			b.recordIRCMessageID(channel, sent.ID, ircMsgID)
+		}
+		return
+	}
+
+	// Keep messages that failed because Discord is having trouble, not because of the message
+	if _, outage := discordRetryDelay(err, 0); keep && outage {
+		b.keepForDiscord(p)
+		return
+	}
+	b.discordSendFailed(channel, username, content, err)
+}
+
+func (b *Bridge) keepForDiscord(p discordPending) {
+	buf := &b.discordOffline
+	buf.Lock()
+	defer buf.Unlock()
+
+	buf.messages = append(buf.messages, p)
+	if size := b.Config().DiscordOfflineBuffer; len(buf.messages) > size {
+		buf.messages = buf.messages[len(buf.messages)-size:]
+		buf.dropped++
+	}
+}
+
+func (buf *discordOfflineBuffer) waiting() bool {
+	buf.Lock()
+	defer buf.Unlock()
+	return len(buf.messages) > 0
+}
+
+// take returns the kept messages, and how many were dropped, emptying the buffer
+func (buf *discordOfflineBuffer) take() ([]discordPending, int) {
+	buf.Lock()
+	defer buf.Unlock()
+
+	messages, dropped := buf.messages, buf.dropped
+	buf.messages, buf.dropped = nil, 0
+	return messages, dropped
+}
+
+// flushDiscordOffline sends the messages kept while Discord was unavailable.
+// If DiscordOfflineBatch is set, each channel's messages are collapsed into as few messages as possible.
+func (b *Bridge) flushDiscordOffline() {
+	if !b.discordAvailable() || !b.discordOffline.waiting() || b.relayPause(DirectionIRCToDiscord) != "" {
+		return
+	}
+
+	messages, dropped := b.discordOffline.take()
+	discordLog.WithField("messages", len(messages)).WithField("dropped", dropped).Infoln("Sending messages from while Discord was unavailable")
+	if dropped > 0 {
+		b.relayErrors.Add("%d messages from IRC were not sent to Discord, as too many were sent while Discord was unavailable", dropped)
+	}
+
+	if !b.Config().DiscordOfflineBatch {
+		for _, p := range messages {
+			p := p
+			b.workers.Do(toDiscordWorker(p.ircChannel), func() {
+				b.sendToDiscordOrKeep(p.ircChannel, p.ircMsgID, p.channel, p.username, p.avatar, p.content, p.image)
+			})
+		}
+		return
+	}
+
+	// Batch by channel, keeping the order channels were first seen in
+	var order []string
+	batches := make(map[string][]discordPending)
+	for _, p := range messages {
+		if _, ok := batches[p.channel]; !ok {
+			order = append(order, p.channel)
+		}
+		batches[p.channel] = append(batches[p.channel], p)
+	}
+
+	for _, channel := range order {
+		batch := batches[channel]
+		channel := channel
+		b.workers.Do(toDiscordWorker(batch[0].ircChannel), func() {
+			for _, content := range discordBatchMessages(batch) {
+				b.sendToDiscord(channel, "", "", content)
+			}
+		})
+	}
+}
+
+// discordBatchMessages collapses messages into as few Discord messages as fit
+func discordBatchMessages(messages []discordPending) []string {
+	var out []string
+	var sb strings.Builder
+	sb.WriteString("**While Discord was unavailable:**")
+
+	for _, p := range messages {
+		line := fmt.Sprintf("<t:%d:t> %s", p.at.Unix(), p.content)
+		if p.username != "" {
+			line = fmt.Sprintf("<t:%d:t> **%s**: %s", p.at.Unix(), p.username, p.content)
+		}
+
+		if sb.Len()+1+len(line) > discordMessageLimit && sb.Len() > 0 {
+			out = append(out, sb.String())
+			sb.Reset()
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(line)
+	}
+	return append(out, sb.String())
+}
+
+// watchDiscordOffline sends kept messages once Discord is reachable again
+func (b *Bridge) watchDiscordOffline() {
+	ticker := time.NewTicker(discordFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.discordBackChan:
+		case <-b.stop:
+			return
+		}
+		b.flushDiscordOffline()
+	}
+}
+
+// onDiscordConnect tells watchDiscordOffline that the gateway has (re)connected
+func (b *Bridge) onDiscordConnect() {
+	select {
+	case b.discordBackChan <- struct{}{}:
+	default:
+	}
+}
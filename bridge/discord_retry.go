@@ -0,0 +1,117 @@
+package bridge
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// discordRetries is how many more times a failed send to Discord is tried
+const discordRetries = 4
+
+// discordRetryBackoff is how long to wait before the first retry, doubling each time after
+const discordRetryBackoff = time.Second
+
+// discordRetryDelay returns how long to wait before trying a failed Discord request again,
+// or false if trying again won't help (like when the bot doesn't have permission).
+func discordRetryDelay(err error, attempt int) (time.Duration, bool) {
+	backoff := discordRetryBackoff << uint(attempt)
+	backoff += time.Duration(rand.Int63n(int64(backoff) / 2)) // so channels don't all retry at once
+
+	switch err := err.(type) {
+	case *discordgo.RESTError:
+		if err.Response == nil {
+			return backoff, true
+		}
+		if err.Response.StatusCode == http.StatusTooManyRequests {
+			if after, ok := retryAfter(err.Response.Header); ok {
+				return after, true
+			}
+			return backoff, true
+		}
+		return backoff, err.Response.StatusCode >= 500
+
+	case net.Error:
+		return backoff, true
+	}
+	return 0, false
+}
+
+// retryAfter returns how long Discord asked us to wait in a rate limited response
+func retryAfter(h http.Header) (time.Duration, bool) {
+	for _, name := range []string{"Retry-After", "X-RateLimit-Reset-After"} {
+		if seconds, err := strconv.ParseFloat(h.Get(name), 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds * float64(time.Second)), true
+		}
+	}
+	return 0, false
+}
+
+// retryDiscord calls send until it succeeds, Discord says it won't, or it has been retried enough
+func (b *Bridge) retryDiscord(channel string, send func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = send(); err == nil {
+			return nil
+		}
+
+		delay, ok := discordRetryDelay(err, attempt)
+		if !ok || attempt == discordRetries {
+			return err
+		}
+
+		discordLog.WithError(err).WithField("channel", channel).WithField("delay", delay).Warnln("could not send to Discord, retrying")
+		time.Sleep(delay)
+	}
+}
+
+// deadLetter is a message that could not be sent to Discord, as written to DeadLetterPath
+type deadLetter struct {
+	Time     time.Time `json:"time"`
+	Channel  string    `json:"channel"`
+	Username string    `json:"username,omitempty"`
+	Content  string    `json:"content"`
+	Error    string    `json:"error"`
+}
+
+// deadLetters keeps messages that could not be sent to Discord, so they aren't lost without a trace
+type deadLetters struct {
+	sync.Mutex
+	path string
+}
+
+// Add logs the message, and appends it to the dead letter file if there is one
+func (d *deadLetters) Add(l deadLetter) {
+	log.WithFields(log.Fields{
+		"error":        l.Error,
+		"msg.channel":  l.Channel,
+		"msg.username": l.Username,
+		"msg.content":  l.Content,
+	}).Errorln("gave up sending message to discord")
+
+	if d.path == "" {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.WithError(err).WithField("path", d.path).Errorln("could not open dead letter file")
+		return
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(l); err != nil {
+		log.WithError(err).WithField("path", d.path).Errorln("could not write to dead letter file")
+	}
+}
@@ -0,0 +1,57 @@
+package bridge
+
+import "github.com/bwmarrin/discordgo"
+
+// messageMember returns the guild member that sent a message. For DMs, this is their member
+// in the first bridged guild they are in.
+func (d *discordBot) messageMember(m *discordgo.Message) (*discordgo.Member, bool) {
+	if m.Member != nil {
+		return m.Member, true
+	}
+	var member *discordgo.Member
+	var err error
+	if m.GuildID == "" {
+		member, _, err = d.member(m.Author.ID)
+	} else {
+		member, err = d.Session.State.Member(m.GuildID, m.Author.ID)
+	}
+	if err != nil {
+		return nil, false
+	}
+	return member, true
+}
+
+// hasAnyRole returns true if member has one of roles
+func hasAnyRole(member *discordgo.Member, roles map[string]struct{}) bool {
+	for _, role := range member.Roles {
+		if _, ok := roles[role]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// canRelayToIRC returns true if the author of a message in the guild may speak on IRC.
+// Members with a role in RelayExcludedRoles can't. Otherwise, if the channel has
+// RelayChannelRoles (or failing that, if RelayRoles is set), they need one of those roles.
+func (d *discordBot) canRelayToIRC(m *discordgo.Message) bool {
+	conf := d.bridge.Config()
+	required, ok := conf.RelayChannelRoles[m.ChannelID]
+	if !ok {
+		required = conf.RelayRoles
+	}
+	if len(required) == 0 && len(conf.RelayExcludedRoles) == 0 {
+		return true
+	}
+
+	member, ok := d.messageMember(m)
+	if !ok {
+		// Without their roles, only let them speak if no role is needed
+		return len(required) == 0
+	}
+
+	if hasAnyRole(member, conf.RelayExcludedRoles) {
+		return false
+	}
+	return len(required) == 0 || hasAnyRole(member, required)
+}
@@ -0,0 +1,72 @@
+package bridge
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errDryRun is the error for requests to Discord that dryRunTransport didn't send
+var errDryRun = errors.New("dry run, not sent to Discord")
+
+// dryRunTransport is the transport of the Discord session. When Config.DryRun is on, it only
+// sends requests that read from Discord, so that nothing the bridge does (relaying, DMs,
+// command replies, reactions and so on) changes anything there.
+type dryRunTransport struct {
+	bridge *Bridge
+	next   http.RoundTripper
+}
+
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead || !t.bridge.Config().DryRun {
+		return t.next.RoundTrip(req)
+	}
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	log.WithField("request", req.Method+" "+req.URL.Path).Infoln(errDryRun)
+	return nil, errDryRun
+}
+
+// logDryRun logs a Discord message (with its filtered content) as it would have been sent to IRC,
+// when Config.DryRun is on. The nick is what the user's puppet would be called, or empty in simple mode.
+func (m *IRCManager) logDryRun(channel string, msg *DiscordMessage, content string) {
+	var nick string
+	if !m.bridge.Config().SimpleMode {
+		user := DiscordUser{
+			ID:            msg.Author.ID,
+			Username:      msg.Author.Username,
+			Discriminator: msg.Author.Discriminator,
+			Bot:           msg.Author.Bot,
+		}
+		if msg.Member != nil {
+			user.Nick = msg.Member.Nick
+		}
+		nick = m.generateNickname(user)
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		entry := log.WithFields(log.Fields{
+			"channel": channel,
+			"nick":    nick,
+		})
+
+		if nick == "" {
+			line = simpleModeLine(msg, line)
+		} else if msg.IsAction {
+			line = "\001ACTION " + line + "\001"
+		}
+		entry.Infoln("dry run, not sent to IRC:", line)
+	}
+}
+
+// logDryRunDiscord logs a message as it would have been sent to Discord, when Config.DryRun is on
+func (b *Bridge) logDryRunDiscord(channel, username, content string) {
+	log.WithFields(log.Fields{
+		"channel":  channel,
+		"username": username,
+	}).Infoln("dry run, not sent to Discord:", content)
+}
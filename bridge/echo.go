@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"crypto/sha256"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// echoTTL is how long relayed messages are remembered for loop detection
+const echoTTL = 10 * time.Second
+
+// echoPrefix matches the "<nick> " or "nick: " another bridge adds to lines it relays
+var echoPrefix = regexp.MustCompile(`(?s)^(?:<([^>]+)>|([^\s:]+):)\s+(.*)$`)
+
+// echoGuard remembers fingerprints of messages we've just relayed to a channel, and who said them,
+// so that if another bridge or bot reflects them back they aren't relayed again.
+// Without this, two bridges sharing a channel can relay a message back and forth forever.
+type echoGuard struct {
+	sync.Mutex
+	seen map[[sha256.Size]byte]time.Time
+}
+
+func newEchoGuard() *echoGuard {
+	return &echoGuard{seen: make(map[[sha256.Size]byte]time.Time)}
+}
+
+func echoFingerprint(channel, author, content string) [sha256.Size]byte {
+	content = strings.ToLower(strings.TrimSpace(content))
+	return sha256.Sum256([]byte(strings.ToLower(channel) + "\x00" + strings.ToLower(author) + "\x00" + content))
+}
+
+// Record remembers that content was relayed to channel, as said by any of authors
+func (g *echoGuard) Record(channel, content string, authors ...string) {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	for fp, expiry := range g.seen {
+		if now.After(expiry) {
+			delete(g.seen, fp)
+		}
+	}
+	for _, author := range authors {
+		if author != "" {
+			g.seen[echoFingerprint(channel, author, content)] = now.Add(echoTTL)
+		}
+	}
+}
+
+// IsEcho returns true if content, sent to channel by sender, is a message that was just relayed there.
+// Anyone can send "<author> content", but people often repeat short messages, so content alone
+// (or "author: content") is only an echo if sender is a bot or webhook, relaying as author.
+func (g *echoGuard) IsEcho(channel, sender string, bot bool, content string) bool {
+	type said struct{ author, content string }
+	var candidates []said
+	if m := echoPrefix.FindStringSubmatch(content); m != nil {
+		if m[1] != "" {
+			candidates = append(candidates, said{m[1], m[3]})
+		} else if bot {
+			candidates = append(candidates, said{m[2], m[3]})
+		}
+	}
+	if bot {
+		candidates = append(candidates, said{sender, content})
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	for _, c := range candidates {
+		if expiry, ok := g.seen[echoFingerprint(channel, c.author, c.content)]; ok && now.Before(expiry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/qaisjp/go-discord-irc/pattern"
+)
+
+// Values for MessageFilter.Action, what happens to a message matching a filter
+const (
+	FilterActionDrop   = "drop"
+	FilterActionRedact = "redact"
+	FilterActionFlag   = "flag"
+)
+
+// redacted replaces the parts of a message matched by a FilterActionRedact filter
+const redacted = "[redacted]"
+
+// MessageFilter matches messages that shouldn't be relayed as they are
+type MessageFilter struct {
+	// Glob may be a pattern.Regexp, which matches anywhere in a line
+	Glob glob.Glob
+	// Action is FilterActionDrop (the default if empty), FilterActionRedact or FilterActionFlag
+	Action string
+}
+
+// Match returns true if the filter matches text
+func (f MessageFilter) Match(text string) bool {
+	return f.Glob.Match(text)
+}
+
+// Redact replaces the parts of text matched by a regexp filter. For globs, which match whole
+// strings, it replaces the words matched by the filter, or all of text if none are.
+func (f MessageFilter) Redact(text string) string {
+	if r, ok := f.Glob.(pattern.Regexp); ok {
+		return r.ReplaceAllString(text, redacted)
+	}
+
+	words := strings.Fields(text)
+	found := false
+	for i, word := range words {
+		if f.Glob.Match(word) {
+			words[i] = redacted
+			found = true
+		}
+	}
+	if !found {
+		return redacted
+	}
+	return strings.Join(words, " ")
+}
+
+// filterLines applies filters to each line of a message from nick in channel. Lines matching a
+// drop or flag filter are left out, and flagged lines are sent to Config.FilterChannel for review.
+// Returns false if no lines are left.
+func (b *Bridge) filterLines(filters []MessageFilter, nick, channel, content string) (string, bool) {
+	if len(filters) == 0 {
+		return content, true
+	}
+
+	var kept []string
+	for _, line := range strings.Split(content, "\n") {
+		if line, ok := b.filterLine(filters, nick, channel, line); ok {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n"), len(kept) > 0
+}
+
+func (b *Bridge) filterLine(filters []MessageFilter, nick, channel, line string) (string, bool) {
+	for _, filter := range filters {
+		if !filter.Match(line) {
+			continue
+		}
+
+		switch filter.Action {
+		case FilterActionRedact:
+			line = filter.Redact(line)
+		case FilterActionFlag:
+			b.flagMessage(nick, channel, line)
+			return "", false
+		default:
+			return "", false
+		}
+	}
+	return line, true
+}
+
+// flagMessage sends a message held back by a FilterActionFlag filter to Config.FilterChannel
+func (b *Bridge) flagMessage(nick, channel, line string) {
+	listenerLog.WithField("channel", channel).WithField("nick", nick).Infoln("Flagged message:", line)
+
+	filterChannel := b.Config().FilterChannel
+	if filterChannel == "" {
+		return
+	}
+	message := fmt.Sprintf("_Held back from %s by %s:_ %s", channel, nick, line)
+	go b.sendToDiscord(filterChannel, "", "", message)
+}
@@ -0,0 +1,113 @@
+package bridge
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// servicesInfoTimeout is how long to wait for NickServ to describe an account
+const servicesInfoTimeout = 5 * time.Second
+
+// servicesEmailRegex finds the email address in NickServ's INFO reply, as given by Atheme and Anope
+var servicesEmailRegex = regexp.MustCompile(`(?i)e-?mail(?: address)?\s*:\s*(\S+@\S+)`)
+
+// gravatarCache remembers the Gravatar hash of each IRC account's services email,
+// blank if it has none (or it is hidden)
+type gravatarCache struct {
+	sync.Mutex
+	hashes  map[string]string
+	looking map[string]bool
+
+	// lookup is held while asking NickServ, as its replies don't say which account they are for
+	lookup sync.Mutex
+}
+
+func newGravatarCache() *gravatarCache {
+	return &gravatarCache{hashes: make(map[string]string), looking: make(map[string]bool)}
+}
+
+// emailHash returns the MD5 hash Gravatar uses for an email address
+func emailHash(email string) string {
+	sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+// gravatar returns the Gravatar for account's services email, falling back to fallback if it
+// has no Gravatar. Returns false if the email isn't known yet, in which case it is looked up
+// in the background, so that later messages have it.
+func (b *Bridge) gravatar(account, fallback string) (string, bool) {
+	key := b.ircListener.isupport.Fold(account)
+
+	b.gravatars.Lock()
+	defer b.gravatars.Unlock()
+
+	if hash, ok := b.gravatars.hashes[key]; ok {
+		if hash == "" {
+			return "", false
+		}
+		return "https://www.gravatar.com/avatar/" + hash + "?d=" + url.QueryEscape(fallback), true
+	}
+
+	if !b.gravatars.looking[key] {
+		b.gravatars.looking[key] = true
+		go func() {
+			email, _ := b.ircListener.servicesEmail(account)
+			var hash string
+			if email != "" {
+				hash = emailHash(email)
+			}
+
+			b.gravatars.Lock()
+			defer b.gravatars.Unlock()
+			b.gravatars.hashes[key] = hash
+			delete(b.gravatars.looking, key)
+		}()
+	}
+	return "", false
+}
+
+// servicesEmail asks NickServ for the email address of account. NickServ usually only
+// tells IRC operators, or everyone if the account has chosen to show it.
+func (i *ircListener) servicesEmail(account string) (string, bool) {
+	if !i.Registered() {
+		return "", false
+	}
+
+	i.bridge.gravatars.lookup.Lock()
+	defer i.bridge.gravatars.lookup.Unlock()
+
+	found := make(chan string, 1)
+	id := i.AddCallback("NOTICE", func(e *irc.Event) {
+		if !i.isupport.EqualFold(e.Nick, "NickServ") {
+			return
+		}
+
+		var email string
+		if match := servicesEmailRegex.FindStringSubmatch(e.Message()); match != nil {
+			email = match[1]
+		} else if !strings.Contains(strings.ToLower(e.Message()), "end of info") {
+			return
+		}
+		select {
+		case found <- email:
+		default:
+		}
+	})
+	defer i.RemoveCallback("NOTICE", id)
+
+	i.Privmsg("NickServ", "INFO "+account)
+
+	select {
+	case email := <-found:
+		return email, email != ""
+	case <-time.After(servicesInfoTimeout):
+		return "", false
+	}
+}
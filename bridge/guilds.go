@@ -0,0 +1,113 @@
+package bridge
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// bridgesGuild returns true if guildID is one of the guilds in Config.GuildIDs
+func (d *discordBot) bridgesGuild(guildID string) bool {
+	for _, id := range d.guildIDs {
+		if id == guildID {
+			return true
+		}
+	}
+	return false
+}
+
+// guildOf returns the bridged guild a channel is in, or an empty string if there isn't one
+func (d *discordBot) guildOf(channelID string) string {
+	channel, err := d.Session.State.Channel(channelID)
+	if err != nil || !d.bridgesGuild(channel.GuildID) {
+		return ""
+	}
+	return channel.GuildID
+}
+
+// member returns a user's member in the first bridged guild they are in, and that guild
+func (d *discordBot) member(userID string) (*discordgo.Member, string, error) {
+	err := discordgo.ErrStateNotFound
+	for _, guildID := range d.guildIDs {
+		var member *discordgo.Member
+		if member, err = d.Session.State.Member(guildID, userID); err == nil {
+			return member, guildID, nil
+		}
+	}
+	return nil, "", err
+}
+
+// members returns the members of every bridged guild, with each user only once
+func (d *discordBot) members() []*discordgo.Member {
+	var members []*discordgo.Member
+	seen := make(map[string]bool)
+	for _, guildID := range d.guildIDs {
+		guild, err := d.Session.State.Guild(guildID)
+		if err != nil {
+			continue
+		}
+		for _, member := range guild.Members {
+			if member.User == nil || seen[member.User.ID] {
+				continue
+			}
+			seen[member.User.ID] = true
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// channels returns the channels of every bridged guild
+func (d *discordBot) channels() []*discordgo.Channel {
+	var channels []*discordgo.Channel
+	for _, guildID := range d.guildIDs {
+		if guild, err := d.Session.State.Guild(guildID); err == nil {
+			channels = append(channels, guild.Channels...)
+		}
+	}
+	return channels
+}
+
+// presence returns a user's presence in the first bridged guild that has one for them
+func (d *discordBot) presence(userID string) (*discordgo.Presence, error) {
+	err := discordgo.ErrStateNotFound
+	for _, guildID := range d.guildIDs {
+		var presence *discordgo.Presence
+		if presence, err = d.Session.State.Presence(guildID, userID); err == nil {
+			return presence, nil
+		}
+	}
+	return nil, err
+}
+
+// role returns a role from any bridged guild, as role IDs are unique across guilds
+func (d *discordBot) role(roleID string) (*discordgo.Role, error) {
+	err := discordgo.ErrStateNotFound
+	for _, guildID := range d.guildIDs {
+		var role *discordgo.Role
+		if role, err = d.Session.State.Role(guildID, roleID); err == nil {
+			return role, nil
+		}
+	}
+	return nil, err
+}
+
+// setGuildEmoji replaces the custom emoji known for a guild
+func (d *discordBot) setGuildEmoji(guildID string, emoji []*discordgo.Emoji) {
+	byName := make(map[string]*discordgo.Emoji, len(emoji))
+	for _, e := range emoji {
+		byName[strings.ToLower(e.Name)] = e
+	}
+
+	d.emojiMu.Lock()
+	defer d.emojiMu.Unlock()
+	d.emoji[guildID] = byName
+}
+
+// guildEmoji returns the custom emoji of a guild called name, ignoring case
+func (d *discordBot) guildEmoji(guildID, name string) (*discordgo.Emoji, bool) {
+	d.emojiMu.RLock()
+	defer d.emojiMu.RUnlock()
+	e, ok := d.emoji[guildID][strings.ToLower(name)]
+	return e, ok
+}
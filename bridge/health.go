@@ -0,0 +1,57 @@
+package bridge
+
+// Health is the state of a bridge's connections
+type Health struct {
+	DiscordConnected bool `json:"discord_connected"`
+	IRCRegistered    bool `json:"irc_registered"`
+	// IRCLag is the round trip of the last PING to the IRC server, in milliseconds, if known
+	IRCLag int64 `json:"irc_lag_ms,omitempty"`
+	// DiscordLag is the round trip of the last heartbeat to the Discord gateway, in milliseconds
+	DiscordLag int64 `json:"discord_lag_ms,omitempty"`
+
+	// Paused is how relaying is paused in each direction that is, see Bridge.PauseRelay
+	Paused map[string]string `json:"paused,omitempty"`
+
+	// Channels are the mapped IRC channels, and whether the listener is in them
+	Channels map[string]bool `json:"channels"`
+}
+
+// Live returns true if the bridge is connected to both Discord and IRC
+func (h Health) Live() bool {
+	return h.DiscordConnected && h.IRCRegistered
+}
+
+// Ready returns true if the bridge is connected and in every mapped channel
+func (h Health) Ready() bool {
+	if !h.Live() {
+		return false
+	}
+	for _, joined := range h.Channels {
+		if !joined {
+			return false
+		}
+	}
+	return true
+}
+
+// Health returns the state of the bridge's connections
+func (b *Bridge) Health() Health {
+	b.discord.Session.RLock()
+	discordConnected := b.discord.Session.DataReady
+	b.discord.Session.RUnlock()
+
+	h := Health{
+		DiscordConnected: discordConnected,
+		IRCRegistered:    b.ircListener.Registered(),
+		IRCLag:           b.ircListener.lag().Milliseconds(),
+		DiscordLag:       b.discord.Session.HeartbeatLatency().Milliseconds(),
+		Paused:           b.RelayPauses(),
+		Channels:         make(map[string]bool),
+	}
+
+	for _, mapping := range b.mappingTable().mappings {
+		_, joined := b.ircListener.GetChannel(mapping.IRCChannel)
+		h.Channels[mapping.IRCChannel] = h.IRCRegistered && joined
+	}
+	return h
+}
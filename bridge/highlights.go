@@ -0,0 +1,246 @@
+package bridge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// highlightBucket is the store bucket for highlight keywords, by Discord user ID, separated by newlines
+const highlightBucket = "highlights"
+
+// highlightCommand manages highlight keywords, from Discord DMs
+const highlightCommand = "!highlight"
+
+// highlightMaxKeywords is how many keywords each Discord user can have
+const highlightMaxKeywords = 20
+
+// highlightKeywords returns the keywords a Discord user is highlighted for, besides their linked IRC nick
+func (b *Bridge) highlightKeywords(discordID string) []string {
+	var keywords []string
+	if saved, ok := b.store.Get(highlightBucket, discordID); ok && saved != "" {
+		keywords = strings.Split(saved, "\n")
+	}
+	return keywords
+}
+
+// setHighlightKeywords saves a Discord user's keywords, removing them from the store if there are none
+func (b *Bridge) setHighlightKeywords(discordID string, keywords []string) error {
+	if len(keywords) == 0 {
+		return b.store.Delete(highlightBucket, discordID)
+	}
+	return b.store.Set(highlightBucket, discordID, strings.Join(keywords, "\n"))
+}
+
+// highlightReply runs a highlightCommand for a Discord user, returning a reply for them.
+// Returns false if message is not a highlightCommand.
+func (b *Bridge) highlightReply(discordID string, message string) (string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) == 0 || fields[0] != highlightCommand {
+		return "", false
+	}
+
+	nick, linked := b.LinkedNick(discordID)
+	if !linked {
+		return fmt.Sprintf("Link your IRC nick with `%s <irc nick>` first, then you can be sent IRC messages that mention you.", linkCommand), true
+	}
+
+	usage := fmt.Sprintf("Usage: `%s add <keyword>`, `%s remove <keyword>`, `%s list` or `%s clear`",
+		highlightCommand, highlightCommand, highlightCommand, highlightCommand)
+	if len(fields) < 2 {
+		return usage, true
+	}
+
+	keywords := b.highlightKeywords(discordID)
+	keyword := strings.Join(fields[2:], " ")
+	var reply string
+	switch {
+	case fields[1] == "list" && keyword == "":
+		if len(keywords) == 0 {
+			return fmt.Sprintf("You are only sent IRC messages that mention %s.", nick), true
+		}
+		sort.Strings(keywords)
+		return fmt.Sprintf("You are sent IRC messages that mention %s or: %s", nick, strings.Join(keywords, ", ")), true
+
+	case fields[1] == "add" && keyword != "":
+		for _, k := range keywords {
+			if strings.EqualFold(k, keyword) {
+				return fmt.Sprintf("You already have the keyword %s.", keyword), true
+			}
+		}
+		if len(keywords) >= highlightMaxKeywords {
+			return fmt.Sprintf("You can't have more than %d keywords.", highlightMaxKeywords), true
+		}
+		keywords = append(keywords, keyword)
+		reply = fmt.Sprintf("You will be sent IRC messages that mention %s while you're away.", keyword)
+
+	case fields[1] == "remove" && keyword != "":
+		kept := keywords[:0]
+		for _, k := range keywords {
+			if !strings.EqualFold(k, keyword) {
+				kept = append(kept, k)
+			}
+		}
+		if len(kept) == len(keywords) {
+			return fmt.Sprintf("You don't have the keyword %s.", keyword), true
+		}
+		keywords = kept
+		reply = fmt.Sprintf("Removed the keyword %s.", keyword)
+
+	case fields[1] == "clear" && keyword == "":
+		keywords = nil
+		reply = fmt.Sprintf("Removed your keywords. You are still sent IRC messages that mention %s.", nick)
+
+	default:
+		return usage, true
+	}
+
+	if err := b.setHighlightKeywords(discordID, keywords); err != nil {
+		discordLog.WithField("error", err).WithField("discord", discordID).Errorln("could not save highlight keywords")
+		return "Sorry, your keywords could not be saved.", true
+	}
+	return reply, true
+}
+
+// handleHighlightCommand handles highlightCommand in Discord DMs, returning true if it was one
+func (d *discordBot) handleHighlightCommand(m *discordgo.Message) bool {
+	reply, ok := d.bridge.highlightReply(m.Author.ID, m.Content)
+	if !ok {
+		return false
+	}
+
+	if _, err := d.Session.ChannelMessageSend(m.ChannelID, reply); err != nil {
+		discordLog.WithField("error", err).Warnln("could not reply to highlight command")
+	}
+	return true
+}
+
+// notifyHighlights DMs linked Discord users who are away when an IRC message mentions
+// their nick or one of their keywords, if they can see the channel it is relayed to
+func (b *Bridge) notifyHighlights(msg IRCMessage, discordChannel string) {
+	// System messages have no nick
+	if msg.Nick == "" {
+		return
+	}
+	if b.Config().DryRun {
+		return
+	}
+
+	for _, discordID := range b.store.Keys(linkDiscordBucket) {
+		nick, ok := b.LinkedNick(discordID)
+		if !ok || b.IRCEqualFold(nick, msg.Nick) || !b.discord.isAway(discordID) {
+			continue
+		}
+
+		for _, keyword := range append([]string{nick}, b.highlightKeywords(discordID)...) {
+			if containsWord(msg.Message, keyword) {
+				if b.discord.canView(discordID, discordChannel) {
+					go b.discord.sendHighlight(discordID, msg, discordChannel)
+				}
+				break
+			}
+		}
+	}
+}
+
+// containsWord returns true if text contains word, ignoring case, and not as part of a longer word
+func containsWord(text, word string) bool {
+	text, word = strings.ToLower(text), strings.ToLower(word)
+	if word == "" {
+		return false
+	}
+
+	for start := 0; ; {
+		i := strings.Index(text[start:], word)
+		if i == -1 {
+			return false
+		}
+		i += start
+		end := i + len(word)
+
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+		start = i + 1
+	}
+}
+
+// isAway returns true if a guild member isn't online on Discord
+func (d *discordBot) isAway(userID string) bool {
+	presence, err := d.presence(userID)
+	return err != nil || presence.Status != discordgo.StatusOnline
+}
+
+// sendHighlight DMs a Discord user an IRC message that mentions them
+func (d *discordBot) sendHighlight(userID string, msg IRCMessage, discordChannel string) {
+	dm, err := d.Session.UserChannelCreate(userID)
+	if err != nil {
+		discordLog.WithField("error", err).WithField("user", userID).Warnln("could not open DM for highlight")
+		return
+	}
+
+	content := fmt.Sprintf("**%s** in %s (<#%s>): %s", msg.Nick, msg.IRCChannel, discordChannel, msg.Message)
+	_, err = d.Session.ChannelMessageSendComplex(dm.ID, &discordgo.MessageSend{
+		Content:         truncateMessage(content),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		discordLog.WithField("error", err).WithField("user", userID).Warnln("could not send highlight")
+	}
+}
+
+// canView returns true if a Discord user can see the messages in channel
+func (d *discordBot) canView(userID, channel string) bool {
+	perms, err := d.Session.State.UserChannelPermissions(userID, channel)
+	return err == nil && perms&discordgo.PermissionViewChannel != 0
+}
+
+// isWordRune returns true if r can be part of a word, for containsWord and replaceWords
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// replaceWords replaces each key of replacements in text with its value, where it isn't part of a
+// longer word (so "bob" isn't replaced in "bobcat"). Longer keys are tried first.
+func replaceWords(text string, replacements map[string]string) string {
+	words := make([]string, 0, len(replacements))
+	for word := range replacements {
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	sort.Slice(words, func(i, j int) bool { return len(words[i]) > len(words[j]) })
+
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		replaced := false
+		if !isWordRune(before) {
+			for _, word := range words {
+				end := i + len(word)
+				if !strings.HasPrefix(text[i:], word) {
+					continue
+				}
+				if after, _ := utf8.DecodeRuneInString(text[end:]); isWordRune(after) {
+					continue
+				}
+				b.WriteString(replacements[word])
+				i = end
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			_, size := utf8.DecodeRuneInString(text[i:])
+			b.WriteString(text[i : i+size])
+			i += size
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,34 @@
+package bridge
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	ircidentd "github.com/qaisjp/go-discord-irc/irc/identd"
+)
+
+// SetIdentd sets the ident server to tell about puppet connections, which can be shared
+// by every network. It must be set before Open.
+func (b *Bridge) SetIdentd(server *ircidentd.Server) {
+	b.identd = server
+}
+
+// expectIdent tells the ident server, if there is one, that a puppet is connecting as username
+func (b *Bridge) expectIdent(username string) {
+	if b.identd == nil {
+		return
+	}
+
+	_, port, err := net.SplitHostPort(b.Config().IRCServer)
+	if err != nil {
+		puppeteerLog.WithError(err).Warnln("could not find the IRC server's port for identd")
+		return
+	}
+	serverPort, err := strconv.Atoi(port)
+	if err != nil {
+		puppeteerLog.WithError(err).Warnln("could not find the IRC server's port for identd")
+		return
+	}
+	b.identd.Expect(username, serverPort, time.Now())
+}
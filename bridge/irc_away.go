@@ -0,0 +1,84 @@
+package bridge
+
+import (
+	"sync"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// awayTracker keeps the latest away status of IRC users, as told to us by away-notify.
+type awayTracker struct {
+	sync.Mutex
+	away map[string]string // folded nick to away message
+	fold func(string) string
+}
+
+func newAwayTracker(fold func(string) string) *awayTracker {
+	return &awayTracker{away: make(map[string]string), fold: fold}
+}
+
+// Get returns the away message of a nick, and whether they are away.
+func (a *awayTracker) Get(nick string) (string, bool) {
+	a.Lock()
+	defer a.Unlock()
+	reason, ok := a.away[a.fold(nick)]
+	return reason, ok
+}
+
+func (a *awayTracker) set(nick, reason string) {
+	a.Lock()
+	defer a.Unlock()
+	a.away[a.fold(nick)] = reason
+}
+
+func (a *awayTracker) remove(nick string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.away, a.fold(nick))
+}
+
+func (a *awayTracker) rename(oldNick, newNick string) {
+	a.Lock()
+	defer a.Unlock()
+	if reason, ok := a.away[a.fold(oldNick)]; ok {
+		delete(a.away, a.fold(oldNick))
+		a.away[a.fold(newNick)] = reason
+	}
+}
+
+// OnAway handles AWAY messages sent to us because of away-notify
+func (i *ircListener) OnAway(e *irc.Event) {
+	if i.isPuppetNick(e.Nick) {
+		return
+	}
+
+	var message string
+	if len(e.Arguments) > 0 && e.Message() != "" {
+		i.away.set(e.Nick, e.Message())
+		message = "_" + e.Nick + " is now away: " + e.Message() + "_"
+	} else {
+		i.away.remove(e.Nick)
+		message = "_" + e.Nick + " is back_"
+	}
+
+	channel := i.bridge.Config().AwayStatusChannel
+	if channel == "" || i.bridge.ircManager.isIgnoredHostmask(e.Source) {
+		return
+	}
+
+	go i.bridge.sendToDiscord(channel, "", "", message)
+}
+
+// onAwayNickChange follows nick changes so that away statuses aren't lost
+func (i *ircListener) onAwayNickChange(e *irc.Event) {
+	i.away.rename(e.Nick, e.Message())
+}
+
+// onAwayJoin forgets the away status of users when they join.
+//
+// This is not done on QUIT, so that the away status can still be shown
+// when the quit is relayed. If they are still away, the server will tell
+// us again right after they join.
+func (i *ircListener) onAwayJoin(e *irc.Event) {
+	i.away.remove(e.Nick)
+}
@@ -0,0 +1,116 @@
+package bridge
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// chathistoryTimeFormat is the timestamp format used by CHATHISTORY message references
+const chathistoryTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// chathistory tracks what we have seen on each channel, so that after
+// reconnecting we can ask the server for anything we missed.
+type chathistory struct {
+	sync.Mutex
+
+	// lastSeen is the server-time of the last message seen per (folded) channel
+	lastSeen map[string]time.Time
+
+	// batches are the currently open chathistory BATCH references
+	batches map[string]struct{}
+
+	fold func(string) string
+}
+
+func newChathistory(fold func(string) string) *chathistory {
+	return &chathistory{
+		lastSeen: make(map[string]time.Time),
+		batches:  make(map[string]struct{}),
+		fold:     fold,
+	}
+}
+
+// Seen records that a message was received on a channel at the given time.
+func (h *chathistory) Seen(channel string, t time.Time) {
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	channel = h.fold(channel)
+	if t.After(h.lastSeen[channel]) {
+		h.lastSeen[channel] = t
+	}
+}
+
+// OnBatch keeps track of which batches contain history playback.
+func (h *chathistory) OnBatch(e *irc.Event) {
+	if len(e.Arguments) == 0 || len(e.Arguments[0]) < 2 {
+		return
+	}
+
+	ref := e.Arguments[0][1:]
+
+	h.Lock()
+	defer h.Unlock()
+
+	switch e.Arguments[0][0] {
+	case '+':
+		if len(e.Arguments) > 1 && e.Arguments[1] == "chathistory" {
+			h.batches[ref] = struct{}{}
+		}
+	case '-':
+		delete(h.batches, ref)
+	}
+}
+
+// IsHistory returns true if the event was delivered as part of history playback.
+func (h *chathistory) IsHistory(e *irc.Event) bool {
+	ref, ok := eventTags(e)["batch"]
+	if !ok {
+		return false
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	_, ok = h.batches[ref]
+	return ok
+}
+
+// Request asks the server for the messages we missed on a channel.
+// Nothing is asked for the first time a channel is joined, as the latest messages would most
+// likely have been relayed before the bridge was restarted. Later joins ask for what was said since.
+func (h *chathistory) Request(con *irc.Connection, channel string, limit int) {
+	h.Lock()
+	folded := h.fold(channel)
+	last, ok := h.lastSeen[folded]
+	if !ok {
+		h.lastSeen[folded] = time.Now()
+	}
+	h.Unlock()
+
+	if !ok {
+		listenerLog.WithField("channel", channel).Debugln("Not requesting missed messages on first join")
+		return
+	}
+	ref := "timestamp=" + last.UTC().Format(chathistoryTimeFormat)
+
+	listenerLog.WithField("channel", channel).WithField("after", ref).Infoln("Requesting missed messages using CHATHISTORY")
+	con.SendRaw(fmt.Sprintf("CHATHISTORY LATEST %s %s %d", channel, ref, limit))
+}
+
+// hasCap returns true if the server acknowledged the given capability
+func hasCap(con *irc.Connection, capability string) bool {
+	for _, c := range con.AcknowledgedCaps {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
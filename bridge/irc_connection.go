@@ -5,11 +5,14 @@ import (
 	"strings"
 	"time"
 
+	ircflood "github.com/qaisjp/go-discord-irc/irc/flood"
 	"github.com/qaisjp/go-discord-irc/irc/varys"
 	irc "github.com/qaisjp/go-ircevent"
-	log "github.com/sirupsen/logrus"
 )
 
+// nickChangeInterval is the minimum time between a puppet's nick changes
+const nickChangeInterval = 10 * time.Second
+
 // An ircConnection should only ever communicate with its manager
 // Refer to `(m *ircManager) CreateConnection` to see how these are spawned
 type ircConnection struct {
@@ -18,10 +21,34 @@ type ircConnection struct {
 
 	quitMessage string
 
+	// away is the away message last set on IRC
+	away string
+
 	messages      chan IRCMessage
+	sendQueue     *ircflood.Queue
 	cooldownTimer *time.Timer
+	// done is closed when the connection is closed
+	done chan struct{}
+
+	// lastActive is when the Discord user last spoke or came online, used for eviction
+	lastActive time.Time
+
+	// lastNickChange is when the puppet last changed nick, to rate limit renames
+	lastNickChange time.Time
+	// nickChangeTimer applies a rename that was rate limited
+	nickChangeTimer *time.Timer
+
+	// idleTimer disconnects the puppet when its user stops talking
+	idleTimer *time.Timer
+	// idleRenewals counts how often idleTimer was renewed, so expiries of older timers are ignored
+	idleRenewals int
+	// spokenChannels are the IRC channels the user has spoken in
+	spokenChannels map[string]struct{}
+	// onlyChannels, if not nil, are the only IRC channels to join
+	onlyChannels map[string]struct{}
 
 	manager *IRCManager
+	rejoin  *rejoinBackoff
 
 	// channel ID for their discord channel for PMs
 	pmDiscordChannel string
@@ -49,34 +76,71 @@ func (i *ircConnection) Connected() bool {
 
 func (i *ircConnection) OnWelcome(e *irc.Event) {
 	// execute puppet prejoin commands
-	err := i.manager.varys.SendRaw(i.discord.ID, varys.InterpolationParams{Nick: true}, i.manager.bridge.Config.IRCPuppetPrejoinCommands...)
+	err := i.manager.varys.SendRaw(i.discord.ID, varys.InterpolationParams{Nick: true}, i.manager.bridge.Config().IRCPuppetPrejoinCommands...)
 	if err != nil {
 		panic(err.Error())
 	}
+	i.identify()
 
 	i.JoinChannels()
 
+	if i.away != "" {
+		i.SendRaw(fmt.Sprintf("AWAY :%s", i.away))
+	}
+
 	// just in case NickServ, Q:Lines, or otherwise force our nick to be not what we expect!
-	i.manager.puppetNicks[i.GetNick()] = i
+	i.manager.setPuppetNick("", i.GetNick(), i)
 
 	go func(i *ircConnection) {
-		for m := range i.messages {
+		for {
+			var m IRCMessage
+			select {
+			case m = <-i.messages:
+			case <-i.done:
+				return
+			}
+
 			msg := m.Message
 			if m.IsAction {
 				msg = fmt.Sprintf("\001ACTION %s\001", msg)
 			}
-			i.Privmsg(m.IRCChannel, msg)
+
+			// Messages with newlines are only queued if multiline is supported
+			if strings.Contains(msg, "\n") {
+				for _, raw := range multilinePrivmsg(m.Label, m.ReplyTo, m.IRCChannel, msg) {
+					i.SendRaw(raw)
+				}
+				continue
+			}
+
+			i.SendRaw(labeledPrivmsg(m.Label, m.ReplyTo, m.IRCChannel, msg))
 		}
 	}(i)
 }
 
 func (i *ircConnection) JoinChannels() {
-	i.SendRaw(i.manager.bridge.GetJoinCommand(i.manager.RequestChannels(i.discord.ID)))
+	mappings := i.joinMappings()
+	if len(mappings) == 0 {
+		return
+	}
+	i.SendRaw(i.manager.bridge.GetJoinCommand(mappings))
+}
+
+// rejoinChannel joins an IRC channel again, if the puppet should be in it
+func (i *ircConnection) rejoinChannel(channel string) {
+	for _, mapping := range i.joinMappings() {
+		if i.manager.bridge.IRCEqualFold(mapping.IRCChannel, channel) {
+			i.SendRaw(i.manager.bridge.GetJoinCommand([]Mapping{mapping}))
+			return
+		}
+	}
 }
 
 func (i *ircConnection) UpdateDetails(discord DiscordUser) {
-	if i.discord.Username != discord.Username {
-		i.quitMessage = fmt.Sprintf("Changing real name from %s to %s", i.discord.Username, discord.Username)
+	// The ident and real name can only be changed by reconnecting
+	oldRealName, newRealName := i.manager.generateRealName(i.discord), i.manager.generateRealName(discord)
+	if oldRealName != newRealName || i.manager.generateUsername(i.discord) != i.manager.generateUsername(discord) {
+		i.quitMessage = fmt.Sprintf("Changing real name from %s to %s", oldRealName, newRealName)
 		i.manager.CloseConnection(i)
 
 		// After one second make the user reconnect.
@@ -92,10 +156,28 @@ func (i *ircConnection) UpdateDetails(discord DiscordUser) {
 		return
 	}
 
+	// Don't let someone flood the server with nick changes by renaming themselves.
+	// Only the latest rename is applied once the wait is over.
+	if wait := time.Until(i.lastNickChange.Add(nickChangeInterval)); wait > 0 {
+		if i.nickChangeTimer != nil {
+			i.nickChangeTimer.Stop()
+		}
+		i.nickChangeTimer = time.AfterFunc(wait, func() {
+			i.manager.bridge.updateUserChan <- discord
+		})
+		return
+	}
+	if i.nickChangeTimer != nil {
+		i.nickChangeTimer.Stop()
+		i.nickChangeTimer = nil
+	}
+	i.lastNickChange = time.Now()
+
 	i.discord = discord
-	delete(i.manager.puppetNicks, i.nick)
+	oldNick := i.nick
+	i.manager.recentNicks.Add(oldNick)
 	i.nick = i.manager.generateNickname(i.discord)
-	i.manager.puppetNicks[i.nick] = i
+	i.manager.setPuppetNick(oldNick, i.nick, i)
 
 	if err := i.manager.varys.Nick(i.discord.ID, i.nick); err != nil {
 		panic(err.Error())
@@ -109,7 +191,7 @@ func (i *ircConnection) introducePM(nick string) {
 		c, err := d.Session.UserChannelCreate(i.discord.ID)
 		if err != nil {
 			// todo: sentry
-			log.Warnln("Could not create private message room", i.discord, err)
+			puppeteerLog.Warnln("Could not create private message room", i.discord, err)
 			return
 		}
 		i.pmDiscordChannel = c.ID
@@ -119,14 +201,14 @@ func (i *ircConnection) introducePM(nick string) {
 		i.pmNoticed = true
 		_, err := d.Session.ChannelMessageSend(
 			i.pmDiscordChannel,
-			fmt.Sprintf("To reply type: `%s@%s, your message here`", nick, i.manager.bridge.Config.Discriminator))
+			fmt.Sprintf("To reply type: `%s@%s, your message here`", nick, i.manager.bridge.Config().Discriminator))
 		if err != nil {
-			log.Warnln("Could not send pmNotice", i.discord, err)
+			puppeteerLog.Warnln("Could not send pmNotice", i.discord, err)
 			return
 		}
 	}
 
-	nick = strings.ToLower(nick)
+	nick = i.manager.bridge.ircListener.isupport.Fold(nick)
 	if _, ok := i.pmNoticedSenders[nick]; !ok {
 		i.pmNoticedSenders[nick] = struct{}{}
 	}
@@ -139,7 +221,8 @@ func (i *ircConnection) OnPrivateMessage(e *irc.Event) {
 	}
 
 	// Alert private messages
-	if string(e.Arguments[0][0]) != "#" {
+	isupport := i.manager.bridge.ircListener.isupport
+	if _, channel := isupport.SplitStatusMsg(e.Arguments[0]); !isupport.IsChannel(channel) {
 		if e.Message() == "help" {
 			i.Privmsg(e.Nick, "Commands: help, who")
 		} else if e.Message() == "who" {
@@ -150,31 +233,61 @@ func (i *ircConnection) OnPrivateMessage(e *irc.Event) {
 
 		i.introducePM(e.Nick)
 
-		msg := fmt.Sprintf(
-			"%s,%s - %s@%s: %s", e.Connection.Server, e.Source,
-			e.Nick, i.manager.bridge.Config.Discriminator, e.Message())
+		msg := i.manager.bridge.pmMessage(e, e.Message())
 		_, err := d.Session.ChannelMessageSend(i.pmDiscordChannel, msg)
 		if err != nil {
-			log.Warnln("Could not send PM", i.discord, err)
+			puppeteerLog.Warnln("Could not send PM", i.discord, err)
 			return
 		}
+		i.manager.bridge.pmReplies.Set(i.discord.ID, e.Nick)
 		return
 	}
 
 	// GTANet does not support deafness so the below logmsg has been disabled
-	// log.Println("Non listener IRC connection received PRIVMSG from channel. Something went wrong.")
+	// puppeteerLog.Println("Non listener IRC connection received PRIVMSG from channel. Something went wrong.")
 }
 
+// SendRaw queues a line to be sent once the flood limit allows
 func (i *ircConnection) SendRaw(message string) {
+	i.sendQueue.Push(message)
+}
+
+// sendRawNow sends a line straight away, for the send queue
+func (i *ircConnection) sendRawNow(message string) {
 	if err := i.manager.varys.SendRaw(i.discord.ID, varys.InterpolationParams{}, message); err != nil {
 		panic(err.Error())
 	}
 }
 
+// SetAway marks the puppet as away, or back if status is empty.
+// Nothing is sent if the status hasn't changed.
 func (i *ircConnection) SetAway(status string) {
+	if i.away == status {
+		return
+	}
+	i.away = status
+
+	if status == "" {
+		i.SendRaw("AWAY")
+		return
+	}
 	i.SendRaw(fmt.Sprintf("AWAY :%s", status))
 }
 
 func (i *ircConnection) Privmsg(target, message string) {
 	i.SendRaw(fmt.Sprintf("PRIVMSG %s :%s\r\n", target, message))
 }
+
+// hasCaps returns true if the server acknowledged all of the given capabilities
+func (i *ircConnection) hasCaps(caps []string) bool {
+	for _, c := range caps {
+		ok, err := i.manager.varys.HasCap(i.discord.ID, c)
+		if err != nil {
+			panic(err.Error())
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,245 @@
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/qaisjp/go-discord-irc/dstate"
+	irctags "github.com/qaisjp/go-discord-irc/irc/tags"
+	irc "github.com/qaisjp/go-ircevent"
+	log "github.com/sirupsen/logrus"
+)
+
+// deliveryCaps are the capabilities required to confirm delivery of lines sent to IRC
+var deliveryCaps = []string{"echo-message", "labeled-response"}
+
+type pendingDelivery struct {
+	message *discordgo.Message
+	timer   *time.Timer
+}
+
+// deliveryTracker labels lines sent to IRC and waits for the server to echo
+// them back. If a line isn't echoed in time, the original Discord message
+// gets an error reaction so that the author knows it wasn't delivered.
+type deliveryTracker struct {
+	sync.Mutex
+
+	bridge  *Bridge
+	counter uint64
+	pending map[string]*pendingDelivery
+}
+
+func newDeliveryTracker(bridge *Bridge) *deliveryTracker {
+	return &deliveryTracker{
+		bridge:  bridge,
+		pending: make(map[string]*pendingDelivery),
+	}
+}
+
+// Track starts waiting for the echo of a line relayed from the given Discord
+// message, and returns the label to send the line with. Returns an empty
+// label if delivery confirmation is disabled.
+func (d *deliveryTracker) Track(m *discordgo.Message) string {
+	timeout := d.bridge.Config().IRCDeliveryTimeout
+	if timeout <= 0 || m == nil || m.ID == "" {
+		return ""
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.counter++
+	label := "dib" + strconv.FormatUint(d.counter, 36)
+
+	p := &pendingDelivery{message: m}
+	p.timer = time.AfterFunc(timeout, func() {
+		d.fail(label, "timed out waiting for echo")
+	})
+	d.pending[label] = p
+
+	return label
+}
+
+// OnEvent should be called for every event on a connection that sends labeled lines.
+func (d *deliveryTracker) OnEvent(e *irc.Event) {
+	label, ok := eventTags(e)["label"]
+	if !ok {
+		return
+	}
+
+	switch {
+	case e.Code == "PRIVMSG", e.Code == "CTCP_ACTION", e.Code == "BATCH", e.Code == "ACK":
+		d.confirm(label, e)
+	case len(e.Code) == 3 && (e.Code[0] == '4' || e.Code[0] == '5'):
+		d.fail(label, e.Code+" "+e.Message())
+	}
+}
+
+func (d *deliveryTracker) take(label string) *pendingDelivery {
+	d.Lock()
+	defer d.Unlock()
+
+	p, ok := d.pending[label]
+	if !ok {
+		return nil
+	}
+	delete(d.pending, label)
+	p.timer.Stop()
+	return p
+}
+
+// confirm stops waiting for a line, remembering its msgid for edits and deletes of the Discord message
+func (d *deliveryTracker) confirm(label string, e *irc.Event) {
+	p := d.take(label)
+	if p == nil {
+		return
+	}
+
+	var channel string
+	switch {
+	case e.Code == "PRIVMSG" || e.Code == "CTCP_ACTION":
+		channel = e.Arguments[0]
+	case e.Code == "BATCH" && len(e.Arguments) >= 3 && strings.HasPrefix(e.Arguments[0], "+"):
+		channel = e.Arguments[2] // the start of a multiline batch
+	}
+	if channel == "" || !d.bridge.ircListener.isupport.IsChannel(channel) {
+		return
+	}
+
+	sender := relayedByListener
+	if con, ok := d.bridge.ircManager.puppet(e.Nick); ok {
+		sender = con.discord.ID
+	}
+	d.bridge.recordRelayedMessageID(p.message.ID, sender, channel, eventTags(e)["msgid"])
+}
+
+func (d *deliveryTracker) fail(label string, reason string) {
+	p := d.take(label)
+	if p == nil {
+		return
+	}
+	d.bridge.deliveryFailed(p.message, reason)
+}
+
+// deliveryFailed marks a Discord message as not relayed to IRC, by reacting to it with
+// Config.DeliveryFailedEmoji and, if Config.DeliveryFailedDM is set, telling its author.
+// It talks to Discord, so shouldn't be called from the loop.
+func (b *Bridge) deliveryFailed(m *discordgo.Message, reason string) {
+	if m == nil || m.ID == "" {
+		return
+	}
+
+	listenerLog.WithFields(log.Fields{
+		"channel": m.ChannelID,
+		"message": m.ID,
+		"reason":  reason,
+	}).Warnln("Discord message was not delivered to IRC")
+	b.relayErrors.Add("message %s in Discord channel %s was not delivered to IRC: %s", m.ID, m.ChannelID, reason)
+
+	conf := b.Config()
+	if conf.DeliveryFailedEmoji != "" {
+		if err := b.discord.Session.MessageReactionAdd(m.ChannelID, m.ID, conf.DeliveryFailedEmoji); err != nil {
+			listenerLog.WithError(err).Errorln("could not react to undelivered message")
+		}
+	}
+
+	if !conf.DeliveryFailedDM || m.Author == nil || m.Author.Bot {
+		return
+	}
+	dm, err := b.discord.Session.UserChannelCreate(m.Author.ID)
+	if err != nil {
+		listenerLog.WithError(err).Errorln("could not open DM about undelivered message")
+		return
+	}
+	guildID := m.GuildID
+	if guildID == "" {
+		guildID = "@me"
+	}
+	link := fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, m.ChannelID, m.ID)
+	_, err = b.discord.Session.ChannelMessageSendComplex(dm.ID, &discordgo.MessageSend{
+		Content: fmt.Sprintf("Your message %s was not sent to IRC: %s.", link, reason),
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{discordgo.Button{
+				Label:    "Retry",
+				Style:    discordgo.PrimaryButton,
+				CustomID: strings.Join([]string{retryDeliveryPrefix, m.GuildID, m.ChannelID, m.ID}, ":"),
+			}},
+		}},
+	})
+	if err != nil {
+		listenerLog.WithError(err).Errorln("could not DM about undelivered message")
+	}
+}
+
+// retryDeliveryPrefix starts the custom ID of the Retry button on a failure DM, followed by
+// the guild, channel and ID of the message, separated by colons
+const retryDeliveryPrefix = "retry_delivery"
+
+// onRetryDelivery relays a message again when its author clicks Retry on the failure DM,
+// if the bridge is connected to IRC by then
+func (d *discordBot) onRetryDelivery(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	parts := strings.Split(i.MessageComponentData().CustomID, ":")
+	if len(parts) != 4 || parts[0] != retryDeliveryPrefix {
+		return
+	}
+	guildID, channelID, messageID := parts[1], parts[2], parts[3]
+
+	user := i.User
+	if i.Member != nil {
+		user = i.Member.User
+	}
+
+	m, err := dstate.ChannelMessage(s, channelID, messageID)
+	if err != nil || user == nil || m.Author == nil || m.Author.ID != user.ID {
+		d.respond(i.Interaction, "That message can't be sent again, it may have been deleted.")
+		return
+	}
+	if !d.bridge.ircListener.Registered() {
+		d.respond(i.Interaction, "The bridge still isn't connected to IRC, try again later.")
+		return
+	}
+
+	// The message may be shared with the state, and relaying changes its content
+	retry := *m
+	retry.GuildID = guildID // messages from the API don't say which guild they are in
+	d.publishMessage(s, &retry, false)
+
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    i.Message.Content + "\nSent again.",
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		discordLog.WithError(err).Warnln("Could not respond to retry button")
+	}
+}
+
+// labeledPrivmsg formats a PRIVMSG, tagged with a label and the msgid it replies to if they are given
+func labeledPrivmsg(label, replyTo, target, message string) string {
+	return messageTags(label, replyTo) + "PRIVMSG " + target + " :" + message
+}
+
+// messageTags formats the tags to send a message with, followed by a space, or nothing if there are none
+func messageTags(label, replyTo string) string {
+	var tags []string
+	if label != "" {
+		tags = append(tags, "label="+label)
+	}
+	if replyTo != "" {
+		tags = append(tags, "+draft/reply="+irctags.Escape(replyTo))
+	}
+
+	if len(tags) == 0 {
+		return ""
+	}
+	return "@" + strings.Join(tags, ";") + " "
+}
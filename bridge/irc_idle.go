@@ -0,0 +1,132 @@
+package bridge
+
+import (
+	"fmt"
+	"time"
+)
+
+// idlePuppet is a Discord user whose puppet was disconnected for being idle
+type idlePuppet struct {
+	user DiscordUser
+
+	// channels are the IRC channels the user spoke in before going idle
+	channels map[string]struct{}
+}
+
+// SetIdleTimer renews/starts a timer for disconnecting a puppet that has stopped talking.
+func (m *IRCManager) SetIdleTimer(con *ircConnection) {
+	timeout := m.bridge.Config().PuppetIdleTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	if con.idleTimer != nil {
+		con.idleTimer.Stop()
+	}
+
+	// The timer only tells the bridge loop, which owns the puppets
+	con.idleRenewals++
+	expiry := idleExpiry{con: con, renewal: con.idleRenewals, timeout: timeout}
+	con.idleTimer = time.AfterFunc(timeout, func() {
+		select {
+		case m.bridge.idleExpiredChan <- expiry:
+		case <-m.bridge.stop:
+		}
+	})
+}
+
+// idleExpiry is sent to the bridge loop when a puppet's idleTimer fires
+type idleExpiry struct {
+	con *ircConnection
+	// renewal is con.idleRenewals when the timer was set
+	renewal int
+	timeout time.Duration
+}
+
+// expireIdle disconnects a puppet whose idleTimer fired, unless it was renewed or closed since.
+// Must be called from the bridge loop.
+func (m *IRCManager) expireIdle(expiry idleExpiry) {
+	con := expiry.con
+	if current, ok := m.connection(con.discord.ID); !ok || current != con || con.idleRenewals != expiry.renewal {
+		return
+	}
+
+	puppeteerLog.WithField("nick", con.nick).Println("IRC connection expired by idleTimer...")
+
+	// Users synced back from varys don't have enough details to reconnect them
+	if con.discord.Username != "" {
+		m.idlePuppets[con.discord.ID] = idlePuppet{
+			user:     con.discord,
+			channels: con.spokenChannels,
+		}
+	}
+
+	con.quitMessage = fmt.Sprintf("Idle for %s", expiry.timeout)
+	m.CloseConnection(con)
+}
+
+// wakePuppet reconnects a puppet that was disconnected for being idle,
+// only joining the channels its user spoke in and the channel being spoken in now.
+func (m *IRCManager) wakePuppet(userID string, channel string) (*ircConnection, bool) {
+	idle, ok := m.idlePuppets[userID]
+	if !ok {
+		return nil, false
+	}
+	delete(m.idlePuppets, userID)
+
+	puppeteerLog.WithField("nick", idle.user.Nick).Println("Waking up idle puppet")
+
+	m.HandleUser(idle.user)
+	con, ok := m.connection(userID)
+	if !ok {
+		return nil, false
+	}
+
+	con.onlyChannels = make(map[string]struct{}, len(idle.channels)+1)
+	for c := range idle.channels {
+		con.onlyChannels[c] = struct{}{}
+	}
+	con.onlyChannels[channel] = struct{}{}
+	return con, true
+}
+
+// spokeIn records that the puppet's user spoke in channel, joining it if the puppet
+// was woken up without it.
+func (i *ircConnection) spokeIn(channel string) {
+	if !i.manager.bridge.ircListener.isupport.IsChannel(channel) {
+		return
+	}
+
+	if i.spokenChannels == nil {
+		i.spokenChannels = make(map[string]struct{})
+	}
+	i.spokenChannels[channel] = struct{}{}
+
+	if i.onlyChannels == nil {
+		return
+	}
+	if _, ok := i.onlyChannels[channel]; ok {
+		return
+	}
+	i.onlyChannels[channel] = struct{}{}
+
+	if mapping, ok := i.manager.bridge.GetMappingByIRC(channel); ok {
+		i.SendRaw(i.manager.bridge.GetJoinCommand([]Mapping{mapping}))
+	}
+}
+
+// joinMappings returns the mappings the puppet should join
+func (i *ircConnection) joinMappings() []Mapping {
+	mappings := i.manager.RequestChannels(i.discord.ID)
+	if i.onlyChannels == nil {
+		return mappings
+	}
+
+	var joined []Mapping
+	for _, mapping := range mappings {
+		if _, ok := i.onlyChannels[mapping.IRCChannel]; ok {
+			joined = append(joined, mapping)
+		}
+	}
+	return joined
+}
@@ -0,0 +1,37 @@
+package bridge
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/qaisjp/go-discord-irc/unfurl"
+)
+
+// linkedImage is an image that a message only linked to, to upload to Discord instead of the link
+type linkedImage struct {
+	name string
+	data []byte
+}
+
+// file returns the image to attach to a Discord message. A new one is needed for each attempt to send it.
+func (i *linkedImage) file() *discordgo.File {
+	return &discordgo.File{Name: i.name, Reader: bytes.NewReader(i.data)}
+}
+
+// imageLinkedBy downloads the image content links to, if Config.IRCImageUploads is set and content
+// is nothing but a link to an image no bigger than Config.IRCImageMaxSize. Returns nil otherwise.
+func (b *Bridge) imageLinkedBy(content string) *linkedImage {
+	conf := b.Config()
+	link := strings.Trim(content, " \u200B") // messages with spaces are wrapped in zero width spaces
+	if !conf.IRCImageUploads || strings.ContainsAny(link, " \t\n") || !unfurl.IsImageURL(link) {
+		return nil
+	}
+
+	data, name, err := b.unfurler.Image(link, conf.IRCImageMaxSize)
+	if err != nil {
+		discordLog.WithError(err).WithField("url", link).Debugln("Could not download linked image, sending the link")
+		return nil
+	}
+	return &linkedImage{name: name, data: data}
+}
@@ -0,0 +1,86 @@
+package bridge
+
+import (
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// Values for Config.IRCInviteRequest, how to ask for an invite to an invite only channel (473)
+const (
+	InviteRequestNone     = "none"
+	InviteRequestChanServ = "chanserv"
+	InviteRequestKnock    = "knock"
+)
+
+// inviteRetryInterval is the least time between asking for invites to the same channel, and
+// inviteMaxAttempts how many are asked for before giving up on it
+const (
+	inviteRetryInterval = 5 * time.Minute
+	inviteMaxAttempts   = 3
+)
+
+type inviteAttempts struct {
+	count int
+	last  time.Time
+}
+
+// inviteRequester returns a function asking for an invite to an IRC channel with send, for the
+// connection with nick, as Config.IRCInviteRequest says to. The function returns false if
+// invites aren't asked for.
+func (b *Bridge) inviteRequester(nick func() string, send func(string)) func(channel string) bool {
+	return func(channel string) bool {
+		switch b.Config().IRCInviteRequest {
+		case InviteRequestChanServ:
+			command := servicesVars{Nick: nick(), Channel: channel}.fill(b.Config().Services.Invite)
+			if command == "" {
+				return false
+			}
+			send(command)
+		case InviteRequestKnock:
+			send("KNOCK " + channel)
+		default:
+			return false
+		}
+		return true
+	}
+}
+
+// requestInvite asks for an invite to an invite only channel, returning false if we have
+// given up on it. It must be called with r.mu held.
+func (r *rejoinBackoff) requestInvite(channel, key string) bool {
+	if r.invite == nil {
+		return false
+	}
+
+	attempts, ok := r.invites[key]
+	if !ok {
+		attempts = &inviteAttempts{}
+		r.invites[key] = attempts
+	}
+	if attempts.count >= inviteMaxAttempts {
+		return false
+	}
+	if time.Since(attempts.last) < inviteRetryInterval {
+		// Still waiting for the last one
+		return true
+	}
+
+	if !r.invite(channel) {
+		return false
+	}
+	attempts.count++
+	attempts.last = time.Now()
+	r.log.WithField("channel", channel).WithField("nick", r.nick()).WithField("attempt", attempts.count).
+		Infoln("Asked for an invite to IRC channel")
+	return true
+}
+
+// OnInvite joins the channel we have been invited to, if it is mapped
+func (r *rejoinBackoff) OnInvite(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+	r.log.WithField("channel", e.Arguments[1]).WithField("by", e.Nick).Infoln("Invited to IRC channel")
+	r.join(e.Arguments[1])
+}
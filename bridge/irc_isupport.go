@@ -0,0 +1,172 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	ircnick "github.com/qaisjp/go-discord-irc/irc/nick"
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// isupport holds the tokens advertised by the server in RPL_ISUPPORT (005).
+type isupport struct {
+	sync.RWMutex
+	tokens map[string]string
+}
+
+func newISupport() *isupport {
+	return &isupport{tokens: make(map[string]string)}
+}
+
+// OnISupport handles RPL_ISUPPORT (005)
+func (s *isupport) OnISupport(e *irc.Event) {
+	// The first argument is our nick, and the last is "are supported by this server"
+	if len(e.Arguments) < 3 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, token := range e.Arguments[1 : len(e.Arguments)-1] {
+		if strings.HasPrefix(token, "-") {
+			delete(s.tokens, token[1:])
+			continue
+		}
+
+		key, value := token, ""
+		if i := strings.IndexByte(token, '='); i != -1 {
+			key, value = token[:i], token[i+1:]
+		}
+		s.tokens[key] = value
+	}
+}
+
+// Get returns the value of a token, and whether it was advertised
+func (s *isupport) Get(key string) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	value, ok := s.tokens[key]
+	return value, ok
+}
+
+// NickLen returns the maximum nick length advertised by the server, or 0 if unknown
+func (s *isupport) NickLen() int {
+	value, _ := s.Get("NICKLEN")
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+// IsChannel returns true if the given target is a channel, according to CHANTYPES
+func (s *isupport) IsChannel(target string) bool {
+	chantypes, ok := s.Get("CHANTYPES")
+	if !ok {
+		chantypes = "#&"
+	}
+	return target != "" && strings.IndexByte(chantypes, target[0]) != -1
+}
+
+// Fold lowercases a nick or channel name according to CASEMAPPING
+func (s *isupport) Fold(name string) string {
+	casemapping, ok := s.Get("CASEMAPPING")
+	if !ok {
+		casemapping = ircnick.DefaultCasemapping
+	}
+	return ircnick.ToLower(name, casemapping)
+}
+
+// EqualFold compares two nicks or channel names according to CASEMAPPING
+func (s *isupport) EqualFold(a, b string) bool {
+	return s.Fold(a) == s.Fold(b)
+}
+
+// modeChange is one mode set or unset by a MODE command
+type modeChange struct {
+	adding bool
+	mode   byte
+	param  string
+}
+
+// takesParam returns true if a channel mode has a parameter when it is set (or unset),
+// according to CHANMODES and PREFIX
+func (s *isupport) takesParam(mode byte, adding bool) bool {
+	prefix, ok := s.Get("PREFIX")
+	if !ok {
+		prefix = "(ov)@+"
+	}
+	if i := strings.IndexByte(prefix, ')'); i != -1 && strings.IndexByte(prefix[:i], mode) != -1 {
+		return true
+	}
+
+	chanmodes, ok := s.Get("CHANMODES")
+	if !ok {
+		chanmodes = "beI,k,l,imnpst"
+	}
+	for group, modes := range strings.Split(chanmodes, ",") {
+		if strings.IndexByte(modes, mode) == -1 {
+			continue
+		}
+		// Lists and modes with a setting always have a parameter, and the third group only when set
+		return group < 2 || (group == 2 && adding)
+	}
+	return false
+}
+
+// ParseModes splits the arguments of a channel MODE command (without the channel) into changes
+func (s *isupport) ParseModes(args []string) []modeChange {
+	if len(args) == 0 {
+		return nil
+	}
+
+	var changes []modeChange
+	params := args[1:]
+	adding := true
+	for i := 0; i < len(args[0]); i++ {
+		mode := args[0][i]
+		switch mode {
+		case '+':
+			adding = true
+			continue
+		case '-':
+			adding = false
+			continue
+		}
+
+		change := modeChange{adding: adding, mode: mode}
+		if s.takesParam(mode, adding) && len(params) > 0 {
+			change.param, params = params[0], params[1:]
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// StatusMsg returns the prefixes that can be used to message a subset
+// of channel members, e.g. "@+" for "@#channel" and "+#channel".
+func (s *isupport) StatusMsg() string {
+	value, _ := s.Get("STATUSMSG")
+	return value
+}
+
+// SplitStatusMsg splits a message target into its STATUSMSG prefix and the channel
+func (s *isupport) SplitStatusMsg(target string) (status, channel string) {
+	channel = strings.TrimLeft(target, s.StatusMsg())
+	return target[:len(target)-len(channel)], channel
+}
+
+// statusMsgMarker describes who a STATUSMSG message was sent to
+func statusMsgMarker(status string) string {
+	switch status {
+	case "":
+		return ""
+	case "@":
+		return "[ops] "
+	case "+":
+		return "[voiced] "
+	case "%":
+		return "[halfops] "
+	default:
+		return "[" + status + "] "
+	}
+}
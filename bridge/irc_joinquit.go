@@ -0,0 +1,209 @@
+package bridge
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// joinQuitMaxNicks is how many nicks a summary of joins and quits lists before "and N others"
+const joinQuitMaxNicks = 10
+
+// speakerPruneInterval is how often recentSpeakers forgets people who haven't spoken for a while
+const speakerPruneInterval = time.Minute
+
+// netsplitReason matches the QUIT reason servers give when a netsplit disconnects users,
+// which is the names of the two servers that lost their link, like "irc.a.net irc.b.net"
+var netsplitReason = regexp.MustCompile(`^[\w-]+(\.[\w-]+)+ [\w-]+(\.[\w-]+)+$`)
+
+// joinQuitVerbs describe the kinds of joinQuitEvent that are summarised, in the order they are summarised
+var joinQuitVerbs = []struct{ kind, verb string }{
+	{JoinQuitEventJoin, "joined"},
+	{JoinQuitEventPart, "left"},
+	{JoinQuitEventQuit, "quit"},
+}
+
+// joinQuitEnabled returns true if joins, quits and so on might be shown on Discord
+func (b *Bridge) joinQuitEnabled() bool {
+	conf := b.Config()
+	return conf.ShowJoinQuit || len(conf.JoinQuitChannelEvents) > 0
+}
+
+// showsJoinQuitEvent returns true if events of kind in an IRC channel are shown on Discord
+func (b *Bridge) showsJoinQuitEvent(channel, kind string) bool {
+	conf := b.Config()
+	for c, events := range conf.JoinQuitChannelEvents {
+		if b.IRCEqualFold(c, channel) {
+			_, ok := events[kind]
+			return ok
+		}
+	}
+
+	if !conf.ShowJoinQuit {
+		return false
+	}
+	if conf.JoinQuitEvents == nil {
+		return kind != JoinQuitEventMode
+	}
+	_, ok := conf.JoinQuitEvents[kind]
+	return ok
+}
+
+// joinQuitEvent is someone joining or leaving an IRC channel, to be shown on Discord
+type joinQuitEvent struct {
+	channel string
+	nick    string
+	// kind is one of JoinQuitEventJoin and so on
+	kind string
+	// message is shown if the event isn't summarised with others
+	message string
+	// netsplit is the servers that split, if a quit was caused by a netsplit
+	netsplit string
+}
+
+// joinQuitBatcher collects joins and quits for each channel for a little while, so that
+// bursts (like netsplits) are shown on Discord as one summary instead of flooding it
+type joinQuitBatcher struct {
+	sync.Mutex
+	pending map[string][]joinQuitEvent // by channel
+	bridge  *Bridge
+}
+
+func newJoinQuitBatcher(bridge *Bridge) *joinQuitBatcher {
+	return &joinQuitBatcher{pending: make(map[string][]joinQuitEvent), bridge: bridge}
+}
+
+// Add shows an event on Discord after Config.JoinQuitBatchDelay, with the others
+// for its channel in the meantime, or straight away if there's no delay
+func (j *joinQuitBatcher) Add(e joinQuitEvent) {
+	delay := j.bridge.Config().JoinQuitBatchDelay
+	if delay <= 0 {
+		j.send(e.channel, e.message)
+		return
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	if len(j.pending[e.channel]) == 0 {
+		time.AfterFunc(delay, func() {
+			j.flush(e.channel)
+		})
+	}
+	j.pending[e.channel] = append(j.pending[e.channel], e)
+}
+
+func (j *joinQuitBatcher) flush(channel string) {
+	j.Lock()
+	events := j.pending[channel]
+	delete(j.pending, channel)
+	j.Unlock()
+
+	if len(events) > 0 {
+		j.send(channel, summariseJoinQuits(events))
+	}
+}
+
+func (j *joinQuitBatcher) send(channel, message string) {
+	j.bridge.queueIRCMessage(IRCMessage{
+		IRCChannel: channel,
+		Username:   "",
+		Message:    message,
+	})
+}
+
+// summariseJoinQuits describes events in one message, with a line for each kind of event
+func summariseJoinQuits(events []joinQuitEvent) string {
+	if len(events) == 1 {
+		return events[0].message
+	}
+
+	var kept []string
+	nicks := make(map[string][]string)
+	var netsplits []string
+	for _, e := range events {
+		switch {
+		case e.kind == JoinQuitEventKick || e.kind == JoinQuitEventMode:
+			// Kicks and mode changes say who did it (and why), so they're never summarised
+			kept = append(kept, e.message)
+		case e.netsplit != "":
+			if _, ok := nicks[e.netsplit]; !ok {
+				netsplits = append(netsplits, e.netsplit)
+			}
+			nicks[e.netsplit] = append(nicks[e.netsplit], e.nick)
+		default:
+			nicks[e.kind] = append(nicks[e.kind], e.nick)
+		}
+	}
+
+	var lines []string
+	for _, v := range joinQuitVerbs {
+		if len(nicks[v.kind]) > 0 {
+			lines = append(lines, listNicks(nicks[v.kind])+" "+v.verb)
+		}
+	}
+	for _, servers := range netsplits {
+		lines = append(lines, fmt.Sprintf("%s quit (netsplit: %s)", listNicks(nicks[servers]), servers))
+	}
+	lines = append(lines, kept...)
+
+	return strings.Join(lines, "\n")
+}
+
+// listNicks lists nicks like "a, b and c", cutting long lists short
+func listNicks(nicks []string) string {
+	if len(nicks) > joinQuitMaxNicks {
+		others := len(nicks) - joinQuitMaxNicks + 1
+		return strings.Join(nicks[:joinQuitMaxNicks-1], ", ") + fmt.Sprintf(" and %d others", others)
+	}
+	if len(nicks) == 1 {
+		return nicks[0]
+	}
+	return strings.Join(nicks[:len(nicks)-1], ", ") + " and " + nicks[len(nicks)-1]
+}
+
+// recentSpeakers remembers when people last spoke in each channel, so that joins and
+// quits can be shown only for people who are part of the conversation
+type recentSpeakers struct {
+	sync.Mutex
+	spoke     map[string]time.Time // folded channel and nick to when they last spoke
+	fold      func(string) string
+	lastPrune time.Time
+}
+
+func newRecentSpeakers(fold func(string) string) *recentSpeakers {
+	return &recentSpeakers{spoke: make(map[string]time.Time), fold: fold}
+}
+
+func (r *recentSpeakers) key(channel, nick string) string {
+	return r.fold(channel) + " " + r.fold(nick)
+}
+
+// Seen records that nick spoke in channel. Anyone who hasn't spoken for keep is forgotten.
+func (r *recentSpeakers) Seen(channel, nick string, keep time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	r.spoke[r.key(channel, nick)] = now
+
+	if now.Sub(r.lastPrune) < speakerPruneInterval {
+		return
+	}
+	r.lastPrune = now
+	for key, spoke := range r.spoke {
+		if now.Sub(spoke) > keep {
+			delete(r.spoke, key)
+		}
+	}
+}
+
+// SpokeWithin returns true if nick spoke in channel in the last d
+func (r *recentSpeakers) SpokeWithin(channel, nick string, d time.Duration) bool {
+	r.Lock()
+	defer r.Unlock()
+	spoke, ok := r.spoke[r.key(channel, nick)]
+	return ok && time.Since(spoke) <= d
+}
@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// watchLag sends the listener a PING every Config.IRCPingInterval to measure the lag,
+// and reconnects it if one isn't answered within Config.IRCPingTimeout, as a connection
+// can stop working without being closed.
+func (b *Bridge) watchLag() {
+	for {
+		interval := b.Config().IRCPingInterval
+		if interval <= 0 {
+			interval = statsRecheckInterval
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-b.stop:
+			return
+		}
+
+		conf := b.Config()
+		if conf.IRCPingInterval <= 0 || !b.ircListener.Registered() {
+			continue
+		}
+
+		if waited := b.ircListener.unansweredPing(); conf.IRCPingTimeout > 0 && waited > conf.IRCPingTimeout {
+			listenerLog.WithField("waited", waited.Round(time.Second)).Warnln("IRC server stopped answering PINGs, reconnecting")
+			b.relayErrors.Add("the IRC server did not answer a PING for %s, so the bridge reconnected", waited.Round(time.Second))
+			atomic.StoreInt64(&b.ircListener.pingSentAt, 0)
+			atomic.StoreInt32(&b.ircListener.registered, 0)
+			if err := b.ReconnectIRC(); err != nil {
+				listenerLog.WithError(err).Errorln("could not reconnect to IRC")
+			}
+			continue
+		}
+
+		b.ircListener.ping()
+	}
+}
+
+// ping sends a PING with the time, so that onPong can measure the round trip.
+// It skips the send queue, so that the lag isn't how long lines are waiting to be sent.
+func (i *ircListener) ping() {
+	now := time.Now().UnixNano()
+	atomic.CompareAndSwapInt64(&i.pingSentAt, 0, now)
+	i.Connection.SendRaw("PING " + strconv.FormatInt(now, 10))
+}
+
+// onPong records how long a PING with the time it was sent took to be answered,
+// including those the library sends to keep the connection alive
+func (i *ircListener) onPong(e *irc.Event) {
+	sent, err := strconv.ParseInt(e.Message(), 10, 64)
+	if err != nil {
+		return
+	}
+	atomic.StoreInt64(&i.lagNanos, time.Now().UnixNano()-sent)
+	atomic.StoreInt64(&i.pingSentAt, 0)
+}
+
+// lag returns the round trip of the last PING answered, or zero if none has been
+func (i *ircListener) lag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&i.lagNanos))
+}
+
+// unansweredPing returns how long ago the oldest PING still waiting for a PONG was sent,
+// or zero if they have all been answered
+func (i *ircListener) unansweredPing() time.Duration {
+	sent := atomic.LoadInt64(&i.pingSentAt)
+	if sent == 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - sent)
+}
@@ -3,31 +3,139 @@ package bridge
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	ircflood "github.com/qaisjp/go-discord-irc/irc/flood"
 	ircf "github.com/qaisjp/go-discord-irc/irc/format"
+	irctags "github.com/qaisjp/go-discord-irc/irc/tags"
 	irc "github.com/qaisjp/go-ircevent"
-	log "github.com/sirupsen/logrus"
 )
 
+// joinAfterAuthTimeout is how long to wait to log in before joining channels anyway, see Config.JoinAfterAuth
+const joinAfterAuthTimeout = 30 * time.Second
+
 type ircListener struct {
 	*irc.Connection
 	bridge *Bridge
 
 	listenerCallbackIDs map[string]int
+
+	// registered is 1 once the server has welcomed us, and 0 after an error
+	registered int32
+	// authed is 1 once we have logged in to services (900), and 0 after an error
+	authed int32
+	// authTimer joins channels if logging in takes too long, see Config.JoinAfterAuth
+	authTimer *time.Timer
+	// welcomedAt is when the server welcomed us, lagNanos the last PING round trip, and
+	// pingSentAt when the oldest unanswered PING was sent, see watchLag
+	welcomedAt int64
+	lagNanos   int64
+	pingSentAt int64
+
+	// sendQueue paces lines sent by the bridge, so the listener isn't killed for flooding
+	sendQueue *ircflood.Queue
+
+	history  *chathistory
+	away     *awayTracker
+	joinQuit *joinQuitBatcher
+	speakers *recentSpeakers
+	monitor  *monitor
+	isupport *isupport
+	queries  ircQueries
+	rejoin   *rejoinBackoff
 }
 
 func newIRCListener(dib *Bridge, webIRCPass string) *ircListener {
-	irccon := irc.IRC(dib.Config.IRCListenerName, "discord")
-	listener := &ircListener{irccon, dib, make(map[string]int)}
+	irccon := irc.IRC(dib.Config().IRCListenerName, dib.Config().IRCListenerUsername)
+	irccon.RealName = dib.Config().IRCListenerRealName
+	isupport := newISupport()
+	listener := &ircListener{
+		Connection:          irccon,
+		bridge:              dib,
+		listenerCallbackIDs: make(map[string]int),
+
+		history:  newChathistory(isupport.Fold),
+		away:     newAwayTracker(isupport.Fold),
+		joinQuit: newJoinQuitBatcher(dib),
+		speakers: newRecentSpeakers(isupport.Fold),
+		isupport: isupport,
+	}
+	listener.monitor = newMonitor(listener)
+	listener.rejoin = newRejoinBackoff(listenerLog, isupport.Fold, irccon.GetNick, dib.rejoinMapped(listener.SendRaw))
+	listener.rejoin.invite = dib.inviteRequester(irccon.GetNick, listener.SendRaw)
+	listener.rejoin.lockedOut = dib.noticeLockedOut
+	listener.sendQueue = ircflood.NewQueue(dib.newSendLimiter(), irccon.SendRaw)
 
 	dib.SetupIRCConnection(irccon, "discord.", "fd75:f5f5:226f::")
-	listener.SetDebugMode(dib.Config.Debug)
+	listener.SetDebugMode(dib.Config().Debug)
+
+	// Ask for server-time so that replayed messages keep their original timestamps
+	irccon.RequestCaps = append(irccon.RequestCaps, "server-time")
+
+	// Tags used to attribute messages and to recognise our own relayed lines
+	irccon.RequestCaps = append(irccon.RequestCaps, "message-tags", "account-tag")
+
+	// Be told when users go away or come back
+	irccon.RequestCaps = append(irccon.RequestCaps, "away-notify")
+	irccon.AddCallback("AWAY", listener.OnAway)
+
+	// Watch for important nicks coming and going
+	irccon.AddCallback("001", listener.monitor.Start)
+	irccon.AddCallback("730", listener.monitor.OnOnline)
+	irccon.AddCallback("731", listener.monitor.OnOffline)
+	irccon.AddCallback("734", listener.monitor.OnListFull)
+
+	// Send messages with several lines as one message where supported
+	irccon.RequestCaps = append(irccon.RequestCaps, multilineCaps...)
+
+	// Confirm that relayed lines actually reach IRC
+	if dib.Config().IRCDeliveryTimeout > 0 {
+		irccon.RequestCaps = append(irccon.RequestCaps, deliveryCaps...)
+		irccon.AddCallback("*", dib.delivery.OnEvent)
+	}
+
+	// Delete messages on Discord when they are redacted on IRC, and redact messages deleted on Discord
+	irccon.RequestCaps = append(irccon.RequestCaps, redactCaps...)
+	irccon.AddCallback("REDACT", listener.OnRedact)
+
+	// Backfill messages missed whilst disconnected
+	if dib.Config().IRCChathistoryLimit > 0 {
+		irccon.RequestCaps = append(irccon.RequestCaps, "draft/chathistory") // "batch" is requested above
+		irccon.AddCallback("BATCH", listener.history.OnBatch)
+	}
+
+	// Rejoin after being kicked, backing off if it keeps happening
+	irccon.AddCallback("KICK", listener.rejoin.OnKick)
+	irccon.AddCallback("JOIN", listener.rejoin.OnJoin)
+	irccon.AddCallback("INVITE", listener.rejoin.OnInvite)
+	for _, code := range joinFailedCodes {
+		irccon.AddCallback(code, listener.rejoin.OnJoinFailed)
+	}
+
+	// Punish the Discord users of puppets kicked or banned on IRC
+	irccon.AddCallback("KICK", listener.onModerationKick)
+	irccon.AddCallback("MODE", listener.onModerationMode)
 
 	// Nick tracker for nick tracking
 	irccon.SetupNickTrack()
 
+	// Pick another nick if ours is taken, and take it back when we can
+	irccon.ClearCallback("433")
+	irccon.ClearCallback("437")
+	irccon.AddCallback("433", listener.onNickInUse)
+	irccon.AddCallback("437", listener.onNickInUse)
+	irccon.AddCallback("QUIT", listener.onNickFreed)
+	irccon.AddCallback("NICK", listener.onNickFreed)
+
 	// Welcome event
 	irccon.AddCallback("001", listener.OnWelcome)
+	irccon.AddCallback("ERROR", func(e *irc.Event) {
+		atomic.StoreInt32(&listener.registered, 0)
+		atomic.StoreInt32(&listener.authed, 0)
+	})
+	irccon.AddCallback("005", listener.isupport.OnISupport)
+	irccon.AddCallback("PONG", listener.onPong)
 
 	// Called when received channel names... essentially OnJoinChannel
 	irccon.AddCallback("366", listener.OnJoinChannel)
@@ -35,14 +143,18 @@ func newIRCListener(dib *Bridge, webIRCPass string) *ircListener {
 	irccon.AddCallback("NOTICE", listener.OnPrivateMessage)
 	irccon.AddCallback("CTCP_ACTION", listener.OnPrivateMessage)
 
-	irccon.AddCallback("900", func(e *irc.Event) {
-		// Try to rejoni channels after authenticated with NickServ
-		listener.JoinChannels()
-	})
+	irccon.AddCallback("900", listener.OnLoggedIn)
 
 	// we are assuming this will be posible to run independent of any
 	// future NICK callbacks added, otherwise do it like the STQUIT callback
 	listener.AddCallback("NICK", listener.nickTrackNick)
+	listener.AddCallback("NICK", listener.onAwayNickChange)
+	listener.AddCallback("JOIN", listener.onAwayJoin)
+
+	// Log channel traffic that isn't relayed, if asked to
+	for _, code := range []string{"PRIVMSG", "NOTICE", "CTCP_ACTION", "STJOIN", "STPART", "STQUIT", "STNICK", "KICK", "TOPIC"} {
+		listener.AddCallback(code, listener.onChannelLog)
+	}
 
 	// Note that this might override SetupNickTrack!
 	listener.OnJoinQuitSettingChange()
@@ -53,9 +165,9 @@ func newIRCListener(dib *Bridge, webIRCPass string) *ircListener {
 func (i *ircListener) nickTrackNick(event *irc.Event) {
 	oldNick := event.Nick
 	newNick := event.Message()
-	if con, ok := i.bridge.ircManager.puppetNicks[oldNick]; ok {
-		i.bridge.ircManager.puppetNicks[newNick] = con
-		delete(i.bridge.ircManager.puppetNicks, oldNick)
+	if con, ok := i.bridge.ircManager.puppet(oldNick); ok {
+		i.bridge.ircManager.setPuppetNick(oldNick, newNick, con)
+		i.bridge.ircManager.recentNicks.Add(oldNick)
 	}
 }
 
@@ -75,24 +187,59 @@ func (i *ircListener) OnNickRelayToDiscord(event *irc.Event) {
 		Message:  fmt.Sprintf("_%s changed their nick to %s_", oldNick, newNick),
 	}
 
-	for _, m := range i.bridge.mappings {
+	for _, m := range i.bridge.mappingTable().mappings {
 		channel := m.IRCChannel
 		if channelObj, ok := i.Connection.GetChannel(channel); ok {
-			if _, ok := channelObj.GetUser(newNick); ok {
+			if _, ok := channelObj.GetUser(newNick); ok && i.showJoinQuit(channel, JoinQuitEventNick, oldNick) {
 				msg.IRCChannel = channel
-				i.bridge.discordMessagesChan <- msg
+				i.bridge.queueIRCMessage(msg)
 			}
 		}
 	}
 }
 
+// showJoinQuit returns true if an event of kind by nick in channel should be shown on Discord.
+// Config.JoinQuitSpokeWithin can limit events other than kicks and mode changes to people who spoke recently.
+func (i *ircListener) showJoinQuit(channel, kind, nick string) bool {
+	if !i.bridge.showsJoinQuitEvent(channel, kind) {
+		return false
+	}
+	if kind == JoinQuitEventKick || kind == JoinQuitEventMode {
+		// These are done to people or channels rather than by them
+		return true
+	}
+	within := i.bridge.Config().JoinQuitSpokeWithin
+	return within <= 0 || i.speakers.SpokeWithin(channel, nick, within)
+}
+
+// OnModeRelayToDiscord shows channel mode changes on Discord
+func (i *ircListener) OnModeRelayToDiscord(event *irc.Event) {
+	if len(event.Arguments) < 2 || !i.isupport.IsChannel(event.Arguments[0]) {
+		return
+	}
+	if i.bridge.ircManager.isIgnoredHostmask(event.Source) || i.isPuppetNick(event.Nick) {
+		return
+	}
+
+	channel := event.Arguments[0]
+	if !i.showJoinQuit(channel, JoinQuitEventMode, event.Nick) {
+		return
+	}
+	i.joinQuit.Add(joinQuitEvent{
+		channel: channel,
+		nick:    event.Nick,
+		kind:    JoinQuitEventMode,
+		message: event.Nick + " sets mode " + strings.Join(event.Arguments[1:], " "),
+	})
+}
+
 func (i *ircListener) nickTrackPuppetQuit(e *irc.Event) {
 	// Protect against HostServ changing nicks or ircd's with CHGHOST/CHGIDENT or similar
 	// sending us a QUIT for a puppet nick only for it to rejoin right after.
 	// The puppet nick won't see a true disconnection itself and thus will still see itself
 	// as connected.
-	if con, ok := i.bridge.ircManager.puppetNicks[e.Nick]; ok && !con.Connected() {
-		delete(i.bridge.ircManager.puppetNicks, e.Nick)
+	if con, ok := i.bridge.ircManager.puppet(e.Nick); ok && !con.Connected() {
+		i.bridge.ircManager.forgetPuppetNick(e.Nick, con)
 	}
 }
 
@@ -105,8 +252,9 @@ func (i *ircListener) OnJoinQuitSettingChange() {
 
 	// we're either going to track quits, or track and relay said, so swap out the callback
 	// based on which is in effect.
-	if i.bridge.Config.ShowJoinQuit {
+	if i.bridge.joinQuitEnabled() {
 		i.listenerCallbackIDs["STNICK"] = i.AddCallback("STNICK", i.OnNickRelayToDiscord)
+		i.listenerCallbackIDs["MODE"] = i.AddCallback("MODE", i.OnModeRelayToDiscord)
 
 		// KICK is not state tracked!
 		callbacks := []string{"STJOIN", "STPART", "STQUIT", "KICK"}
@@ -140,15 +288,19 @@ func (i *ircListener) OnJoinQuitCallback(event *irc.Event) {
 	message := event.Nick
 	id := " (" + event.User + "@" + event.Host + ") "
 
+	var kind, netsplit string
 	switch event.Code {
 	case "STJOIN":
+		kind = JoinQuitEventJoin
 		message += " joined" + id
 	case "STPART":
+		kind = JoinQuitEventPart
 		message += " left" + id
 		if len(event.Arguments) > 1 {
 			message += ": " + event.Arguments[1]
 		}
 	case "STQUIT":
+		kind = JoinQuitEventQuit
 		message += " quit" + id
 
 		reason := event.Nick
@@ -156,35 +308,51 @@ func (i *ircListener) OnJoinQuitCallback(event *irc.Event) {
 			reason = event.Arguments[0]
 		}
 		message += "Quit: " + reason
+
+		if netsplitReason.MatchString(reason) {
+			netsplit = reason
+		}
 	case "KICK":
+		kind = JoinQuitEventKick
 		who = event.Arguments[1]
 		message = event.Arguments[1] + " was kicked by " + event.Nick + ": " + event.Arguments[2]
 	}
 
-	msg := IRCMessage{
-		// IRCChannel: set on the fly
-		Username: "",
-		Message:  message,
+	// Note whether the user was away when they left
+	if event.Code == "STPART" || event.Code == "STQUIT" {
+		if reason, ok := i.away.Get(event.Nick); ok {
+			message += " (was away: " + reason + ")"
+		}
+	}
+
+	e := joinQuitEvent{
+		// channel: set on the fly
+		nick:     who,
+		kind:     kind,
+		message:  message,
+		netsplit: netsplit,
 	}
 
 	if event.Code == "STQUIT" {
 		// Notify channels that the user is in
-		for _, m := range i.bridge.mappings {
+		for _, m := range i.bridge.mappingTable().mappings {
 			channel := m.IRCChannel
 			channelObj, ok := i.Connection.GetChannel(channel)
 			if !ok {
-				log.WithField("channel", channel).WithField("who", who).Warnln("Trying to process QUIT. Channel not found in irc listener cache.")
+				listenerLog.WithField("channel", channel).WithField("who", who).Warnln("Trying to process QUIT. Channel not found in irc listener cache.")
 				continue
 			}
-			if _, ok := channelObj.GetUser(who); !ok {
+			if _, ok := channelObj.GetUser(who); !ok || !i.showJoinQuit(channel, kind, who) {
 				continue
 			}
-			msg.IRCChannel = channel
-			i.bridge.discordMessagesChan <- msg
+			e.channel = channel
+			i.joinQuit.Add(e)
 		}
 	} else {
-		msg.IRCChannel = event.Arguments[0]
-		i.bridge.discordMessagesChan <- msg
+		e.channel = event.Arguments[0]
+		if i.showJoinQuit(e.channel, kind, who) {
+			i.joinQuit.Add(e)
+		}
 	}
 }
 
@@ -207,55 +375,128 @@ func (i *ircListener) SetDebugMode(debug bool) {
 }
 
 func (i *ircListener) OnWelcome(e *irc.Event) {
+	atomic.StoreInt32(&i.registered, 1)
+	atomic.StoreInt64(&i.welcomedAt, time.Now().UnixNano())
+	atomic.StoreInt64(&i.pingSentAt, 0)
+
 	// Execute prejoin commands
-	for _, com := range i.bridge.Config.IRCListenerPrejoinCommands {
+	for _, com := range i.bridge.Config().IRCListenerPrejoinCommands {
 		i.SendRaw(strings.ReplaceAll(com, "${NICK}", i.GetNick()))
 	}
+	i.identify()
+
+	// Join all channels, unless that has to wait until we have logged in
+	if i.bridge.Config().JoinAfterAuth && atomic.LoadInt32(&i.authed) == 0 {
+		listenerLog.Infof("Waiting up to %s to log in before joining channels", joinAfterAuthTimeout)
+		if i.authTimer != nil {
+			i.authTimer.Stop()
+		}
+		i.authTimer = time.AfterFunc(joinAfterAuthTimeout, func() {
+			if atomic.LoadInt32(&i.authed) == 0 {
+				listenerLog.Warnln("Did not log in in time, joining channels anyway")
+				i.JoinChannels()
+			}
+		})
+	} else {
+		i.JoinChannels()
+	}
 
-	// Join all channels
+	i.bridge.onIRCWelcome()
+}
+
+// OnLoggedIn (re)joins channels after logging in to services (900), as some need us to be logged in
+func (i *ircListener) OnLoggedIn(e *irc.Event) {
+	atomic.StoreInt32(&i.authed, 1)
+	if i.authTimer != nil {
+		i.authTimer.Stop()
+		i.authTimer = nil
+	}
+	i.regainNick()
 	i.JoinChannels()
 }
 
 func (i *ircListener) JoinChannels() {
-	i.SendRaw(i.bridge.GetJoinCommand(i.bridge.mappings))
+	i.SendRaw(i.bridge.GetJoinCommand(i.bridge.mappingTable().mappings))
 }
 
 func (i *ircListener) OnJoinChannel(e *irc.Event) {
-	log.Infof("Listener has joined IRC channel %s.", e.Arguments[1])
+	// NAMES asked for by the bridge also ends like this
+	if i.answeringQuery(e) {
+		return
+	}
+
+	listenerLog.Infof("Listener has joined IRC channel %s.", e.Arguments[1])
+	i.requestOp(e)
+
+	if limit := i.bridge.Config().IRCChathistoryLimit; limit > 0 && hasCap(i.Connection, "draft/chathistory") {
+		i.history.Request(i.Connection, e.Arguments[1], limit)
+	}
 }
 
 func (i *ircListener) isPuppetNick(nick string) bool {
+	if nick == "" {
+		return false
+	}
 	if i.GetNick() == nick {
 		return true
 	}
-	if _, ok := i.bridge.ircManager.puppetNicks[nick]; ok {
+	if _, ok := i.bridge.ircManager.puppet(nick); ok {
 		return true
 	}
-	return false
+	return i.bridge.ircManager.recentNicks.Has(nick)
 }
 
 func (i *ircListener) OnPrivateMessage(e *irc.Event) {
-	// Ignore private messages
-	if string(e.Arguments[0][0]) != "#" {
-		// If you decide to extend this to respond to PMs, make sure
-		// you do not respond to NOTICEs, see issue #50.
+	// Messages to "@#channel" are only for some members of "#channel"
+	status, channel := i.isupport.SplitStatusMsg(e.Arguments[0])
+
+	// Private messages can be forwarded to Discord users.
+	// Make sure you do not respond to NOTICEs, see issue #50.
+	if !i.isupport.IsChannel(channel) {
+		i.onDirectMessage(e)
 		return
 	}
 
+	tags := eventTags(e)
+
 	if i.isPuppetNick(e.Nick) || // ignore msg's from our puppets
+		i.isPuppetNick(tags["draft/relaymsg"]) || // ignore lines we relayed using RELAYMSG
 		i.bridge.ircManager.isIgnoredHostmask(e.Source) || //ignored hostmasks
-		i.bridge.ircManager.isFilteredIRCMessage(e.Message()) { // filtered
+		i.bridge.IRCOptedOut(e.Nick) || // asked not to be relayed
+		i.bridge.echoes.IsEcho(channel, e.Nick, isIRCBot(tags), e.Message()) { // reflected back by another bridge
+		return
+	}
+
+	if e.Code == "PRIVMSG" && (i.onSearchCommand(e.Nick, channel, e.Message()) || i.onLastCommand(e.Nick, channel, e.Message())) {
+		return
+	}
+
+	text, ok := i.bridge.filterLines(i.bridge.ircFilters(), e.Nick, channel, e.Message())
+	if !ok {
 		return
 	}
 
 	replacements := []string{}
-	for _, con := range i.bridge.ircManager.ircConnections {
+	for _, con := range i.bridge.ircManager.connections() {
 		replacements = append(replacements, con.nick, "<@!"+con.discord.ID+">")
 	}
+	linked := make(map[string]string)
+	for _, discordID := range i.bridge.store.Keys(linkDiscordBucket) {
+		if nick, ok := i.bridge.LinkedNick(discordID); ok {
+			linked[nick] = "<@!" + discordID + ">"
+		}
+	}
 
 	msg := strings.NewReplacer(
 		replacements...,
-	).Replace(e.Message())
+	).Replace(i.bridge.rewriteToDiscord(text))
+	msg = replaceWords(msg, linked)
+
+	timestamp := serverTime(e)
+	i.history.Seen(channel, timestamp)
+	if within := i.bridge.Config().JoinQuitSpokeWithin; within > 0 {
+		i.speakers.Seen(channel, e.Nick, within)
+	}
 
 	if e.Code == "CTCP_ACTION" {
 		msg = "_" + msg + "_"
@@ -263,11 +504,85 @@ func (i *ircListener) OnPrivateMessage(e *irc.Event) {
 
 	msg = ircf.BlocksToMarkdown(ircf.Parse(msg))
 
-	go func(e *irc.Event) {
-		i.bridge.discordMessagesChan <- IRCMessage{
-			IRCChannel: e.Arguments[0],
-			Username:   e.Nick,
-			Message:    msg,
+	msg = statusMsgMarker(status) + msg
+
+	message := IRCMessage{
+		IRCChannel: channel,
+		Username:   i.bridge.DisplayName(e.Nick, tags["account"]),
+		Nick:       e.Nick,
+		Message:    msg,
+		Timestamp:  timestamp,
+		Tags:       tags,
+	}
+
+	if i.history.IsHistory(e) {
+		message.Message = "[history] " + msg
+		i.bridge.queueIRCMessage(message)
+		return
+	}
+
+	// People sending too much are held back, or not relayed at all
+	delay, ok := i.bridge.throttle.Allow(i.bridge.ircThrottleKey(e.Nick), e.Nick, text)
+	if !ok {
+		return
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, func() {
+			i.bridge.queueIRCMessage(message)
+		})
+		return
+	}
+	i.bridge.queueIRCMessage(message)
+}
+
+// isIRCBot returns true if tags have the IRCv3 bot tag, which servers add to messages from users marked as bots
+func isIRCBot(tags map[string]string) bool {
+	_, bot := tags["bot"]
+	_, draftBot := tags["draft/bot"]
+	return bot || draftBot
+}
+
+// eventTags returns the IRCv3 message tags of an event
+func eventTags(e *irc.Event) map[string]string {
+	return irctags.Parse(e.Raw)
+}
+
+// serverTime returns the time the server received an event, as given by
+// the IRCv3 server-time tag. Returns the zero time if there is no tag.
+func serverTime(e *irc.Event) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, eventTags(e)["time"])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Registered returns true if the listener is connected and the server has welcomed it
+func (i *ircListener) Registered() bool {
+	return i.Connected() && atomic.LoadInt32(&i.registered) == 1
+}
+
+// SendRaw queues a line to be sent once the flood limit allows
+func (i *ircListener) SendRaw(message string) {
+	i.sendQueue.Push(message)
+}
+
+// Privmsg queues a PRIVMSG, see SendRaw
+func (i *ircListener) Privmsg(target, message string) {
+	i.SendRaw("PRIVMSG " + target + " :" + message)
+}
+
+// Notice queues a NOTICE, see SendRaw
+func (i *ircListener) Notice(target, message string) {
+	i.SendRaw("NOTICE " + target + " :" + message)
+}
+
+// hasCaps returns true if the server acknowledged all of the given capabilities
+func (i *ircListener) hasCaps(caps []string) bool {
+	for _, c := range caps {
+		if !hasCap(i.Connection, c) {
+			return false
 		}
-	}(e)
+	}
+	return true
 }
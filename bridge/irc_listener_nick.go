@@ -0,0 +1,66 @@
+package bridge
+
+import (
+	"sync/atomic"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// listenerNickRetryInterval is how often the listener tries to take back its nick, while someone else has it
+const listenerNickRetryInterval = time.Minute
+
+// onNickInUse picks another nick while registering, when the one asked for is taken (433, 437):
+// Config.IRCListenerAltNick, and then that nick with underscores after it. Once registered,
+// watchListenerNick takes back the listener's nick.
+func (i *ircListener) onNickInUse(e *irc.Event) {
+	if atomic.LoadInt32(&i.registered) == 1 || len(e.Arguments) < 2 {
+		// We were trying to change nick, and can try again later
+		return
+	}
+
+	taken := e.Arguments[1]
+	next := taken + "_"
+	if alt := i.bridge.Config().IRCListenerAltNick; alt != "" && i.isupport.EqualFold(taken, i.bridge.Config().IRCListenerName) {
+		next = alt
+	}
+
+	listenerLog.WithField("nick", taken).Warnf("IRC nick is in use, trying %s", next)
+	i.SendRaw("NICK " + next)
+}
+
+// onNickFreed takes back the listener's nick as soon as whoever had it quits or changes nick
+func (i *ircListener) onNickFreed(e *irc.Event) {
+	wanted := i.bridge.Config().IRCListenerName
+	if !i.isupport.EqualFold(e.Nick, wanted) || i.isupport.EqualFold(i.GetNick(), wanted) {
+		return
+	}
+	i.SendRaw("NICK " + wanted)
+}
+
+// watchListenerNick keeps trying to take back the listener's nick while it doesn't have it,
+// with services if it has logged in
+func (b *Bridge) watchListenerNick() {
+	ticker := time.NewTicker(listenerNickRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+
+		i := b.ircListener
+		wanted := b.Config().IRCListenerName
+		if !i.Registered() || i.isupport.EqualFold(i.GetNick(), wanted) {
+			continue
+		}
+
+		if atomic.LoadInt32(&i.authed) == 1 {
+			i.regainNick()
+		} else {
+			i.SendRaw("NICK " + wanted)
+		}
+	}
+}
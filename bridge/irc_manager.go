@@ -3,51 +3,55 @@ package bridge
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
-	"github.com/mozillazg/go-unidecode"
 	"github.com/pkg/errors"
 
+	ircflood "github.com/qaisjp/go-discord-irc/irc/flood"
 	ircnick "github.com/qaisjp/go-discord-irc/irc/nick"
 	"github.com/qaisjp/go-discord-irc/irc/varys"
-	irc "github.com/qaisjp/go-ircevent"
 	log "github.com/sirupsen/logrus"
 )
 
 // DevMode is a hack
 var DevMode = false
 
-// IRCManager should only be used from one thread.
+// IRCManager should only be used from one thread, apart from the connection accessors.
 type IRCManager struct {
+	// connectionsMu guards ircConnections and puppetNicks, which HTTP handlers and IRC and Discord
+	// callbacks read while the bridge loop changes them. Read them with connection, connections,
+	// connectionCount and puppet, and change puppetNicks with setPuppetNick and forgetPuppetNick.
+	connectionsMu  sync.RWMutex
 	ircConnections map[string]*ircConnection
 	puppetNicks    map[string]*ircConnection
+	idlePuppets    map[string]idlePuppet
+	recentNicks    *recentNicks
 
 	bridge *Bridge
 	varys  varys.Client
+
+	// evictions is the number of puppets evicted because MaxPuppets was reached
+	evictions int
 }
 
 // NewIRCManager creates a new IRCManager
 func newIRCManager(bridge *Bridge) (*IRCManager, error) {
-	conf := bridge.Config
 	m := &IRCManager{
 		ircConnections: make(map[string]*ircConnection),
 		puppetNicks:    make(map[string]*ircConnection),
+		idlePuppets:    make(map[string]idlePuppet),
+		recentNicks:    newRecentNicks(bridge.ircListener.isupport.Fold),
 		bridge:         bridge,
 	}
 
 	// Set up varys
 	m.varys = varys.NewMemClient()
-	err := m.varys.Setup(varys.SetupParams{
-		UseTLS:             !conf.NoTLS,
-		InsecureSkipVerify: conf.InsecureSkipVerify,
-
-		Server:         conf.IRCServer,
-		ServerPassword: conf.IRCServerPass,
-		WebIRCPassword: conf.WebIRCPass,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to set up params: %w", err)
+	if err := m.setupVarys(); err != nil {
+		return nil, err
 	}
 
 	// Sync back state, if there is any
@@ -58,44 +62,137 @@ func newIRCManager(bridge *Bridge) (*IRCManager, error) {
 	m.ircConnections = make(map[string]*ircConnection, len(discordToNicks))
 	m.puppetNicks = make(map[string]*ircConnection, len(discordToNicks))
 	for discord, nick := range discordToNicks {
-		m.ircConnections[discord] = &ircConnection{
+		con := &ircConnection{
 			discord:          DiscordUser{ID: discord},
 			nick:             nick,
-			messages:         make(chan IRCMessage),
+			messages:         make(chan IRCMessage, bridge.relayQueueSize()),
+			done:             make(chan struct{}),
 			manager:          m,
 			pmNoticedSenders: make(map[string]struct{}),
 		}
+		con.sendQueue = ircflood.NewQueue(bridge.newSendLimiter(), con.sendRawNow)
+		m.ircConnections[discord] = con
 	}
 
 	return m, nil
 }
 
+// setupVarys tells varys how puppets connect to the IRC server.
+// Changes apply to puppets that connect afterwards.
+func (m *IRCManager) setupVarys() error {
+	conf := m.bridge.Config()
+	err := m.varys.Setup(varys.SetupParams{
+		UseTLS:             !conf.NoTLS,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+
+		Server:         conf.IRCServer,
+		ServerPassword: conf.IRCServerPass,
+		WebIRCPassword: conf.WebIRCPass,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up params: %w", err)
+	}
+	return nil
+}
+
+// connection returns the puppet of a Discord user, if they have one
+func (m *IRCManager) connection(userID string) (*ircConnection, bool) {
+	m.connectionsMu.RLock()
+	defer m.connectionsMu.RUnlock()
+	con, ok := m.ircConnections[userID]
+	return con, ok
+}
+
+// connections returns every puppet, so they can be looped over from any goroutine
+// (and closed while looping)
+func (m *IRCManager) connections() []*ircConnection {
+	m.connectionsMu.RLock()
+	defer m.connectionsMu.RUnlock()
+	cons := make([]*ircConnection, 0, len(m.ircConnections))
+	for _, con := range m.ircConnections {
+		cons = append(cons, con)
+	}
+	return cons
+}
+
+// connectionCount returns how many puppets there are
+func (m *IRCManager) connectionCount() int {
+	m.connectionsMu.RLock()
+	defer m.connectionsMu.RUnlock()
+	return len(m.ircConnections)
+}
+
+// puppet returns the puppet using nick, if there is one
+func (m *IRCManager) puppet(nick string) (*ircConnection, bool) {
+	m.connectionsMu.RLock()
+	defer m.connectionsMu.RUnlock()
+	con, ok := m.puppetNicks[nick]
+	return con, ok
+}
+
+// setPuppetNick records that con now uses nick instead of oldNick, which may be empty
+func (m *IRCManager) setPuppetNick(oldNick, nick string, con *ircConnection) {
+	m.connectionsMu.Lock()
+	defer m.connectionsMu.Unlock()
+	if oldNick != "" {
+		delete(m.puppetNicks, oldNick)
+	}
+	m.puppetNicks[nick] = con
+}
+
+// forgetPuppetNick forgets that con uses nick, unless nick has been taken by another puppet since
+func (m *IRCManager) forgetPuppetNick(nick string, con *ircConnection) {
+	m.connectionsMu.Lock()
+	defer m.connectionsMu.Unlock()
+	if m.puppetNicks[nick] == con {
+		delete(m.puppetNicks, nick)
+	}
+}
+
 // CloseConnection shuts down a particular connection and its channels.
 func (m *IRCManager) CloseConnection(i *ircConnection) {
-	log.WithField("nick", i.nick).Println("Closing connection.")
+	puppeteerLog.WithField("nick", i.nick).Println("Closing connection.")
 	// Destroy the cooldown timer
 	if i.cooldownTimer != nil {
 		i.cooldownTimer.Stop()
 		i.cooldownTimer = nil
 	}
+	if i.idleTimer != nil {
+		i.idleTimer.Stop()
+		i.idleTimer = nil
+	}
+	if i.nickChangeTimer != nil {
+		i.nickChangeTimer.Stop()
+		i.nickChangeTimer = nil
+	}
+	i.rejoin.Stop()
 
+	m.connectionsMu.Lock()
 	delete(m.ircConnections, i.discord.ID)
-	delete(m.puppetNicks, i.nick)
-	close(i.messages)
+	if m.puppetNicks[i.nick] == i {
+		delete(m.puppetNicks, i.nick)
+	}
+	m.connectionsMu.Unlock()
+	m.recentNicks.Add(i.nick)
+	close(i.done)
+	i.sendQueue.Close()
 
 	if DevMode {
-		fmt.Println("Decrementing total connections. It's now", len(m.ircConnections))
+		fmt.Println("Decrementing total connections. It's now", m.connectionCount())
 	}
 
 	if err := m.varys.QuitIfConnected(i.discord.ID, i.quitMessage); err != nil {
-		log.WithError(err).WithFields(log.Fields{"discord": i.discord.ID}).Errorln("failed to quit")
+		puppeteerLog.WithError(err).WithFields(log.Fields{"discord": i.discord.ID}).Errorln("failed to quit")
 	}
 }
 
 // Close closes all of an IRCManager's connections.
 func (m *IRCManager) Close() {
 	i := 0
-	for _, con := range m.ircConnections {
+	for _, con := range m.connections() {
+		if con.quitMessage == "" {
+			con.quitMessage = m.bridge.Config().IRCQuitMessage
+		}
 		m.CloseConnection(con)
 		i++
 	}
@@ -104,69 +201,114 @@ func (m *IRCManager) Close() {
 // SetConnectionCooldown renews/starts a timer for expiring a connection.
 func (m *IRCManager) SetConnectionCooldown(con *ircConnection) {
 	if con.cooldownTimer != nil {
-		log.WithField("nick", con.nick).Println("IRC connection cooldownTimer stopped!")
+		puppeteerLog.WithField("nick", con.nick).Println("IRC connection cooldownTimer stopped!")
 		con.cooldownTimer.Stop()
 	}
 
 	con.cooldownTimer = time.AfterFunc(
-		m.bridge.Config.CooldownDuration,
+		m.bridge.Config().CooldownDuration,
 		func() {
-			log.WithField("nick", con.nick).Println("IRC connection expired by cooldownTimer...")
+			puppeteerLog.WithField("nick", con.nick).Println("IRC connection expired by cooldownTimer...")
 			m.CloseConnection(con)
 		},
 	)
 
-	log.WithField("nick", con.nick).Println("IRC connection cooldownTimer created...")
+	puppeteerLog.WithField("nick", con.nick).Println("IRC connection cooldownTimer created...")
 }
 
 // DisconnectUser immediately disconnects a Discord user if it exists
 func (m *IRCManager) DisconnectUser(userID string) {
-	con, ok := m.ircConnections[userID]
+	delete(m.idlePuppets, userID)
+
+	con, ok := m.connection(userID)
 	if !ok {
 		return
 	}
 	m.CloseConnection(con)
 }
 
+// evictPuppet closes the least recently active puppet to make room for another,
+// sending that user's messages through the listener until they are active again.
+func (m *IRCManager) evictPuppet() {
+	var oldest *ircConnection
+	for _, con := range m.connections() {
+		if oldest == nil || con.lastActive.Before(oldest.lastActive) {
+			oldest = con
+		}
+	}
+	if oldest == nil {
+		return
+	}
+
+	m.evictions++
+	puppeteerLog.WithFields(log.Fields{
+		"nick":        oldest.nick,
+		"idle":        time.Since(oldest.lastActive).Round(time.Second),
+		"puppets":     m.connectionCount(),
+		"max_puppets": m.bridge.Config().MaxPuppets,
+		"evictions":   m.evictions,
+	}).Warnln("Puppet pool is full, evicting least recently active puppet")
+
+	m.CloseConnection(oldest)
+}
+
 var connectionsIgnored = 0
 
 func (m *IRCManager) ircIgnoredDiscord(user string) bool {
-	_, ret := m.bridge.Config.DiscordIgnores[user]
-	return ret
+	_, ret := m.bridge.Config().DiscordIgnores[user]
+	return ret || m.bridge.DiscordOptedOut(user)
 }
 
 // HandleUser deals with messages sent from a DiscordUser
 //
 // When `user.Online == false`, we make `user.ID` the only other data present in discord.handlePresenceUpdate
 func (m *IRCManager) HandleUser(user DiscordUser) {
-	if m.ircIgnoredDiscord(user.ID) {
+	// Puppets would be seen on IRC
+	if m.ircIgnoredDiscord(user.ID) || m.bridge.Config().DryRun {
+		return
+	}
+
+	// Bots that aren't relayed don't need a puppet
+	if user.Bot && !m.bridge.relaysBot(user.ID, false) {
 		return
 	}
 
 	// If we have an allowed list of users at all
-	if allowed := m.bridge.Config.DiscordAllowed; allowed != nil {
+	if allowed := m.bridge.Config().DiscordAllowed; allowed != nil {
 		// Short-circuit if they aren't in the list
 		if _, ok := allowed[user.ID]; !ok {
 			return
 		}
 	}
 
+	// Idle puppets are only reconnected when their user talks again
+	if idle, ok := m.idlePuppets[user.ID]; ok {
+		if user.Nick != "" {
+			idle.user = user
+			m.idlePuppets[user.ID] = idle
+		}
+		return
+	}
+
 	// Does the user exist on the IRC side?
-	if con, ok := m.ircConnections[user.ID]; ok {
+	if con, ok := m.connection(user.ID); ok {
 		// Close the connection if they are not
 		// online on Discord anymore (after cooldown)
 		if !user.Online {
 			m.SetConnectionCooldown(con)
 			con.SetAway("offline on discord")
 		} else {
+			con.lastActive = time.Now()
+
 			// The user is online, destroy any connection cooldown.
 			if con.cooldownTimer != nil {
-				log.WithField("nick", user.Nick).Println("Destroying connection cooldown.")
+				puppeteerLog.WithField("nick", user.Nick).Println("Destroying connection cooldown.")
 				con.cooldownTimer.Stop()
 				con.cooldownTimer = nil
-
-				con.SetAway("")
 			}
+
+			// Mirror idle and do not disturb as AWAY
+			con.SetAway(user.Away)
 		}
 
 		// If user.Nick is empty then we probably just had a status change
@@ -189,7 +331,7 @@ func (m *IRCManager) HandleUser(user DiscordUser) {
 			return
 		}
 
-		log.WithFields(log.Fields{
+		puppeteerLog.WithFields(log.Fields{
 			"err":                errors.WithStack(errors.New("Username or Discriminator is empty")).Error(),
 			"user.Username":      user.Username,
 			"user.Discriminator": user.Discriminator,
@@ -200,18 +342,25 @@ func (m *IRCManager) HandleUser(user DiscordUser) {
 
 	// DEV MODE: Only create a connection if it sounds like qaisjp or if we have 10 connections
 	if DevMode {
-		if len(m.ircConnections) > 4 && !strings.Contains(user.Username, "qais") {
+		if m.connectionCount() > 4 && !strings.Contains(user.Username, "qais") {
 			connectionsIgnored++
-			// fmt.Println("Not letting", user.Username, "connect. We have", len(m.ircConnections), "connections. Ignored", connectionsIgnored, "connections.")
+			// fmt.Println("Not letting", user.Username, "connect. We have", m.connectionCount(), "connections. Ignored", connectionsIgnored, "connections.")
 			return
 		}
 	}
 
 	// Don't connect them if we're over our configured connection limit! (Includes our listener)
-	if m.bridge.Config.ConnectionLimit > 0 && len(m.ircConnections)+1 >= m.bridge.Config.ConnectionLimit {
+	if m.bridge.Config().ConnectionLimit > 0 && m.connectionCount()+1 >= m.bridge.Config().ConnectionLimit {
 		return
 	}
 
+	// Make room in the puppet pool
+	if max := m.bridge.Config().MaxPuppets; max > 0 {
+		for m.connectionCount() >= max {
+			m.evictPuppet()
+		}
+	}
+
 	nick := m.generateNickname(user)
 	username := m.generateUsername(user)
 
@@ -226,60 +375,109 @@ func (m *IRCManager) HandleUser(user DiscordUser) {
 		ip = SnowflakeToIP(baseip, user.ID)
 	}
 
-	hostname := user.ID
-	if user.Bot {
-		hostname += ".bot.discord"
-	} else {
-		hostname += ".user.discord"
-	}
+	hostname := m.bridge.WebIRCHostname(user)
 
 	con := &ircConnection{
 		discord:          user,
 		nick:             nick,
-		messages:         make(chan IRCMessage),
+		messages:         make(chan IRCMessage, m.bridge.relayQueueSize()),
+		done:             make(chan struct{}),
 		manager:          m,
 		pmNoticedSenders: make(map[string]struct{}),
-		quitMessage:      fmt.Sprintf("Offline for %s", m.bridge.Config.CooldownDuration),
+		quitMessage:      fmt.Sprintf("Offline for %s", m.bridge.Config().CooldownDuration),
+		away:             user.Away,
+		lastActive:       time.Now(),
 	}
 
+	con.sendQueue = ircflood.NewQueue(m.bridge.newSendLimiter(), con.sendRawNow)
+	m.connectionsMu.Lock()
 	m.ircConnections[user.ID] = con
 	m.puppetNicks[nick] = con
+	m.connectionsMu.Unlock()
+	m.SetIdleTimer(con)
 
 	if DevMode {
-		fmt.Println("Incrementing total connections. It's now", len(m.ircConnections))
+		fmt.Println("Incrementing total connections. It's now", m.connectionCount())
+	}
+
+	con.rejoin = newRejoinBackoff(puppeteerLog, m.bridge.ircListener.isupport.Fold, con.GetNick, con.rejoinChannel)
+	con.rejoin.invite = m.bridge.inviteRequester(con.GetNick, con.SendRaw)
+
+	callbacks := m.bridge.ctcpCallbacks()
+	callbacks["001"] = con.OnWelcome
+	callbacks["PRIVMSG"] = con.OnPrivateMessage
+	callbacks["KICK"] = con.rejoin.OnKick
+	callbacks["JOIN"] = con.rejoin.OnJoin
+	callbacks["INVITE"] = con.rejoin.OnInvite
+	for _, code := range joinFailedCodes {
+		callbacks[code] = con.rejoin.OnJoinFailed
+	}
+
+	caps := append([]string{}, multilineCaps...)
+	caps = append(caps, replyCaps...)
+	caps = append(caps, redactCaps...)
+	if m.bridge.Config().IRCDeliveryTimeout > 0 {
+		caps = append(caps, deliveryCaps...)
+		callbacks["*"] = m.bridge.delivery.OnEvent
 	}
 
+	account := m.bridge.Config().PuppetAccounts[user.ID]
+
+	m.bridge.expectIdent(username)
 	err := m.varys.Connect(varys.ConnectParams{
 		UID: user.ID,
 
 		Nick:     nick,
 		Username: username,
-		RealName: user.Username,
+		RealName: m.generateRealName(user),
 
-		WebIRCSuffix: fmt.Sprintf("discord %s %s", hostname, ip),
+		WebIRCSuffix: fmt.Sprintf("%s %s %s", m.bridge.Config().WebIRCGateway, hostname, ip),
 
-		Callbacks: map[string]func(*irc.Event){
-			"001":     con.OnWelcome,
-			"PRIVMSG": con.OnPrivateMessage,
-		},
+		SASLLogin:    account.Account,
+		SASLPassword: account.Password,
+
+		RequestCaps: caps,
+		Callbacks:   callbacks,
 	})
 	if err != nil {
-		log.WithError(err).Errorln("error opening irc connection")
+		puppeteerLog.WithError(err).Errorln("error opening irc connection")
 		return
 	}
 }
 
+// truncateNick cuts nick down to at most length bytes, without splitting multi-byte sequences.
+func truncateNick(nick string, length int) string {
+	if length <= 0 {
+		return ""
+	}
+	if len(nick) <= length {
+		return nick
+	}
+	for length > 0 && !utf8.RuneStart(nick[length]) {
+		length--
+	}
+	return nick[:length]
+}
+
+// nickTaken returns true if nick is in use by anyone other than the given Discord user.
+func (m *IRCManager) nickTaken(nick string, discordID string) bool {
+	if con, ok := m.puppet(nick); ok {
+		return con.discord.ID != discordID
+	}
+	return m.bridge.ircListener.DoesUserExist(nick)
+}
+
 // Converts a nickname to a sanitised form.
 // Does not check IRC or Discord existence, so don't use this method
 // unless you're also checking IRC and Discord.
-func sanitiseNickname(nick string) string {
+func sanitiseNickname(nick string, transliterate ircnick.Transliterator) string {
 	if nick == "" {
 		fmt.Println(errors.WithStack(errors.New("trying to sanitise an empty nick")))
 		return "_"
 	}
 
-	// Unidecode the nickname — we make sure it's not empty to prevent "🔴🔴" becoming ""
-	if newnick := unidecode.Unidecode(nick); newnick != "" {
+	// Transliterate the nickname — we make sure it's not empty to prevent "🔴🔴" becoming ""
+	if newnick := transliterate(nick); newnick != "" {
 		nick = newnick
 	}
 
@@ -308,24 +506,27 @@ func sanitiseNickname(nick string) string {
 }
 
 func (m *IRCManager) generateNickname(discord DiscordUser) string {
-	nick := sanitiseNickname(discord.Nick)
-	suffix := m.bridge.Config.Suffix
+	// Configured nicks win, as long as nobody else is using them
+	if nick, ok := m.bridge.Config().NickOverrides[discord.ID]; ok && !m.nickTaken(nick, discord.ID) {
+		return nick
+	}
+	if nick, ok := m.bridge.LinkedNick(discord.ID); ok && !m.nickTaken(nick, discord.ID) {
+		return nick
+	}
+
+	nick := m.readableNickname(discord.Nick, discord.ID)
+	suffix := m.bridge.Config().Suffix
 	newNick := nick + suffix
 
-	useFallback := len(newNick) > m.bridge.Config.MaxNickLength || m.bridge.ircListener.DoesUserExist(newNick)
-	// log.WithFields(log.Fields{
+	maxLength := m.bridge.MaxNickLength()
+	useFallback := len(newNick) > maxLength || m.bridge.ircListener.DoesUserExist(newNick)
+	// puppeteerLog.WithFields(log.Fields{
 	// 	"length":      len(newNick) > ircnick.MAXLENGTH,
 	// 	"useFallback": useFallback,
 	// }).Infoln("nickgen: fallback?")
 
 	if !useFallback {
-		guild, err := m.bridge.discord.Session.State.Guild(m.bridge.Config.GuildID)
-		if err != nil {
-			// log.Fatalln("nickgen: guild not found when generating nickname")
-			return ""
-		}
-
-		for _, member := range guild.Members {
+		for _, member := range m.bridge.discord.members() {
 			if member.User.ID == discord.ID {
 				continue
 			}
@@ -336,12 +537,12 @@ func (m *IRCManager) generateNickname(discord DiscordUser) string {
 			}
 
 			if name == "" {
-				log.WithField("member", member).Errorln("blank username encountered")
+				puppeteerLog.WithField("member", member).Errorln("blank username encountered")
 				continue
 			}
 
-			if strings.EqualFold(sanitiseNickname(name), nick) {
-				// log.WithField("member", member).Infoln("nickgen: using fallback because of discord")
+			if m.bridge.IRCEqualFold(sanitiseNickname(name, m.transliterate), nick) {
+				// puppeteerLog.WithField("member", member).Infoln("nickgen: using fallback because of discord")
 				useFallback = true
 				break
 			}
@@ -350,18 +551,18 @@ func (m *IRCManager) generateNickname(discord DiscordUser) string {
 
 	if useFallback {
 		discriminator := discord.Discriminator
-		username := sanitiseNickname(discord.Username)
-		suffix = m.bridge.Config.Separator + discriminator + suffix
+		username := m.readableNickname(discord.Username, discord.ID)
+		suffix = m.bridge.Config().Separator + discriminator + suffix
 
 		// Maximum length of a username but without the suffix
-		length := ircnick.MAXLENGTH - len(suffix)
-		if length >= len(username) {
-			length = len(username)
-			// log.Infoln("nickgen: maximum length limit not reached")
-		}
+		newNick = truncateNick(username, maxLength-len(suffix)) + suffix
 
-		newNick = username[:length] + suffix
-		// log.WithFields(log.Fields{
+		// Truncation can make two users end up with the same nick, so disambiguate with a counter
+		for i := 2; i < 100 && m.nickTaken(newNick, discord.ID); i++ {
+			counter := strconv.Itoa(i)
+			newNick = truncateNick(username, maxLength-len(suffix)-len(counter)) + counter + suffix
+		}
+		// puppeteerLog.WithFields(log.Fields{
 		// 	"nick":     discord.Nick,
 		// 	"username": discord.Username,
 		// 	"newNick":  newNick,
@@ -369,7 +570,7 @@ func (m *IRCManager) generateNickname(discord DiscordUser) string {
 		return newNick
 	}
 
-	// log.WithFields(log.Fields{
+	// puppeteerLog.WithFields(log.Fields{
 	// 	"nick":     discord.Nick,
 	// 	"username": discord.Username,
 	// 	"newNick":  newNick,
@@ -384,22 +585,83 @@ func (m *IRCManager) SendMessage(channel string, msg *DiscordMessage) {
 		return
 	}
 
-	con, ok := m.ircConnections[msg.Author.ID]
+	channel = strings.Split(channel, " ")[0]
+	_, ircChannel := m.bridge.ircListener.isupport.SplitStatusMsg(channel)
 
-	content := msg.Content
+	content, ok := m.bridge.filterLines(m.bridge.discordFilters(), msg.Author.Username, channel, msg.Content)
+	if !ok {
+		return
+	}
+	var discordNick string
+	if msg.Member != nil {
+		discordNick = msg.Member.Nick
+	}
+	for _, line := range strings.Split(content, "\n") {
+		m.bridge.echoes.Record(ircChannel, line, msg.Author.Username, discordNick)
+	}
 
-	channel = strings.Split(channel, " ")[0]
+	if m.bridge.Config().DryRun {
+		m.logDryRun(channel, msg, content)
+		return
+	}
+
+	con, ok := m.connection(msg.Author.ID)
+	if !ok {
+		con, ok = m.wakePuppet(msg.Author.ID, ircChannel)
+	}
+	if ok {
+		con.lastActive = time.Now()
+		con.spokeIn(ircChannel)
+		m.SetIdleTimer(con)
+	}
 
 	// Person is appearing offline (or the bridge is running in Simple Mode)
 	if !ok {
-		length := len(msg.Author.Username)
-		for _, line := range strings.Split(content, "\n") {
-			m.bridge.ircListener.Privmsg(channel, fmt.Sprintf(
-				"<%s#%s> %s",
-				msg.Author.Username[:1]+"\u200B"+msg.Author.Username[1:length],
-				msg.Author.Discriminator,
-				line,
-			))
+		listener := m.bridge.ircListener
+		lines := strings.Split(content, "\n")
+		for i, line := range lines {
+			lines[i] = simpleModeLine(msg, line)
+			m.bridge.echoes.Record(ircChannel, lines[i], listener.GetNick())
+		}
+
+		if !listener.Registered() {
+			go m.bridge.deliveryFailed(msg.Message, "the bridge is not connected to IRC")
+			return
+		}
+		if listener.isupport.IsChannel(ircChannel) {
+			if _, joined := listener.GetChannel(ircChannel); !joined {
+				go m.bridge.deliveryFailed(msg.Message, "the bridge is not in "+ircChannel)
+				return
+			}
+		}
+		confirm := listener.hasCaps(deliveryCaps)
+
+		var replyTo string
+		if listener.hasCaps(replyCaps) {
+			replyTo = msg.ReplyTo
+		}
+
+		// Send the whole message at once if the server supports it
+		if len(lines) > 1 && listener.hasCaps(multilineCaps) {
+			var label string
+			if confirm {
+				label = m.bridge.delivery.Track(msg.Message)
+			}
+
+			for _, raw := range multilinePrivmsg(label, replyTo, channel, strings.Join(lines, "\n")) {
+				listener.SendRaw(raw)
+			}
+			return
+		}
+
+		for _, line := range lines {
+			var label string
+			if confirm {
+				label = m.bridge.delivery.Track(msg.Message)
+			}
+
+			listener.SendRaw(labeledPrivmsg(label, replyTo, channel, line))
+			replyTo = "" // only the first line is the reply
 		}
 		return
 	}
@@ -409,6 +671,8 @@ func (m *IRCManager) SendMessage(channel string, msg *DiscordMessage) {
 		m.SetConnectionCooldown(con)
 	}
 
+	var ircMessages []IRCMessage
+	hasAction := false
 	for _, line := range strings.Split(content, "\n") {
 		ircMessage := IRCMessage{
 			IRCChannel: channel,
@@ -421,20 +685,58 @@ func (m *IRCManager) SendMessage(channel string, msg *DiscordMessage) {
 			ircMessage.Message = line[4:]
 		}
 
-		if m.isFilteredDiscordMessage(line) {
-			continue
+		hasAction = hasAction || ircMessage.IsAction
+		ircMessages = append(ircMessages, ircMessage)
+		m.bridge.echoes.Record(ircChannel, ircMessage.Message, con.nick)
+	}
+
+	// Send the whole message at once if the server supports it.
+	// Actions can't be part of a multiline batch, so those are still sent line by line.
+	if len(ircMessages) > 1 && !hasAction && con.hasCaps(multilineCaps) {
+		lines := make([]string, len(ircMessages))
+		for i, ircMessage := range ircMessages {
+			lines[i] = ircMessage.Message
 		}
 
-		select {
-		// Try to send the message immediately
-		case con.messages <- ircMessage:
-		// If it can't after 5ms, do it in a separate goroutine
-		case <-time.After(time.Millisecond * 5):
-			go func() {
-				con.messages <- ircMessage
-			}()
+		ircMessages = []IRCMessage{{
+			IRCChannel: channel,
+			Message:    strings.Join(lines, "\n"),
+		}}
+	}
+
+	if len(ircMessages) > 0 && con.hasCaps(replyCaps) {
+		ircMessages[0].ReplyTo = msg.ReplyTo
+	}
+
+	confirm := con.hasCaps(deliveryCaps)
+	for i := range ircMessages {
+		if confirm {
+			ircMessages[i].Label = m.bridge.delivery.Track(msg.Message)
 		}
 	}
+
+	// The puppet may still be connecting, so wait on the channel's worker
+	m.bridge.workers.Do(toIRCWorker(ircChannel), func() {
+		for _, ircMessage := range ircMessages {
+			select {
+			case con.messages <- ircMessage:
+			case <-con.done:
+				m.bridge.deliveryFailed(msg.Message, "the puppet was disconnected from IRC")
+				return
+			}
+		}
+	})
+}
+
+// simpleModeLine formats a line of a Discord message for the listener to send
+func simpleModeLine(msg *DiscordMessage, line string) string {
+	length := len(msg.Author.Username)
+	return fmt.Sprintf(
+		"<%s#%s> %s",
+		msg.Author.Username[:1]+"\u200B"+msg.Author.Username[1:length],
+		msg.Author.Discriminator,
+		line,
+	)
 }
 
 // RequestChannels finds all the Discord channels this user belongs to,
@@ -442,11 +744,11 @@ func (m *IRCManager) SendMessage(channel string, msg *DiscordMessage) {
 // Currently just returns all participating IRC channels
 // TODO (?)
 func (m *IRCManager) RequestChannels(userID string) []Mapping {
-	return m.bridge.mappings
+	return m.bridge.mappingTable().mappings
 }
 
 func (m *IRCManager) isIgnoredHostmask(mask string) bool {
-	for _, ban := range m.bridge.Config.IRCIgnores {
+	for _, ban := range m.bridge.ircIgnores() {
 		if ban.Match(mask) {
 			return true
 		}
@@ -454,27 +756,40 @@ func (m *IRCManager) isIgnoredHostmask(mask string) bool {
 	return false
 }
 
-func (m *IRCManager) isFilteredIRCMessage(txt string) bool {
-	for _, ban := range m.bridge.Config.IRCFilteredMessages {
-		if ban.Match(txt) {
-			return true
-		}
+// generateUsername returns the ident a puppet connects with, from Config.PuppetUsername
+func (m *IRCManager) generateUsername(discordUser DiscordUser) string {
+	template := m.bridge.Config().PuppetUsername
+	if template == "" {
+		template = "${USERNAME}"
 	}
-	return false
-}
 
-func (m *IRCManager) isFilteredDiscordMessage(txt string) bool {
-	for _, ban := range m.bridge.Config.DiscordFilteredMessages {
-		if ban.Match(txt) {
-			return true
-		}
+	// Idents can't have the characters nicks can't have either
+	sanitised := discordUser
+	sanitised.Username = sanitiseNickname(discordUser.Username, m.transliterate)
+	if discordUser.Nick != "" {
+		sanitised.Nick = sanitiseNickname(discordUser.Nick, m.transliterate)
 	}
-	return false
+	return puppetTemplate(template, sanitised)
 }
 
-func (m *IRCManager) generateUsername(discordUser DiscordUser) string {
-	if len(m.bridge.Config.PuppetUsername) > 0 {
-		return m.bridge.Config.PuppetUsername
+// generateRealName returns the real name (GECOS) a puppet connects with, from Config.PuppetRealName
+func (m *IRCManager) generateRealName(discordUser DiscordUser) string {
+	template := m.bridge.Config().PuppetRealName
+	if template == "" {
+		template = "${USERNAME}"
 	}
-	return sanitiseNickname(discordUser.Username)
+	return puppetTemplate(template, discordUser)
+}
+
+// puppetTemplate fills in ${USERNAME}, ${DISPLAYNAME} and ${ID} for a Discord user
+func puppetTemplate(template string, user DiscordUser) string {
+	displayName := user.Nick
+	if displayName == "" {
+		displayName = user.Username
+	}
+	return strings.NewReplacer(
+		"${USERNAME}", user.Username,
+		"${DISPLAYNAME}", displayName,
+		"${ID}", user.ID,
+	).Replace(template)
 }
@@ -0,0 +1,107 @@
+package bridge
+
+import (
+	"strings"
+	"sync"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// monitor uses MONITOR to keep track of whether important IRC nicks are online,
+// and posts a notice to Discord whenever one of them comes or goes.
+type monitor struct {
+	sync.Mutex
+
+	listener *ircListener
+	online   map[string]bool // folded nick to online status
+}
+
+func newMonitor(listener *ircListener) *monitor {
+	return &monitor{
+		listener: listener,
+		online:   make(map[string]bool),
+	}
+}
+
+// Start asks the server to monitor the configured nicks
+func (m *monitor) Start(e *irc.Event) {
+	nicks := m.listener.bridge.Config().IRCMonitorNicks
+	if len(nicks) == 0 {
+		return
+	}
+
+	// Clear anything left over from a previous connection
+	m.listener.SendRaw("MONITOR C")
+	m.listener.SendRaw("MONITOR + " + strings.Join(nicks, ","))
+}
+
+// SetNicks replaces the list of monitored nicks
+func (m *monitor) SetNicks(nicks []string) {
+	m.listener.bridge.UpdateConfig(func(conf *Config) {
+		conf.IRCMonitorNicks = nicks
+	})
+
+	m.Lock()
+	m.online = make(map[string]bool)
+	m.Unlock()
+
+	if !m.listener.Connected() {
+		return
+	}
+
+	if len(nicks) == 0 {
+		m.listener.SendRaw("MONITOR C")
+		return
+	}
+	m.Start(nil)
+}
+
+// OnOnline handles RPL_MONONLINE (730)
+func (m *monitor) OnOnline(e *irc.Event) {
+	for _, target := range strings.Split(e.Message(), ",") {
+		// Targets are given as nick!user@host
+		m.update(strings.SplitN(target, "!", 2)[0], true)
+	}
+}
+
+// OnOffline handles RPL_MONOFFLINE (731)
+func (m *monitor) OnOffline(e *irc.Event) {
+	for _, nick := range strings.Split(e.Message(), ",") {
+		m.update(nick, false)
+	}
+}
+
+// OnListFull handles ERR_MONLISTFULL (734)
+func (m *monitor) OnListFull(e *irc.Event) {
+	listenerLog.WithField("nicks", e.Arguments[2]).Warnln("MONITOR list is full, some nicks will not be monitored")
+}
+
+func (m *monitor) update(nick string, online bool) {
+	if nick == "" {
+		return
+	}
+
+	folded := m.listener.isupport.Fold(nick)
+
+	m.Lock()
+	was, known := m.online[folded]
+	m.online[folded] = online
+	m.Unlock()
+
+	// The first reply tells us the current status, which isn't a change
+	if !known || was == online {
+		return
+	}
+
+	channel := m.listener.bridge.Config().IRCMonitorChannel
+	if channel == "" {
+		return
+	}
+
+	message := "_" + nick + " is now offline on IRC_"
+	if online {
+		message = "_" + nick + " is now online on IRC_"
+	}
+
+	go m.listener.bridge.sendToDiscord(channel, "", "", message)
+}
@@ -0,0 +1,25 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// multilineCaps are the capabilities required to send a message as a draft/multiline BATCH
+var multilineCaps = []string{"batch", "draft/multiline"}
+
+var multilineBatchCounter uint64
+
+// multilinePrivmsg formats a message containing newlines as a draft/multiline
+// BATCH, so that it is delivered as one message rather than one per line.
+func multilinePrivmsg(label, replyTo, target, message string) []string {
+	ref := "ml" + strconv.FormatUint(atomic.AddUint64(&multilineBatchCounter, 1), 36)
+
+	lines := []string{messageTags(label, replyTo) + "BATCH +" + ref + " draft/multiline " + target}
+	for _, line := range strings.Split(message, "\n") {
+		lines = append(lines, "@batch="+ref+" PRIVMSG "+target+" :"+line)
+	}
+
+	return append(lines, "BATCH -"+ref)
+}
@@ -0,0 +1,76 @@
+package bridge
+
+import (
+	"fmt"
+	"time"
+)
+
+// offlineMessage is a Discord message waiting for IRC to come back
+type offlineMessage struct {
+	target string
+	msg    *DiscordMessage
+	at     time.Time
+}
+
+// offlineBuffer keeps Discord messages sent while IRC is disconnected,
+// so they can be sent once it's back. It is only used by the loop.
+type offlineBuffer struct {
+	messages []offlineMessage
+	dropped  int
+}
+
+// sendToIRC sends a Discord message to IRC, or keeps it for later if IRC is disconnected or relaying is paused
+func (b *Bridge) sendToIRC(target string, msg *DiscordMessage) {
+	size := b.Config().IRCOfflineBuffer
+	paused := b.relayPause(DirectionDiscordToIRC)
+	if paused == PauseDrop || (paused != "" && size <= 0) {
+		go b.deliveryFailed(msg.Message, "relaying to IRC is paused")
+		return
+	}
+	if paused == "" && (size <= 0 || b.Config().DryRun || b.ircListener.Registered()) {
+		b.ircManager.SendMessage(target, msg)
+		return
+	}
+
+	buf := &b.offline
+	buf.messages = append(buf.messages, offlineMessage{target: target, msg: msg, at: time.Now()})
+	if len(buf.messages) > size {
+		go b.deliveryFailed(buf.messages[0].msg.Message, "too many messages were sent while IRC was disconnected")
+		buf.messages = buf.messages[len(buf.messages)-size:]
+		buf.dropped++
+	}
+}
+
+// replayOffline sends the messages kept while IRC was disconnected,
+// marked with when they were sent.
+func (b *Bridge) replayOffline() {
+	buf := &b.offline
+	if len(buf.messages) == 0 || b.relayPause(DirectionDiscordToIRC) != "" || !b.ircListener.Registered() {
+		return
+	}
+
+	listenerLog.WithField("messages", len(buf.messages)).WithField("dropped", buf.dropped).Infoln("Sending messages from while IRC was disconnected")
+	if buf.dropped > 0 {
+		b.relayErrors.Add("%d messages from Discord were not sent to IRC, as too many were sent while IRC was disconnected", buf.dropped)
+	}
+
+	for _, m := range buf.messages {
+		b.ircManager.SendMessage(m.target, delayedForIRC(m))
+	}
+	*buf = offlineBuffer{}
+}
+
+// delayedForIRC returns a copy of a kept message, marked with when it was sent
+func delayedForIRC(m offlineMessage) *DiscordMessage {
+	delayed := *m.msg
+	delayed.Content = fmt.Sprintf("[delayed, sent %s UTC] %s", m.at.UTC().Format("15:04"), delayed.Content)
+	return &delayed
+}
+
+// onIRCWelcome tells the loop that the listener has (re)connected
+func (b *Bridge) onIRCWelcome() {
+	select {
+	case b.ircWelcomeChan <- struct{}{}:
+	default:
+	}
+}
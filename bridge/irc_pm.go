@@ -0,0 +1,187 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	irctags "github.com/qaisjp/go-discord-irc/irc/tags"
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// pmReplies remembers the last IRC user to private message each Discord user,
+// so that replies in Discord DMs don't need to be addressed with "nick@server,".
+type pmReplies struct {
+	sync.Mutex
+	last map[string]string // Discord user ID to IRC nick
+}
+
+func newPMReplies() *pmReplies {
+	return &pmReplies{last: make(map[string]string)}
+}
+
+func (p *pmReplies) Get(discordID string) (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+	nick, ok := p.last[discordID]
+	return nick, ok
+}
+
+func (p *pmReplies) Set(discordID string, nick string) {
+	p.Lock()
+	defer p.Unlock()
+	p.last[discordID] = nick
+}
+
+// pmMessage formats a private message from IRC for a Discord DM
+func (b *Bridge) pmMessage(e *irc.Event, message string) string {
+	return fmt.Sprintf(
+		"%s,%s - %s@%s: %s", e.Connection.Server, e.Source,
+		e.Nick, b.Config().Discriminator, message)
+}
+
+// onDirectMessage forwards "@nick message" private messages sent to the listener
+// to the Discord user with that nick.
+func (i *ircListener) onDirectMessage(e *irc.Event) {
+	// Services and other bots send notices, which must never be answered
+	if e.Code == "NOTICE" || i.isPuppetNick(e.Nick) || i.bridge.ircManager.isIgnoredHostmask(e.Source) {
+		return
+	}
+
+	if reply, ok := i.bridge.mappingReply(i.bridge.IsAdminIRC(e.Source), e.Message()); ok {
+		i.Notice(e.Nick, reply)
+		return
+	}
+
+	if reply, ok := i.bridge.listReply(i.bridge.IsAdminIRC(e.Source), e.Message()); ok {
+		i.Notice(e.Nick, reply)
+		return
+	}
+
+	if reply, ok := i.bridge.adminReply(i.bridge.IsAdminIRC(e.Source), e.Message()); ok {
+		i.Notice(e.Nick, reply)
+		return
+	}
+
+	if reply, ok := i.bridge.optOutReply(ircOptOutBucket, i.isupport.Fold(e.Nick), e.Message()); ok {
+		i.Notice(e.Nick, reply)
+		return
+	}
+
+	if reply, ok := i.bridge.puppetWhoisReply(e.Message()); ok {
+		i.Notice(e.Nick, reply)
+		return
+	}
+
+	account := irctags.Account(eventTags(e))
+	if reply, ok := i.bridge.avatarReply(account, e.Nick, e.Message()); ok {
+		i.Notice(e.Nick, reply)
+		return
+	}
+
+	if i.onSearchCommand(e.Nick, "", e.Message()) {
+		return
+	}
+
+	parts := strings.SplitN(e.Message(), " ", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "@") || parts[1] == "" {
+		i.Notice(e.Nick, "To message a Discord user, type: @nick your message here. To find out who a relayed nick is, type: "+
+			puppetWhoisCommand+" nick. To stop being relayed, type: "+optOutCommand+" optout")
+		return
+	}
+
+	discordID, ok := i.bridge.ircManager.discordIDByNick(parts[0][1:])
+	if !ok {
+		i.Notice(e.Nick, fmt.Sprintf("Could not find Discord user %s", parts[0][1:]))
+		return
+	}
+
+	d := i.bridge.discord
+	c, err := d.Session.UserChannelCreate(discordID)
+	if err != nil {
+		listenerLog.WithField("error", err).WithField("discord", discordID).Warnln("Could not create private message room")
+		return
+	}
+
+	msg := i.bridge.pmMessage(e, parts[1])
+	i.bridge.workers.Do(toDiscordWorker(c.ID), func() {
+		i.bridge.sendToDiscord(c.ID, "", "", msg)
+	})
+	i.bridge.pmReplies.Set(discordID, e.Nick)
+}
+
+// discordIDByNick finds the Discord user linked to nick, with a puppet nick,
+// or with a nick or username that looks like nick once sanitised.
+func (m *IRCManager) discordIDByNick(nick string) (string, bool) {
+	if discordID, ok := m.bridge.LinkedDiscordID(nick); ok {
+		return discordID, true
+	}
+
+	if con, ok := m.puppetByNick(nick); ok {
+		return con.discord.ID, true
+	}
+
+	for _, member := range m.bridge.discord.members() {
+		for _, name := range []string{member.Nick, member.User.Username} {
+			if name != "" && m.bridge.IRCEqualFold(sanitiseNickname(name, m.transliterate), nick) {
+				return member.User.ID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// puppetWhoisCommand, sent to the listener, describes the Discord user behind a puppet nick
+const puppetWhoisCommand = "whois"
+
+// puppetWhoisReply runs puppetWhoisCommand, returning a reply for the user.
+// Returns false if message is not this command.
+func (b *Bridge) puppetWhoisReply(message string) (string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], puppetWhoisCommand) {
+		return "", false
+	}
+	if len(fields) != 2 {
+		return "Usage: " + puppetWhoisCommand + " <nick>", true
+	}
+
+	con, ok := b.ircManager.puppetByNick(fields[1])
+	if !ok {
+		return fmt.Sprintf("%s is not relayed from Discord.", fields[1]), true
+	}
+
+	user := con.discord
+	member, _, err := b.discord.member(user.ID)
+	if err != nil {
+		return fmt.Sprintf("%s is the Discord user %s (ID %s).", con.nick, user.Username, user.ID), true
+	}
+
+	displayName := member.Nick
+	if displayName == "" {
+		displayName = user.Username
+	}
+	reply := fmt.Sprintf("%s is the Discord user %s, shown as %s (ID %s)", con.nick, user.Username, displayName, user.ID)
+
+	var roles []string
+	for _, id := range member.Roles {
+		if role, err := b.discord.role(id); err == nil {
+			roles = append(roles, role.Name)
+		}
+	}
+	if len(roles) > 0 {
+		reply += ", with the roles " + strings.Join(roles, ", ")
+	}
+	return reply + ".", true
+}
+
+// puppetByNick finds the puppet using nick
+func (m *IRCManager) puppetByNick(nick string) (*ircConnection, bool) {
+	m.connectionsMu.RLock()
+	defer m.connectionsMu.RUnlock()
+	for puppetNick, con := range m.puppetNicks {
+		if m.bridge.IRCEqualFold(puppetNick, nick) {
+			return con, true
+		}
+	}
+	return nil, false
+}
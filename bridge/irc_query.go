@@ -0,0 +1,216 @@
+package bridge
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// ircQueryTimeout is how long to wait for the server to answer a query like NAMES or WHOIS
+const ircQueryTimeout = 5 * time.Second
+
+// errQueryTimeout is returned when the server doesn't finish answering a query in time
+var errQueryTimeout = errors.New("the IRC server did not answer in time")
+
+// ircQuery is a command sent by the listener whose numeric replies are being collected
+type ircQuery struct {
+	// target is the nick or channel the query is about
+	target string
+	// codes are the replies to collect, and end the replies that finish the answer
+	codes map[string]struct{}
+	end   map[string]struct{}
+
+	replies []*irc.Event
+	done    chan struct{}
+}
+
+// ircQueries lets one query at a time collect its replies from the listener
+type ircQueries struct {
+	// run is held while a query is running, mu while its replies are collected
+	run     sync.Mutex
+	mu      sync.Mutex
+	current *ircQuery
+}
+
+// Query sends command with the listener, and returns the replies with one of codes about target,
+// up to and including the first of end. Queries are run one at a time, as replies
+// don't say which command they are for. It must not be called from a listener callback,
+// as the replies would never be read.
+func (i *ircListener) Query(command, target string, codes, end []string) ([]*irc.Event, error) {
+	if !i.Registered() {
+		return nil, errors.New("the bridge is not connected to IRC")
+	}
+
+	i.queries.run.Lock()
+	defer i.queries.run.Unlock()
+
+	q := &ircQuery{
+		target: target,
+		codes:  make(map[string]struct{}),
+		end:    make(map[string]struct{}),
+		done:   make(chan struct{}),
+	}
+	for _, code := range codes {
+		q.codes[code] = struct{}{}
+	}
+	for _, code := range end {
+		q.codes[code] = struct{}{}
+		q.end[code] = struct{}{}
+	}
+	i.queries.mu.Lock()
+	i.queries.current = q
+	i.queries.mu.Unlock()
+
+	ids := make(map[string]int, len(q.codes))
+	for code := range q.codes {
+		ids[code] = i.AddCallback(code, i.onQueryReply)
+	}
+	defer func() {
+		for code, id := range ids {
+			i.RemoveCallback(code, id)
+		}
+		i.queries.mu.Lock()
+		i.queries.current = nil
+		i.queries.mu.Unlock()
+	}()
+
+	i.SendRaw(command)
+
+	select {
+	case <-q.done:
+	case <-time.After(ircQueryTimeout):
+		return nil, errQueryTimeout
+	}
+
+	i.queries.mu.Lock()
+	defer i.queries.mu.Unlock()
+	return q.replies, nil
+}
+
+// onQueryReply collects a reply for the running query, if it is about the query's target
+func (i *ircListener) onQueryReply(e *irc.Event) {
+	i.queries.mu.Lock()
+	defer i.queries.mu.Unlock()
+
+	q := i.queries.current
+	if q == nil || !i.isQueryReply(q, e) {
+		return
+	}
+	if _, ok := q.codes[e.Code]; !ok {
+		return
+	}
+
+	select {
+	case <-q.done:
+		return // already answered
+	default:
+	}
+
+	q.replies = append(q.replies, e)
+	if _, ok := q.end[e.Code]; ok {
+		close(q.done)
+	}
+}
+
+// isQueryReply returns true if e is about the target of q
+func (i *ircListener) isQueryReply(q *ircQuery, e *irc.Event) bool {
+	if len(e.Arguments) < 2 {
+		return false
+	}
+	for _, arg := range e.Arguments[1:] {
+		if i.isupport.EqualFold(arg, q.target) {
+			return true
+		}
+	}
+	return false
+}
+
+// answeringQuery returns true if e is a reply to the running query, rather than something
+// the listener would otherwise handle, like the end of NAMES after joining a channel
+func (i *ircListener) answeringQuery(e *irc.Event) bool {
+	i.queries.mu.Lock()
+	defer i.queries.mu.Unlock()
+
+	q := i.queries.current
+	if q == nil {
+		return false
+	}
+	_, ok := q.codes[e.Code]
+	return ok && i.isQueryReply(q, e)
+}
+
+// ChannelNames asks the IRC server who is in channel, returning their nicks with
+// their status prefixes (like "@nick")
+func (b *Bridge) ChannelNames(channel string) ([]string, error) {
+	replies, err := b.ircListener.Query("NAMES "+channel, channel, []string{"353"}, []string{"366"})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range replies {
+		if e.Code != "353" || len(e.Arguments) < 4 {
+			continue
+		}
+		for _, name := range strings.Fields(e.Arguments[len(e.Arguments)-1]) {
+			// With userhost-in-names, names are full hostmasks
+			names = append(names, strings.SplitN(name, "!", 2)[0])
+		}
+	}
+	return names, nil
+}
+
+// IRCWhois is the server's answer to WHOIS about a nick
+type IRCWhois struct {
+	Nick     string
+	User     string
+	Host     string
+	RealName string
+	Server   string
+	// Account is who they are logged in as, if anyone
+	Account  string
+	Channels []string
+	Idle     time.Duration
+	Away     string
+	Operator bool
+}
+
+// Whois asks the IRC server about nick. Returns false if there is nobody with that nick.
+func (b *Bridge) Whois(nick string) (*IRCWhois, bool, error) {
+	codes := []string{"301", "311", "312", "313", "317", "319", "330", "401"}
+	// Asking with the nick twice gets the idle time from their own server
+	replies, err := b.ircListener.Query("WHOIS "+nick+" "+nick, nick, codes, []string{"318"})
+	if err != nil {
+		return nil, false, err
+	}
+
+	w := &IRCWhois{Nick: nick}
+	found := false
+	for _, e := range replies {
+		args := e.Arguments
+		switch {
+		case e.Code == "311" && len(args) >= 6:
+			found = true
+			w.Nick, w.User, w.Host, w.RealName = args[1], args[2], args[3], args[5]
+		case e.Code == "312" && len(args) >= 3:
+			w.Server = args[2]
+		case e.Code == "313":
+			w.Operator = true
+		case e.Code == "317" && len(args) >= 3:
+			if seconds, err := strconv.Atoi(args[2]); err == nil {
+				w.Idle = time.Duration(seconds) * time.Second
+			}
+		case e.Code == "319" && len(args) >= 3:
+			w.Channels = append(w.Channels, strings.Fields(args[2])...)
+		case e.Code == "330" && len(args) >= 3:
+			w.Account = args[2]
+		case e.Code == "301" && len(args) >= 3:
+			w.Away = args[2]
+		}
+	}
+	return w, found, nil
+}
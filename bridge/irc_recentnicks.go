@@ -0,0 +1,43 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+)
+
+// recentNickTTL is how long a nick is remembered after a puppet stops using it
+const recentNickTTL = time.Minute
+
+// recentNicks remembers nicks that puppets stopped using recently, so that their
+// QUITs and late echoes of lines they sent aren't relayed back to Discord.
+type recentNicks struct {
+	sync.Mutex
+	expiry map[string]time.Time // folded nick to when it is forgotten
+	fold   func(string) string
+}
+
+func newRecentNicks(fold func(string) string) *recentNicks {
+	return &recentNicks{expiry: make(map[string]time.Time), fold: fold}
+}
+
+// Add remembers a nick a puppet has just stopped using
+func (r *recentNicks) Add(nick string) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	for n, expiry := range r.expiry {
+		if now.After(expiry) {
+			delete(r.expiry, n)
+		}
+	}
+	r.expiry[r.fold(nick)] = now.Add(recentNickTTL)
+}
+
+// Has returns true if a puppet used nick recently
+func (r *recentNicks) Has(nick string) bool {
+	r.Lock()
+	defer r.Unlock()
+	expiry, ok := r.expiry[r.fold(nick)]
+	return ok && time.Now().Before(expiry)
+}
@@ -0,0 +1,134 @@
+package bridge
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// ircReconnectMin and ircReconnectMax bound the wait between attempts to connect the listener
+	ircReconnectMin = 5 * time.Second
+	ircReconnectMax = 5 * time.Minute
+
+	// ircOutageCheckInterval is how often the listener is checked for being disconnected
+	ircOutageCheckInterval = 10 * time.Second
+
+	// ircRestartPuppetDelay is how long restartIRC waits before reconnecting puppets
+	ircRestartPuppetDelay = 5 * time.Second
+)
+
+// ircReconnectDelay returns how long to wait before the given attempt to connect,
+// doubling each time with some jitter, so a network outage doesn't make every
+// bridge reconnect at once.
+func ircReconnectDelay(attempt int) time.Duration {
+	delay := ircReconnectMax
+	if attempt < 16 {
+		if d := ircReconnectMin << uint(attempt); d < ircReconnectMax {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)/2))
+}
+
+// connectIRC connects the listener, trying again until it works or the bridge is closed.
+// Once connected, the listener's loop reconnects it if the connection drops,
+// and OnWelcome sends the prejoin commands and rejoins channels.
+func (b *Bridge) connectIRC() {
+	for attempt := 0; ; attempt++ {
+		err := b.ircListener.Connect(b.Config().IRCServer)
+		if err == nil {
+			go b.ircListener.Loop()
+			return
+		}
+
+		delay := ircReconnectDelay(attempt)
+		listenerLog.WithError(err).WithField("delay", delay).Errorln("could not connect to IRC, trying again")
+
+		select {
+		case <-time.After(delay):
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// watchIRCOutage tells mapped Discord channels when IRC has been disconnected
+// for longer than IRCDownNotice, and again when it's back.
+func (b *Bridge) watchIRCOutage() {
+	ticker := time.NewTicker(ircOutageCheckInterval)
+	defer ticker.Stop()
+
+	var downSince time.Time
+	noticed := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+
+		if b.ircListener.Registered() {
+			if noticed {
+				b.noticeIRCOutage(fmt.Sprintf("_IRC is back, after being disconnected for %s._", time.Since(downSince).Round(time.Second)))
+			}
+			downSince = time.Time{}
+			noticed = false
+			continue
+		}
+
+		if downSince.IsZero() {
+			downSince = time.Now()
+		}
+		if !noticed && b.Config().IRCDownNotice > 0 && time.Since(downSince) >= b.Config().IRCDownNotice {
+			noticed = true
+			b.noticeIRCOutage(fmt.Sprintf("_IRC has been disconnected since <t:%d:t>. Messages sent here won't reach IRC until it's back._", downSince.Unix()))
+		}
+	}
+}
+
+// noticeIRCOutage posts a message to every mapped Discord channel
+func (b *Bridge) noticeIRCOutage(message string) {
+	for _, mapping := range b.mappingTable().mappings {
+		// Only people who can talk to IRC need to know
+		if !mapping.RelaysToIRC() {
+			continue
+		}
+
+		channel := mapping.DiscordChannel
+		b.workers.Do(toDiscordWorker(mapping.IRCChannel), func() {
+			b.sendToDiscord(channel, "", "", message)
+		})
+	}
+}
+
+// restartIRC reconnects the listener and every puppet using the current config, so changes to
+// the server, passwords or puppet accounts are applied without touching the Discord session.
+// Puppets come back once the listener has had time to reconnect.
+func (b *Bridge) restartIRC() {
+	listenerLog.WithField("server", b.Config().IRCServer).Infoln("Restarting IRC connections")
+
+	var users []DiscordUser
+	for _, con := range b.ircManager.connections() {
+		users = append(users, con.discord)
+		con.quitMessage = "Reconnecting"
+		b.ircManager.CloseConnection(con)
+	}
+
+	if err := b.ircManager.setupVarys(); err != nil {
+		puppeteerLog.WithError(err).Errorln("could not apply IRC settings to puppets")
+	}
+
+	b.applyIRCServerConfig(b.ircListener.Connection, "discord.", "fd75:f5f5:226f::")
+	b.ircListener.Server = b.Config().IRCServer
+	if err := b.ircListener.Reconnect(); err != nil {
+		listenerLog.WithError(err).Errorln("could not reconnect to IRC, trying again")
+		go b.connectIRC()
+	}
+
+	time.AfterFunc(ircRestartPuppetDelay, func() {
+		for _, user := range users {
+			b.updateUserChan <- user
+		}
+	})
+}
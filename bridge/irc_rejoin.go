@@ -0,0 +1,184 @@
+package bridge
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	irc "github.com/qaisjp/go-ircevent"
+	log "github.com/sirupsen/logrus"
+)
+
+// After being kicked, a connection waits rejoinBaseDelay before rejoining, doubling for each
+// kick from the same channel in a row, up to rejoinMaxDelay. Kicks further apart than
+// rejoinResetAfter start again from rejoinBaseDelay.
+const (
+	rejoinBaseDelay  = 2 * time.Second
+	rejoinMaxDelay   = 5 * time.Minute
+	rejoinResetAfter = 15 * time.Minute
+)
+
+// joinFailedCodes are the replies to JOIN saying the channel can't be joined:
+// it is full, invite only, we are banned, or the key is wrong
+var joinFailedCodes = []string{"471", "473", "474", "475"}
+
+// rejoinBackoff rejoins the channels a connection is kicked from, waiting longer the more
+// often it is kicked, so that a kick/rejoin loop doesn't get the connection banned.
+// It asks for invites to invite only channels, and stops trying to join channels that
+// refuse to let it in.
+type rejoinBackoff struct {
+	mu      sync.Mutex
+	kicks   map[string]*rejoinKicks    // by folded channel
+	invites map[string]*inviteAttempts // by folded channel
+	locked  map[string]struct{}        // folded channels refusing to let us in
+
+	log  *log.Entry
+	fold func(string) string
+	nick func() string
+	join func(channel string)
+	// invite asks for an invite to a channel, see inviteRequester
+	invite func(channel string) bool
+	// lockedOut is told about channels refusing to let us in, the first time they do
+	lockedOut func(channel, reason string)
+}
+
+type rejoinKicks struct {
+	count int
+	last  time.Time
+	timer *time.Timer
+}
+
+func newRejoinBackoff(log *log.Entry, fold func(string) string, nick func() string, join func(channel string)) *rejoinBackoff {
+	return &rejoinBackoff{
+		kicks:   make(map[string]*rejoinKicks),
+		invites: make(map[string]*inviteAttempts),
+		locked:  make(map[string]struct{}),
+		log:     log,
+		fold:    fold,
+		nick:    nick,
+		join:    join,
+	}
+}
+
+// rejoinDelay returns how long to wait before rejoining after kicks kicks in a row
+func rejoinDelay(kicks int) time.Duration {
+	delay := rejoinBaseDelay
+	for i := 1; i < kicks && delay < rejoinMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > rejoinMaxDelay {
+		delay = rejoinMaxDelay
+	}
+	return delay
+}
+
+// OnKick rejoins the channel after rejoinDelay, if we were the one kicked
+func (r *rejoinBackoff) OnKick(e *irc.Event) {
+	if len(e.Arguments) < 2 || r.fold(e.Arguments[1]) != r.fold(r.nick()) {
+		return
+	}
+	channel := e.Arguments[0]
+	key := r.fold(channel)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kicks, ok := r.kicks[key]
+	if !ok || time.Since(kicks.last) > rejoinResetAfter {
+		kicks = &rejoinKicks{}
+		r.kicks[key] = kicks
+	}
+	if kicks.timer != nil {
+		kicks.timer.Stop()
+	}
+	kicks.count++
+	kicks.last = time.Now()
+
+	delay := rejoinDelay(kicks.count)
+	r.log.WithField("channel", channel).WithField("nick", e.Arguments[1]).WithField("by", e.Nick).
+		Infof("Kicked from IRC channel, rejoining in %s", delay)
+	kicks.timer = time.AfterFunc(delay, func() {
+		r.join(channel)
+	})
+}
+
+// OnJoinFailed gives up on joining a channel that refuses to let us in,
+// unless it is invite only and we can ask for an invite
+func (r *rejoinBackoff) OnJoinFailed(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+	channel := e.Arguments[1]
+	key := r.fold(channel)
+
+	r.mu.Lock()
+	if e.Code == "473" && r.requestInvite(channel, key) {
+		r.mu.Unlock()
+		return
+	}
+	if kicks, ok := r.kicks[key]; ok && kicks.timer != nil {
+		kicks.timer.Stop()
+		kicks.timer = nil
+	}
+	_, noticed := r.locked[key]
+	r.locked[key] = struct{}{}
+	r.mu.Unlock()
+
+	r.log.WithField("channel", channel).WithField("nick", r.nick()).WithField("reason", e.Message()).
+		Warnln("Could not join IRC channel")
+	if !noticed && r.lockedOut != nil {
+		r.lockedOut(channel, e.Message())
+	}
+}
+
+// OnJoin forgets that a channel refused to let us in, once we have joined it
+func (r *rejoinBackoff) OnJoin(e *irc.Event) {
+	if len(e.Arguments) < 1 || r.fold(e.Nick) != r.fold(r.nick()) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.locked, r.fold(e.Arguments[0]))
+	delete(r.invites, r.fold(e.Arguments[0]))
+}
+
+// Stop cancels any rejoins that are waiting
+func (r *rejoinBackoff) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, kicks := range r.kicks {
+		if kicks.timer != nil {
+			kicks.timer.Stop()
+			kicks.timer = nil
+		}
+	}
+}
+
+// rejoinMapped returns a function that joins an IRC channel with send, if it is still mapped
+func (b *Bridge) rejoinMapped(send func(string)) func(channel string) {
+	return func(channel string) {
+		if mapping, ok := b.GetMappingByIRC(channel); ok {
+			send(b.GetJoinCommand([]Mapping{mapping}))
+		}
+	}
+}
+
+// noticeLockedOut tells the Discord channels mapped to an IRC channel, and Config.ModChannel,
+// that the listener can't join it
+func (b *Bridge) noticeLockedOut(channel, reason string) {
+	message := fmt.Sprintf("_The bridge can't join IRC channel %s (%s), so messages aren't being relayed._", channel, reason)
+	if modChannel := b.Config().ModChannel; modChannel != "" {
+		go b.sendToDiscord(modChannel, "", "", message)
+	}
+	for _, mapping := range b.mappingTable().mappings {
+		if !b.IRCEqualFold(mapping.IRCChannel, channel) {
+			continue
+		}
+
+		discordChannel := mapping.DiscordChannel
+		b.workers.Do(toDiscordWorker(mapping.IRCChannel), func() {
+			b.sendToDiscord(discordChannel, "", "", message)
+		})
+	}
+}
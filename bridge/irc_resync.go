@@ -0,0 +1,128 @@
+package bridge
+
+import "time"
+
+// resyncRecheckInterval is how often watchResync checks whether resyncing has been turned on
+const resyncRecheckInterval = time.Minute
+
+// watchResync checks who is in the mapped IRC channels every Config.ResyncInterval, while it is set
+func (b *Bridge) watchResync() {
+	for {
+		interval := b.Config().ResyncInterval
+		if interval <= 0 {
+			interval = resyncRecheckInterval
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-b.stop:
+			return
+		}
+
+		if b.Config().ResyncInterval > 0 {
+			b.resync()
+		}
+	}
+}
+
+// resync asks the IRC server with WHO who is in each mapped channel, as a netsplit, or being
+// removed from a channel by an IRC operator, can leave the listener's idea of who is where stale.
+// The listener rejoins channels it is no longer in, and asks for NAMES where the nick tracker
+// is missing someone. The loop then rejoins puppets that are missing from their channels.
+func (b *Bridge) resync() {
+	if !b.ircListener.Registered() {
+		return
+	}
+
+	members := make(map[string]map[string]struct{})
+	for _, mapping := range b.mappingTable().mappings {
+		if _, ok := members[mapping.IRCChannel]; ok {
+			continue
+		}
+
+		nicks, err := b.channelWho(mapping.IRCChannel)
+		if err != nil {
+			listenerLog.WithField("error", err).WithField("channel", mapping.IRCChannel).Warnln("could not check who is in channel")
+			continue
+		}
+		members[mapping.IRCChannel] = nicks
+
+		if _, ok := nicks[b.ircListener.isupport.Fold(b.ircListener.GetNick())]; !ok {
+			listenerLog.WithField("channel", mapping.IRCChannel).Warnln("Listener is no longer in IRC channel, rejoining")
+			b.ircListener.SendRaw(b.GetJoinCommand([]Mapping{mapping}))
+			continue
+		}
+
+		if b.ircListener.trackerMissing(mapping.IRCChannel, nicks) {
+			listenerLog.WithField("channel", mapping.IRCChannel).Infoln("Nick tracker is out of date, refreshing it with NAMES")
+			// The nick tracker sees the replies too
+			if _, err := b.ChannelNames(mapping.IRCChannel); err != nil {
+				listenerLog.WithField("error", err).WithField("channel", mapping.IRCChannel).Warnln("could not refresh nick tracker")
+			}
+		}
+	}
+
+	select {
+	case b.resyncChan <- members:
+	case <-b.stop:
+	}
+}
+
+// channelWho asks the IRC server who is in channel with WHO, returning their folded nicks
+func (b *Bridge) channelWho(channel string) (map[string]struct{}, error) {
+	replies, err := b.ircListener.Query("WHO "+channel, channel, []string{"352"}, []string{"315"})
+	if err != nil {
+		return nil, err
+	}
+
+	nicks := make(map[string]struct{})
+	for _, e := range replies {
+		// <client> <channel> <user> <host> <server> <nick> <flags> :<hopcount> <realname>
+		if e.Code == "352" && len(e.Arguments) >= 6 {
+			nicks[b.ircListener.isupport.Fold(e.Arguments[5])] = struct{}{}
+		}
+	}
+	return nicks, nil
+}
+
+// trackerMissing returns true if the nick tracker doesn't know about channel,
+// or about someone WHO says is in it
+func (i *ircListener) trackerMissing(channel string, nicks map[string]struct{}) bool {
+	ch, ok := i.GetChannel(channel)
+	if !ok {
+		return true
+	}
+	for nick := range nicks {
+		if _, ok := ch.GetUser(nick); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rejoinMissing makes puppets rejoin the channels they should be in that members,
+// from resync, says they aren't in
+func (m *IRCManager) rejoinMissing(members map[string]map[string]struct{}) {
+	for _, con := range m.connections() {
+		if !con.Connected() {
+			continue
+		}
+
+		nick := m.bridge.ircListener.isupport.Fold(con.GetNick())
+		var missing []Mapping
+		for _, mapping := range con.joinMappings() {
+			nicks, ok := members[mapping.IRCChannel]
+			if !ok {
+				continue
+			}
+			if _, ok := nicks[nick]; !ok {
+				missing = append(missing, mapping)
+			}
+		}
+
+		if len(missing) > 0 {
+			puppeteerLog.WithField("nick", nick).WithField("channels", len(missing)).Infoln("Puppet is missing from IRC channels, rejoining")
+			con.SendRaw(m.bridge.GetJoinCommand(missing))
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package bridge
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Store buckets for linked identities
+const (
+	linkDiscordBucket = "links_discord" // Discord user ID to IRC nick
+	linkIRCBucket     = "links_irc"     // folded IRC nick to Discord user ID
+)
+
+// linkCommand links a Discord user to an IRC nick, from Discord DMs
+const linkCommand = "!link"
+
+// linkCodeExpiry is how long a Discord user has to confirm a link
+const linkCodeExpiry = 10 * time.Minute
+
+// linkRequestInterval is how often a Discord user can have a code sent to IRC,
+// so that the bridge can't be used to flood someone
+const linkRequestInterval = time.Minute
+
+type pendingLink struct {
+	nick    string
+	code    string
+	expires time.Time
+}
+
+// linker verifies that a Discord user owns an IRC nick by sending the nick a code,
+// which the Discord user then has to give back to the bridge.
+type linker struct {
+	sync.Mutex
+	pending map[string]pendingLink // Discord user ID to pending link
+	// requested is when each Discord user last had a code sent, see linkRequestInterval
+	requested map[string]time.Time
+}
+
+func newLinker() *linker {
+	return &linker{
+		pending:   make(map[string]pendingLink),
+		requested: make(map[string]time.Time),
+	}
+}
+
+// LinkedNick returns the IRC nick linked to a Discord user
+func (b *Bridge) LinkedNick(discordID string) (string, bool) {
+	return b.store.Get(linkDiscordBucket, discordID)
+}
+
+// LinkedDiscordID returns the Discord user linked to an IRC nick
+func (b *Bridge) LinkedDiscordID(nick string) (string, bool) {
+	return b.store.Get(linkIRCBucket, b.ircListener.isupport.Fold(nick))
+}
+
+func (b *Bridge) link(discordID string, nick string) error {
+	if err := b.unlink(discordID); err != nil {
+		return err
+	}
+	if err := b.store.Set(linkDiscordBucket, discordID, nick); err != nil {
+		return err
+	}
+	return b.store.Set(linkIRCBucket, b.ircListener.isupport.Fold(nick), discordID)
+}
+
+func (b *Bridge) unlink(discordID string) error {
+	nick, ok := b.LinkedNick(discordID)
+	if !ok {
+		return nil
+	}
+	if err := b.store.Delete(linkIRCBucket, b.ircListener.isupport.Fold(nick)); err != nil {
+		return err
+	}
+	return b.store.Delete(linkDiscordBucket, discordID)
+}
+
+// linkReply runs a linkCommand for a Discord user, returning a reply for them.
+// Returns false if message is not a linkCommand.
+func (b *Bridge) linkReply(discordID string, message string) (string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) == 0 || fields[0] != linkCommand {
+		return "", false
+	}
+
+	usage := fmt.Sprintf("Usage: `%s <irc nick>`, `%s confirm <code>` or `%s remove`", linkCommand, linkCommand, linkCommand)
+	if len(fields) < 2 {
+		if nick, ok := b.LinkedNick(discordID); ok {
+			return fmt.Sprintf("You are linked to %s@%s. %s", nick, b.Config().Discriminator, usage), true
+		}
+		return usage, true
+	}
+
+	switch fields[1] {
+	case "remove":
+		if err := b.unlink(discordID); err != nil {
+			discordLog.WithField("error", err).WithField("discord", discordID).Errorln("could not remove link")
+			return "Sorry, your link could not be removed.", true
+		}
+		return "You are no longer linked to an IRC nick.", true
+
+	case "confirm":
+		if len(fields) < 3 {
+			return usage, true
+		}
+
+		b.linker.Lock()
+		pending, ok := b.linker.pending[discordID]
+		if ok && time.Now().Before(pending.expires) && pending.code == fields[2] {
+			delete(b.linker.pending, discordID)
+		} else {
+			ok = false
+		}
+		b.linker.Unlock()
+
+		if !ok {
+			return "That code is wrong or has expired.", true
+		}
+
+		if other, taken := b.LinkedDiscordID(pending.nick); taken && other != discordID {
+			return fmt.Sprintf("%s is already linked to someone else.", pending.nick), true
+		}
+
+		if err := b.link(discordID, pending.nick); err != nil {
+			discordLog.WithField("error", err).WithField("discord", discordID).Errorln("could not save link")
+			return "Sorry, your link could not be saved.", true
+		}
+		return fmt.Sprintf("You are now linked to %s@%s.", pending.nick, b.Config().Discriminator), true
+	}
+
+	nick := fields[1]
+	if b.ircListener.isupport.IsChannel(nick) || strings.Contains(nick, ",") {
+		return "That isn't an IRC nick.", true
+	}
+	if b.ircListener.isPuppetNick(nick) {
+		return "You can't link to a Discord user's nick.", true
+	}
+
+	code, err := linkCode()
+	if err != nil {
+		discordLog.WithField("error", err).Errorln("could not generate link code")
+		return "Sorry, a code could not be generated.", true
+	}
+
+	b.linker.Lock()
+	now := time.Now()
+	if wait := b.linker.requested[discordID].Add(linkRequestInterval).Sub(now); wait > 0 {
+		b.linker.Unlock()
+		return fmt.Sprintf("Please wait %s before asking for another code.", wait.Round(time.Second)), true
+	}
+	for id, at := range b.linker.requested {
+		if now.Sub(at) >= linkRequestInterval {
+			delete(b.linker.requested, id)
+		}
+	}
+	b.linker.requested[discordID] = now
+	b.linker.pending[discordID] = pendingLink{nick: nick, code: code, expires: now.Add(linkCodeExpiry)}
+	b.linker.Unlock()
+
+	b.ircListener.Privmsg(nick, fmt.Sprintf(
+		"Someone on Discord wants to link their account to your nick. If that's you, send me this in Discord: %s confirm %s",
+		linkCommand, code))
+
+	return fmt.Sprintf("I've sent a code to %s on IRC. Reply here with `%s confirm <code>` within %s.", nick, linkCommand, linkCodeExpiry), true
+}
+
+// linkCode returns a random six digit code
+func linkCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// handleLinkCommand handles linkCommand in Discord DMs, returning true if it was one
+func (d *discordBot) handleLinkCommand(m *discordgo.Message) bool {
+	reply, ok := d.bridge.linkReply(m.Author.ID, m.Content)
+	if !ok {
+		return false
+	}
+
+	if _, err := d.Session.ChannelMessageSend(m.ChannelID, reply); err != nil {
+		discordLog.WithField("error", err).Warnln("could not reply to link command")
+	}
+	return true
+}
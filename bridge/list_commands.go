@@ -0,0 +1,240 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gobwas/glob"
+	"github.com/qaisjp/go-discord-irc/pattern"
+)
+
+// Store buckets for ignores and filters added by admins, on top of those in the config.
+// Ignored hostmasks are keys with blank values, message filters map patterns to their action.
+const (
+	ignoresBucket = "ignored_irc_hostmasks"
+	filtersBucket = "message_filters"
+)
+
+// storedLists are the compiled ignores and filters from the store
+type storedLists struct {
+	sync.RWMutex
+	ignores []glob.Glob
+	// filters apply to messages in both directions
+	filters []MessageFilter
+}
+
+// loadStoredLists compiles the stored ignores and filters, skipping any that no longer compile
+func (b *Bridge) loadStoredLists() {
+	var ignores []glob.Glob
+	for _, mask := range b.store.Keys(ignoresBucket) {
+		if g, err := pattern.Compile(mask); err == nil {
+			ignores = append(ignores, g)
+		}
+	}
+
+	var filters []MessageFilter
+	for _, p := range b.store.Keys(filtersBucket) {
+		action, _ := b.store.Get(filtersBucket, p)
+		if g, err := pattern.Compile(p); err == nil {
+			filters = append(filters, MessageFilter{Glob: g, Action: action})
+		}
+	}
+
+	b.lists.Lock()
+	b.lists.ignores, b.lists.filters = ignores, filters
+	b.lists.Unlock()
+}
+
+// ircIgnores returns the IRC hostmasks to not relay, from the config and the store
+func (b *Bridge) ircIgnores() []glob.Glob {
+	b.lists.RLock()
+	defer b.lists.RUnlock()
+	return append(append([]glob.Glob{}, b.Config().IRCIgnores...), b.lists.ignores...)
+}
+
+// ircFilters and discordFilters return the message filters for each side, from the config and the store
+func (b *Bridge) ircFilters() []MessageFilter {
+	b.lists.RLock()
+	defer b.lists.RUnlock()
+	return append(append([]MessageFilter{}, b.Config().IRCFilteredMessages...), b.lists.filters...)
+}
+
+func (b *Bridge) discordFilters() []MessageFilter {
+	b.lists.RLock()
+	defer b.lists.RUnlock()
+	return append(append([]MessageFilter{}, b.Config().DiscordFilteredMessages...), b.lists.filters...)
+}
+
+// AddIgnore stops relaying IRC users matching mask, and saves it
+func (b *Bridge) AddIgnore(mask string) error {
+	if _, err := pattern.Compile(mask); err != nil {
+		return err
+	}
+	return b.changeList(ignoresBucket, mask, "", true)
+}
+
+// RemoveIgnore undoes AddIgnore. Ignores in the config can't be removed.
+func (b *Bridge) RemoveIgnore(mask string) error {
+	return b.changeList(ignoresBucket, mask, "", false)
+}
+
+// AddFilter adds a message filter for both directions, with an action like FilterActionRedact
+// (FilterActionDrop if empty), and saves it
+func (b *Bridge) AddFilter(p, action string) error {
+	if action != "" && action != FilterActionDrop && action != FilterActionRedact && action != FilterActionFlag {
+		return fmt.Errorf("the action must be %s, %s or %s", FilterActionDrop, FilterActionRedact, FilterActionFlag)
+	}
+	if _, err := pattern.Compile(p); err != nil {
+		return err
+	}
+	return b.changeList(filtersBucket, p, action, true)
+}
+
+// RemoveFilter undoes AddFilter. Filters in the config can't be removed.
+func (b *Bridge) RemoveFilter(p string) error {
+	return b.changeList(filtersBucket, p, "", false)
+}
+
+// changeList adds or removes a stored ignore or filter, and recompiles them
+func (b *Bridge) changeList(bucket, key, value string, add bool) error {
+	var err error
+	if add {
+		err = b.store.Set(bucket, key, value)
+	} else if !b.store.Has(bucket, key) {
+		return fmt.Errorf("%s was not added with %s", key, optOutCommand)
+	} else {
+		err = b.store.Delete(bucket, key)
+	}
+	b.loadStoredLists()
+
+	if err != nil {
+		listenerLog.WithField("error", err).WithField("bucket", bucket).Errorln("could not save ignore or filter")
+		return ErrListNotSaved
+	}
+	return nil
+}
+
+// ErrListNotSaved is returned when an ignore or filter was changed, but will be lost on restart
+var ErrListNotSaved = errors.New("ignore or filter was changed, but could not be saved")
+
+// listReply runs "!bridge ignore" or "!bridge filter", returning a reply for the user.
+// Returns false if message is not one of these commands.
+func (b *Bridge) listReply(admin bool, message string) (string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) < 2 || fields[0] != optOutCommand || (fields[1] != "ignore" && fields[1] != "filter") {
+		return "", false
+	}
+
+	if !admin {
+		return "Only bridge admins can change ignores and filters.", true
+	}
+
+	usage := fmt.Sprintf("Usage: %s ignore add|remove <hostmask>, %s ignore list, "+
+		"%s filter add [%s|%s|%s] <pattern>, %s filter remove <pattern>, or %s filter list",
+		optOutCommand, optOutCommand, optOutCommand, FilterActionDrop, FilterActionRedact, FilterActionFlag,
+		optOutCommand, optOutCommand)
+	if len(fields) < 3 {
+		return usage, true
+	}
+
+	if fields[2] == "list" {
+		if fields[1] == "ignore" {
+			return listKeys("Ignored hostmasks", b.store.Keys(ignoresBucket)), true
+		}
+		var filters []string
+		for _, p := range b.store.Keys(filtersBucket) {
+			if action, _ := b.store.Get(filtersBucket, p); action != "" {
+				p += " (" + action + ")"
+			}
+			filters = append(filters, p)
+		}
+		return listKeys("Message filters", filters), true
+	}
+	if fields[2] != "add" && fields[2] != "remove" {
+		return usage, true
+	}
+
+	// Patterns can have spaces in them
+	args := fields[3:]
+	var action string
+	if fields[1] == "filter" && fields[2] == "add" && len(args) > 1 &&
+		(args[0] == FilterActionDrop || args[0] == FilterActionRedact || args[0] == FilterActionFlag) {
+		action, args = args[0], args[1:]
+	}
+	arg := strings.Join(args, " ")
+	if arg == "" {
+		return usage, true
+	}
+
+	var err error
+	var reply string
+	switch fields[1] + " " + fields[2] {
+	case "ignore add":
+		err = b.AddIgnore(arg)
+		reply = fmt.Sprintf("%s is now ignored.", arg)
+	case "ignore remove":
+		err = b.RemoveIgnore(arg)
+		reply = fmt.Sprintf("%s is no longer ignored.", arg)
+	case "filter add":
+		err = b.AddFilter(arg, action)
+		reply = fmt.Sprintf("Added the filter %s.", arg)
+	case "filter remove":
+		err = b.RemoveFilter(arg)
+		reply = fmt.Sprintf("Removed the filter %s.", arg)
+	}
+
+	if err == ErrListNotSaved {
+		return "The change was made, but could not be saved, so it will be lost on restart.", true
+	} else if err != nil {
+		return fmt.Sprintf("Could not change that: %s.", err), true
+	}
+	return reply, true
+}
+
+// listKeys describes the ignores or filters added by admins, on one line
+func listKeys(what string, keys []string) string {
+	if len(keys) == 0 {
+		return what + " added with " + optOutCommand + ": none."
+	}
+	sort.Strings(keys)
+	return what + " added with " + optOutCommand + ": " + strings.Join(keys, ", ")
+}
+
+// isAdmin returns true if the author of a message is a bridge admin, by ID or role
+func (d *discordBot) isAdmin(m *discordgo.Message) bool {
+	if d.bridge.IsAdminDiscord(m.Author.ID) {
+		return true
+	}
+	if len(d.bridge.Config().AdminDiscordRoles) == 0 {
+		return false
+	}
+	if m.GuildID == "" {
+		// In DMs, an admin role in any bridged guild counts
+		for _, guildID := range d.guildIDs {
+			member, err := d.Session.State.Member(guildID, m.Author.ID)
+			if err == nil && hasAnyRole(member, d.bridge.Config().AdminDiscordRoles) {
+				return true
+			}
+		}
+		return false
+	}
+	member, ok := d.messageMember(m)
+	return ok && hasAnyRole(member, d.bridge.Config().AdminDiscordRoles)
+}
+
+// handleListCommand handles "!bridge ignore" and "!bridge filter" in Discord DMs, returning true if it was one
+func (d *discordBot) handleListCommand(m *discordgo.Message) bool {
+	reply, ok := d.bridge.listReply(d.isAdmin(m), m.Content)
+	if !ok {
+		return false
+	}
+
+	if _, err := d.Session.ChannelMessageSend(m.ChannelID, reply); err != nil {
+		discordLog.WithField("error", err).Warnln("could not reply to ignore or filter command")
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/qaisjp/go-discord-irc/chanlog"
+)
+
+// searchCommand searches the logs of an IRC channel, when sent in it or in a private message
+// to the listener (as "!search #channel query"). It isn't relayed to Discord.
+const searchCommand = "!search"
+
+// searchMaxResults is how many matches a search returns
+const searchMaxResults = 5
+
+// searchLogs returns lines of the IRC channel's logs in Config.LogDir containing every word of query,
+// as described by chanlog.Search
+func (b *Bridge) searchLogs(channel, query string) ([]chanlog.Match, error) {
+	if !b.logsChannel(channel) {
+		return nil, fmt.Errorf("%s is not logged", channel)
+	}
+	return chanlog.Search(b.Config().LogDir, channel, query, searchMaxResults)
+}
+
+// searchReply searches the logs of channel, and describes each match on its own line
+func (b *Bridge) searchReply(channel, query string) []string {
+	if strings.TrimSpace(query) == "" {
+		return []string{"Usage: " + searchCommand + " <words>"}
+	}
+
+	matches, err := b.searchLogs(channel, query)
+	if err != nil {
+		return []string{fmt.Sprintf("Could not search %s: %s.", channel, err)}
+	}
+	if len(matches) == 0 {
+		return []string{fmt.Sprintf("Nothing in %s matches %q.", channel, query)}
+	}
+
+	lines := make([]string, len(matches))
+	for i, m := range matches {
+		lines[i] = m.Time.Format("[2006-01-02 15:04:05] ") + m.Line
+	}
+	return lines
+}
+
+// onSearchCommand answers searchCommand with notices, from channel or a private message if channel
+// is empty. Returns false if message is not this command.
+func (i *ircListener) onSearchCommand(nick, channel, message string) bool {
+	fields := strings.SplitN(message, " ", 2)
+	if fields[0] != searchCommand {
+		return false
+	}
+
+	query := ""
+	if len(fields) > 1 {
+		query = fields[1]
+	}
+	if channel == "" {
+		args := strings.SplitN(strings.TrimSpace(query), " ", 2)
+		if len(args) < 2 || !i.isupport.IsChannel(args[0]) {
+			i.Notice(nick, "Usage: "+searchCommand+" <#channel> <words>")
+			return true
+		}
+		channel, query = args[0], args[1]
+
+		// Only people in a channel can search it
+		ch, ok := i.GetChannel(channel)
+		if ok {
+			_, ok = ch.GetUser(nick)
+		}
+		if !ok {
+			i.Notice(nick, fmt.Sprintf("You need to be in %s to search it.", channel))
+			return true
+		}
+	}
+
+	// Reading the logs shouldn't hold up other IRC events
+	go func() {
+		for _, line := range i.bridge.searchReply(channel, query) {
+			i.Notice(nick, line)
+		}
+	}()
+	return true
+}
@@ -0,0 +1,10 @@
+package bridge
+
+import "github.com/qaisjp/go-discord-irc/logging"
+
+// Loggers for each subsystem, so that their levels can be set separately
+var (
+	discordLog   = logging.For(logging.Discord)
+	listenerLog  = logging.For(logging.IRCListener)
+	puppeteerLog = logging.For(logging.Puppeteer)
+)
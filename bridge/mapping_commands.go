@@ -0,0 +1,188 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// mappingsBucket is the store bucket for channel mappings changed by admins,
+// from IRC channel to Discord channel, or blank if the channel was unmapped.
+// These take precedence over channel_mappings in the config.
+const mappingsBucket = "channel_mappings"
+
+// storedMappings returns the channel mappings changed by admins
+func (b *Bridge) storedMappings() map[string]string {
+	stored := make(map[string]string)
+	for _, channel := range b.store.Keys(mappingsBucket) {
+		stored[channel], _ = b.store.Get(mappingsBucket, channel)
+	}
+	return stored
+}
+
+// withStoredMappings returns the config mappings, with the stored mappings applied on top
+func (b *Bridge) withStoredMappings(config map[string]string, stored map[string]string) map[string]string {
+	mappings := make(map[string]string, len(config)+len(stored))
+	for irc, discord := range config {
+		overridden := false
+		for channel := range stored {
+			if fields := strings.Fields(irc); len(fields) > 0 && b.IRCEqualFold(fields[0], channel) {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			mappings[irc] = discord
+		}
+	}
+
+	for channel, discord := range stored {
+		if discord != "" {
+			mappings[channel] = discord
+		}
+	}
+	return mappings
+}
+
+// IsAdminDiscord returns true if a Discord user can change the bridge's settings
+func (b *Bridge) IsAdminDiscord(userID string) bool {
+	_, ok := b.Config().AdminDiscordIDs[userID]
+	return ok
+}
+
+// IsAdminIRC returns true if an IRC hostmask can change the bridge's settings
+func (b *Bridge) IsAdminIRC(mask string) bool {
+	for _, admin := range b.Config().AdminIRCHostmasks {
+		if admin.Match(mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// mappingReply runs "!bridge map" or "!bridge unmap", returning a reply for the user.
+// Returns false if message is not one of these commands.
+func (b *Bridge) mappingReply(admin bool, message string) (string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) < 2 || fields[0] != optOutCommand || (fields[1] != "map" && fields[1] != "unmap") {
+		return "", false
+	}
+
+	if !admin {
+		return "Only bridge admins can change channel mappings.", true
+	}
+
+	switch {
+	case fields[1] == "map" && (len(fields) == 4 || len(fields) == 5):
+		var direction string
+		if len(fields) == 5 {
+			direction = fields[4]
+		}
+		discordChannel, err := b.MapChannel(fields[2], fields[3], direction)
+		if err != nil {
+			return mappingErrorReply(err), true
+		}
+		return fmt.Sprintf("%s is now bridged to <#%s>.", fields[2], discordChannel), true
+	case fields[1] == "unmap" && len(fields) == 3:
+		if err := b.UnmapChannel(fields[2]); err != nil {
+			return mappingErrorReply(err), true
+		}
+		return fmt.Sprintf("%s is no longer bridged.", fields[2]), true
+	default:
+		return fmt.Sprintf("Usage: %s map <#irc channel> <#discord channel> [%s|%s], or %s unmap <#irc channel>",
+			optOutCommand, DirectionIRCToDiscord, DirectionDiscordToIRC, optOutCommand), true
+	}
+}
+
+func mappingErrorReply(err error) string {
+	if err == ErrMappingNotSaved {
+		return "The mapping was changed, but could not be saved, so it will be lost on restart."
+	}
+	return fmt.Sprintf("Could not change the mapping: %s.", err)
+}
+
+// ErrMappingNotSaved is returned when a mapping was changed, but will be lost on restart
+var ErrMappingNotSaved = errors.New("mapping was changed, but could not be saved")
+
+// MapChannel bridges an IRC channel to a Discord channel (a mention, ID or name),
+// optionally only in one direction, overriding the config.
+// Returns the ID of the Discord channel.
+func (b *Bridge) MapChannel(ircChannel, discordChannel, direction string) (string, error) {
+	discordID, ok := b.discord.findChannel(discordChannel)
+	if !ok {
+		return "", fmt.Errorf("could not find the Discord channel %s", discordChannel)
+	}
+
+	if direction != "" && direction != DirectionIRCToDiscord && direction != DirectionDiscordToIRC {
+		return "", fmt.Errorf("the direction must be %s or %s", DirectionIRCToDiscord, DirectionDiscordToIRC)
+	}
+
+	discord := discordID
+	if direction != "" {
+		discord += " " + direction
+	}
+	return discordID, b.setStoredMapping(ircChannel, discord)
+}
+
+// UnmapChannel stops bridging an IRC channel, overriding the config
+func (b *Bridge) UnmapChannel(ircChannel string) error {
+	return b.setStoredMapping(ircChannel, "")
+}
+
+// setStoredMapping maps an IRC channel, or unmaps it if discord is empty, and saves it
+func (b *Bridge) setStoredMapping(channel, discord string) error {
+	if b.ircListener != nil && !b.ircListener.isupport.IsChannel(channel) {
+		return fmt.Errorf("%s is not an IRC channel", channel)
+	}
+
+	b.mappingsMu.Lock()
+	defer b.mappingsMu.Unlock()
+
+	stored := b.storedMappings()
+	for existing := range stored {
+		if b.IRCEqualFold(existing, channel) {
+			delete(stored, existing)
+			channel = existing
+		}
+	}
+	stored[channel] = discord
+
+	if err := b.setChannelMappings(b.effectiveMappings(b.configMappings, stored)); err != nil {
+		return err
+	}
+	if err := b.store.Set(mappingsBucket, channel, discord); err != nil {
+		discordLog.WithField("error", err).WithField("channel", channel).Errorln("could not save channel mapping")
+		return ErrMappingNotSaved
+	}
+	return nil
+}
+
+// findChannel finds a text channel in a bridged guild by mention (<#id>), ID, or name
+func (d *discordBot) findChannel(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "<#"), ">")
+
+	for _, c := range d.channels() {
+		if c.Type != discordgo.ChannelTypeGuildText {
+			continue
+		}
+		if c.ID == name || c.Name == strings.TrimPrefix(name, "#") {
+			return c.ID, true
+		}
+	}
+	return "", false
+}
+
+// handleMappingCommand handles "!bridge map" and "!bridge unmap" in Discord DMs, returning true if it was one
+func (d *discordBot) handleMappingCommand(m *discordgo.Message) bool {
+	reply, ok := d.bridge.mappingReply(d.isAdmin(m), m.Content)
+	if !ok {
+		return false
+	}
+
+	if _, err := d.Session.ChannelMessageSend(m.ChannelID, reply); err != nil {
+		discordLog.WithField("error", err).Warnln("could not reply to channel mapping command")
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package bridge
+
+import (
+	"strings"
+
+	ircnick "github.com/qaisjp/go-discord-irc/irc/nick"
+)
+
+// mappingTable is a set of channel mappings, indexed by channel.
+// It is never changed once built, so it can be read from any goroutine.
+// SetChannelMappings swaps in a new one.
+type mappingTable struct {
+	mappings       []Mapping
+	byIRC          map[string][]Mapping // From mappingKey("#Test") to mappings, compared with IRCEqualFold
+	byDiscord      map[string]Mapping
+	ircChannelKeys map[string]string   // From "#test" to "password"
+	discordMirrors map[string][]string // From "#test" to Discord channels that only receive messages
+}
+
+func newMappingTable(mappings []Mapping, ircChannelKeys map[string]string, discordMirrors map[string][]string) *mappingTable {
+	t := &mappingTable{
+		mappings:       mappings,
+		byIRC:          make(map[string][]Mapping, len(mappings)),
+		byDiscord:      make(map[string]Mapping, len(mappings)),
+		ircChannelKeys: ircChannelKeys,
+		discordMirrors: discordMirrors,
+	}
+	for _, mapping := range mappings {
+		key := mappingKey(mapping.IRCChannel)
+		t.byIRC[key] = append(t.byIRC[key], mapping)
+		t.byDiscord[mapping.DiscordChannel] = mapping
+	}
+	return t
+}
+
+// mappingKey folds an IRC channel name loosely enough that channels equal under any
+// casemapping have the same key, as the server's casemapping may not be known yet
+func mappingKey(channel string) string {
+	return ircnick.ToLower(strings.ToLower(channel), ircnick.CasemappingRFC1459)
+}
+
+// mappingTable returns the channel mappings in use
+func (b *Bridge) mappingTable() *mappingTable {
+	if t, ok := b.mappings.Load().(*mappingTable); ok {
+		return t
+	}
+	return newMappingTable(nil, nil, nil)
+}
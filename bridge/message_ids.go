@@ -0,0 +1,143 @@
+package bridge
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	irc "github.com/qaisjp/go-ircevent"
+	log "github.com/sirupsen/logrus"
+)
+
+// ircMessageIDsBucket maps the Discord IDs of messages relayed from IRC to "<IRC msgid> <Discord channel>",
+// so that Discord replies to them can be sent as IRC replies, and they can be deleted when redacted on IRC.
+// Values saved by older versions don't have the channel.
+const ircMessageIDsBucket = "irc_message_ids"
+
+// relayedMessageIDsBucket maps the Discord IDs of messages relayed to IRC to "<sender> <IRC channel> <msgid>...",
+// where sender is the Discord user ID of the puppet that sent them, or relayedByListener.
+// Edits are sent as replies to them, and deleting them redacts them on IRC.
+const relayedMessageIDsBucket = "relayed_message_ids"
+
+// relayedByListener is the sender of messages relayed to IRC by the listener, see relayedMessageIDsBucket
+const relayedByListener = "listener"
+
+// ircMessageIDsKept is how many relayed messages are remembered, each way
+const ircMessageIDsKept = 1000
+
+// replyCaps are the capabilities required to send a message as a reply (with +draft/reply)
+var replyCaps = []string{"message-tags"}
+
+// redactCaps are the capabilities required to send and receive REDACT
+var redactCaps = []string{"draft/message-redaction"}
+
+// recordIRCMessageID remembers that an IRC message was relayed as a Discord message in channel
+func (b *Bridge) recordIRCMessageID(channel, discordID, msgid string) {
+	if discordID == "" || msgid == "" {
+		return
+	}
+	if err := b.store.SetCapped(ircMessageIDsBucket, discordID, msgid+" "+channel, ircMessageIDsKept); err != nil {
+		log.WithError(err).Errorln("could not save IRC message ID")
+	}
+}
+
+// ircMessageID returns the msgid of the IRC message relayed as a Discord message
+func (b *Bridge) ircMessageID(discordID string) (string, bool) {
+	value, ok := b.store.Get(ircMessageIDsBucket, discordID)
+	if !ok {
+		return "", false
+	}
+	return strings.Fields(value)[0], true
+}
+
+// discordMessageFor returns the Discord channel and ID of the message an IRC message was relayed as
+func (b *Bridge) discordMessageFor(msgid string) (channel, discordID string, ok bool) {
+	for _, id := range b.store.Keys(ircMessageIDsBucket) {
+		value, _ := b.store.Get(ircMessageIDsBucket, id)
+		if fields := strings.Fields(value); len(fields) == 2 && fields[0] == msgid {
+			return fields[1], id, true
+		}
+	}
+	return "", "", false
+}
+
+// recordRelayedMessageID remembers that a line of a Discord message was sent to an IRC channel with msgid.
+// sender is the Discord user whose puppet sent it, or relayedByListener.
+func (b *Bridge) recordRelayedMessageID(discordID, sender, channel, msgid string) {
+	if discordID == "" || msgid == "" {
+		return
+	}
+
+	value := sender + " " + channel
+	if old, ok := b.store.Get(relayedMessageIDsBucket, discordID); ok && strings.HasPrefix(old, value+" ") {
+		value = old
+	}
+	if err := b.store.SetCapped(relayedMessageIDsBucket, discordID, value+" "+msgid, ircMessageIDsKept); err != nil {
+		log.WithError(err).Errorln("could not save relayed message ID")
+	}
+}
+
+// relayedMessageIDs returns who sent a Discord message to IRC, where, and the msgids of its lines
+func (b *Bridge) relayedMessageIDs(discordID string) (sender, channel string, msgids []string, ok bool) {
+	value, ok := b.store.Get(relayedMessageIDsBucket, discordID)
+	fields := strings.Fields(value)
+	if !ok || len(fields) < 3 {
+		return "", "", nil, false
+	}
+	return fields[0], fields[1], fields[2:], true
+}
+
+// onMessageDelete redacts a deleted Discord message on IRC, if the server supports it
+// and whoever sent it is still connected
+func (d *discordBot) onMessageDelete(s *discordgo.Session, m *discordgo.MessageDelete) {
+	if !d.bridgesGuild(m.GuildID) {
+		return
+	}
+
+	b := d.bridge
+	sender, channel, msgids, ok := b.relayedMessageIDs(m.ID)
+	if !ok {
+		return
+	}
+	if err := b.store.Delete(relayedMessageIDsBucket, m.ID); err != nil {
+		log.WithError(err).Errorln("could not forget relayed message ID")
+	}
+
+	var send func(string)
+	if sender == relayedByListener {
+		if !b.ircListener.hasCaps(redactCaps) {
+			return
+		}
+		send = b.ircListener.SendRaw
+	} else {
+		con, ok := b.ircManager.connection(sender)
+		if !ok || !con.hasCaps(redactCaps) {
+			return
+		}
+		send = con.SendRaw
+	}
+
+	for _, msgid := range msgids {
+		send("REDACT " + channel + " " + msgid)
+	}
+}
+
+// OnRedact deletes the Discord message an IRC message was relayed as, when it is redacted
+func (i *ircListener) OnRedact(e *irc.Event) {
+	if len(e.Arguments) < 2 || !i.isupport.IsChannel(e.Arguments[0]) {
+		return
+	}
+
+	channel, discordID, ok := i.bridge.discordMessageFor(e.Arguments[1])
+	if !ok {
+		return
+	}
+	if err := i.bridge.store.Delete(ircMessageIDsBucket, discordID); err != nil {
+		log.WithError(err).Errorln("could not forget IRC message ID")
+	}
+
+	go func() {
+		if err := i.bridge.discord.Session.ChannelMessageDelete(channel, discordID); err != nil {
+			listenerLog.WithError(err).WithField("message", discordID).Warnln("could not delete redacted message on Discord")
+		}
+	}()
+}
@@ -0,0 +1,168 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gobwas/glob"
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// Values for Config.ModerationAction, what happens to a Discord user whose puppet is kicked or banned on IRC
+const (
+	ModerationActionNone    = "none"
+	ModerationActionTimeout = "timeout"
+	ModerationActionKick    = "kick"
+	ModerationActionRole    = "role"
+)
+
+// onModerationKick applies Config.ModerationAction to the Discord user of a kicked puppet
+func (i *ircListener) onModerationKick(e *irc.Event) {
+	if len(e.Arguments) < 2 || !i.bridge.moderationEnabled() {
+		return
+	}
+
+	con, ok := i.bridge.ircManager.puppet(e.Arguments[1])
+	if !ok {
+		return
+	}
+
+	reason := fmt.Sprintf("Kicked from IRC channel %s by %s", e.Arguments[0], e.Nick)
+	if len(e.Arguments) > 2 && e.Arguments[2] != "" {
+		reason += ": " + e.Arguments[2]
+	}
+	i.bridge.moderateDiscordUser(con.discord, reason)
+}
+
+// onModerationMode applies Config.ModerationAction to the Discord user of a puppet banned with MODE +b.
+// Masks can match anyone, so only a mask matching exactly one puppet of a linked user (see linkCommand) counts.
+func (i *ircListener) onModerationMode(e *irc.Event) {
+	if len(e.Arguments) < 2 || !i.isupport.IsChannel(e.Arguments[0]) || !i.bridge.moderationEnabled() {
+		return
+	}
+
+	for _, change := range i.isupport.ParseModes(e.Arguments[1:]) {
+		if !change.adding || change.mode != 'b' || change.param == "" {
+			continue
+		}
+
+		mask, err := glob.Compile(strings.ToLower(change.param))
+		if err != nil {
+			continue
+		}
+		var matched []*ircConnection
+		for _, con := range i.bridge.ircManager.connections() {
+			if i.bridge.puppetMatches(con, mask) {
+				matched = append(matched, con)
+			}
+		}
+		if len(matched) > 1 {
+			listenerLog.WithField("mask", change.param).WithField("puppets", len(matched)).
+				Warnln("Not moderating a ban mask that matches several puppets")
+			continue
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		if _, ok := i.bridge.LinkedNick(matched[0].discord.ID); !ok {
+			continue
+		}
+
+		reason := fmt.Sprintf("Banned from IRC channel %s by %s (%s)", e.Arguments[0], e.Nick, change.param)
+		i.bridge.moderateDiscordUser(matched[0].discord, reason)
+	}
+}
+
+// puppetMatches returns true if a lowercased ban mask matches a puppet's hostmask
+func (b *Bridge) puppetMatches(con *ircConnection, mask glob.Glob) bool {
+	username := b.ircManager.generateUsername(con.discord)
+	host := b.WebIRCHostname(con.discord)
+	for _, user := range []string{username, "~" + username} {
+		if mask.Match(strings.ToLower(con.nick + "!" + user + "@" + host)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bridge) moderationEnabled() bool {
+	action := b.Config().ModerationAction
+	return action != "" && action != ModerationActionNone
+}
+
+// moderateDiscordUser applies Config.ModerationAction to a Discord user in each bridged guild they are in,
+// because of something done to their puppet
+func (b *Bridge) moderateDiscordUser(user DiscordUser, reason string) {
+	conf := b.Config()
+	session := b.discord.Session
+
+	for _, guildID := range conf.GuildIDs {
+		if _, err := session.State.Member(guildID, user.ID); err != nil {
+			continue
+		}
+
+		var err error
+		switch conf.ModerationAction {
+		case ModerationActionTimeout:
+			until := time.Now().Add(conf.ModerationTimeout)
+			err = session.GuildMemberTimeout(guildID, user.ID, &until)
+		case ModerationActionKick:
+			err = session.GuildMemberDeleteWithReason(guildID, user.ID, reason)
+		case ModerationActionRole:
+			// The role only exists in one of the guilds
+			if _, err := session.State.Role(guildID, conf.ModerationRole); err != nil {
+				continue
+			}
+			err = session.GuildMemberRoleAdd(guildID, user.ID, conf.ModerationRole)
+		default:
+			return
+		}
+
+		if err != nil {
+			b.relayErrors.Add("could not %s Discord user %s (%s): %s", conf.ModerationAction, user.Username, reason, err)
+			continue
+		}
+		discordLog.WithField("user", user.ID).WithField("guild", guildID).WithField("action", conf.ModerationAction).Infoln(reason)
+	}
+}
+
+// discordBanMask is the IRC ban mask for a Discord user's puppet, which doesn't change with their nick
+func (b *Bridge) discordBanMask(user *discordgo.User) string {
+	return "*!*@" + b.WebIRCHostname(DiscordUser{ID: user.ID, Bot: user.Bot})
+}
+
+// onGuildBan bans the puppet of a banned Discord member from mapped IRC channels (and unbans them),
+// if Config.DiscordBansToIRC is set. The listener must be a channel operator.
+func (d *discordBot) onGuildBan(s *discordgo.Session, e interface{}) {
+	if !d.bridge.Config().DiscordBansToIRC {
+		return
+	}
+
+	var mode string
+	var user *discordgo.User
+	switch ban := e.(type) {
+	case *discordgo.GuildBanAdd:
+		if !d.bridgesGuild(ban.GuildID) {
+			return
+		}
+		mode, user = "+b", ban.User
+	case *discordgo.GuildBanRemove:
+		if !d.bridgesGuild(ban.GuildID) {
+			return
+		}
+		mode, user = "-b", ban.User
+	default:
+		return
+	}
+	if user == nil {
+		return
+	}
+
+	mask := d.bridge.discordBanMask(user)
+	for _, mapping := range d.bridge.mappingTable().mappings {
+		d.bridge.ircListener.SendRaw("MODE " + mapping.IRCChannel + " " + mode + " " + mask)
+	}
+	discordLog.WithField("user", user.ID).Infof("Set %s %s on IRC", mode, mask)
+}
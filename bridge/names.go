@@ -0,0 +1,125 @@
+package bridge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// namesCommand, sent in a bridged Discord channel, lists who is in its IRC channel.
+// It isn't relayed to IRC.
+const namesCommand = "!names"
+
+// namesPerPage is how many nicks are listed in each embed, and namesMaxPages how many
+// embeds are sent, as that is the most a Discord message can have
+const (
+	namesPerPage  = 60
+	namesMaxPages = 10
+)
+
+// Prefixes returns the status prefixes of channel members from PREFIX, highest first, e.g. "@+"
+func (s *isupport) Prefixes() string {
+	prefix, ok := s.Get("PREFIX")
+	if !ok {
+		prefix = "(ov)@+"
+	}
+	if i := strings.IndexByte(prefix, ')'); i != -1 {
+		return prefix[i+1:]
+	}
+	return prefix
+}
+
+// sortNames sorts nicks from NAMES by their highest status prefix, then by nick
+func sortNames(names []string, prefixes string) {
+	rank := func(name string) int {
+		if name != "" {
+			if i := strings.IndexByte(prefixes, name[0]); i != -1 {
+				return i
+			}
+		}
+		return len(prefixes)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		if ri, rj := rank(names[i]), rank(names[j]); ri != rj {
+			return ri < rj
+		}
+		return strings.ToLower(strings.TrimLeft(names[i], prefixes)) < strings.ToLower(strings.TrimLeft(names[j], prefixes))
+	})
+}
+
+// namesEmbeds lists the nicks in an IRC channel, namesPerPage to an embed
+func namesEmbeds(channel string, names []string) []*discordgo.MessageEmbed {
+	pages := (len(names) + namesPerPage - 1) / namesPerPage
+	if pages == 0 {
+		return []*discordgo.MessageEmbed{{
+			Title:       channel,
+			Description: "Nobody is in this channel.",
+		}}
+	}
+
+	var embeds []*discordgo.MessageEmbed
+	for page := 0; page < pages && page < namesMaxPages; page++ {
+		end := (page + 1) * namesPerPage
+		if end > len(names) {
+			end = len(names)
+		}
+
+		embed := &discordgo.MessageEmbed{
+			// Nicks are in a code block so that characters like _ aren't taken as markdown
+			Description: "```\n" + strings.Join(names[page*namesPerPage:end], "  ") + "\n```",
+			Footer: &discordgo.MessageEmbedFooter{
+				Text: fmt.Sprintf("Page %d of %d", page+1, pages),
+			},
+		}
+		if page == 0 {
+			embed.Title = fmt.Sprintf("%d in %s", len(names), channel)
+		}
+		if page == namesMaxPages-1 && pages > namesMaxPages {
+			embed.Footer.Text += fmt.Sprintf(", %d more not shown", len(names)-end)
+		}
+		embeds = append(embeds, embed)
+	}
+	return embeds
+}
+
+// channelNamesEmbeds asks the IRC server who is in channel, and lists them with namesEmbeds
+func (b *Bridge) channelNamesEmbeds(channel string) ([]*discordgo.MessageEmbed, error) {
+	names, err := b.ChannelNames(channel)
+	if err != nil {
+		return nil, err
+	}
+	sortNames(names, b.ircListener.isupport.Prefixes())
+	return namesEmbeds(channel, names), nil
+}
+
+// handleNamesCommand handles namesCommand in a bridged Discord channel, returning true if it was one
+func (d *discordBot) handleNamesCommand(m *discordgo.Message) bool {
+	if strings.TrimSpace(m.Content) != namesCommand {
+		return false
+	}
+	mapping, ok := d.bridge.GetMappingByDiscord(m.ChannelID)
+	if !ok {
+		return false
+	}
+
+	// Waiting for the IRC server shouldn't hold up other Discord events
+	go func() {
+		send := &discordgo.MessageSend{
+			Reference:       m.Reference(),
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		}
+		embeds, err := d.bridge.channelNamesEmbeds(mapping.IRCChannel)
+		if err != nil {
+			send.Content = fmt.Sprintf("Could not list %s: %s.", mapping.IRCChannel, err)
+		} else {
+			send.Embeds = embeds
+		}
+
+		if _, err := d.Session.ChannelMessageSendComplex(m.ChannelID, send); err != nil {
+			discordLog.WithField("error", err).Warnln("could not reply to names command")
+		}
+	}()
+	return true
+}
@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mozillazg/go-unidecode"
+	ircnick "github.com/qaisjp/go-discord-irc/irc/nick"
+)
+
+// NickRomanizer is used for scripts with the "romanize" nick script policy,
+// for example to romanize CJK names with a dedicated library. Unidecode is used if it is nil.
+var NickRomanizer ircnick.Transliterator
+
+// Policies for Config.NickScriptPolicies
+const (
+	NickPolicyUnidecode   = "unidecode"   // transliterate with unidecode (the default)
+	NickPolicyConfusables = "confusables" // replace lookalikes with the ASCII letter, then unidecode
+	NickPolicyRomanize    = "romanize"    // use NickRomanizer
+	NickPolicyStrip       = "strip"       // remove the characters
+)
+
+func nickPolicyTransliterator(policy string) (ircnick.Transliterator, bool) {
+	switch policy {
+	case NickPolicyUnidecode:
+		return unidecode.Unidecode, true
+	case NickPolicyConfusables:
+		return func(s string) string { return unidecode.Unidecode(ircnick.FoldConfusables(s)) }, true
+	case NickPolicyRomanize:
+		if NickRomanizer != nil {
+			return NickRomanizer, true
+		}
+		return unidecode.Unidecode, true
+	case NickPolicyStrip:
+		return func(string) string { return "" }, true
+	}
+	return nil, false
+}
+
+// transliterate converts a Discord name to ASCII for use in a nick, using the
+// policy configured for each script in NickScriptPolicies.
+func (m *IRCManager) transliterate(name string) string {
+	scripts := make(map[string]ircnick.Transliterator, len(m.bridge.Config().NickScriptPolicies))
+	for script, policy := range m.bridge.Config().NickScriptPolicies {
+		t, ok := nickPolicyTransliterator(policy)
+		if !ok {
+			puppeteerLog.WithField("script", script).WithField("policy", policy).Warnln("unknown nick script policy")
+			continue
+		}
+
+		// Script names may have been lowercased by the config loader
+		for name := range unicode.Scripts {
+			if strings.EqualFold(name, script) {
+				scripts[name] = t
+				break
+			}
+		}
+	}
+
+	return ircnick.Transliterate(ircnick.FoldCompatibility(name), scripts, unidecode.Unidecode)
+}
+
+// readableNickname sanitises a Discord name, or falls back to "user_<base36 id>" if
+// nothing readable is left of it.
+func (m *IRCManager) readableNickname(name string, discordID string) string {
+	nick := sanitiseNickname(name, m.transliterate)
+	for _, c := range []byte(nick) {
+		if ircnick.IsAlNum(c) {
+			return nick
+		}
+	}
+
+	id, err := strconv.ParseUint(discordID, 10, 64)
+	if err != nil {
+		return nick
+	}
+	return "user_" + strconv.FormatUint(id, 36)
+}
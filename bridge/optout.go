@@ -0,0 +1,83 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Store buckets for users who don't want to be relayed
+const (
+	discordOptOutBucket = "discord_optout" // Discord user IDs
+	ircOptOutBucket     = "irc_optout"     // folded IRC nicks
+)
+
+// optOutCommand is the command for changing relay preferences, from Discord DMs or IRC PMs
+const optOutCommand = "!bridge"
+
+// DiscordOptedOut returns true if a Discord user asked not to be relayed to IRC
+func (b *Bridge) DiscordOptedOut(userID string) bool {
+	return b.store.Has(discordOptOutBucket, userID)
+}
+
+// IRCOptedOut returns true if an IRC user asked not to be relayed to Discord
+func (b *Bridge) IRCOptedOut(nick string) bool {
+	return b.store.Has(ircOptOutBucket, b.ircListener.isupport.Fold(nick))
+}
+
+// optOutReply runs an optOutCommand in bucket for key, returning a reply for the user.
+// Returns false if message is not an optOutCommand.
+func (b *Bridge) optOutReply(bucket string, key string, message string) (string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) == 0 || fields[0] != optOutCommand {
+		return "", false
+	}
+
+	var subcommand string
+	if len(fields) > 1 {
+		subcommand = fields[1]
+	}
+
+	var err error
+	var reply string
+	switch subcommand {
+	case "optout":
+		err = b.store.Set(bucket, key, "")
+		reply = "Your messages will no longer be relayed. Use `" + optOutCommand + " optin` to undo this."
+	case "optin":
+		err = b.store.Delete(bucket, key)
+		reply = "Your messages will be relayed again."
+	case "status":
+		if b.store.Has(bucket, key) {
+			reply = "Your messages are not being relayed."
+		} else {
+			reply = "Your messages are being relayed."
+		}
+	default:
+		reply = fmt.Sprintf("Usage: %s optout|optin|status", optOutCommand)
+	}
+
+	if err != nil {
+		discordLog.WithField("error", err).WithField("key", key).Errorln("could not save relay preference")
+		return "Sorry, your preference could not be saved.", true
+	}
+	return reply, true
+}
+
+// handleDiscordOptOut handles optOutCommand in Discord DMs, returning true if it was one
+func (d *discordBot) handleDiscordOptOut(m *discordgo.Message) bool {
+	reply, ok := d.bridge.optOutReply(discordOptOutBucket, m.Author.ID, m.Content)
+	if !ok {
+		return false
+	}
+
+	if d.bridge.DiscordOptedOut(m.Author.ID) {
+		d.bridge.removeUserChan <- m.Author.ID
+	}
+
+	if _, err := d.Session.ChannelMessageSend(m.ChannelID, reply); err != nil {
+		discordLog.WithField("error", err).Warnln("could not reply to relay preference command")
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// What happens to messages while relaying is paused, see PauseRelay
+const (
+	// PauseQueue keeps messages (up to IRCOfflineBuffer or DiscordOfflineBuffer) to send on resuming
+	PauseQueue = "queue"
+	// PauseDrop doesn't relay them at all
+	PauseDrop = "drop"
+)
+
+// relayPauses is how relaying is paused each way, empty if it isn't
+type relayPauses struct {
+	sync.Mutex
+	toIRC     string
+	toDiscord string
+}
+
+// relayPause returns how relaying is paused in direction (DirectionDiscordToIRC or
+// DirectionIRCToDiscord), or an empty string if it isn't
+func (b *Bridge) relayPause(direction string) string {
+	b.pauses.Lock()
+	defer b.pauses.Unlock()
+	if direction == DirectionDiscordToIRC {
+		return b.pauses.toIRC
+	}
+	return b.pauses.toDiscord
+}
+
+// pauseDirections returns the directions direction stands for, with an empty direction meaning both
+func pauseDirections(direction string) ([]string, error) {
+	switch direction {
+	case "", "both":
+		return []string{DirectionDiscordToIRC, DirectionIRCToDiscord}, nil
+	case DirectionDiscordToIRC, DirectionIRCToDiscord:
+		return []string{direction}, nil
+	}
+	return nil, fmt.Errorf("the direction must be %s, %s or both", DirectionDiscordToIRC, DirectionIRCToDiscord)
+}
+
+// PauseRelay stops relaying messages in direction (DirectionDiscordToIRC, DirectionIRCToDiscord,
+// or both if empty), such as during IRC network maintenance. With PauseQueue (the default if mode
+// is empty) messages are sent once ResumeRelay is called, with PauseDrop they are not.
+// Affected channels are told on both sides.
+func (b *Bridge) PauseRelay(direction, mode string) error {
+	if mode == "" {
+		mode = PauseQueue
+	}
+	if mode != PauseQueue && mode != PauseDrop {
+		return fmt.Errorf("the mode must be %s or %s", PauseQueue, PauseDrop)
+	}
+	directions, err := pauseDirections(direction)
+	if err != nil {
+		return err
+	}
+
+	b.pauses.Lock()
+	for _, d := range directions {
+		if d == DirectionDiscordToIRC {
+			b.pauses.toIRC = mode
+		} else {
+			b.pauses.toDiscord = mode
+		}
+	}
+	b.pauses.Unlock()
+
+	outcome := "they will be sent once it resumes"
+	if mode == PauseDrop {
+		outcome = "they won't be relayed"
+	}
+	for _, d := range directions {
+		b.announcePause(d, fmt.Sprintf("Relaying messages %s is paused for maintenance, %s.", pauseDescription(d), outcome))
+	}
+	return nil
+}
+
+// ResumeRelay relays messages in direction again after PauseRelay, sending any that were queued
+func (b *Bridge) ResumeRelay(direction string) error {
+	directions, err := pauseDirections(direction)
+	if err != nil {
+		return err
+	}
+
+	var resumed []string
+	b.pauses.Lock()
+	for _, d := range directions {
+		if d == DirectionDiscordToIRC && b.pauses.toIRC != "" {
+			b.pauses.toIRC = ""
+			resumed = append(resumed, d)
+		} else if d == DirectionIRCToDiscord && b.pauses.toDiscord != "" {
+			b.pauses.toDiscord = ""
+			resumed = append(resumed, d)
+		}
+	}
+	b.pauses.Unlock()
+
+	for _, d := range resumed {
+		b.announcePause(d, fmt.Sprintf("Relaying messages %s has resumed.", pauseDescription(d)))
+		// Send what was queued, the same way as after an outage
+		if d == DirectionDiscordToIRC {
+			b.onIRCWelcome()
+		} else {
+			b.onDiscordConnect()
+		}
+	}
+	return nil
+}
+
+// RelayPauses returns how relaying is paused in each direction that is
+func (b *Bridge) RelayPauses() map[string]string {
+	b.pauses.Lock()
+	defer b.pauses.Unlock()
+
+	pauses := make(map[string]string)
+	if b.pauses.toIRC != "" {
+		pauses[DirectionDiscordToIRC] = b.pauses.toIRC
+	}
+	if b.pauses.toDiscord != "" {
+		pauses[DirectionIRCToDiscord] = b.pauses.toDiscord
+	}
+	return pauses
+}
+
+// pauseDescription describes a direction for announcements
+func pauseDescription(direction string) string {
+	if direction == DirectionDiscordToIRC {
+		return "from Discord to IRC"
+	}
+	return "from IRC to Discord"
+}
+
+// announcePause tells both sides of the mappings that relay in direction about a pause
+func (b *Bridge) announcePause(direction, message string) {
+	listenerLog.Infoln(message)
+	for _, mapping := range b.mappingTable().mappings {
+		if (direction == DirectionDiscordToIRC && !mapping.RelaysToIRC()) ||
+			(direction == DirectionIRCToDiscord && !mapping.RelaysToDiscord()) {
+			continue
+		}
+
+		if b.ircListener.Registered() {
+			b.ircListener.Notice(mapping.IRCChannel, message)
+		}
+		channel := mapping.DiscordChannel
+		b.workers.Do(toDiscordWorker(mapping.IRCChannel), func() {
+			b.sendToDiscord(channel, "", "", "_"+message+"_")
+		})
+	}
+}
+
+// pauseCommandReply runs the "pause" and "resume" admin commands, whose arguments are
+// a direction and, for pause, a mode, in any order
+func (b *Bridge) pauseCommandReply(command string, args []string) string {
+	var direction, mode string
+	for _, arg := range args {
+		switch strings.ToLower(arg) {
+		case PauseQueue, PauseDrop:
+			mode = strings.ToLower(arg)
+		default:
+			direction = strings.ToLower(arg)
+		}
+	}
+
+	if command == "resume" {
+		if err := b.ResumeRelay(direction); err != nil {
+			return fmt.Sprintf("Could not resume: %s.", err)
+		}
+		return "Resumed relaying."
+	}
+	if err := b.PauseRelay(direction, mode); err != nil {
+		return fmt.Sprintf("Could not pause: %s.", err)
+	}
+	return "Paused relaying."
+}
@@ -0,0 +1,139 @@
+package bridge
+
+import (
+	"sync/atomic"
+
+	ircflood "github.com/qaisjp/go-discord-irc/irc/flood"
+	log "github.com/sirupsen/logrus"
+)
+
+// Values for Config.RelayOverflowPolicy
+const (
+	OverflowBlock      = "block"       // wait for room, holding up whatever is relaying the message
+	OverflowDropOldest = "drop-oldest" // drop the oldest queued message to make room
+	OverflowDropNewest = "drop-newest" // drop the message being queued
+)
+
+// defaultRelayQueueSize is used if Config.RelayQueueSize isn't set
+const defaultRelayQueueSize = 100
+
+// Names of the relay queues, as in RelayQueues
+const (
+	queueIRCToDiscord = "irc_to_discord"
+	queueDiscordToIRC = "discord_to_irc"
+)
+
+// queueDrops counts the messages dropped from each relay queue
+type queueDrops struct {
+	ircToDiscord uint64
+	discordToIRC uint64
+}
+
+// relayQueueSize returns how many messages each relay queue can hold
+func (b *Bridge) relayQueueSize() int {
+	if b.Config().RelayQueueSize <= 0 {
+		return defaultRelayQueueSize
+	}
+	return b.Config().RelayQueueSize
+}
+
+// newSendLimiter returns a flood limiter for an IRC connection
+func (b *Bridge) newSendLimiter() *ircflood.Limiter {
+	return ircflood.NewLimiter(b.Config().IRCSendRate, b.Config().IRCSendBurst)
+}
+
+// queueIRCMessage queues a message from IRC to be relayed to Discord,
+// following RelayOverflowPolicy if the queue is full.
+func (b *Bridge) queueIRCMessage(msg IRCMessage) {
+	if b.isClosing() {
+		return
+	}
+
+	switch b.Config().RelayOverflowPolicy {
+	case OverflowDropNewest:
+		select {
+		case b.discordMessagesChan <- msg:
+		default:
+			b.dropped(queueIRCToDiscord, &b.drops.ircToDiscord)
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case b.discordMessagesChan <- msg:
+				return
+			default:
+			}
+
+			select {
+			case <-b.discordMessagesChan:
+				b.dropped(queueIRCToDiscord, &b.drops.ircToDiscord)
+			default:
+			}
+		}
+
+	default:
+		b.discordMessagesChan <- msg
+	}
+}
+
+// queueDiscordMessage queues a message from Discord to be relayed to IRC,
+// following RelayOverflowPolicy if the queue is full.
+func (b *Bridge) queueDiscordMessage(msg *DiscordMessage) {
+	if b.isClosing() {
+		return
+	}
+
+	switch b.Config().RelayOverflowPolicy {
+	case OverflowDropNewest:
+		select {
+		case b.discordMessageEventsChan <- msg:
+		default:
+			b.dropped(queueDiscordToIRC, &b.drops.discordToIRC)
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case b.discordMessageEventsChan <- msg:
+				return
+			default:
+			}
+
+			select {
+			case <-b.discordMessageEventsChan:
+				b.dropped(queueDiscordToIRC, &b.drops.discordToIRC)
+			default:
+			}
+		}
+
+	default:
+		b.discordMessageEventsChan <- msg
+	}
+}
+
+// dropped counts a message dropped from a full queue.
+// Only some drops are logged, so a flood doesn't flood the log too.
+func (b *Bridge) dropped(queue string, count *uint64) {
+	n := atomic.AddUint64(count, 1)
+	if n == 1 || n%100 == 0 {
+		log.WithField("queue", queue).WithField("dropped", n).Warnln("Relay queue is full, dropping messages")
+		b.relayErrors.Add("%s queue is full, %d messages dropped so far", queue, n)
+	}
+}
+
+// RelayQueues returns how full each relay queue is, and how many messages were dropped from it
+func (b *Bridge) RelayQueues() map[string]ChannelDepth {
+	return map[string]ChannelDepth{
+		queueIRCToDiscord: {
+			Len:     len(b.discordMessagesChan),
+			Cap:     cap(b.discordMessagesChan),
+			Dropped: atomic.LoadUint64(&b.drops.ircToDiscord),
+		},
+		queueDiscordToIRC: {
+			Len:     len(b.discordMessageEventsChan),
+			Cap:     cap(b.discordMessageEventsChan),
+			Dropped: atomic.LoadUint64(&b.drops.discordToIRC),
+		},
+	}
+}
@@ -0,0 +1,173 @@
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// lastCommand, sent in a bridged channel on either side, replies with the last messages
+// sent on the other side, for people who just joined. It isn't relayed.
+const lastCommand = "!last"
+
+// lastDefault is how many messages lastCommand shows if not told, and recentMessagesKept
+// how many are kept for each side of each mapping, which is the most it can show
+const (
+	lastDefault        = 10
+	recentMessagesKept = 50
+)
+
+// recentMessage is a message relayed across a mapping
+type recentMessage struct {
+	at   time.Time
+	nick string
+	text string
+}
+
+// recentMessages keeps the last messages relayed each way, by IRC channel
+type recentMessages struct {
+	sync.Mutex
+	fromIRC     map[string][]recentMessage
+	fromDiscord map[string][]recentMessage
+}
+
+func newRecentMessages() *recentMessages {
+	return &recentMessages{
+		fromIRC:     make(map[string][]recentMessage),
+		fromDiscord: make(map[string][]recentMessage),
+	}
+}
+
+// add keeps a message in one of the maps, forgetting the oldest beyond recentMessagesKept
+func (r *recentMessages) add(messages map[string][]recentMessage, channel string, m recentMessage) {
+	r.Lock()
+	defer r.Unlock()
+
+	kept := append(messages[channel], m)
+	if len(kept) > recentMessagesKept {
+		kept = append([]recentMessage(nil), kept[len(kept)-recentMessagesKept:]...)
+	}
+	messages[channel] = kept
+}
+
+// last returns up to n of the latest messages in one of the maps, oldest first
+func (r *recentMessages) last(messages map[string][]recentMessage, channel string, n int) []recentMessage {
+	r.Lock()
+	defer r.Unlock()
+
+	kept := messages[channel]
+	if n < len(kept) {
+		kept = kept[len(kept)-n:]
+	}
+	return append([]recentMessage(nil), kept...)
+}
+
+// FromIRC keeps a message relayed from an IRC channel to Discord
+func (r *recentMessages) FromIRC(channel, nick, text string) {
+	r.add(r.fromIRC, channel, recentMessage{at: time.Now(), nick: nick, text: text})
+}
+
+// FromDiscord keeps a message relayed from Discord to an IRC channel
+func (r *recentMessages) FromDiscord(channel, nick, text string) {
+	r.add(r.fromDiscord, channel, recentMessage{at: time.Now(), nick: nick, text: text})
+}
+
+// LastFromIRC returns up to n of the latest messages relayed from an IRC channel, oldest first
+func (r *recentMessages) LastFromIRC(channel string, n int) []recentMessage {
+	return r.last(r.fromIRC, channel, n)
+}
+
+// LastFromDiscord returns up to n of the latest messages relayed to an IRC channel, oldest first
+func (r *recentMessages) LastFromDiscord(channel string, n int) []recentMessage {
+	return r.last(r.fromDiscord, channel, n)
+}
+
+// lastCount returns how many messages lastCommand asks for, and false if message is not this command.
+// Zero is returned if the count isn't a positive number.
+func lastCount(message string) (int, bool) {
+	fields := strings.Fields(message)
+	if len(fields) == 0 || fields[0] != lastCommand || len(fields) > 2 {
+		return 0, false
+	}
+	if len(fields) == 1 {
+		return lastDefault, true
+	}
+
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n <= 0 {
+		return 0, true
+	}
+	if n > recentMessagesKept {
+		n = recentMessagesKept
+	}
+	return n, true
+}
+
+// onLastCommand answers lastCommand in an IRC channel with notices of the messages from Discord.
+// Returns false if message is not this command.
+func (i *ircListener) onLastCommand(nick, channel, message string) bool {
+	n, ok := lastCount(message)
+	if !ok {
+		return false
+	}
+	if n == 0 {
+		i.Notice(nick, fmt.Sprintf("Usage: %s [1-%d]", lastCommand, recentMessagesKept))
+		return true
+	}
+
+	messages := i.bridge.recentMessages.LastFromDiscord(i.isupport.Fold(channel), n)
+	if len(messages) == 0 {
+		i.Notice(nick, "Nothing has been said on Discord in "+channel+" recently.")
+		return true
+	}
+	for _, m := range messages {
+		for _, line := range strings.Split(m.text, "\n") {
+			i.Notice(nick, fmt.Sprintf("[%s] <%s> %s", m.at.Format("15:04"), m.nick, line))
+		}
+	}
+	return true
+}
+
+// handleLastCommand answers lastCommand in a bridged Discord channel with the messages from IRC,
+// returning true if it was one
+func (d *discordBot) handleLastCommand(m *discordgo.Message) bool {
+	n, ok := lastCount(m.Content)
+	if !ok {
+		return false
+	}
+	mapping, ok := d.bridge.GetMappingByDiscord(m.ChannelID)
+	if !ok {
+		return false
+	}
+
+	var reply string
+	if n == 0 {
+		reply = fmt.Sprintf("Usage: %s [1-%d]", lastCommand, recentMessagesKept)
+	} else if messages := d.bridge.recentMessages.LastFromIRC(d.bridge.ircListener.isupport.Fold(mapping.IRCChannel), n); len(messages) == 0 {
+		reply = "Nothing has been said on IRC in " + mapping.IRCChannel + " recently."
+	} else {
+		lines := make([]string, len(messages))
+		for i, message := range messages {
+			lines[i] = fmt.Sprintf("<t:%d:t> **%s**: %s", message.at.Unix(), message.nick, message.text)
+		}
+		// The latest messages are the ones to keep if they don't all fit
+		for len(lines) > 1 && len(strings.Join(lines, "\n")) > discordMessageLimit {
+			lines = lines[1:]
+		}
+		reply = strings.Join(lines, "\n")
+	}
+
+	_, err := d.Session.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Content:         truncateMessage(reply),
+		Reference:       m.Reference(),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		discordLog.WithField("error", err).Warnln("could not reply to last command")
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package bridge
+
+import (
+	"time"
+)
+
+// relayWindowCheckInterval is how often messages held outside a relay window are checked for being sendable
+const relayWindowCheckInterval = time.Minute
+
+// heldForIRC is a Discord message held until its IRC channel's relay window opens
+type heldForIRC struct {
+	ircChannel string
+	offlineMessage
+}
+
+// relayWindowHeld keeps messages sent outside their mapping's relay window, see Config.RelayWindows.
+// It is only used by the loop, apart from toDiscord, which sendToDiscordOrKeep adds to from the workers.
+type relayWindowHeld struct {
+	toIRC     []heldForIRC
+	toDiscord discordOfflineBuffer
+}
+
+// inRelayWindow returns true if messages in ircChannel's mapping are relayed now, see Config.RelayWindows
+func (b *Bridge) inRelayWindow(ircChannel string) bool {
+	for channel, schedule := range b.Config().RelayWindows {
+		if b.IRCEqualFold(channel, ircChannel) {
+			return schedule.Contains(time.Now())
+		}
+	}
+	return true
+}
+
+// holdForIRC keeps a Discord message sent outside its mapping's relay window, if
+// Config.RelayWindowAction is PauseQueue. Returns false if it should be dropped instead.
+func (b *Bridge) holdForIRC(ircChannel, target string, msg *DiscordMessage) bool {
+	size := b.Config().IRCOfflineBuffer
+	if b.Config().RelayWindowAction != PauseQueue || size <= 0 {
+		return false
+	}
+
+	held := &b.windowHeld
+	held.toIRC = append(held.toIRC, heldForIRC{ircChannel, offlineMessage{target: target, msg: msg, at: time.Now()}})
+	if len(held.toIRC) > size {
+		go b.deliveryFailed(held.toIRC[0].msg.Message, "too many messages were sent outside the channel's relay window")
+		held.toIRC = held.toIRC[len(held.toIRC)-size:]
+	}
+	return true
+}
+
+// holdForDiscord keeps an IRC message sent outside its mapping's relay window, if
+// Config.RelayWindowAction is PauseQueue. Returns false if it should be dropped instead.
+func (b *Bridge) holdForDiscord(p discordPending) bool {
+	size := b.Config().DiscordOfflineBuffer
+	if b.Config().RelayWindowAction != PauseQueue || size <= 0 {
+		return false
+	}
+
+	buf := &b.windowHeld.toDiscord
+	buf.Lock()
+	defer buf.Unlock()
+	buf.messages = append(buf.messages, p)
+	if len(buf.messages) > size {
+		buf.messages = buf.messages[len(buf.messages)-size:]
+		buf.dropped++
+	}
+	return true
+}
+
+// watchRelayWindows sends held messages once their relay window opens
+func (b *Bridge) watchRelayWindows() {
+	ticker := time.NewTicker(relayWindowCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+
+		b.releaseForDiscord()
+		select {
+		case b.relayWindowChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// releaseForDiscord sends the IRC messages held for relay windows that have opened
+func (b *Bridge) releaseForDiscord() {
+	buf := &b.windowHeld.toDiscord
+	buf.Lock()
+	var open, closed []discordPending
+	for _, p := range buf.messages {
+		if b.inRelayWindow(p.ircChannel) {
+			open = append(open, p)
+		} else {
+			closed = append(closed, p)
+		}
+	}
+	buf.messages = closed
+	dropped := buf.dropped
+	buf.dropped = 0
+	buf.Unlock()
+
+	if dropped > 0 {
+		b.relayErrors.Add("%d messages from IRC were not sent to Discord, as too many were sent outside relay windows", dropped)
+	}
+	for _, p := range open {
+		p := p
+		b.workers.Do(toDiscordWorker(p.ircChannel), func() {
+			// The link is sent rather than the image, so that the time it was sent is shown
+			b.sendToDiscordOrKeep(p.ircChannel, p.ircMsgID, p.channel, p.username, p.avatar, delayedForDiscord(p.at, p.content), nil)
+		})
+	}
+}
+
+// releaseForIRC sends the Discord messages held for relay windows that have opened. It is called by the loop.
+func (b *Bridge) releaseForIRC() {
+	var closed []heldForIRC
+	for _, m := range b.windowHeld.toIRC {
+		if !b.inRelayWindow(m.ircChannel) {
+			closed = append(closed, m)
+			continue
+		}
+		b.sendToIRC(m.target, delayedForIRC(m.offlineMessage))
+	}
+	b.windowHeld.toIRC = closed
+}
@@ -0,0 +1,39 @@
+package bridge
+
+import "regexp"
+
+// Values for the direction of a Rewrite in the config
+const (
+	RewriteToIRC     = "to_irc"
+	RewriteToDiscord = "to_discord"
+	RewriteBoth      = "both"
+)
+
+// Rewrite replaces matches of Pattern in messages relayed in some directions.
+// Replacement can refer to submatches like regexp.Regexp.ReplaceAllString.
+type Rewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+	ToIRC       bool
+	ToDiscord   bool
+}
+
+// rewriteToIRC applies Config.Rewrites to a message from Discord, in order
+func (b *Bridge) rewriteToIRC(content string) string {
+	for _, r := range b.Config().Rewrites {
+		if r.ToIRC {
+			content = r.Pattern.ReplaceAllString(content, r.Replacement)
+		}
+	}
+	return content
+}
+
+// rewriteToDiscord applies Config.Rewrites to a message from IRC, in order
+func (b *Bridge) rewriteToDiscord(content string) string {
+	for _, r := range b.Config().Rewrites {
+		if r.ToDiscord {
+			content = r.Pattern.ReplaceAllString(content, r.Replacement)
+		}
+	}
+	return content
+}
@@ -0,0 +1,114 @@
+package bridge
+
+import (
+	"strings"
+
+	irc "github.com/qaisjp/go-ircevent"
+)
+
+// ServicesCommands are templates for the commands sent to services like NickServ and ChanServ.
+// ${NICK}, ${ACCOUNT}, ${PASSWORD} and ${CHANNEL} are filled in, and empty commands aren't sent.
+type ServicesCommands struct {
+	// Identify logs in, for the listener with IRCListenerPassword, and for puppets in PuppetAccounts
+	// if the server didn't let them log in with SASL
+	Identify string
+	// Regain takes back our nick from whoever is using it, for services that can. Otherwise,
+	// Ghost disconnects whoever is using it, and Release lets go of it if services are holding it.
+	Regain  string
+	Ghost   string
+	Release string
+	// Invite asks for an invite to a channel, see InviteRequestChanServ
+	Invite string
+	// Op asks to be made a channel operator, see ServicesRequestOp
+	Op string
+}
+
+// servicesVars are what is filled in to ServicesCommands
+type servicesVars struct {
+	Nick, Account, Password, Channel string
+}
+
+// fill returns template with the vars filled in, or "" if template is empty
+func (v servicesVars) fill(template string) string {
+	return strings.NewReplacer(
+		"${NICK}", v.Nick,
+		"${ACCOUNT}", v.Account,
+		"${PASSWORD}", v.Password,
+		"${CHANNEL}", v.Channel,
+	).Replace(template)
+}
+
+// listenerAccount returns the account the listener logs in to, its nick if one isn't configured
+func (b *Bridge) listenerAccount() string {
+	if account := b.Config().IRCListenerAccount; account != "" {
+		return account
+	}
+	return b.Config().IRCListenerName
+}
+
+// identify logs the listener in to services, if it has a password
+func (i *ircListener) identify() {
+	conf := i.bridge.Config()
+	if conf.IRCListenerPassword == "" {
+		return
+	}
+
+	vars := servicesVars{Nick: i.GetNick(), Account: i.bridge.listenerAccount(), Password: conf.IRCListenerPassword}
+	if command := vars.fill(conf.Services.Identify); command != "" {
+		i.SendRaw(command)
+	}
+}
+
+// regainNick takes back the listener's nick once it has logged in, if someone else has it
+func (i *ircListener) regainNick() {
+	conf := i.bridge.Config()
+	wanted := conf.IRCListenerName
+	if i.isupport.EqualFold(i.GetNick(), wanted) {
+		return
+	}
+
+	listenerLog.WithField("nick", wanted).Infoln("Taking back the listener's nick with services")
+	vars := servicesVars{Nick: wanted, Account: i.bridge.listenerAccount(), Password: conf.IRCListenerPassword}
+	if regain := vars.fill(conf.Services.Regain); regain != "" {
+		i.SendRaw(regain)
+		return
+	}
+	for _, command := range []string{vars.fill(conf.Services.Ghost), vars.fill(conf.Services.Release)} {
+		if command != "" {
+			i.SendRaw(command)
+		}
+	}
+	i.SendRaw("NICK " + wanted)
+}
+
+// requestOp asks services to make the listener an operator in a mapped channel it has joined,
+// if Config.ServicesRequestOp is set
+func (i *ircListener) requestOp(e *irc.Event) {
+	conf := i.bridge.Config()
+	if !conf.ServicesRequestOp || len(e.Arguments) < 2 {
+		return
+	}
+	if _, ok := i.bridge.GetMappingByIRC(e.Arguments[1]); !ok {
+		return
+	}
+
+	vars := servicesVars{Nick: i.GetNick(), Account: i.bridge.listenerAccount(), Channel: e.Arguments[1]}
+	if command := vars.fill(conf.Services.Op); command != "" {
+		i.SendRaw(command)
+	}
+}
+
+// identify logs a puppet in to its account with services, if it has one
+// and the server didn't let it log in with SASL
+func (i *ircConnection) identify() {
+	conf := i.manager.bridge.Config()
+	account, ok := conf.PuppetAccounts[i.discord.ID]
+	if !ok || account.Password == "" || i.hasCaps([]string{"sasl"}) {
+		return
+	}
+
+	vars := servicesVars{Nick: i.GetNick(), Account: account.Account, Password: account.Password}
+	if command := vars.fill(conf.Services.Identify); command != "" {
+		i.SendRaw(command)
+	}
+}
@@ -0,0 +1,64 @@
+package bridge
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultShutdownTimeout is how long Close waits for queued messages to be sent
+// if Config.ShutdownTimeout is not set
+const defaultShutdownTimeout = 10 * time.Second
+
+// drainCheckInterval is how often the loop checks whether everything has been sent while closing
+const drainCheckInterval = 100 * time.Millisecond
+
+// isClosing returns true once Close has been called, after which new messages are not relayed
+func (b *Bridge) isClosing() bool {
+	return atomic.LoadInt32(&b.closing) == 1
+}
+
+func (b *Bridge) shutdownTimeout() time.Duration {
+	if b.Config().ShutdownTimeout > 0 {
+		return b.Config().ShutdownTimeout
+	}
+	return defaultShutdownTimeout
+}
+
+// drained returns true if nothing is waiting to be relayed or sent to IRC.
+// Lines for IRC are not waited for if IRC is down, as they can't be sent.
+func (b *Bridge) drained() bool {
+	if len(b.discordMessagesChan) > 0 || len(b.discordMessageEventsChan) > 0 || b.workers.Pending() > 0 {
+		return false
+	}
+
+	if !b.ircListener.Registered() {
+		return true
+	}
+	if b.ircListener.sendQueue.Len() > 0 {
+		return false
+	}
+	for _, con := range b.ircManager.connections() {
+		if len(con.messages) > 0 || con.sendQueue.Len() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// shutdown disconnects from IRC and Discord, once the loop has finished draining
+func (b *Bridge) shutdown() {
+	close(b.stop)
+
+	b.ircListener.QuitMessage = b.Config().IRCQuitMessage
+	b.ircListener.Quit()
+	b.ircManager.Close()
+	if err := b.discord.Close(); err != nil {
+		discordLog.WithError(err).Warnln("Could not close the Discord session")
+	}
+	b.closeChannelLogs()
+	if err := b.store.Close(); err != nil {
+		log.WithError(err).Errorln("Could not save the store")
+	}
+}
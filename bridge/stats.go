@@ -0,0 +1,156 @@
+package bridge
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// statsRecheckInterval is how often watchStats checks whether stats have been turned on
+const statsRecheckInterval = time.Minute
+
+// statsTopicSeparator separates the stats from the rest of an IRC channel topic
+const statsTopicSeparator = " | "
+
+// watchStats updates the stats every Config.StatsInterval, while it is set
+func (b *Bridge) watchStats() {
+	for {
+		interval := b.Config().StatsInterval
+		if interval <= 0 {
+			interval = statsRecheckInterval
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-b.stop:
+			return
+		}
+
+		if b.Config().StatsInterval > 0 {
+			b.updateStats()
+		}
+	}
+}
+
+// formatStats fills in ${IRC} and ${DISCORD} in Config.StatsTemplate
+func (b *Bridge) formatStats(irc, discord int) string {
+	return strings.NewReplacer(
+		"${IRC}", strconv.Itoa(irc),
+		"${DISCORD}", strconv.Itoa(discord),
+	).Replace(b.Config().StatsTemplate)
+}
+
+// statsPattern matches a topic ending with stats formatted by formatStats
+func (b *Bridge) statsPattern() *regexp.Regexp {
+	pattern := regexp.QuoteMeta(b.Config().StatsTemplate)
+	for _, placeholder := range []string{"${IRC}", "${DISCORD}"} {
+		pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta(placeholder), `\d+`)
+	}
+	return regexp.MustCompile("(" + regexp.QuoteMeta(statsTopicSeparator) + ")?" + pattern + "$")
+}
+
+// updateStats counts who is on each side, and shows it in the configured places
+func (b *Bridge) updateStats() {
+	conf := b.Config()
+	if !b.ircListener.Registered() || (conf.StatsDiscordChannel == "" && !conf.StatsIRCTopics) {
+		return
+	}
+
+	online := b.discord.onlineCount()
+	everyone := make(map[string]struct{})
+	for _, mapping := range b.mappingTable().mappings {
+		names, err := b.ChannelNames(mapping.IRCChannel)
+		if err != nil {
+			listenerLog.WithField("error", err).WithField("channel", mapping.IRCChannel).Warnln("could not count users for stats")
+			continue
+		}
+
+		nicks := b.ircNicks(names)
+		for _, nick := range nicks {
+			everyone[b.ircListener.isupport.Fold(nick)] = struct{}{}
+		}
+		if conf.StatsIRCTopics {
+			b.updateTopicStats(mapping.IRCChannel, b.formatStats(len(nicks), online))
+		}
+	}
+
+	if conf.StatsDiscordChannel != "" {
+		b.discord.renameForStats(conf.StatsDiscordChannel, b.formatStats(len(everyone), online))
+	}
+}
+
+// ircNicks returns the nicks from NAMES without status prefixes, leaving out the listener and puppets
+func (b *Bridge) ircNicks(names []string) []string {
+	var nicks []string
+	for _, name := range names {
+		nick := strings.TrimLeft(name, b.ircListener.isupport.Prefixes())
+		if b.ircListener.isupport.EqualFold(nick, b.ircListener.GetNick()) {
+			continue
+		}
+		if _, ok := b.ircManager.puppetByNick(nick); ok {
+			continue
+		}
+		nicks = append(nicks, nick)
+	}
+	return nicks
+}
+
+// updateTopicStats replaces the stats at the end of an IRC channel's topic.
+// The listener needs to be allowed to change the topic.
+func (b *Bridge) updateTopicStats(channel, stats string) {
+	replies, err := b.ircListener.Query("TOPIC "+channel, channel, nil, []string{"331", "332"})
+	if err != nil {
+		listenerLog.WithField("error", err).WithField("channel", channel).Warnln("could not get topic for stats")
+		return
+	}
+
+	var topic string
+	for _, e := range replies {
+		if e.Code == "332" && len(e.Arguments) >= 3 {
+			topic = e.Arguments[2]
+		}
+	}
+
+	updated := b.statsPattern().ReplaceAllString(topic, "")
+	if updated != "" {
+		updated += statsTopicSeparator
+	}
+	updated += stats
+	if updated != topic {
+		b.ircListener.SendRaw("TOPIC " + channel + " :" + updated)
+	}
+}
+
+// onlineCount returns how many members of the bridged guilds aren't offline, counting each user once
+func (d *discordBot) onlineCount() int {
+	online := make(map[string]bool)
+	for _, guildID := range d.guildIDs {
+		guild, err := d.Session.State.Guild(guildID)
+		if err != nil {
+			continue
+		}
+		for _, presence := range guild.Presences {
+			if presence.Status != discordgo.StatusOffline && presence.User != nil {
+				online[presence.User.ID] = true
+			}
+		}
+	}
+	return len(online)
+}
+
+// renameForStats names a Discord channel after the stats, such as a voice channel nobody can join.
+// Discord only allows channels to be renamed twice every ten minutes.
+func (d *discordBot) renameForStats(channelID, stats string) {
+	if channel, err := d.Session.State.Channel(channelID); err == nil && channel.Name == stats {
+		return
+	}
+
+	// ChannelEdit would also send position 0, moving the channel to the top of the list
+	endpoint := discordgo.EndpointChannel(channelID)
+	if _, err := d.Session.RequestWithBucketID("PATCH", endpoint, map[string]string{"name": stats}, endpoint); err != nil {
+		discordLog.WithField("error", err).WithField("channel", channelID).Warnln("could not rename channel for stats")
+	}
+}
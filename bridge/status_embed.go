@@ -0,0 +1,151 @@
+package bridge
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// statusEmbedTitle is the title of the pinned status embed, and how it is found again after a restart
+const statusEmbedTitle = "IRC bridge status"
+
+// Colours of the status embed, for when the bridge is in every channel, connected but
+// missing some, and disconnected
+const (
+	statusColourReady        = 0x43b581
+	statusColourLive         = 0xfaa61a
+	statusColourDisconnected = 0xf04747
+)
+
+// watchStatusEmbed keeps the embed in Config.StatusChannel up to date every Config.StatusInterval,
+// while both are set
+func (b *Bridge) watchStatusEmbed() {
+	var messageID, channelID string
+	for {
+		interval := b.Config().StatusInterval
+		if interval <= 0 {
+			interval = statsRecheckInterval
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-b.stop:
+			return
+		}
+
+		conf := b.Config()
+		if conf.StatusChannel == "" || conf.StatusInterval <= 0 {
+			continue
+		}
+		if conf.StatusChannel != channelID {
+			channelID, messageID = conf.StatusChannel, b.discord.findStatusMessage(conf.StatusChannel)
+		}
+
+		messageID = b.discord.updateStatusEmbed(channelID, messageID, b.statusEmbed())
+	}
+}
+
+// statusEmbed describes the state of the bridge
+func (b *Bridge) statusEmbed() *discordgo.MessageEmbed {
+	h := b.Health()
+
+	ircState, colour := "Disconnected", statusColourDisconnected
+	if h.IRCRegistered {
+		ircState, colour = "Connected for "+b.ircListener.connectedFor().String(), statusColourLive
+		if h.Ready() {
+			colour = statusColourReady
+		}
+	}
+
+	lag := "Unknown"
+	if d := b.ircListener.lag(); h.IRCRegistered && d > 0 {
+		lag = d.Round(time.Millisecond).String()
+	}
+
+	var channels []string
+	joined := 0
+	for channel, in := range h.Channels {
+		if in {
+			joined++
+		} else {
+			channel += " (not joined)"
+		}
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	channelList := strings.Join(channels, "\n")
+	if channelList == "" {
+		channelList = "None"
+	}
+
+	return &discordgo.MessageEmbed{
+		Title: statusEmbedTitle,
+		Color: colour,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "IRC", Value: ircState, Inline: true},
+			{Name: "Lag", Value: lag, Inline: true},
+			{Name: "Discord lag", Value: fmt.Sprintf("%dms", h.DiscordLag), Inline: true},
+			{Name: "Uptime", Value: time.Since(b.startedAt).Round(time.Second).String(), Inline: true},
+			{Name: "Puppets", Value: strconv.Itoa(len(b.Puppets())), Inline: true},
+			{Name: fmt.Sprintf("Channels (%d of %d joined)", joined, len(channels)), Value: truncateEmbedField(channelList)},
+		},
+		Footer:    &discordgo.MessageEmbedFooter{Text: "Last updated"},
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+}
+
+// truncateEmbedField cuts value short enough for an embed field
+func truncateEmbedField(value string) string {
+	const limit = 1024
+	if len(value) <= limit {
+		return value
+	}
+	return truncateNick(value, limit-len("…")) + "…"
+}
+
+// findStatusMessage returns the ID of the status embed pinned in channelID by an earlier run, if there is one
+func (d *discordBot) findStatusMessage(channelID string) string {
+	pinned, err := d.Session.ChannelMessagesPinned(channelID)
+	if err != nil || d.Session.State.User == nil {
+		return ""
+	}
+	for _, m := range pinned {
+		if m.Author != nil && m.Author.ID == d.Session.State.User.ID &&
+			len(m.Embeds) > 0 && m.Embeds[0].Title == statusEmbedTitle {
+			return m.ID
+		}
+	}
+	return ""
+}
+
+// updateStatusEmbed edits the status message in place, or sends and pins a new one if there isn't one.
+// Returns the ID of the status message.
+func (d *discordBot) updateStatusEmbed(channelID, messageID string, embed *discordgo.MessageEmbed) string {
+	if messageID != "" {
+		if _, err := d.Session.ChannelMessageEditEmbed(channelID, messageID, embed); err == nil {
+			return messageID
+		}
+		// It was probably deleted, so send another
+	}
+
+	m, err := d.Session.ChannelMessageSendEmbed(channelID, embed)
+	if err != nil {
+		discordLog.WithField("error", err).WithField("channel", channelID).Warnln("could not send status embed")
+		return ""
+	}
+	if err := d.Session.ChannelMessagePin(channelID, m.ID); err != nil {
+		discordLog.WithField("error", err).WithField("channel", channelID).Warnln("could not pin status embed")
+	}
+	return m.ID
+}
+
+// connectedFor returns how long ago the server welcomed the listener
+func (i *ircListener) connectedFor() time.Duration {
+	welcomed := atomic.LoadInt64(&i.welcomedAt)
+	return time.Duration(time.Now().UnixNano() - welcomed).Round(time.Second)
+}
@@ -1,6 +1,8 @@
 package bridge
 
 import (
+	"time"
+
 	"github.com/bwmarrin/discordgo"
 )
 
@@ -10,6 +12,13 @@ type DiscordMessage struct {
 	Content  string
 	IsAction bool
 	PmTarget string // target username, for PMs
+
+	// StatusMsg is the STATUSMSG prefix to send the message with, e.g. "@" to only
+	// message channel operators.
+	StatusMsg string
+
+	// ReplyTo is the msgid of the IRC message this one replies to, if it was relayed from IRC
+	ReplyTo string
 }
 
 // IRCMessage is a chat message sent to Discord (from IRCListener)
@@ -18,6 +27,22 @@ type IRCMessage struct {
 	Username   string
 	Message    string
 	IsAction   bool
+
+	// Nick is who sent the message, which Username may be a display name for
+	Nick string
+
+	// Timestamp is when the server received the message (IRCv3 server-time).
+	// It is zero for messages that did not come with a timestamp.
+	Timestamp time.Time
+
+	// Label is the IRCv3 label to send the message with, for delivery confirmation
+	Label string
+	// ReplyTo is the msgid of the IRC message this one replies to, if any
+	ReplyTo string
+
+	// Tags are the IRCv3 message tags the message was received with,
+	// such as "account", "msgid" and "+draft/reply".
+	Tags map[string]string
 }
 
 // DiscordUser is information that IRC needs to know about a user
@@ -28,10 +53,37 @@ type DiscordUser struct {
 	Nick          string // still non-unique
 	Bot           bool   // are they a bot?
 	Online        bool
+	Away          string // away message for IRC if they are idle or busy, empty if they are active
 }
 
 // Mapping is a mapping between a Discord channel and an IRC channel (essentially a tuple).
 type Mapping struct {
 	DiscordChannel string
 	IRCChannel     string
+
+	// Direction limits which way messages are relayed, both ways if empty
+	Direction string
+}
+
+// Mapping directions for one-way channels
+const (
+	DirectionIRCToDiscord = "irc_to_discord"
+	DirectionDiscordToIRC = "discord_to_irc"
+)
+
+// RelaysToDiscord returns true if IRC messages should be relayed to Discord
+func (m Mapping) RelaysToDiscord() bool {
+	return m.Direction != DirectionDiscordToIRC
+}
+
+// RelaysToIRC returns true if Discord messages should be relayed to IRC
+func (m Mapping) RelaysToIRC() bool {
+	return m.Direction != DirectionIRCToDiscord
+}
+
+// PuppetAccount is the services account a puppet logs in to using SASL,
+// so that it can speak in channels that only allow registered users.
+type PuppetAccount struct {
+	Account  string
+	Password string
 }
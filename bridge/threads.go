@@ -0,0 +1,80 @@
+package bridge
+
+import (
+	"encoding/json"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/qaisjp/go-discord-irc/transmitter"
+)
+
+// replacedThreadsBucket is the store bucket for mapped threads that were deleted, from the
+// deleted thread's ID to the ID of the one made to replace it
+const replacedThreadsBucket = "replaced_threads"
+
+// channelTypeGuildForum is the type of forum channels, which the discordgo we use doesn't know about
+const channelTypeGuildForum discordgo.ChannelType = 15
+
+// replacedThread returns the thread that replaced channel, if it is a deleted thread, or channel
+func (b *Bridge) replacedThread(channel string) string {
+	// A replacement can be deleted too, but not forever
+	for i := 0; i < 10; i++ {
+		replacement, ok := b.store.Get(replacedThreadsBucket, channel)
+		if !ok {
+			break
+		}
+		channel = replacement
+	}
+	return channel
+}
+
+// recreateThread makes a new thread to replace a mapped thread or forum post that was deleted,
+// in the same channel and with the same name, and maps it instead
+func (b *Bridge) recreateThread(old string) (string, bool) {
+	info, ok := b.discord.transmitter.ThreadInfo(old)
+	if !ok {
+		return "", false
+	}
+
+	// Forum posts need a first message, and other threads a type
+	data := map[string]interface{}{"name": info.Name}
+	if parent, err := b.discord.Session.State.Channel(info.ParentID); err == nil && parent.Type == channelTypeGuildForum {
+		data["message"] = map[string]string{"content": "Relaying IRC here, as the last post was deleted."}
+	} else {
+		data["type"] = discordgo.ChannelTypeGuildPublicThread
+	}
+
+	endpoint := discordgo.EndpointChannelThreads(info.ParentID)
+	body, err := b.discord.Session.RequestWithBucketID("POST", endpoint, data, endpoint)
+	var thread discordgo.Channel
+	if err == nil {
+		err = json.Unmarshal(body, &thread)
+	}
+	if err != nil {
+		discordLog.WithError(err).WithField("thread", old).Errorln("could not recreate deleted thread")
+		return "", false
+	}
+
+	discordLog.WithField("thread", old).WithField("replacement", thread.ID).Println("Recreated deleted thread")
+	if err := b.store.Set(replacedThreadsBucket, old, thread.ID); err != nil {
+		discordLog.WithError(err).WithField("thread", old).Errorln("could not save recreated thread")
+	}
+	b.mappingsMu.Lock()
+	err = b.setChannelMappings(b.effectiveMappings(b.configMappings, b.storedMappings()))
+	b.mappingsMu.Unlock()
+	if err != nil {
+		discordLog.WithError(err).Errorln("could not map recreated thread")
+	}
+	return thread.ID, true
+}
+
+// sendWithWebhook sends a message to channel with the transmitter, recreating the
+// channel if it was a thread that has been deleted
+func (b *Bridge) sendWithWebhook(channel string, params *discordgo.WebhookParams) (*discordgo.Message, error) {
+	sent, err := b.discord.transmitter.Send(channel, params)
+	if err == transmitter.ErrThreadNotFound {
+		if replacement, ok := b.recreateThread(channel); ok {
+			return b.discord.transmitter.Send(replacement, params)
+		}
+	}
+	return sent, err
+}
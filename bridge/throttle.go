@@ -0,0 +1,146 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values for Config.ThrottleAction, what happens to messages from someone sending too many
+const (
+	ThrottleActionDrop  = "drop"
+	ThrottleActionDelay = "delay"
+	ThrottleActionMute  = "mute"
+)
+
+// throttleState is what throttler knows about one person
+type throttleState struct {
+	// sent is when their recent messages were (or will be, if delayed) relayed
+	sent []time.Time
+	// last is their last message, repeats is how many times in a row they've sent it
+	last    string
+	repeats int
+	// throttled is set once they've been announced, until a message gets through
+	throttled  bool
+	mutedUntil time.Time
+}
+
+// throttler limits how many messages each person can have relayed in Config.ThrottleInterval,
+// and how many times in a row they can send the same message, in either direction
+type throttler struct {
+	sync.Mutex
+	states map[string]*throttleState // by throttleKey
+	bridge *Bridge
+}
+
+func newThrottler(bridge *Bridge) *throttler {
+	return &throttler{states: make(map[string]*throttleState), bridge: bridge}
+}
+
+// discordThrottleKey and ircThrottleKey name the people throttler keeps track of
+func discordThrottleKey(userID string) string {
+	return "discord " + userID
+}
+
+func (b *Bridge) ircThrottleKey(nick string) string {
+	return "irc " + b.ircListener.isupport.Fold(nick)
+}
+
+// Allow checks a message from the person with key (called name in announcements) against the limits.
+// It returns how long to wait before relaying the message, or false if it shouldn't be relayed.
+func (t *throttler) Allow(key, name, content string) (time.Duration, bool) {
+	conf := t.bridge.Config()
+	if conf.ThrottleInterval <= 0 || (conf.ThrottleMessages <= 0 && conf.ThrottleRepeats <= 0) {
+		return 0, true
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	t.prune(now, conf.ThrottleInterval)
+	s, ok := t.states[key]
+	if !ok {
+		s = &throttleState{}
+		t.states[key] = s
+	}
+
+	if now.Before(s.mutedUntil) {
+		return 0, false
+	}
+
+	content = strings.ToLower(strings.TrimSpace(content))
+	if content == s.last {
+		s.repeats++
+	} else {
+		s.last, s.repeats = content, 1
+	}
+
+	repeated := conf.ThrottleRepeats > 0 && s.repeats > conf.ThrottleRepeats
+	flooding := conf.ThrottleMessages > 0 && len(s.sent) >= conf.ThrottleMessages
+	if !repeated && !flooding {
+		s.sent = append(s.sent, now)
+		s.throttled = false
+		return 0, true
+	}
+
+	reason := fmt.Sprintf("sent more than %d messages in %s", conf.ThrottleMessages, conf.ThrottleInterval)
+	if repeated {
+		reason = fmt.Sprintf("repeated a message %d times", s.repeats)
+	}
+
+	switch conf.ThrottleAction {
+	case ThrottleActionMute:
+		s.mutedUntil = now.Add(conf.ThrottleMuteDuration)
+		s.throttled = true
+		t.announce(fmt.Sprintf("%s %s, so they are muted for %s", name, reason, conf.ThrottleMuteDuration))
+		return 0, false
+
+	case ThrottleActionDelay:
+		// Repeats would still be repeats later, and messages too far behind are dropped
+		if repeated {
+			break
+		}
+		at := s.sent[len(s.sent)-conf.ThrottleMessages].Add(conf.ThrottleInterval)
+		if at.Sub(now) <= conf.ThrottleInterval {
+			s.sent = append(s.sent, at)
+			if !s.throttled {
+				s.throttled = true
+				t.announce(fmt.Sprintf("%s %s, so their messages are delayed", name, reason))
+			}
+			return at.Sub(now), true
+		}
+	}
+
+	if !s.throttled {
+		s.throttled = true
+		t.announce(fmt.Sprintf("%s %s, so their messages are dropped", name, reason))
+	}
+	return 0, false
+}
+
+// prune forgets messages older than interval, and people who haven't sent any since
+func (t *throttler) prune(now time.Time, interval time.Duration) {
+	for key, s := range t.states {
+		i := 0
+		for i < len(s.sent) && now.Sub(s.sent[i]) > interval {
+			i++
+		}
+		s.sent = s.sent[i:]
+		if len(s.sent) == 0 && now.After(s.mutedUntil) {
+			delete(t.states, key)
+		}
+	}
+}
+
+// announce tells moderators in Config.ThrottleChannel about a throttle
+func (t *throttler) announce(message string) {
+	listenerLog.Infoln("Throttled:", message)
+
+	channel := t.bridge.Config().ThrottleChannel
+	if channel == "" {
+		return
+	}
+	go t.bridge.sendToDiscord(channel, "", "", "_"+message+"_")
+}
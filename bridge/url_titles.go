@@ -0,0 +1,70 @@
+package bridge
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/qaisjp/go-discord-irc/unfurl"
+	log "github.com/sirupsen/logrus"
+)
+
+// urlTitlesMax is how many URLs in a message have their titles added
+const urlTitlesMax = 3
+
+// urlTitles returns " [Title: …]" for each URL in text with a page title, if Config.URLTitles
+// adds them to messages relayed in direction. It can take a while, as the pages are fetched.
+func (b *Bridge) urlTitles(direction, text string) string {
+	conf := b.Config()
+	if _, ok := conf.URLTitles[direction]; !ok {
+		return ""
+	}
+
+	var titles strings.Builder
+	fetched := 0
+	for _, rawURL := range unfurl.URLs(text) {
+		if fetched == urlTitlesMax {
+			break
+		}
+		// Links to Discord messages are quoted instead, see linkQuotes
+		if messageLinkPattern.MatchString(rawURL) || !b.urlTitleAllowed(rawURL) {
+			continue
+		}
+		fetched++
+
+		title, err := b.unfurler.Title(rawURL)
+		if err != nil {
+			log.WithError(err).WithField("url", rawURL).Debugln("Could not get URL title")
+			continue
+		}
+		if title != "" {
+			titles.WriteString(" [Title: " + title + "]")
+		}
+	}
+	return titles.String()
+}
+
+// urlTitleAllowed returns true if the host of a URL matches Config.URLTitlesAllowed (if it is set),
+// and doesn't match Config.URLTitlesDenied
+func (b *Bridge) urlTitleAllowed(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+
+	conf := b.Config()
+	for _, denied := range conf.URLTitlesDenied {
+		if denied.Match(host) {
+			return false
+		}
+	}
+	if len(conf.URLTitlesAllowed) == 0 {
+		return true
+	}
+	for _, allowed := range conf.URLTitlesAllowed {
+		if allowed.Match(host) {
+			return true
+		}
+	}
+	return false
+}
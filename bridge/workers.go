@@ -0,0 +1,108 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+)
+
+// workerIdleTimeout is how long a channel worker waits for work before stopping
+const workerIdleTimeout = time.Minute
+
+// channelWorkers relays messages for each channel on its own goroutine.
+// Messages for a channel are sent in order, but a channel that is slow to
+// send to (like a rate limited Discord channel) doesn't hold up the others.
+type channelWorkers struct {
+	sync.Mutex
+	workers map[string]*channelWorker
+	size    int
+}
+
+type channelWorker struct {
+	jobs chan func()
+	// pending is how many jobs have been given to the worker and not finished
+	pending int
+}
+
+// toDiscordWorker and toIRCWorker are the keys of the workers for each direction of a channel,
+// so that retrying a send one way doesn't hold up messages going the other way
+func toDiscordWorker(ircChannel string) string { return "i2d:" + ircChannel }
+func toIRCWorker(ircChannel string) string     { return "d2i:" + ircChannel }
+
+func newChannelWorkers(size int) *channelWorkers {
+	return &channelWorkers{
+		workers: make(map[string]*channelWorker),
+		size:    size,
+	}
+}
+
+// Do runs job after the jobs already given for channel.
+// It blocks if the channel's queue is full.
+func (w *channelWorkers) Do(channel string, job func()) {
+	w.Lock()
+	worker, ok := w.workers[channel]
+	if !ok {
+		worker = &channelWorker{jobs: make(chan func(), w.size)}
+		w.workers[channel] = worker
+		go w.run(channel, worker)
+	}
+	worker.pending++
+	w.Unlock()
+
+	worker.jobs <- job
+}
+
+func (w *channelWorkers) run(channel string, worker *channelWorker) {
+	idle := time.NewTimer(workerIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case job := <-worker.jobs:
+			job()
+
+			w.Lock()
+			worker.pending--
+			w.Unlock()
+
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(workerIdleTimeout)
+
+		case <-idle.C:
+			// Only stop if nothing has been given to the worker since it went idle
+			w.Lock()
+			if worker.pending == 0 {
+				delete(w.workers, channel)
+				w.Unlock()
+				return
+			}
+			w.Unlock()
+			idle.Reset(workerIdleTimeout)
+		}
+	}
+}
+
+// Pending returns how many jobs have been given to workers and not finished
+func (w *channelWorkers) Pending() int {
+	w.Lock()
+	defer w.Unlock()
+
+	pending := 0
+	for _, worker := range w.workers {
+		pending += worker.pending
+	}
+	return pending
+}
+
+// Depths returns how many jobs are waiting for each channel
+func (w *channelWorkers) Depths() map[string]ChannelDepth {
+	w.Lock()
+	defer w.Unlock()
+
+	depths := make(map[string]ChannelDepth, len(w.workers))
+	for channel, worker := range w.workers {
+		depths[channel] = ChannelDepth{Len: len(worker.jobs), Cap: cap(worker.jobs)}
+	}
+	return depths
+}
@@ -0,0 +1,195 @@
+// Package chanlog writes the traffic of IRC channels to log files, one file per channel per day,
+// either like ZNC's log module or as JSON lines.
+package chanlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of log file
+const (
+	// FormatZNC writes lines like "[15:04:05] <nick> message", to files ending in .log
+	FormatZNC = "znc"
+	// FormatJSONL writes an Entry as JSON on each line, to files ending in .jsonl
+	FormatJSONL = "jsonl"
+)
+
+// Kind is what happened in a channel
+type Kind string
+
+// Kinds of entry
+const (
+	KindMessage Kind = "message"
+	KindAction  Kind = "action"
+	KindNotice  Kind = "notice"
+	KindJoin    Kind = "join"
+	KindPart    Kind = "part"
+	KindQuit    Kind = "quit"
+	KindKick    Kind = "kick"
+	KindNick    Kind = "nick"
+	KindTopic   Kind = "topic"
+)
+
+// Entry is something that happened in a channel
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	Kind    Kind      `json:"kind"`
+	Nick    string    `json:"nick"`
+	// Text is the message, part or quit reason, new nick, kicked nick and reason (separated by a space), or topic
+	Text string `json:"text,omitempty"`
+	// Source is "irc", or "discord" for messages relayed from Discord
+	Source string `json:"source"`
+}
+
+// Line formats an entry as a line (without a newline) of a log file in format
+func Line(e Entry, format string) (string, error) {
+	if format == FormatJSONL {
+		line, err := json.Marshal(e)
+		return string(line), err
+	}
+
+	stamp := e.Time.Format("[15:04:05] ")
+	nick := e.Nick
+	if e.Source == "discord" {
+		nick += "@discord"
+	}
+	switch e.Kind {
+	case KindAction:
+		return stamp + "* " + nick + " " + e.Text, nil
+	case KindNotice:
+		return stamp + "-" + nick + "- " + e.Text, nil
+	case KindJoin:
+		return stamp + "*** Joins: " + nick, nil
+	case KindPart:
+		return stamp + "*** Parts: " + nick + " (" + e.Text + ")", nil
+	case KindQuit:
+		return stamp + "*** Quits: " + nick + " (" + e.Text + ")", nil
+	case KindKick:
+		kicked := strings.SplitN(e.Text, " ", 2)
+		line := stamp + "*** " + kicked[0] + " was kicked by " + nick
+		if len(kicked) > 1 {
+			line += " (" + kicked[1] + ")"
+		}
+		return line, nil
+	case KindNick:
+		return stamp + "*** " + nick + " is now known as " + e.Text, nil
+	case KindTopic:
+		return stamp + "*** " + nick + " changes topic to '" + e.Text + "'", nil
+	}
+	return stamp + "<" + nick + "> " + e.Text, nil
+}
+
+// FileName returns the file an entry for channel at t is written to, relative to the log directory
+func FileName(channel string, t time.Time, format string) string {
+	ext := ".log"
+	if format == FormatJSONL {
+		ext = ".jsonl"
+	}
+	return filepath.Join(channelDir(channel), t.Format("2006-01-02")+ext)
+}
+
+// channelDir returns the directory a channel's log files are in, relative to the log directory
+func channelDir(channel string) string {
+	// Channel names can contain slashes, which mustn't make another directory
+	dir := strings.NewReplacer("/", "_", "\\", "_").Replace(strings.ToLower(channel))
+	if dir == "." || dir == ".." {
+		dir = "_" + dir
+	}
+	return dir
+}
+
+// Logger writes entries to files in a directory. It is safe to use from multiple goroutines.
+type Logger struct {
+	dir    string
+	format string
+
+	mu sync.Mutex
+	// files are the open log files, by channel, with the file names they were opened for
+	files map[string]*openFile
+}
+
+type openFile struct {
+	name string
+	f    *os.File
+}
+
+// New returns a Logger writing to files in dir, in format (FormatZNC if empty)
+func New(dir, format string) (*Logger, error) {
+	if format == "" {
+		format = FormatZNC
+	}
+	if format != FormatZNC && format != FormatJSONL {
+		return nil, fmt.Errorf("the format must be %s or %s, not %q", FormatZNC, FormatJSONL, format)
+	}
+	return &Logger{dir: dir, format: format, files: make(map[string]*openFile)}, nil
+}
+
+// Dir returns the directory the logger writes to
+func (l *Logger) Dir() string {
+	return l.dir
+}
+
+// Format returns the format the logger writes in
+func (l *Logger) Format() string {
+	return l.format
+}
+
+// Write appends an entry to its channel's log file for the day, in local time
+func (l *Logger) Write(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.Local()
+
+	line, err := Line(e, l.format)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := strings.ToLower(e.Channel)
+	name := filepath.Join(l.dir, FileName(e.Channel, e.Time, l.format))
+	open, ok := l.files[key]
+	if !ok || open.name != name {
+		if ok {
+			open.f.Close()
+			delete(l.files, key)
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		open = &openFile{name: name, f: f}
+		l.files[key] = open
+	}
+
+	_, err = open.f.WriteString(line + "\n")
+	return err
+}
+
+// Close closes the open log files
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var firstErr error
+	for key, open := range l.files {
+		if err := open.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(l.files, key)
+	}
+	return firstErr
+}
@@ -0,0 +1,75 @@
+package chanlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLine(t *testing.T) {
+	at := time.Date(2021, 3, 1, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		entry Entry
+		line  string
+	}{
+		{Entry{Time: at, Kind: KindMessage, Nick: "alice", Text: "hello", Source: "irc"}, "[15:04:05] <alice> hello"},
+		{Entry{Time: at, Kind: KindMessage, Nick: "bob", Text: "hi", Source: "discord"}, "[15:04:05] <bob@discord> hi"},
+		{Entry{Time: at, Kind: KindAction, Nick: "alice", Text: "waves"}, "[15:04:05] * alice waves"},
+		{Entry{Time: at, Kind: KindNotice, Nick: "alice", Text: "psst"}, "[15:04:05] -alice- psst"},
+		{Entry{Time: at, Kind: KindJoin, Nick: "alice"}, "[15:04:05] *** Joins: alice"},
+		{Entry{Time: at, Kind: KindPart, Nick: "alice", Text: "bye"}, "[15:04:05] *** Parts: alice (bye)"},
+		{Entry{Time: at, Kind: KindQuit, Nick: "alice", Text: "gone"}, "[15:04:05] *** Quits: alice (gone)"},
+		{Entry{Time: at, Kind: KindKick, Nick: "op", Text: "alice no spam"}, "[15:04:05] *** alice was kicked by op (no spam)"},
+		{Entry{Time: at, Kind: KindNick, Nick: "alice", Text: "alice_"}, "[15:04:05] *** alice is now known as alice_"},
+		{Entry{Time: at, Kind: KindTopic, Nick: "op", Text: "news"}, "[15:04:05] *** op changes topic to 'news'"},
+	}
+
+	for _, tt := range tests {
+		line, err := Line(tt.entry, FormatZNC)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.line, line)
+	}
+
+	line, err := Line(Entry{Time: at, Channel: "#a", Kind: KindMessage, Nick: "alice", Text: "hi", Source: "irc"}, FormatJSONL)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"time":"2021-03-01T15:04:05Z","channel":"#a","kind":"message","nick":"alice","text":"hi","source":"irc"}`, line)
+}
+
+func TestFileName(t *testing.T) {
+	at := time.Date(2021, 3, 1, 15, 4, 5, 0, time.UTC)
+	assert.Equal(t, filepath.Join("#chan", "2021-03-01.log"), FileName("#Chan", at, FormatZNC))
+	assert.Equal(t, filepath.Join("#a_b", "2021-03-01.jsonl"), FileName("#a/b", at, FormatJSONL))
+	assert.Equal(t, filepath.Join("_..", "2021-03-01.log"), FileName("..", at, FormatZNC))
+}
+
+func TestLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chanlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = New(dir, "xml")
+	assert.Error(t, err)
+
+	l, err := New(dir, "")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatZNC, l.Format())
+
+	day1 := time.Date(2021, 3, 1, 12, 0, 0, 0, time.Local)
+	day2 := day1.Add(24 * time.Hour)
+	assert.NoError(t, l.Write(Entry{Time: day1, Channel: "#a", Kind: KindMessage, Nick: "alice", Text: "one"}))
+	assert.NoError(t, l.Write(Entry{Time: day1, Channel: "#A", Kind: KindMessage, Nick: "alice", Text: "two"}))
+	assert.NoError(t, l.Write(Entry{Time: day2, Channel: "#a", Kind: KindMessage, Nick: "alice", Text: "three"}))
+	assert.NoError(t, l.Close())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, FileName("#a", day1, FormatZNC)))
+	assert.NoError(t, err)
+	assert.Equal(t, "[12:00:00] <alice> one\n[12:00:00] <alice> two\n", string(data))
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, FileName("#a", day2, FormatZNC)))
+	assert.NoError(t, err)
+	assert.Equal(t, "[12:00:00] <alice> three\n", string(data))
+}
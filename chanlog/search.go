@@ -0,0 +1,121 @@
+package chanlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Match is a line of a channel's log that matched a search
+type Match struct {
+	Time time.Time
+	// Line is the line as written in FormatZNC, without the timestamp
+	Line string
+}
+
+// Search returns the most recent lines logged in channel containing every word of query,
+// ignoring case, newest first and at most limit of them. Files of both formats are searched,
+// so changing the format doesn't hide older logs.
+func Search(dir, channel, query string, limit int) ([]Match, error) {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 || limit <= 0 {
+		return nil, nil
+	}
+
+	logs := filepath.Join(dir, channelDir(channel))
+	files, err := ioutil.ReadDir(logs)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// Days are searched newest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() > files[j].Name()
+	})
+
+	var matches []Match
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		day, err := time.ParseInLocation("2006-01-02", strings.TrimSuffix(file.Name(), ext), time.Local)
+		if err != nil || file.IsDir() || (ext != ".log" && ext != ".jsonl") {
+			continue
+		}
+
+		found, err := searchFile(filepath.Join(logs, file.Name()), day, ext == ".jsonl", terms)
+		if err != nil {
+			return matches, err
+		}
+		// Lines in a file are oldest first
+		for i := len(found) - 1; i >= 0 && len(matches) < limit; i-- {
+			matches = append(matches, found[i])
+		}
+		if len(matches) == limit {
+			break
+		}
+	}
+	return matches, nil
+}
+
+// searchFile returns the lines of a log file for day that contain every one of terms, in order.
+// Lines that can't be read are skipped.
+func searchFile(name string, day time.Time, jsonl bool, terms []string) ([]Match, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var matches []Match
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		m, ok := parseLine(scanner.Text(), day, jsonl)
+		if ok && containsAll(strings.ToLower(m.Line), terms) {
+			matches = append(matches, m)
+		}
+	}
+	return matches, scanner.Err()
+}
+
+// parseLine reads a line of a log file for day
+func parseLine(line string, day time.Time, jsonl bool) (Match, bool) {
+	if jsonl {
+		var e Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return Match{}, false
+		}
+		e.Time = e.Time.Local()
+		formatted, err := Line(e, FormatZNC)
+		if err != nil {
+			return Match{}, false
+		}
+		return Match{Time: e.Time, Line: formatted[len("[15:04:05] "):]}, true
+	}
+
+	// "[15:04:05] <nick> message"
+	if len(line) < len("[15:04:05] ") || line[0] != '[' || line[9] != ']' {
+		return Match{}, false
+	}
+	clock, err := time.Parse("15:04:05", line[1:9])
+	if err != nil {
+		return Match{}, false
+	}
+	at := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, time.Local)
+	return Match{Time: at, Line: line[len("[15:04:05] "):]}, true
+}
+
+// containsAll returns true if s contains every one of terms
+func containsAll(s string, terms []string) bool {
+	for _, term := range terms {
+		if !strings.Contains(s, term) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package chanlog
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chanlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	day1 := time.Date(2021, 3, 1, 12, 0, 0, 0, time.Local)
+	day2 := day1.Add(24 * time.Hour)
+
+	// The format was changed between the two days
+	znc, err := New(dir, FormatZNC)
+	assert.NoError(t, err)
+	assert.NoError(t, znc.Write(Entry{Time: day1, Channel: "#a", Kind: KindMessage, Nick: "alice", Text: "the build is broken"}))
+	assert.NoError(t, znc.Write(Entry{Time: day1.Add(time.Minute), Channel: "#a", Kind: KindMessage, Nick: "bob", Text: "Build fixed"}))
+	assert.NoError(t, znc.Write(Entry{Time: day1, Channel: "#b", Kind: KindMessage, Nick: "carol", Text: "build elsewhere"}))
+	assert.NoError(t, znc.Close())
+
+	jsonl, err := New(dir, FormatJSONL)
+	assert.NoError(t, err)
+	assert.NoError(t, jsonl.Write(Entry{Time: day2, Channel: "#a", Kind: KindAction, Nick: "dave", Text: "breaks the build", Source: "discord"}))
+	assert.NoError(t, jsonl.Close())
+
+	matches, err := Search(dir, "#A", "BUILD", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Match{
+		{Time: day2, Line: "* dave@discord breaks the build"},
+		{Time: day1.Add(time.Minute), Line: "<bob> Build fixed"},
+		{Time: day1, Line: "<alice> the build is broken"},
+	}, matches)
+
+	matches, err = Search(dir, "#a", "build", 2)
+	assert.NoError(t, err)
+	assert.Len(t, matches, 2)
+
+	matches, err = Search(dir, "#a", "build broken", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Match{{Time: day1, Line: "<alice> the build is broken"}}, matches)
+
+	matches, err = Search(dir, "#nowhere", "build", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+
+	matches, err = Search(dir, "#a", "  ", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
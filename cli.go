@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"github.com/qaisjp/go-discord-irc/configfile"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// checkDialTimeout is how long check waits to connect to an IRC server
+const checkDialTimeout = 10 * time.Second
+
+// readConfig reads and validates the config file at path, returning it and its format
+func readConfig(path string) (*viper.Viper, string, error) {
+	v := viper.New()
+	ext := filepath.Ext(path)
+	if ext == "" {
+		return nil, "", errors.New("--config must be a file ending in .yml, .toml or .json")
+	}
+	configName := strings.TrimSuffix(filepath.Base(path), ext)
+	configType := ext[1:]
+	configPath := filepath.Dir(path)
+	v.SetConfigName(configName)
+	v.SetConfigType(configType)
+	v.AddConfigPath(configPath)
+
+	log.WithFields(log.Fields{
+		"ConfigName": configName,
+		"ConfigType": configType,
+		"ConfigPath": configPath,
+	}).Infoln("Loading configuration...")
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, "", errors.Wrap(err, "could not read config")
+	}
+	if err := validateConfig(v, path, configType); err != nil {
+		return nil, "", errors.Wrap(err, "config is invalid")
+	}
+	return v, configType, nil
+}
+
+// printVersion prints the bridge version and what it was built with
+func printVersion() {
+	moduleVersion := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		moduleVersion = info.Main.Version
+	}
+	fmt.Printf("go-discord-irc %s (module %s, %s %s/%s)\n", version, moduleVersion, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// check validates the config, and that the Discord bot and IRC servers can be used,
+// without bridging anything. Returns the exit code.
+func check(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	config := fs.String("config", "", "Config file to check")
+	dial := fs.Bool("dial", false, "Also connect to each IRC server to check it can be reached (without registering)")
+	_ = fs.Parse(args)
+
+	if *config == "" {
+		log.Errorln("--config argument is required!")
+		return 2
+	}
+
+	v, _, err := readConfig(*config)
+	if err != nil {
+		log.Errorln(err)
+		return 1
+	}
+
+	ok := true
+	for _, name := range networkNames(v) {
+		nv := networkViper(v, name)
+		logger := log.WithField("network", name)
+
+		if err := checkDiscord(nv); err != nil {
+			logger.WithField("error", err).Errorln("Discord check failed")
+			ok = false
+		} else {
+			logger.Infoln("Discord bot can see the guild")
+		}
+
+		if *dial {
+			if err := checkIRC(nv); err != nil {
+				logger.WithField("error", err).Errorln("IRC check failed")
+				ok = false
+			} else {
+				logger.Infoln("IRC server can be reached")
+			}
+		}
+	}
+
+	if !ok {
+		return 1
+	}
+	log.Infoln("Config is OK!")
+	return 0
+}
+
+// checkDiscord checks the Discord token is valid, and that the bot is in each guild
+func checkDiscord(v *viper.Viper) error {
+	token, err := configfile.Expand(v.GetString("discord_token"))
+	if err != nil {
+		return errors.Wrap(err, "could not read discord_token")
+	}
+
+	session, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return err
+	}
+
+	if _, err := session.User("@me"); err != nil {
+		return errors.Wrap(err, "discord_token is invalid")
+	}
+
+	for _, guildID := range readGuildIDs(v) {
+		if _, err := session.Guild(guildID); err != nil {
+			return errors.Wrapf(err, "could not find guild %s, is the bot in it?", guildID)
+		}
+	}
+	return nil
+}
+
+// checkIRC connects to the IRC server, with TLS unless no_tls is set, then disconnects
+func checkIRC(v *viper.Viper) error {
+	server := v.GetString("irc_server")
+	dialer := &net.Dialer{Timeout: checkDialTimeout}
+
+	var conn net.Conn
+	var err error
+	if v.GetBool("no_tls") {
+		conn, err = dialer.Dial("tcp", server)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", server, &tls.Config{
+			InsecureSkipVerify: v.GetBool("insecure"),
+		})
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to %s", server)
+	}
+	return conn.Close()
+}
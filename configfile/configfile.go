@@ -0,0 +1,258 @@
+// Package configfile finds where options are set in YAML, TOML and JSON config files,
+// so that problems with them can be reported with line numbers before they're used.
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/pelletier/go-toml"
+	"github.com/qaisjp/go-discord-irc/pattern"
+	"gopkg.in/yaml.v3"
+)
+
+// Lines parses a config file in the given format ("yaml", "yml", "toml" or "json"),
+// returning the line each option is set on.
+//
+// Options in nested maps are joined with dots, like "networks.libera.irc_server".
+// Options are lower case, as they are in viper.
+func Lines(data []byte, format string) (map[string]int, error) {
+	lines := make(map[string]int)
+
+	var err error
+	switch strings.ToLower(format) {
+	case "yaml", "yml":
+		err = yamlLines(data, lines)
+	case "toml":
+		err = tomlLines(data, lines)
+	case "json":
+		err = jsonLines(data, lines)
+	default:
+		err = fmt.Errorf("unsupported config format %q, use yaml, toml or json", format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+func join(prefix, key string) string {
+	key = strings.ToLower(key)
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func yamlLines(data []byte, lines map[string]int) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) > 0 {
+		walkYAML(doc.Content[0], "", lines)
+	}
+	return nil
+}
+
+func walkYAML(node *yaml.Node, prefix string, lines map[string]int) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+
+		path := join(prefix, key.Value)
+		if value.Kind == yaml.MappingNode && len(value.Content) > 0 {
+			walkYAML(value, path, lines)
+			continue
+		}
+		lines[path] = key.Line
+	}
+}
+
+func tomlLines(data []byte, lines map[string]int) error {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return err
+	}
+	walkTOML(tree, "", lines)
+	return nil
+}
+
+func walkTOML(tree *toml.Tree, prefix string, lines map[string]int) {
+	for _, key := range tree.Keys() {
+		path := join(prefix, key)
+		if sub, ok := tree.GetPath([]string{key}).(*toml.Tree); ok && len(sub.Keys()) > 0 {
+			walkTOML(sub, path, lines)
+			continue
+		}
+		lines[path] = tree.GetPositionPath([]string{key}).Line
+	}
+}
+
+func jsonLines(data []byte, lines map[string]int) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("line %d: expected an object", lineAt(data, dec.InputOffset()))
+	}
+	return walkJSON(dec, data, "", lines)
+}
+
+// walkJSON reads the rest of an object, after its opening brace
+func walkJSON(dec *json.Decoder, data []byte, prefix string, lines map[string]int) error {
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		path := join(prefix, tok.(string))
+		line := lineAt(data, dec.InputOffset())
+
+		if tok, err = dec.Token(); err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			if dec.More() {
+				if err := walkJSON(dec, data, path, lines); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := dec.Token(); err != nil {
+				return err
+			}
+		case json.Delim('['):
+			if err := skipJSONArray(dec); err != nil {
+				return err
+			}
+		}
+		lines[path] = line
+	}
+
+	// closing brace
+	_, err := dec.Token()
+	return err
+}
+
+// skipJSONArray reads the rest of an array, after its opening bracket
+func skipJSONArray(dec *json.Decoder) error {
+	for depth := 1; depth > 0; {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return nil
+}
+
+// lineAt returns the line number of an offset into data
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// A Problem is something wrong with a config file
+type Problem struct {
+	Line    int // 0 if the problem isn't on a particular line
+	Message string
+
+	// Warning is true if the config can still be used
+	Warning bool
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+// Schema describes the options a config file can have
+type Schema struct {
+	// Known are glob patterns of the options that can be set, where "*" matches
+	// one part of an option and "**" matches any number, e.g. "networks.*.irc_server".
+	Known []string
+
+	// Required are the options that must be set
+	Required []string
+}
+
+// Validate returns the unknown options in lines (as warnings), and the missing required ones.
+// Problems are sorted by line.
+func (s Schema) Validate(lines map[string]int) []Problem {
+	known := make([]glob.Glob, 0, len(s.Known))
+	for _, option := range s.Known {
+		known = append(known, glob.MustCompile(option, '.'))
+	}
+
+	var problems []Problem
+	for option, line := range lines {
+		found := false
+		for _, g := range known {
+			if g.Match(option) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, Problem{
+				Line:    line,
+				Message: fmt.Sprintf("unknown option %q", option),
+				Warning: true,
+			})
+		}
+	}
+
+	for _, option := range s.Required {
+		if _, ok := lines[option]; !ok {
+			problems = append(problems, Problem{Message: fmt.Sprintf("missing required option %q", option)})
+		}
+	}
+
+	Sort(problems)
+	return problems
+}
+
+// Globs returns a problem for each of patterns, set on line, that can't be compiled.
+// Patterns are globs, or regular expressions with pattern.RegexPrefix.
+func Globs(line int, option string, patterns []string) []Problem {
+	var problems []Problem
+	for _, p := range patterns {
+		if _, err := pattern.Compile(p); err != nil {
+			problems = append(problems, Problem{
+				Line:    line,
+				Message: fmt.Sprintf("%s: invalid pattern %q: %s", option, p, err),
+			})
+		}
+	}
+	return problems
+}
+
+// Sort sorts problems by line
+func Sort(problems []Problem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Message < problems[j].Message
+	})
+}
@@ -0,0 +1,102 @@
+package configfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+	}{
+		{"yml", `discord_token: abc
+channel_mappings:
+  "#Test key": 123
+empty: {}
+networks:
+  libera: {irc_server: irc.libera.chat}
+list:
+  - a
+`},
+		{"toml", `discord_token = "abc"
+[channel_mappings]
+"#Test key" = 123
+[empty]
+[networks.libera]
+irc_server = "irc.libera.chat"
+list = ["a"]
+`},
+		{"json", `{"discord_token": "abc",
+"channel_mappings": {
+"#Test key": 123},
+"empty": {},
+"networks": {"libera": {
+"irc_server": "irc.libera.chat"}},
+"list": [
+"a"]}
+`},
+	}
+
+	for _, tt := range tests {
+		lines, err := Lines([]byte(tt.data), tt.format)
+		assert.NoError(t, err, tt.format)
+		assert.Equal(t, 1, lines["discord_token"], tt.format)
+		assert.Equal(t, 3, lines["channel_mappings.#test key"], tt.format)
+		assert.Equal(t, 4, lines["empty"], tt.format)
+		assert.Equal(t, 6, lines["networks.libera.irc_server"], tt.format)
+		assert.NotContains(t, lines, "networks", tt.format)
+	}
+}
+
+func TestLinesLists(t *testing.T) {
+	lines, err := Lines([]byte("a:\n  - b: 1\n  - c\nd: 2\n"), "yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1, "d": 4}, lines)
+
+	lines, err = Lines([]byte("{\"a\": [{\"b\": 1}, [\"c\"]],\n\"d\": 2}"), "json")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1, "d": 2}, lines)
+}
+
+func TestLinesErrors(t *testing.T) {
+	_, err := Lines([]byte("a: [b"), "yaml")
+	assert.Error(t, err)
+	_, err = Lines([]byte("[1]"), "json")
+	assert.Error(t, err)
+	_, err = Lines([]byte("a = 1"), "ini")
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	schema := Schema{
+		Known:    []string{"discord_token", "channel_mappings.**", "networks.*.irc_server"},
+		Required: []string{"discord_token", "irc_server"},
+	}
+
+	problems := schema.Validate(map[string]int{
+		"discord_token":              1,
+		"channel_mappings.#a.b":      2,
+		"networks.libera.irc_server": 3,
+		"networks.libera.irc_sever":  4,
+	})
+	assert.Equal(t, []Problem{
+		{Message: `missing required option "irc_server"`},
+		{Line: 4, Message: `unknown option "networks.libera.irc_sever"`, Warning: true},
+	}, problems)
+}
+
+func TestGlobs(t *testing.T) {
+	assert.Empty(t, Globs(1, "ignored_irc_hostmasks", []string{"*!*@*", "bot?!*@*"}))
+
+	assert.Empty(t, Globs(1, "irc_message_filter", []string{`regex:(?i)\b(foo|bar)\b`}))
+	assert.Len(t, Globs(1, "irc_message_filter", []string{"regex:(foo"}), 1)
+
+	problems := Globs(7, "ignored_irc_hostmasks", []string{"*!*@*", "[bot!*@*"})
+	if assert.Len(t, problems, 1) {
+		assert.Equal(t, 7, problems[0].Line)
+		assert.False(t, problems[0].Warning)
+		assert.Contains(t, problems[0].String(), "line 7: ignored_irc_hostmasks: invalid pattern")
+	}
+}
@@ -0,0 +1,44 @@
+package configfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// envRegex matches "${NAME}" environment variable references
+var envRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// filePrefix starts a value that should be read from a file, like "file:/run/secrets/discord_token"
+const filePrefix = "file:"
+
+// Expand resolves references to secrets kept outside the config file.
+// A value starting with "file:" is replaced by the contents of that file (without trailing newlines),
+// otherwise "${NAME}" is replaced by the environment variable NAME.
+// Other uses of "$" are left as they are, so passwords don't need escaping.
+func Expand(value string) (string, error) {
+	if strings.HasPrefix(value, filePrefix) {
+		path := strings.TrimPrefix(value, filePrefix)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	var err error
+	value = envRegex.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envRegex.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return env
+	})
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
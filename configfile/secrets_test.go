@@ -0,0 +1,52 @@
+package configfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("GDI_TEST_TOKEN", "abc.def")
+	defer os.Unsetenv("GDI_TEST_TOKEN")
+	os.Unsetenv("GDI_TEST_MISSING")
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"${GDI_TEST_TOKEN}", "abc.def"},
+		{"Bot ${GDI_TEST_TOKEN}!", "Bot abc.def!"},
+		{"pa$$word", "pa$$word"},
+		{"$GDI_TEST_TOKEN", "$GDI_TEST_TOKEN"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		value, err := Expand(tt.value)
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, tt.expected, value, tt.value)
+	}
+
+	_, err := Expand("${GDI_TEST_MISSING}")
+	assert.EqualError(t, err, "environment variable GDI_TEST_MISSING is not set")
+}
+
+func TestExpandFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("abc.${def}\n"), 0600))
+
+	value, err := Expand("file:" + path)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc.${def}", value)
+
+	_, err = Expand("file:" + filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
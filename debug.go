@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/qaisjp/go-discord-irc/bridge"
+	log "github.com/sirupsen/logrus"
+)
+
+// debugResponse is the body of /debug/bridge
+type debugResponse struct {
+	Goroutines int                          `json:"goroutines"`
+	Networks   map[string]bridge.DebugState `json:"networks"`
+}
+
+// newDebugHandler returns the handler for --debug-listen.
+// A full goroutine dump is at /debug/pprof/goroutine?debug=2.
+func newDebugHandler(networks []*network) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/debug/bridge", func(w http.ResponseWriter, r *http.Request) {
+		resp := debugResponse{
+			Goroutines: runtime.NumGoroutine(),
+			Networks:   make(map[string]bridge.DebugState),
+		}
+		for _, n := range networks {
+			resp.Networks[n.name] = n.dib.DebugState()
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	return mux
+}
+
+// serveDebug serves pprof and the bridge's internal state on addr, if it isn't empty.
+// This is kept apart from http_listen, as it shouldn't be exposed publicly.
+func serveDebug(addr string, networks []*network) {
+	if addr == "" {
+		return
+	}
+
+	log.WithField("addr", addr).Infoln("Serving debug endpoints")
+	go func() {
+		if err := http.ListenAndServe(addr, newDebugHandler(networks)); err != nil {
+			log.WithField("error", err).Errorln("debug server stopped")
+		}
+	}()
+}
@@ -4,13 +4,16 @@ go 1.15
 
 require (
 	github.com/42wim/matterbridge v1.25.2
-	github.com/bwmarrin/discordgo v0.25.0
+	github.com/bwmarrin/discordgo v0.27.1
 	github.com/fsnotify/fsnotify v1.5.4
 	github.com/gobwas/glob v0.2.3
 	github.com/mozillazg/go-unidecode v0.1.1
+	github.com/pelletier/go-toml v1.9.5
 	github.com/pkg/errors v0.9.1
 	github.com/qaisjp/go-ircevent v0.0.0-20210224154625-07452bfb05b5
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/viper v1.12.0
 	github.com/stretchr/testify v1.7.2
+	golang.org/x/text v0.3.7
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/qaisjp/go-discord-irc/bridge"
+	log "github.com/sirupsen/logrus"
+)
+
+// healthResponse is the body of /healthz and /readyz
+type healthResponse struct {
+	OK       bool                     `json:"ok"`
+	Networks map[string]bridge.Health `json:"networks"`
+}
+
+// newHTTPHandler returns the handler for http_listen.
+// The admin dashboard and API are only served if adminToken is set.
+func newHTTPHandler(networks []*network, adminToken string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler(networks, bridge.Health.Live))
+	mux.HandleFunc("/readyz", healthHandler(networks, bridge.Health.Ready))
+
+	if adminToken != "" {
+		admin := &adminHandler{token: adminToken, networks: networks}
+		mux.HandleFunc("/admin", admin.ServeDashboard)
+		mux.HandleFunc("/admin/action", admin.ServeAction)
+		(&apiHandler{admin}).register(mux)
+	}
+	return mux
+}
+
+// healthHandler reports the health of every network, responding with
+// 503 Service Unavailable unless ok is true for all of them.
+func healthHandler(networks []*network, ok func(bridge.Health) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := healthResponse{OK: true, Networks: make(map[string]bridge.Health)}
+		for _, n := range networks {
+			h := n.dib.Health()
+			resp.Networks[n.name] = h
+			resp.OK = resp.OK && ok(h)
+		}
+
+		status := http.StatusOK
+		if !resp.OK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, resp)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithField("error", err).Warnln("could not write HTTP response")
+	}
+}
+
+// serveHTTP serves the HTTP endpoints on addr, if it isn't empty
+func serveHTTP(addr string, adminToken string, networks []*network) {
+	if addr == "" {
+		return
+	}
+
+	log.WithField("addr", addr).Infoln("Serving HTTP endpoints")
+	go func() {
+		if err := http.ListenAndServe(addr, newHTTPHandler(networks, adminToken)); err != nil {
+			log.WithField("error", err).Errorln("HTTP server stopped")
+		}
+	}()
+}
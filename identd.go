@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"strconv"
+
+	ircidentd "github.com/qaisjp/go-discord-irc/irc/identd"
+	log "github.com/sirupsen/logrus"
+)
+
+// serveIdentd answers ident queries about puppet connections on port, for every network.
+// Ports below 1024 (ident is 113) need root or CAP_NET_BIND_SERVICE.
+func serveIdentd(port int, networks []*network) {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.WithField("error", err).Errorln("could not listen for ident queries, puppets will connect without ident")
+		return
+	}
+
+	server := ircidentd.New()
+	for _, n := range networks {
+		n.dib.SetIdentd(server)
+	}
+
+	log.WithField("port", port).Infoln("Answering ident queries for puppets")
+	go func() {
+		if err := server.Serve(l); err != nil {
+			log.WithField("error", err).Errorln("identd stopped")
+		}
+	}()
+}
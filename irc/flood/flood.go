@@ -0,0 +1,132 @@
+// Package ircflood paces lines sent to an IRC server, so that the server
+// doesn't disconnect us for flooding (i.e. "Excess Flood").
+package ircflood
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket allowing burst lines at once, refilling at rate lines per second.
+// A rate of zero or less never delays anything.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a full Limiter
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// Delay takes a token at now, and returns how long to wait before sending the line.
+// Lines that have to wait are still counted, so calls must be made in the order lines are sent.
+func (l *Limiter) Delay(now time.Time) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Queue sends lines in order, as fast as its Limiter allows.
+// Lines are queued, not dropped, while they wait.
+type Queue struct {
+	limiter *Limiter
+	send    func(line string)
+
+	mu     sync.Mutex
+	lines  []string
+	wake   chan struct{}
+	closed bool
+}
+
+// NewQueue returns a Queue that calls send for each line
+func NewQueue(limiter *Limiter, send func(line string)) *Queue {
+	q := &Queue{
+		limiter: limiter,
+		send:    send,
+		wake:    make(chan struct{}, 1),
+	}
+	go q.run()
+	return q
+}
+
+// Push queues lines to be sent. Lines pushed after Close are ignored.
+func (q *Queue) Push(lines ...string) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.lines = append(q.lines, lines...)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns how many lines are waiting to be sent
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.lines)
+}
+
+// Close stops the queue, throwing away lines that haven't been sent
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.lines = nil
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) run() {
+	for range q.wake {
+		for {
+			q.mu.Lock()
+			if q.closed {
+				q.mu.Unlock()
+				return
+			}
+			if len(q.lines) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			line := q.lines[0]
+			q.lines = q.lines[1:]
+			q.mu.Unlock()
+
+			time.Sleep(q.limiter.Delay(time.Now()))
+			q.send(line)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package ircflood
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterDelay(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		Message  string
+		Rate     float64
+		Burst    int
+		Sends    []time.Duration // since start
+		Expected []time.Duration
+	}{
+		{"unlimited", 0, 1, []time.Duration{0, 0, 0}, []time.Duration{0, 0, 0}},
+		{"within burst", 1, 3, []time.Duration{0, 0, 0}, []time.Duration{0, 0, 0}},
+		{"over burst", 2, 2, []time.Duration{0, 0, 0, 0}, []time.Duration{0, 0, 500 * time.Millisecond, time.Second}},
+		{"refills", 1, 1, []time.Duration{0, time.Second, 3 * time.Second}, []time.Duration{0, 0, 0}},
+		{"refills up to burst", 1, 2, []time.Duration{0, 10 * time.Second, 10 * time.Second, 10 * time.Second}, []time.Duration{0, 0, 0, time.Second}},
+		{"partial refill", 1, 1, []time.Duration{0, 500 * time.Millisecond}, []time.Duration{0, 500 * time.Millisecond}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Message, func(t *testing.T) {
+			l := NewLimiter(c.Rate, c.Burst)
+			var delays []time.Duration
+			for _, at := range c.Sends {
+				delays = append(delays, l.Delay(start.Add(at)))
+			}
+			assert.Equal(t, c.Expected, delays)
+		})
+	}
+}
+
+func TestQueue(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	done := make(chan struct{})
+
+	q := NewQueue(NewLimiter(1000, 2), func(line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, line)
+		if len(sent) == 5 {
+			close(done)
+		}
+	})
+	defer q.Close()
+
+	q.Push("a", "b", "c")
+	q.Push("d", "e")
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lines were not sent")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, sent)
+	assert.Equal(t, 0, q.Len())
+}
@@ -0,0 +1,116 @@
+// Package ircidentd answers ident (RFC 1413) queries from an IRC server about the
+// connections we make to it, as some servers throttle or reject connections without ident.
+package ircidentd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExpectTimeout is how long after a connection is made a query about it is answered.
+// Servers ask as soon as a connection is accepted, so this only needs to cover a slow handshake.
+const ExpectTimeout = 30 * time.Second
+
+// queryTimeout is how long a client has to send its query
+const queryTimeout = 10 * time.Second
+
+// Server answers ident queries with the usernames it has been told to expect.
+//
+// The IRC library doesn't tell us the local port of a connection, so queries can't be matched
+// to connections exactly. Instead, each query takes the oldest username expected for the server port
+// it is about, so usernames are given out in the order their connections were made.
+type Server struct {
+	mu      sync.Mutex
+	pending []expected
+}
+
+type expected struct {
+	username   string
+	serverPort int
+	expires    time.Time
+}
+
+// New returns a Server that isn't expecting anyone
+func New() *Server {
+	return &Server{}
+}
+
+// Expect says a connection is being made at now to serverPort, which should be answered for as username
+func (s *Server) Expect(username string, serverPort int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(now)
+	s.pending = append(s.pending, expected{
+		username:   username,
+		serverPort: serverPort,
+		expires:    now.Add(ExpectTimeout),
+	})
+}
+
+// expire forgets usernames that were never asked about
+func (s *Server) expire(now time.Time) {
+	i := 0
+	for i < len(s.pending) && !now.Before(s.pending[i].expires) {
+		i++
+	}
+	s.pending = s.pending[i:]
+}
+
+// Answer returns the reply to an ident query received at now, such as "6193, 23"
+func (s *Server) Answer(query string, now time.Time) string {
+	ports := strings.SplitN(strings.TrimSpace(query), ",", 2)
+	if len(ports) != 2 {
+		return "0, 0 : ERROR : INVALID-PORT"
+	}
+	localPort, err1 := strconv.Atoi(strings.TrimSpace(ports[0]))
+	serverPort, err2 := strconv.Atoi(strings.TrimSpace(ports[1]))
+	if err1 != nil || err2 != nil || !validPort(localPort) || !validPort(serverPort) {
+		return "0, 0 : ERROR : INVALID-PORT"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(now)
+	for i, e := range s.pending {
+		if e.serverPort != serverPort {
+			continue
+		}
+		s.pending = append(s.pending[:i], s.pending[i+1:]...)
+		return fmt.Sprintf("%d, %d : USERID : UNIX : %s", localPort, serverPort, e.username)
+	}
+	return fmt.Sprintf("%d, %d : ERROR : NO-USER", localPort, serverPort)
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// Serve answers queries from l until it is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers the one query a client is allowed to send
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+	query, err := bufio.NewReaderSize(conn, 64).ReadString('\n')
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(conn, "%s\r\n", s.Answer(query, time.Now()))
+}
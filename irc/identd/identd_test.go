@@ -0,0 +1,54 @@
+package ircidentd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnswer(t *testing.T) {
+	cases := []struct {
+		Message  string
+		Query    string
+		Expected string
+	}{
+		{"expected", "6193, 6697\r\n", "6193, 6697 : USERID : UNIX : alice"},
+		{"no spaces", "6193,6697", "6193, 6697 : USERID : UNIX : alice"},
+		{"other server port", "6193, 6667", "6193, 6667 : ERROR : NO-USER"},
+		{"missing port", "6193", "0, 0 : ERROR : INVALID-PORT"},
+		{"not a port", "6193, ircd", "0, 0 : ERROR : INVALID-PORT"},
+		{"out of range", "6193, 70000", "0, 0 : ERROR : INVALID-PORT"},
+	}
+
+	now := time.Now()
+	for _, c := range cases {
+		t.Run(c.Message, func(t *testing.T) {
+			s := New()
+			s.Expect("alice", 6697, now)
+			assert.Equal(t, c.Expected, s.Answer(c.Query, now))
+		})
+	}
+}
+
+func TestAnswerOrder(t *testing.T) {
+	now := time.Now()
+	s := New()
+	s.Expect("alice", 6697, now)
+	s.Expect("bob", 6697, now)
+	s.Expect("carol", 6667, now)
+
+	assert.Equal(t, "1, 6667 : USERID : UNIX : carol", s.Answer("1, 6667", now))
+	assert.Equal(t, "2, 6697 : USERID : UNIX : alice", s.Answer("2, 6697", now))
+	assert.Equal(t, "3, 6697 : USERID : UNIX : bob", s.Answer("3, 6697", now))
+	assert.Equal(t, "4, 6697 : ERROR : NO-USER", s.Answer("4, 6697", now))
+}
+
+func TestAnswerExpired(t *testing.T) {
+	now := time.Now()
+	s := New()
+	s.Expect("alice", 6697, now)
+	s.Expect("bob", 6697, now.Add(ExpectTimeout/2))
+
+	assert.Equal(t, "1, 6697 : USERID : UNIX : bob", s.Answer("1, 6697", now.Add(ExpectTimeout)))
+}
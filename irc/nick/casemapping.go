@@ -0,0 +1,43 @@
+package ircnick
+
+import "strings"
+
+// Casemappings as advertised in the CASEMAPPING ISUPPORT token
+const (
+	CasemappingASCII         = "ascii"
+	CasemappingRFC1459       = "rfc1459"
+	CasemappingStrictRFC1459 = "strict-rfc1459"
+	CasemappingRFC7613       = "rfc7613"
+	DefaultCasemapping       = CasemappingRFC1459
+)
+
+// ToLower lowercases a nick or channel name according to a casemapping.
+// Unknown casemappings are treated as rfc1459.
+func ToLower(s string, casemapping string) string {
+	switch casemapping {
+	case CasemappingASCII:
+		return asciiLower(s)
+	case CasemappingRFC7613:
+		return strings.ToLower(s)
+	case CasemappingStrictRFC1459:
+		return strictRFC1459Replacer.Replace(asciiLower(s))
+	default:
+		return rfc1459Replacer.Replace(asciiLower(s))
+	}
+}
+
+// In rfc1459, []\~ are the uppercase forms of {}|^
+var rfc1459Replacer = strings.NewReplacer("[", "{", "]", "}", "\\", "|", "~", "^")
+
+// strict-rfc1459 is like rfc1459, but without ~ and ^
+var strictRFC1459Replacer = strings.NewReplacer("[", "{", "]", "}", "\\", "|")
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
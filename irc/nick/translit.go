@@ -0,0 +1,76 @@
+package ircnick
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Transliterator converts text to ASCII
+type Transliterator func(string) string
+
+// confusables are letters from other scripts that look like ASCII letters
+var confusables = strings.NewReplacer(
+	// Cyrillic
+	"А", "A", "В", "B", "Е", "E", "К", "K", "М", "M", "Н", "H", "О", "O", "Р", "P", "С", "C", "Т", "T", "Х", "X",
+	"а", "a", "е", "e", "о", "o", "р", "p", "с", "c", "у", "y", "х", "x", "і", "i", "ј", "j", "ѕ", "s",
+	// Greek
+	"Α", "A", "Β", "B", "Ε", "E", "Ζ", "Z", "Η", "H", "Ι", "I", "Κ", "K", "Μ", "M", "Ν", "N", "Ο", "O",
+	"Ρ", "P", "Τ", "T", "Υ", "Y", "Χ", "X", "ο", "o", "ν", "v",
+)
+
+// FoldCompatibility replaces compatibility forms (like fullwidth, mathematical and
+// circled letters) with the characters they are a form of.
+func FoldCompatibility(s string) string {
+	return norm.NFKC.String(s)
+}
+
+// FoldConfusables replaces characters that look like ASCII letters and digits with them.
+// This covers compatibility forms and Cyrillic and Greek lookalikes.
+// Other characters are left alone.
+func FoldConfusables(s string) string {
+	return confusables.Replace(FoldCompatibility(s))
+}
+
+// Transliterate splits s into runs of characters from the same script, and converts
+// each run with the Transliterator for its script (named as in unicode.Scripts).
+// ASCII and characters from scripts without a Transliterator are converted with fallback.
+func Transliterate(s string, scripts map[string]Transliterator, fallback Transliterator) string {
+	var b strings.Builder
+	var run strings.Builder
+	runScript := ""
+
+	flush := func() {
+		if run.Len() == 0 {
+			return
+		}
+		t := fallback
+		if runScript != "" {
+			t = scripts[runScript]
+		}
+		b.WriteString(t(run.String()))
+		run.Reset()
+	}
+
+	for _, r := range s {
+		script := ""
+		if r >= unicode.MaxASCII {
+			for name := range scripts {
+				if table, ok := unicode.Scripts[name]; ok && unicode.Is(table, r) {
+					script = name
+					break
+				}
+			}
+		}
+
+		if script != runScript {
+			flush()
+			runScript = script
+		}
+		run.WriteRune(r)
+	}
+	flush()
+
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package ircnick
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFoldConfusables(t *testing.T) {
+	cases := []struct {
+		Message  string
+		Input    string
+		Expected string
+	}{
+		{"ascii", "qaisjp", "qaisjp"},
+		{"fullwidth", "ｑａｉｓ", "qais"},
+		{"mathematical", "𝐪𝐚𝐢𝐬", "qais"},
+		{"circled", "ⓠⓐⓘⓢ", "qais"},
+		{"cyrillic lookalikes", "рахос", "paxoc"},
+		{"other scripts untouched", "日本", "日本"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Message, func(t *testing.T) {
+			assert.Equal(t, c.Expected, FoldConfusables(c.Input))
+		})
+	}
+}
+
+func TestTransliterate(t *testing.T) {
+	scripts := map[string]Transliterator{
+		"Han":      func(s string) string { return "<han:" + s + ">" },
+		"Cyrillic": strings.ToUpper,
+	}
+	fallback := func(s string) string { return "[" + s + "]" }
+
+	assert.Equal(t, "", Transliterate("", scripts, fallback))
+	assert.Equal(t, "[abc]", Transliterate("abc", scripts, fallback))
+	assert.Equal(t, "[a]<han:日本>[b]ДА[é]", Transliterate("a日本bдаé", scripts, fallback))
+}
@@ -0,0 +1,98 @@
+// Package irctags parses IRCv3 message tags.
+//
+// See https://ircv3.net/specs/extensions/message-tags
+package irctags
+
+import "strings"
+
+// Parse returns the tags of a raw IRC line, or an empty map if it has none.
+func Parse(line string) map[string]string {
+	tags := make(map[string]string)
+	if !strings.HasPrefix(line, "@") {
+		return tags
+	}
+
+	end := strings.IndexByte(line, ' ')
+	if end == -1 {
+		end = len(line)
+	}
+
+	for _, tag := range strings.Split(line[1:end], ";") {
+		if tag == "" {
+			continue
+		}
+
+		key, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i != -1 {
+			key, value = tag[:i], Unescape(tag[i+1:])
+		}
+
+		// If a tag is repeated, the last value wins
+		tags[key] = value
+	}
+
+	return tags
+}
+
+// Account returns the services account in the account tag of parsed tags,
+// or "" if the sender isn't logged in (which servers send as "*").
+func Account(tags map[string]string) string {
+	account := tags["account"]
+	if account == "*" {
+		return ""
+	}
+	return account
+}
+
+// Unescape decodes an escaped tag value.
+func Unescape(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+
+	var b strings.Builder
+	b.Grow(len(value))
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		// A trailing backslash is dropped
+		i++
+		if i == len(value) {
+			break
+		}
+
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			// Includes `\\`. Invalid escapes are replaced with the character itself.
+			b.WriteByte(value[i])
+		}
+	}
+
+	return b.String()
+}
+
+// Escape encodes a tag value so that it can be sent to the server.
+func Escape(value string) string {
+	return escaper.Replace(value)
+}
+
+var escaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\:`,
+	" ", `\s`,
+	"\r", `\r`,
+	"\n", `\n`,
+)
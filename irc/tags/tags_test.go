@@ -0,0 +1,47 @@
+package irctags
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		Message  string
+		Input    string
+		Expected map[string]string
+	}{
+		{"no tags", ":nick!user@host PRIVMSG #chan :hello", map[string]string{}},
+		{"simple", "@msgid=abc;account=qaisjp :nick!user@host PRIVMSG #chan :hi", map[string]string{"msgid": "abc", "account": "qaisjp"}},
+		{"no value", "@draft/bot;time=2021-01-01T00:00:00.000Z PING", map[string]string{"draft/bot": "", "time": "2021-01-01T00:00:00.000Z"}},
+		{"client tag", "@+draft/reply=123 :a!b@c PRIVMSG #d :e", map[string]string{"+draft/reply": "123"}},
+		{"escapes", `@a=b\sc\:d\\e\nf\r :a!b@c PRIVMSG #d :e`, map[string]string{"a": "b c;d\\e\nf\r"}},
+		{"repeated", "@a=1;a=2 PING", map[string]string{"a": "2"}},
+		{"only tags", "@a=1", map[string]string{"a": "1"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Message, func(t *testing.T) {
+			assert.Equal(t, c.Expected, Parse(c.Input))
+		})
+	}
+}
+
+func TestAccount(t *testing.T) {
+	assert.Equal(t, "qaisjp", Account(Parse("@account=qaisjp :nick!user@host PRIVMSG bot :setavatar clear")))
+	assert.Equal(t, "", Account(Parse("@account=* :nick!user@host PRIVMSG bot :setavatar clear")))
+	assert.Equal(t, "", Account(Parse("@msgid=abc :nick!user@host PRIVMSG bot :setavatar clear")))
+	assert.Equal(t, "", Account(Parse(":nick!user@host PRIVMSG bot :setavatar clear")))
+}
+
+func TestUnescape(t *testing.T) {
+	assert.Equal(t, "trailing", Unescape(`trailing\`))
+	assert.Equal(t, "invalid", Unescape(`\invalid`))
+	assert.Equal(t, "plain", Unescape("plain"))
+}
+
+func TestEscapeRoundTrip(t *testing.T) {
+	value := "semi;colon space\\back\r\n"
+	assert.Equal(t, value, Unescape(Escape(value)))
+}
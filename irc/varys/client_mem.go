@@ -43,3 +43,8 @@ func (c *memClient) Connected(uid string) (result bool, err error) {
 	err = c.varys.Connected(uid, &result)
 	return
 }
+
+func (c *memClient) HasCap(uid string, capability string) (result bool, err error) {
+	err = c.varys.HasCap(HasCapParams{uid, capability}, &result)
+	return
+}
@@ -47,6 +47,8 @@ type Client interface {
 	GetNick(uid string) (string, error)
 	// Connected returns the status of the current connection
 	Connected(uid string) (bool, error)
+	// HasCap returns whether the server acknowledged a capability for the current connection
+	HasCap(uid string, capability string) (bool, error)
 }
 
 type SetupParams struct {
@@ -82,6 +84,16 @@ type ConnectParams struct {
 
 	WebIRCSuffix string
 
+	// SASL PLAIN credentials, if the connection should log in to an account
+	SASLLogin    string
+	SASLPassword string
+
+	// IRCv3 capabilities to request
+	RequestCaps []string
+
+	// Callbacks for CTCP events replace the default go-ircevent CTCP replies,
+	// and a KICK callback replaces rejoining channels we are kicked from.
+	//
 	// TODO(qaisjp): does not support net/rpc!!!!
 	Callbacks map[string]func(*irc.Event)
 }
@@ -90,6 +102,7 @@ func (v *Varys) Connect(params ConnectParams, _ *struct{}) error {
 	conn := irc.IRC(params.Nick, params.Username)
 	// conn.Debug = true
 	conn.RealName = params.RealName
+	conn.RequestCaps = params.RequestCaps
 
 	// TLS things, and the server password
 	conn.Password = v.connConfig.ServerPassword
@@ -100,19 +113,31 @@ func (v *Varys) Connect(params ConnectParams, _ *struct{}) error {
 		}
 	}
 
-	// Set up WebIRC, if a suffix is provided
-	if params.WebIRCSuffix != "" {
+	// Set up WebIRC, if a suffix is provided and we have a gateway password
+	if params.WebIRCSuffix != "" && v.connConfig.WebIRCPassword != "" {
 		conn.WebIRC = v.connConfig.WebIRCPassword + " " + params.WebIRCSuffix
 	}
 
-	// On kick, rejoin the channel
-	conn.AddCallback("KICK", func(e *irc.Event) {
-		if e.Arguments[1] == conn.GetNick() {
-			conn.Join(e.Arguments[0])
-		}
-	})
+	if params.SASLLogin != "" {
+		conn.UseSASL = true
+		conn.SASLMech = "PLAIN"
+		conn.SASLLogin = params.SASLLogin
+		conn.SASLPassword = params.SASLPassword
+	}
+
+	// On kick, rejoin the channel, unless the caller handles kicks itself
+	if _, ok := params.Callbacks["KICK"]; !ok {
+		conn.AddCallback("KICK", func(e *irc.Event) {
+			if e.Arguments[1] == conn.GetNick() {
+				conn.Join(e.Arguments[0])
+			}
+		})
+	}
 
 	for eventcode, callback := range params.Callbacks {
+		if strings.HasPrefix(eventcode, "CTCP_") {
+			conn.ClearCallback(eventcode)
+		}
 		conn.AddCallback(eventcode, callback)
 	}
 
@@ -179,6 +204,23 @@ func (v *Varys) Connected(uid string, result *bool) error {
 	return nil
 }
 
+type HasCapParams struct {
+	UID        string
+	Capability string
+}
+
+func (v *Varys) HasCap(params HasCapParams, result *bool) error {
+	if conn, ok := v.uidToConns[params.UID]; ok {
+		for _, c := range conn.AcknowledgedCaps {
+			if c == params.Capability {
+				*result = true
+				break
+			}
+		}
+	}
+	return nil
+}
+
 type NickParams struct {
 	UID  string
 	Nick string
@@ -0,0 +1,134 @@
+// Package logging sets up logrus, with levels that can be set for each subsystem,
+// JSON output, and logging to a rotated file.
+package logging
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Subsystems that can have their own log level
+const (
+	Discord     = "discord"
+	IRCListener = "irc_listener"
+	Puppeteer   = "puppeteer"
+	Transmitter = "transmitter"
+)
+
+// SubsystemField is the field log entries are tagged with their subsystem in
+const SubsystemField = "subsystem"
+
+var (
+	mu           sync.Mutex
+	defaultLevel = logrus.InfoLevel
+	levels       = make(map[string]logrus.Level)
+	file         *RotatingFile
+)
+
+// For returns a logger for a subsystem
+func For(subsystem string) *logrus.Entry {
+	return logrus.WithField(SubsystemField, subsystem)
+}
+
+// Options for Configure
+type Options struct {
+	// Level is the level for entries without a subsystem, or for subsystems not in Levels
+	Level  logrus.Level
+	Levels map[string]logrus.Level
+
+	// JSON logs each entry as a JSON object instead of text
+	JSON bool
+
+	// File, if not empty, is also logged to. Once it is MaxSize bytes it is
+	// rotated, keeping MaxBackups old files. Files aren't rotated if MaxSize is zero.
+	File       string
+	MaxSize    int64
+	MaxBackups int
+}
+
+// Configure sets up the standard logrus logger
+func Configure(opts Options) error {
+	var out io.Writer = os.Stderr
+	var f *RotatingFile
+	if opts.File != "" {
+		var err error
+		if f, err = OpenRotating(opts.File, opts.MaxSize, opts.MaxBackups); err != nil {
+			return err
+		}
+		out = io.MultiWriter(os.Stderr, f)
+	}
+
+	var formatter logrus.Formatter = &logrus.TextFormatter{}
+	if opts.JSON {
+		formatter = &logrus.JSONFormatter{}
+	}
+
+	logger := logrus.StandardLogger()
+	logger.SetFormatter(levelFilter{formatter})
+	logger.SetOutput(out)
+
+	mu.Lock()
+	old := file
+	file = f
+	defaultLevel = opts.Level
+	levels = make(map[string]logrus.Level, len(opts.Levels))
+	for subsystem, level := range opts.Levels {
+		levels[subsystem] = level
+	}
+	mu.Unlock()
+
+	logger.SetLevel(maxLevel())
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// SetLevel changes the level for entries without a subsystem, or for subsystems without their own level
+func SetLevel(level logrus.Level) {
+	mu.Lock()
+	defaultLevel = level
+	mu.Unlock()
+	logrus.SetLevel(maxLevel())
+}
+
+// maxLevel returns the most verbose level, which the logger is set to
+// so that levelFilter sees every entry that might be logged.
+func maxLevel() logrus.Level {
+	mu.Lock()
+	defer mu.Unlock()
+	max := defaultLevel
+	for _, level := range levels {
+		if level > max {
+			max = level
+		}
+	}
+	return max
+}
+
+// enabled returns true if an entry at level should be logged for subsystem
+func enabled(subsystem string, level logrus.Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	allowed, ok := levels[subsystem]
+	if !ok {
+		allowed = defaultLevel
+	}
+	return level <= allowed
+}
+
+// levelFilter drops entries below their subsystem's level
+type levelFilter struct {
+	logrus.Formatter
+}
+
+func (f levelFilter) Format(entry *logrus.Entry) ([]byte, error) {
+	subsystem, _ := entry.Data[SubsystemField].(string)
+	if !enabled(subsystem, entry.Level) {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevels(t *testing.T) {
+	assert.NoError(t, Configure(Options{
+		Level: logrus.InfoLevel,
+		Levels: map[string]logrus.Level{
+			Puppeteer:   logrus.DebugLevel,
+			IRCListener: logrus.WarnLevel,
+		},
+		JSON: true,
+	}))
+	defer Configure(Options{Level: logrus.InfoLevel})
+
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+
+	For(Puppeteer).Debugln("puppet debug")
+	For(IRCListener).Infoln("listener info")
+	For(IRCListener).Warnln("listener warning")
+	For(Discord).Debugln("discord debug")
+	For(Discord).Infoln("discord info")
+	logrus.Debugln("default debug")
+
+	out := buf.String()
+	assert.Contains(t, out, `"msg":"puppet debug"`)
+	assert.Contains(t, out, `"subsystem":"puppeteer"`)
+	assert.NotContains(t, out, "listener info")
+	assert.Contains(t, out, "listener warning")
+	assert.NotContains(t, out, "discord debug")
+	assert.Contains(t, out, "discord info")
+	assert.NotContains(t, out, "default debug")
+
+	SetLevel(logrus.DebugLevel)
+	logrus.Debugln("default debug")
+	assert.Contains(t, buf.String(), "default debug")
+}
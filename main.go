@@ -2,24 +2,38 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/gobwas/glob"
 	"github.com/pkg/errors"
 	"github.com/qaisjp/go-discord-irc/bridge"
-	ircnick "github.com/qaisjp/go-discord-irc/irc/nick"
+	"github.com/qaisjp/go-discord-irc/configfile"
+	"github.com/qaisjp/go-discord-irc/logging"
+	"github.com/qaisjp/go-discord-irc/pattern"
+	"github.com/qaisjp/go-discord-irc/rehost"
+	"github.com/qaisjp/go-discord-irc/schedule"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(check(os.Args[2:]))
+		case "version":
+			printVersion()
+			return
+		}
+	}
+
 	config := flag.String("config", "", "Config file to read configuration stuff from")
 	simple := flag.Bool("simple", false, "When in simple mode, the bridge will only spawn one IRC connection for listening and speaking")
 	debugMode := flag.Bool("debug", false, "Debug mode? (false = use value from settings)")
@@ -29,6 +43,8 @@ func main() {
 	// Secret devmode
 	devMode := flag.Bool("dev", false, "")
 	debugPresence := flag.Bool("debug-presence", false, "Include presence in debug output")
+	dryRun := flag.Bool("dry-run", false, "Log the messages that would be relayed instead of sending them, and don't connect puppets")
+	debugListen := flag.String("debug-listen", "", "Address to serve pprof and the bridge's internal state on, such as 127.0.0.1:6060")
 
 	flag.Parse()
 	bridge.DevMode = *devMode
@@ -38,91 +54,362 @@ func main() {
 		return
 	}
 
-	if *simple {
-		log.Println("Running in simple mode.")
+	viper, configType, err := readConfig(*config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := setupLogging(viper, *debugMode); err != nil {
+		log.Fatalln(errors.Wrap(err, "could not set up logging"))
 	}
 
-	viper := viper.New()
-	ext := filepath.Ext(*config)
-	configName := strings.TrimSuffix(filepath.Base(*config), ext)
-	configType := ext[1:]
-	configPath := filepath.Dir(*config)
-	viper.SetConfigName(configName)
-	viper.SetConfigType(configType)
-	viper.AddConfigPath(configPath)
+	f := &flags{
+		simple:        simple,
+		debugMode:     debugMode,
+		notls:         notls,
+		insecure:      insecure,
+		debugPresence: debugPresence,
+		dryRun:        dryRun,
+	}
 
-	log.WithFields(log.Fields{
-		"ConfigName": configName,
-		"ConfigType": configType,
-		"ConfigPath": configPath,
-	}).Infoln("Loading configuration...")
+	var networks []*network
+	discriminators := make(map[string]string)
+	tokens := make(map[string]string)
+	for _, name := range networkNames(viper) {
+		n := &network{name: name}
+		conf := n.load(networkViper(viper, name), f)
 
-	err := viper.ReadInConfig()
-	if err != nil {
-		log.Fatalln(errors.Wrap(err, "could not read config"))
+		if other, ok := discriminators[conf.Discriminator]; ok {
+			log.Fatalf("Networks '%s' and '%s' have the same irc_server_name, but it must be unique per network", other, name)
+			return
+		}
+		discriminators[conf.Discriminator] = name
+
+		// Each bridge opens its own gateway session, which would all get every event (and DM)
+		if other, ok := tokens[conf.DiscordBotToken]; ok {
+			log.Fatalf("Networks '%s' and '%s' have the same discord_token, but each network needs its own Discord bot", other, name)
+			return
+		}
+		tokens[conf.DiscordBotToken] = name
+
+		dib, err := bridge.New(conf)
+		if err != nil {
+			log.WithField("error", err).WithField("network", name).Fatalln("Go-Discord-IRC failed to initialise.")
+			return
+		}
+		n.dib = dib
+		networks = append(networks, n)
+
+		log.Infoln("Cooldown duration for IRC puppets is", dib.Config().CooldownDuration)
 	}
 
+	// Create new signal receiver
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+
+	// Changes are applied from the file watcher, SIGHUP, SIGUSR1 and IRC admins. They are all
+	// run by one goroutine (started below), as viper isn't safe to use from several at once.
+	reload := func() error {
+		if err := viper.ReadInConfig(); err != nil {
+			log.WithField("error", err).Errorln("could not read config, not applying changes")
+			return err
+		}
+		if err := validateConfig(viper, *config, configType); err != nil {
+			log.WithField("error", err).Errorln("config is invalid, not applying changes")
+			return err
+		}
+		if err := setupLogging(viper, *f.debugMode); err != nil {
+			log.WithField("error", err).Errorln("could not change logging options")
+		}
+
+		for _, n := range networks {
+			n.reload(networkViper(viper, n.name), f)
+		}
+		return nil
+	}
+
+	// Admins can reload from IRC too, waiting for the reload goroutine to do it
+	reloadRequests := make(chan chan error)
+	for _, n := range networks {
+		n.dib.SetReload(func() error {
+			result := make(chan error, 1)
+			reloadRequests <- result
+			return <-result
+		})
+	}
+
+	// Answer ident queries before any puppets connect
+	viper.SetDefault("identd_port", 113)
+	if viper.GetBool("identd") {
+		serveIdentd(viper.GetInt("identd_port"), networks)
+	}
+
+	// Open the bots
+	for _, n := range networks {
+		if err := n.dib.Open(); err != nil {
+			log.WithField("error", err).WithField("network", n.name).Fatalln("Go-Discord-IRC failed to start.")
+			return
+		}
+	}
+
+	// Health checks and such, shared by every network
+	serveHTTP(viper.GetString("http_listen"), getSecret(viper, "http_admin_token"), networks)
+	serveDebug(*debugListen, networks)
+
+	// Inform the user that things are happening!
+	log.Infoln("Go-Discord-IRC is now running. Press Ctrl-C to exit.")
+
+	// Start watching for live changes...
+	var configChanged <-chan struct{}
+	viper.SetDefault("watch_config", true)
+	if viper.GetBool("watch_config") {
+		changed, err := watchConfig(viper.ConfigFileUsed())
+		if err != nil {
+			log.WithField("error", err).Errorln("could not watch config file, changes need SIGHUP to apply")
+		}
+		configChanged = changed
+	}
+
+	// ...and reload when asked to
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// Reconnect to IRC (after reloading, to pick up new server settings) when asked to
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	// From here on, only this goroutine uses viper
+	go func() {
+		for {
+			select {
+			case <-configChanged:
+				log.Println("Configuration file has changed!")
+				reload()
+
+			case <-hup:
+				log.Println("Received SIGHUP, reloading configuration...")
+				reload()
+
+			case <-usr1:
+				log.Println("Received SIGUSR1, reloading configuration and restarting IRC...")
+				reload()
+				for _, n := range networks {
+					n.dib.RestartIRC()
+				}
+
+			case result := <-reloadRequests:
+				result <- reload()
+			}
+		}
+	}()
+
+	// Watch for a shutdown signal
+	<-sc
+
+	log.Infoln("Shutting down Go-Discord-IRC...")
+
+	// Cleanly close down the bridges.
+	for _, n := range networks {
+		n.dib.Close()
+	}
+}
+
+// load reads the network's bridge config
+func (n *network) load(viper *viper.Viper, f *flags) *bridge.Config {
 	if viper.GetString("nickserv_identify") != "" {
 		log.Fatalln("Please see https://github.com/qaisjp/go-discord-irc/blob/master/config.yml for an example config. `nickserv_identify` is deprecated and superseded by `irc_puppet_prejoin_commands`.")
-		return
+		return nil
 	}
 
 	discriminator := viper.GetString("irc_server_name") // unique per IRC network connected to, keeps PMs working
 	if discriminator == "" {
 		log.Fatalln("'irc_server_name' config option is required and cannot be empty")
-		return
+		return nil
 	}
-	discordBotToken := viper.GetString("discord_token")                                 // Discord Bot User Token
+	discordBotToken := getSecret(viper, "discord_token")                                // Discord Bot User Token
 	channelMappings := viper.GetStringMapString("channel_mappings")                     // Discord:IRC mappings in format '#discord1:#irc1,#discord2:#irc2,...'
 	ircServer := viper.GetString("irc_server")                                          // Server address to use, example `irc.freenode.net:7000`.
-	ircPassword := viper.GetString("irc_pass")                                          // Optional password for connecting to the IRC server
+	ircPassword := getSecret(viper, "irc_pass")                                         // Optional password for connecting to the IRC server
 	ircListenerPrejoinCommands := viper.GetStringSlice("irc_listener_prejoin_commands") // Commands for each connection to send before joining channels
-	guildID := viper.GetString("guild_id")                                              // Guild to use
-	webIRCPass := viper.GetString("webirc_pass")                                        // Password for WEBIRC
+	joinAfterAuth := viper.GetBool("join_after_auth")                                   // Listener waits until it has logged in to join channels
+	ircListenerAltNick := viper.GetString("irc_listener_alt_nick")                      // Nick for the listener while its own is taken
+	ircListenerAccount := viper.GetString("irc_listener_account")                       // Services account for the listener
+	ircListenerPassword := getSecret(viper, "irc_listener_password")                    // Password to identify the listener with
+	servicesRequestOp := viper.GetBool("services_request_op")                           // Ask ChanServ to op the listener in mapped channels
+	guildIDs := readGuildIDs(viper)                                                     // Guilds to bridge
+	webIRCPass := getSecret(viper, "webirc_pass")                                       // Password for WEBIRC
 	ircIgnores := viper.GetStringSlice("ignored_irc_hostmasks")                         // IRC hosts to not relay to Discord
 	rawDiscordIgnores := viper.GetStringSlice("ignored_discord_ids")                    // Ignore these Discord users on IRC
 	rawDiscordAllowed := viper.GetStringSlice("allowed_discord_ids")
-	rawIRCFilter := viper.GetStringSlice("irc_message_filter")         // Ignore lines containing matched text from IRC
-	rawDiscordFilter := viper.GetStringSlice("discord_message_filter") // Ignore lines containing matched text from Discord
-	connectionLimit := viper.GetInt("connection_limit")                // Limiter on how many IRC Connections we can spawn
+	rawIRCFilter := messageFilters(viper, "irc_message_filter")         // Ignore lines containing matched text from IRC
+	rawDiscordFilter := messageFilters(viper, "discord_message_filter") // Ignore lines containing matched text from Discord
+	filterChannel := viper.GetString("filter_channel")                  // Discord channel to send flagged lines to
+	connectionLimit := viper.GetInt("connection_limit")                 // Limiter on how many IRC Connections we can spawn
+	maxPuppets := viper.GetInt("max_puppets")                           // Evict the least recently active puppet beyond this many
 	//
-	if !*debugMode {
-		*debugMode = viper.GetBool("debug")
+	puppetAccounts := setupPuppetAccounts(viper.GetStringMapString("puppet_accounts")) // Services accounts for puppets to log in to
+	nickOverrides := viper.GetStringMapString("nick_overrides")                        // Discord user IDs to IRC nicks
+	nickScriptPolicies := viper.GetStringMapString("nick_script_policies")             // Unicode scripts to transliteration policies
+	displayNameOverrides := viper.GetStringMapString("display_name_overrides")         // IRC accounts to Discord names
+	//
+	if !*f.debugMode {
+		*f.debugMode = viper.GetBool("debug")
 	}
 	//
-	if !*notls {
-		*notls = viper.GetBool("no_tls")
+	if !*f.notls {
+		*f.notls = viper.GetBool("no_tls")
 	}
-	if !*insecure {
-		*insecure = viper.GetBool("insecure")
+	if !*f.insecure {
+		*f.insecure = viper.GetBool("insecure")
 	}
 	//
-	viper.SetDefault("irc_puppet_prejoin_commands", []string{"MODE ${NICK} +D"})
 	ircPuppetPrejoinCommands := viper.GetStringSlice("irc_puppet_prejoin_commands") // Commands for each connection to send before joining channels
 	//
-	viper.SetDefault("avatar_url", "https://robohash.org/${USERNAME}.png?set=set4")
 	avatarURL := viper.GetString("avatar_url")
+	avatarOverrides := viper.GetStringMapString("avatar_overrides")                       // IRC accounts or nicks to avatar URLs
+	avatarGravatar := viper.GetBool("avatar_gravatar")                                    // Use the Gravatar of an IRC account's email
+	avatarCommand := viper.GetString("avatar_command")                                    // Whether IRC users can choose their avatar
+	webhookRotation := viper.GetInt("webhook_rotation")                                   // Webhooks to take turns between in each channel
+	channelWebhooks := setupChannelWebhooks(viper.GetStringMapString("channel_webhooks")) // Webhook URLs for some Discord channels
 	//
-	viper.SetDefault("irc_listener_name", "~d")
 	ircUsername := viper.GetString("irc_listener_name") // Name for IRC-side bot, for listening to messages.
 	// Name to Connect to IRC puppet account with
-	viper.SetDefault("puppet_username", "")
 	puppetUsername := viper.GetString("puppet_username")
+	puppetRealName := viper.GetString("puppet_realname")            // Real name for puppets
+	ircListenerUsername := viper.GetString("irc_listener_username") // Ident for the listener
+	ircListenerRealName := viper.GetString("irc_listener_realname") // Real name for the listener
 	//
-	viper.SetDefault("suffix", "~d")
 	suffix := viper.GetString("suffix") // The suffix to append to IRC connections (not in use when simple mode is on)
 	//
-	viper.SetDefault("separator", "~")
 	separator := viper.GetString("separator")
 	//
-	viper.SetDefault("cooldown_duration", int64((time.Hour * 24).Seconds()))
+	// Puppet mode (one IRC connection per Discord user) is the default, unless simple mode is on
+	simpleMode := *f.simple || viper.GetBool("simple")
+	if simpleMode {
+		log.Println("Running in simple mode.")
+	}
+	if *f.dryRun {
+		log.Println("Running in dry run mode, nothing will be relayed.")
+	}
+	//
 	cooldownDuration := viper.GetInt64("cooldown_duration")
 	//
-	viper.SetDefault("show_joinquit", false)
+	puppetIdleTimeout := viper.GetInt64("puppet_idle_timeout") // Seconds without talking before a puppet disconnects, 0 to disable
+	//
 	showJoinQuit := viper.GetBool("show_joinquit")
+	joinQuitBatchDelay := viper.GetInt64("joinquit_batch_delay")                                  // Seconds to collect joins and quits for before summarising them
+	joinQuitSpokeWithin := viper.GetInt64("joinquit_spoke_within")                                // Seconds, only show joins and quits of people who spoke this recently
+	joinQuitEvents := setupJoinQuitEvents(viper.GetStringSlice("joinquit_events"))                // Kinds of event shown, nil for the default
+	joinQuitChannels := setupJoinQuitChannels(viper.GetStringMapStringSlice("joinquit_channels")) // Kinds of event shown for some channels
+	//
+	ircChathistoryLimit := viper.GetInt("irc_chathistory_limit") // Missed messages to backfill per channel, 0 to disable
+	//
+	awayStatusChannel := viper.GetString("away_status_channel") // Discord channel to post IRC away status changes to
+	//
+	ircMonitorNicks := viper.GetStringSlice("irc_monitor_nicks") // IRC nicks to notify Discord about when they come and go
+	ircMonitorChannel := viper.GetString("irc_monitor_channel")  // Discord channel to notify
+	//
+	statusMsgRoles := viper.GetStringSlice("statusmsg_roles") // Discord roles allowed to message only IRC channel operators
+	//
+	relayRoles := viper.GetStringSlice("relay_roles")                                            // Discord roles allowed to speak on IRC, everyone if empty
+	relayChannelRoles := setupChannelRoles(viper.GetStringMapStringSlice("relay_channel_roles")) // relay_roles for some Discord channels
+	relayExcludedRoles := viper.GetStringSlice("relay_excluded_roles")                           // Discord roles not allowed to speak on IRC
+	//
+	relayWindows := setupRelayWindows(viper.GetStringMapStringSlice("relay_windows")) // When some IRC channels are relayed
+	relayWindowAction := viper.GetString("relay_window_action")                       // What happens to messages outside them
+	//
+	logDir := viper.GetString("log_dir")                       // Where to write channel logs
+	logDirFormat := viper.GetString("log_dir_format")          // The format of channel logs
+	logDirUnrelayed := viper.GetBool("log_dir_unrelayed")      // Also log what isn't relayed
+	logDirChannels := viper.GetStringSlice("log_dir_channels") // IRC channels to log, every mapped channel if empty
+	//
+	relayDiscordBots := viper.GetBool("relay_discord_bots")             // Relay messages from other Discord bots
+	relayDiscordWebhooks := viper.GetBool("relay_discord_webhooks")     // Relay messages from Discord webhooks
+	discordBotsAllowed := viper.GetStringSlice("discord_bots_allowed")  // Bot and webhook IDs to always relay
+	discordBotsDenied := viper.GetStringSlice("discord_bots_denied")    // Bot and webhook IDs to never relay
+	relayDiscordCrossposts := viper.GetBool("relay_discord_crossposts") // Relay messages from followed announcement channels
+	publishAnnouncements := viper.GetBool("publish_announcements")      // Publish IRC messages in announcement channels
+	discordLinkQuotes := viper.GetBool("discord_link_quotes")           // Quote linked Discord messages on IRC
+	//
+	urlTitles := viper.GetStringSlice("url_titles")                // Directions to add the titles of linked web pages in
+	urlTitlesAllowed := viper.GetStringSlice("url_titles_allowed") // Hosts to fetch titles from, any if empty
+	urlTitlesDenied := viper.GetStringSlice("url_titles_denied")   // Hosts to never fetch titles from
+	//
+	rehostMaxSize := viper.GetInt64("rehost_max_size") // Largest attachment to copy, in megabytes
+	//
+	ircImageUploads := viper.GetBool("irc_image_uploads")   // Upload images linked to on IRC to Discord
+	ircImageMaxSize := viper.GetInt64("irc_image_max_size") // Largest image to upload, in megabytes
+	//
+	throttleMessages := viper.GetInt("throttle_messages")            // Messages each person can send in throttle_interval
+	throttleRepeats := viper.GetInt("throttle_repeats")              // Times in a row each person can send the same message
+	throttleInterval := viper.GetInt64("throttle_interval")          // Seconds
+	throttleAction := viper.GetString("throttle_action")             // What to do with messages over the limits
+	throttleMuteDuration := viper.GetInt64("throttle_mute_duration") // Seconds to mute people for
+	throttleChannel := viper.GetString("throttle_channel")           // Discord channel to announce throttles in
+	//
+	statsInterval := viper.GetInt64("stats_interval")               // Seconds, 0 to not show stats
+	statsTemplate := viper.GetString("stats_template")              // ${IRC} and ${DISCORD} are the counts
+	statsDiscordChannel := viper.GetString("stats_discord_channel") // Discord channel to rename to the stats
+	statsIRCTopics := viper.GetBool("stats_irc_topics")             // Put the stats at the end of IRC topics
+	resyncInterval := viper.GetInt64("resync_interval")             // Seconds between checking channel membership, 0 to not
+	//
+	statusChannel := viper.GetString("status_channel")  // Discord channel to keep a pinned status embed in
+	statusInterval := viper.GetInt64("status_interval") // Seconds between updating the status embed, 0 to not
+	//
+	ircModerationAction := viper.GetString("irc_moderation_action")  // What to do to Discord users whose puppet is kicked or banned
+	ircModerationTimeout := viper.GetInt64("irc_moderation_timeout") // Seconds to time them out for
+	ircModerationRole := viper.GetString("irc_moderation_role")      // Discord role to give them
+	discordBansToIRC := viper.GetBool("discord_bans_to_irc")         // Ban the puppets of banned Discord members on IRC
+	//
+	ircInviteRequest := viper.GetString("irc_invite_request") // How to ask for invites to invite only channels
+	modChannel := viper.GetString("mod_channel")              // Discord channel to tell moderators about problems in
+	//
+	ircDeliveryTimeout := viper.GetInt64("irc_delivery_timeout")    // Seconds to wait for IRC to echo a relayed line, 0 to disable
+	deliveryFailedEmoji := viper.GetString("delivery_failed_emoji") // Reaction for messages not relayed to IRC, empty to disable
+	deliveryFailedDM := viper.GetBool("delivery_failed_dm")         // Also DM the author of messages not relayed to IRC
+	//
+	ircPingInterval := viper.GetInt64("irc_ping_interval") // Seconds between PINGs to measure the lag, 0 to not
+	ircPingTimeout := viper.GetInt64("irc_ping_timeout")   // Seconds without a PONG before reconnecting, 0 to never
+	//
+	discordZombieTimeout := viper.GetInt64("discord_zombie_timeout") // Seconds without a heartbeat ACK before reconnecting, 0 to never
+	//
+	ircDownNotice := viper.GetInt64("irc_down_notice")     // Seconds IRC can be down before Discord is told, 0 to disable
+	ircOfflineBuffer := viper.GetInt("irc_offline_buffer") // Discord messages to keep while IRC is down, 0 to disable
+	//
+	discordOfflineBuffer := viper.GetInt("discord_offline_buffer") // IRC messages to keep while Discord is down, 0 to disable
+	discordOfflineBatch := viper.GetBool("discord_offline_batch")  // Send kept IRC messages as one message per channel
 	// Maximum length of user nicks aloud
-	viper.SetDefault("max_nick_length", ircnick.MAXLENGTH)
 	maxNickLength := viper.GetInt("max_nick_length")
+	//
+	puppetNickSource := viper.GetString("puppet_nick_source") // Generate puppet nicks from Discord nicknames or usernames
+	//
+	storagePath := viper.GetString("storage_path") // File to save bridge state to, in memory if empty
+	//
+	avatarCacheTTL := viper.GetInt64("avatar_cache_ttl") // Seconds to reuse the avatar found for an IRC nick, 0 to disable
+	//
+	deadLetterPath := viper.GetString("dead_letter_path") // File to save messages that could not be sent to Discord to
+	//
+	shutdownTimeout := viper.GetInt64("shutdown_timeout") // Seconds to wait for queued messages to be sent when closing
+	ircQuitMessage := viper.GetString("irc_quit_message") // QUIT message sent when closing
+	//
+	adminDiscordIDs := viper.GetStringSlice("admin_discord_ids")     // Discord users who can change channel mappings
+	adminDiscordRoles := viper.GetStringSlice("admin_discord_roles") // Discord roles who can too
+	slashCommands := viper.GetBool("slash_commands")                 // Register the /bridge command for admins
+	adminIRCHostmasks := viper.GetStringSlice("admin_irc_hostmasks") // IRC hostmasks who can change channel mappings
+	//
+	autoMap := viper.GetBool("auto_map")                         // Map Discord channels by topic or name
+	autoMapNamePrefix := viper.GetString("auto_map_name_prefix") // Discord channel name prefix to map to an IRC channel
+	//
+	ircSendRate := viper.GetFloat64("irc_send_rate") // Lines a second each IRC connection sends once the burst is used up
+	ircSendBurst := viper.GetInt("irc_send_burst")   // Lines each IRC connection can send at once
+	//
+	relayQueueSize := viper.GetInt("relay_queue_size")              // Messages that can wait to be relayed in each direction
+	relayOverflowPolicy := viper.GetString("relay_overflow_policy") // What to do with messages when a queue is full
+	//
+	ctcpVersion := viper.GetString("ctcp_version") // Reply to CTCP VERSION, empty to not reply
+	//
+	webIRCGateway := viper.GetString("webirc_gateway") // Gateway name sent along with WEBIRC
+	//
+	webIRCHostname := viper.GetString("webirc_hostname") // Hostname template for puppets
 
 	if webIRCPass == "" {
 		log.Warnln("webirc_pass is empty")
@@ -136,7 +423,8 @@ func main() {
 	matchers := setupHostmaskMatchers(ircIgnores)
 	discordFilter := setupFilter(rawDiscordFilter)
 	ircFilter := setupFilter(rawIRCFilter)
-	SetLogDebug(*debugMode)
+	rewrites := setupRewrites(viper)
+	SetLogDebug(*f.debugMode)
 
 	// Check for nil, as nil means we don't use this list
 	var discordAllowed map[string]struct{}
@@ -145,121 +433,353 @@ func main() {
 		discordAllowed = stringSliceToMap(rawDiscordAllowed)
 	}
 
-	dib, err := bridge.New(&bridge.Config{
+	n.ircUsername = ircUsername
+	n.channelMappings = channelMappings
+	n.ircMonitorNicks = ircMonitorNicks
+
+	return &bridge.Config{
 		AvatarURL:                  avatarURL,
+		AvatarOverrides:            avatarOverrides,
+		AvatarGravatar:             avatarGravatar,
+		AvatarCommand:              avatarCommand,
+		WebhookRotation:            webhookRotation,
+		ChannelWebhooks:            channelWebhooks,
 		Discriminator:              discriminator,
 		DiscordBotToken:            discordBotToken,
-		GuildID:                    guildID,
+		GuildIDs:                   guildIDs,
 		IRCListenerName:            ircUsername,
 		IRCServer:                  ircServer,
 		IRCServerPass:              ircPassword,
 		IRCPuppetPrejoinCommands:   ircPuppetPrejoinCommands,
 		IRCListenerPrejoinCommands: ircListenerPrejoinCommands,
+		JoinAfterAuth:              joinAfterAuth,
+		IRCListenerAltNick:         ircListenerAltNick,
+		IRCListenerAccount:         ircListenerAccount,
+		IRCListenerPassword:        ircListenerPassword,
+		Services:                   setupServices(viper),
+		ServicesRequestOp:          servicesRequestOp,
 		ConnectionLimit:            connectionLimit,
+		MaxPuppets:                 maxPuppets,
+		PuppetAccounts:             puppetAccounts,
+		PuppetNickSource:           puppetNickSource,
+		NickScriptPolicies:         nickScriptPolicies,
+		NickOverrides:              nickOverrides,
+		DisplayNameOverrides:       displayNameOverrides,
 		IRCIgnores:                 matchers,
 		IRCFilteredMessages:        ircFilter,
 		DiscordIgnores:             stringSliceToMap(rawDiscordIgnores),
 		DiscordAllowed:             discordAllowed,
 		DiscordFilteredMessages:    discordFilter,
+		FilterChannel:              filterChannel,
+		Rewrites:                   rewrites,
 		PuppetUsername:             puppetUsername,
+		PuppetRealName:             puppetRealName,
+		IRCListenerUsername:        ircListenerUsername,
+		IRCListenerRealName:        ircListenerRealName,
 		WebIRCPass:                 webIRCPass,
-		NoTLS:                      *notls,
-		InsecureSkipVerify:         *insecure,
+		WebIRCGateway:              webIRCGateway,
+		WebIRCHostname:             webIRCHostname,
+		NoTLS:                      *f.notls,
+		InsecureSkipVerify:         *f.insecure,
 		Suffix:                     suffix,
 		Separator:                  separator,
-		SimpleMode:                 *simple,
+		SimpleMode:                 simpleMode,
 		ChannelMappings:            channelMappings,
 		CooldownDuration:           time.Second * time.Duration(cooldownDuration),
+		PuppetIdleTimeout:          time.Second * time.Duration(puppetIdleTimeout),
 		ShowJoinQuit:               showJoinQuit,
+		JoinQuitEvents:             joinQuitEvents,
+		JoinQuitChannelEvents:      joinQuitChannels,
+		JoinQuitBatchDelay:         time.Second * time.Duration(joinQuitBatchDelay),
+		JoinQuitSpokeWithin:        time.Second * time.Duration(joinQuitSpokeWithin),
+		IRCChathistoryLimit:        ircChathistoryLimit,
+		AwayStatusChannel:          awayStatusChannel,
+		IRCMonitorNicks:            ircMonitorNicks,
+		IRCMonitorChannel:          ircMonitorChannel,
+		StatusMsgRoles:             stringSliceToMap(statusMsgRoles),
+		RelayRoles:                 stringSliceToMap(relayRoles),
+		RelayChannelRoles:          relayChannelRoles,
+		RelayExcludedRoles:         stringSliceToMap(relayExcludedRoles),
+		RelayWindows:               relayWindows,
+		RelayWindowAction:          relayWindowAction,
+		LogDir:                     logDir,
+		LogDirFormat:               logDirFormat,
+		LogDirUnrelayed:            logDirUnrelayed,
+		LogDirChannels:             logDirChannels,
+		RelayDiscordBots:           relayDiscordBots,
+		RelayDiscordWebhooks:       relayDiscordWebhooks,
+		DiscordBotsAllowed:         stringSliceToMap(discordBotsAllowed),
+		DiscordBotsDenied:          stringSliceToMap(discordBotsDenied),
+		RelayDiscordCrossposts:     relayDiscordCrossposts,
+		PublishAnnouncements:       publishAnnouncements,
+		DiscordLinkQuotes:          discordLinkQuotes,
+		URLTitles:                  stringSliceToMap(urlTitles),
+		URLTitlesAllowed:           setupHostmaskMatchers(urlTitlesAllowed),
+		URLTitlesDenied:            setupHostmaskMatchers(urlTitlesDenied),
+		Rehost:                     setupRehost(viper, getSecret(viper, "rehost_password")),
+		RehostMaxSize:              rehostMaxSize * 1024 * 1024,
+		IRCImageUploads:            ircImageUploads,
+		IRCImageMaxSize:            ircImageMaxSize * 1024 * 1024,
+		ThrottleMessages:           throttleMessages,
+		ThrottleRepeats:            throttleRepeats,
+		ThrottleInterval:           time.Second * time.Duration(throttleInterval),
+		ThrottleAction:             throttleAction,
+		ThrottleMuteDuration:       time.Second * time.Duration(throttleMuteDuration),
+		ThrottleChannel:            throttleChannel,
+		StatsInterval:              time.Second * time.Duration(statsInterval),
+		StatsTemplate:              statsTemplate,
+		StatsDiscordChannel:        statsDiscordChannel,
+		StatsIRCTopics:             statsIRCTopics,
+		ResyncInterval:             time.Second * time.Duration(resyncInterval),
+		StatusChannel:              statusChannel,
+		StatusInterval:             time.Second * time.Duration(statusInterval),
+		ModerationAction:           ircModerationAction,
+		ModerationTimeout:          time.Second * time.Duration(ircModerationTimeout),
+		ModerationRole:             ircModerationRole,
+		DiscordBansToIRC:           discordBansToIRC,
+		IRCInviteRequest:           ircInviteRequest,
+		ModChannel:                 modChannel,
+		IRCDownNotice:              time.Second * time.Duration(ircDownNotice),
+		IRCOfflineBuffer:           ircOfflineBuffer,
+		DiscordOfflineBuffer:       discordOfflineBuffer,
+		DiscordOfflineBatch:        discordOfflineBatch,
+		IRCDeliveryTimeout:         time.Second * time.Duration(ircDeliveryTimeout),
+		DeliveryFailedEmoji:        deliveryFailedEmoji,
+		DeliveryFailedDM:           deliveryFailedDM,
+		IRCPingInterval:            time.Second * time.Duration(ircPingInterval),
+		IRCPingTimeout:             time.Second * time.Duration(ircPingTimeout),
+		DiscordZombieTimeout:       time.Second * time.Duration(discordZombieTimeout),
 		MaxNickLength:              maxNickLength,
+		CTCPVersion:                ctcpVersion,
+		StoragePath:                storagePath,
+		AvatarCacheTTL:             time.Second * time.Duration(avatarCacheTTL),
+		DeadLetterPath:             deadLetterPath,
+		ShutdownTimeout:            time.Second * time.Duration(shutdownTimeout),
+		IRCQuitMessage:             ircQuitMessage,
+		AutoMap:                    autoMap,
+		AutoMapNamePrefix:          autoMapNamePrefix,
+		AdminDiscordIDs:            stringSliceToMap(adminDiscordIDs),
+		AdminDiscordRoles:          stringSliceToMap(adminDiscordRoles),
+		SlashCommands:              slashCommands,
+		AdminIRCHostmasks:          setupHostmaskMatchers(adminIRCHostmasks),
+		IRCSendRate:                ircSendRate,
+		IRCSendBurst:               ircSendBurst,
+		RelayQueueSize:             relayQueueSize,
+		RelayOverflowPolicy:        relayOverflowPolicy,
 
-		Debug:         *debugMode,
-		DebugPresence: *debugPresence,
-	})
+		Debug:         *f.debugMode,
+		DebugPresence: *f.debugPresence,
+		DryRun:        *f.dryRun,
+	}
+}
 
-	if err != nil {
-		log.WithField("error", err).Fatalln("Go-Discord-IRC failed to initialise.")
-		return
+// reload applies config changes that can be made while the network's bridge is running
+func (n *network) reload(viper *viper.Viper, f *flags) {
+	n.reloadIRCServer(viper)
+
+	if newUsername := viper.GetString("irc_listener_name"); n.ircUsername != newUsername {
+		log.Printf("Changed irc_listener_name from '%s' to '%s'", n.ircUsername, newUsername)
+		// Listener name has changed
+		n.ircUsername = newUsername
+		n.dib.SetIRCListenerName(n.ircUsername)
 	}
 
-	log.Infoln("Cooldown duration for IRC puppets is", dib.Config.CooldownDuration)
+	if showJoinQuit := viper.GetBool("show_joinquit"); n.dib.Config().ShowJoinQuit != showJoinQuit {
+		log.Printf("Changed show_joinquit from %+v to %+v", n.dib.Config().ShowJoinQuit, showJoinQuit)
+		n.dib.SetShowJoinQuit(showJoinQuit)
+	}
 
-	// Create new signal receiver
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	joinQuitEvents := setupJoinQuitEvents(viper.GetStringSlice("joinquit_events"))
+	joinQuitChannels := setupJoinQuitChannels(viper.GetStringMapStringSlice("joinquit_channels"))
+	if conf := n.dib.Config(); !reflect.DeepEqual(joinQuitEvents, conf.JoinQuitEvents) ||
+		!reflect.DeepEqual(joinQuitChannels, conf.JoinQuitChannelEvents) {
+		log.Println("Join and quit events to show updated!")
+		n.dib.SetJoinQuitEvents(joinQuitEvents, joinQuitChannels)
+	}
 
-	// Open the bot
-	err = dib.Open()
-	if err != nil {
-		log.WithField("error", err).Fatalln("Go-Discord-IRC failed to start.")
-		return
+	if nicks := viper.GetStringSlice("irc_monitor_nicks"); !reflect.DeepEqual(nicks, n.ircMonitorNicks) {
+		log.Println("IRC monitor nicks updated!")
+		n.ircMonitorNicks = nicks
+		n.dib.SetIRCMonitorNicks(nicks)
 	}
 
-	// Inform the user that things are happening!
-	log.Infoln("Go-Discord-IRC is now running. Press Ctrl-C to exit.")
+	if rotation := viper.GetInt("webhook_rotation"); n.dib.Config().WebhookRotation != rotation {
+		log.Printf("Changed webhook_rotation from %d to %d", n.dib.Config().WebhookRotation, rotation)
+		n.dib.SetWebhookRotation(rotation)
+	}
 
-	// Start watching for live changes...
-	viper.WatchConfig()
-	viper.OnConfigChange(func(e fsnotify.Event) {
-		log.Println("Configuration file has changed!")
-		if newUsername := viper.GetString("irc_listener_name"); ircUsername != newUsername {
-			log.Printf("Changed irc_listener_name from '%s' to '%s'", ircUsername, newUsername)
-			// Listener name has changed
-			ircUsername = newUsername
-			dib.SetIRCListenerName(ircUsername)
-		}
+	webhooks := setupChannelWebhooks(viper.GetStringMapString("channel_webhooks"))
+	if !reflect.DeepEqual(webhooks, n.dib.Config().ChannelWebhooks) {
+		log.Println("Channel webhooks updated!")
+		n.dib.SetChannelWebhooks(webhooks)
+	}
+
+	if debug := viper.GetBool("debug"); n.dib.Config().Debug != debug {
+		log.Printf("Debug changed from %+v to %+v", n.dib.Config().Debug, debug)
+		*f.debugMode = debug
+		n.dib.SetDebugMode(debug)
+		SetLogDebug(debug)
+	}
 
+	// Everything else changes at once, so the bridge never sees half of a reload
+	n.dib.UpdateConfig(func(conf *bridge.Config) {
 		ircIgnores := viper.GetStringSlice("ignored_irc_hostmasks")
-		dib.Config.IRCIgnores = setupHostmaskMatchers(ircIgnores)
+		conf.IRCIgnores = setupHostmaskMatchers(ircIgnores)
 
-		rawIRCFilter := viper.GetStringSlice("irc_message_filter")
-		rawDiscordFilter := viper.GetStringSlice("discord_message_filter")
-		dib.Config.DiscordFilteredMessages = setupFilter(rawDiscordFilter)
-		dib.Config.IRCFilteredMessages = setupFilter(rawIRCFilter)
+		rawIRCFilter := messageFilters(viper, "irc_message_filter")
+		rawDiscordFilter := messageFilters(viper, "discord_message_filter")
+		conf.DiscordFilteredMessages = setupFilter(rawDiscordFilter)
+		conf.IRCFilteredMessages = setupFilter(rawIRCFilter)
+		conf.FilterChannel = viper.GetString("filter_channel")
+		conf.Rewrites = setupRewrites(viper)
 
-		avatarURL := viper.GetString("avatar_url")
-		dib.Config.AvatarURL = avatarURL
+		conf.AvatarURL = viper.GetString("avatar_url")
+		conf.AvatarOverrides = viper.GetStringMapString("avatar_overrides")
+		conf.AvatarGravatar = viper.GetBool("avatar_gravatar")
+		conf.AvatarCommand = viper.GetString("avatar_command")
+		conf.AvatarCacheTTL = time.Second * time.Duration(viper.GetInt64("avatar_cache_ttl"))
+		conf.CTCPVersion = viper.GetString("ctcp_version")
+		conf.MaxPuppets = viper.GetInt("max_puppets")
+		conf.PuppetAccounts = setupPuppetAccounts(viper.GetStringMapString("puppet_accounts"))
+		conf.PuppetNickSource = viper.GetString("puppet_nick_source")
+		conf.NickOverrides = viper.GetStringMapString("nick_overrides")
+		conf.DisplayNameOverrides = viper.GetStringMapString("display_name_overrides")
+		conf.NickScriptPolicies = viper.GetStringMapString("nick_script_policies")
+		conf.WebIRCHostname = viper.GetString("webirc_hostname")
+		conf.PuppetUsername = viper.GetString("puppet_username")
+		conf.PuppetRealName = viper.GetString("puppet_realname")
+		conf.RelayOverflowPolicy = viper.GetString("relay_overflow_policy")
 
-		if debug := viper.GetBool("debug"); *debugMode != debug {
-			log.Printf("Debug changed from %+v to %+v", *debugMode, debug)
-			*debugMode = debug
-			dib.SetDebugMode(debug)
-			SetLogDebug(debug)
-		}
+		conf.JoinQuitBatchDelay = time.Second * time.Duration(viper.GetInt64("joinquit_batch_delay"))
+		conf.JoinQuitSpokeWithin = time.Second * time.Duration(viper.GetInt64("joinquit_spoke_within"))
+		conf.AwayStatusChannel = viper.GetString("away_status_channel")
+		conf.IRCChathistoryLimit = viper.GetInt("irc_chathistory_limit")
+		conf.IRCDeliveryTimeout = time.Second * time.Duration(viper.GetInt64("irc_delivery_timeout"))
+		conf.DeliveryFailedEmoji = viper.GetString("delivery_failed_emoji")
+		conf.DeliveryFailedDM = viper.GetBool("delivery_failed_dm")
+		conf.IRCPingInterval = time.Second * time.Duration(viper.GetInt64("irc_ping_interval"))
+		conf.IRCPingTimeout = time.Second * time.Duration(viper.GetInt64("irc_ping_timeout"))
+		conf.DiscordZombieTimeout = time.Second * time.Duration(viper.GetInt64("discord_zombie_timeout"))
+		conf.IRCDownNotice = time.Second * time.Duration(viper.GetInt64("irc_down_notice"))
+		conf.IRCOfflineBuffer = viper.GetInt("irc_offline_buffer")
+		conf.DiscordOfflineBuffer = viper.GetInt("discord_offline_buffer")
+		conf.DiscordOfflineBatch = viper.GetBool("discord_offline_batch")
+		conf.CooldownDuration = time.Second * time.Duration(viper.GetInt64("cooldown_duration"))
+		conf.ShutdownTimeout = time.Second * time.Duration(viper.GetInt64("shutdown_timeout"))
+		conf.IRCQuitMessage = viper.GetString("irc_quit_message")
+		conf.PuppetIdleTimeout = time.Second * time.Duration(viper.GetInt64("puppet_idle_timeout"))
+		conf.IRCMonitorChannel = viper.GetString("irc_monitor_channel")
 
 		rawDiscordIgnores := viper.GetStringSlice("ignored_discord_ids")
-		dib.Config.DiscordIgnores = stringSliceToMap(rawDiscordIgnores)
+		conf.DiscordIgnores = stringSliceToMap(rawDiscordIgnores)
+
+		conf.StatusMsgRoles = stringSliceToMap(viper.GetStringSlice("statusmsg_roles"))
+		conf.RelayRoles = stringSliceToMap(viper.GetStringSlice("relay_roles"))
+		conf.RelayChannelRoles = setupChannelRoles(viper.GetStringMapStringSlice("relay_channel_roles"))
+		conf.RelayExcludedRoles = stringSliceToMap(viper.GetStringSlice("relay_excluded_roles"))
+		conf.RelayWindows = setupRelayWindows(viper.GetStringMapStringSlice("relay_windows"))
+		conf.RelayWindowAction = viper.GetString("relay_window_action")
+		conf.LogDir = viper.GetString("log_dir")
+		conf.LogDirFormat = viper.GetString("log_dir_format")
+		conf.LogDirUnrelayed = viper.GetBool("log_dir_unrelayed")
+		conf.LogDirChannels = viper.GetStringSlice("log_dir_channels")
+		conf.RelayDiscordBots = viper.GetBool("relay_discord_bots")
+		conf.RelayDiscordWebhooks = viper.GetBool("relay_discord_webhooks")
+		conf.DiscordBotsAllowed = stringSliceToMap(viper.GetStringSlice("discord_bots_allowed"))
+		conf.DiscordBotsDenied = stringSliceToMap(viper.GetStringSlice("discord_bots_denied"))
+		conf.RelayDiscordCrossposts = viper.GetBool("relay_discord_crossposts")
+		conf.PublishAnnouncements = viper.GetBool("publish_announcements")
+		conf.DiscordLinkQuotes = viper.GetBool("discord_link_quotes")
+		conf.URLTitles = stringSliceToMap(viper.GetStringSlice("url_titles"))
+		conf.URLTitlesAllowed = setupHostmaskMatchers(viper.GetStringSlice("url_titles_allowed"))
+		conf.URLTitlesDenied = setupHostmaskMatchers(viper.GetStringSlice("url_titles_denied"))
+		if password, err := readSecret(viper, "rehost_password"); err != nil {
+			log.WithField("error", err).Errorln("Keeping the old rehost settings after reloading config")
+		} else {
+			conf.Rehost = setupRehost(viper, password)
+		}
+		conf.RehostMaxSize = viper.GetInt64("rehost_max_size") * 1024 * 1024
+		conf.IRCImageUploads = viper.GetBool("irc_image_uploads")
+		conf.IRCImageMaxSize = viper.GetInt64("irc_image_max_size") * 1024 * 1024
+		conf.ThrottleMessages = viper.GetInt("throttle_messages")
+		conf.ThrottleRepeats = viper.GetInt("throttle_repeats")
+		conf.ThrottleInterval = time.Second * time.Duration(viper.GetInt64("throttle_interval"))
+		conf.ThrottleAction = viper.GetString("throttle_action")
+		conf.ThrottleMuteDuration = time.Second * time.Duration(viper.GetInt64("throttle_mute_duration"))
+		conf.ThrottleChannel = viper.GetString("throttle_channel")
+		conf.StatsInterval = time.Second * time.Duration(viper.GetInt64("stats_interval"))
+		conf.StatsTemplate = viper.GetString("stats_template")
+		conf.StatsDiscordChannel = viper.GetString("stats_discord_channel")
+		conf.StatsIRCTopics = viper.GetBool("stats_irc_topics")
+		conf.ResyncInterval = time.Second * time.Duration(viper.GetInt64("resync_interval"))
+		conf.StatusChannel = viper.GetString("status_channel")
+		conf.StatusInterval = time.Second * time.Duration(viper.GetInt64("status_interval"))
+		conf.ModerationAction = viper.GetString("irc_moderation_action")
+		conf.ModerationTimeout = time.Second * time.Duration(viper.GetInt64("irc_moderation_timeout"))
+		conf.ModerationRole = viper.GetString("irc_moderation_role")
+		conf.DiscordBansToIRC = viper.GetBool("discord_bans_to_irc")
+		conf.IRCInviteRequest = viper.GetString("irc_invite_request")
+		conf.ModChannel = viper.GetString("mod_channel")
+		conf.JoinAfterAuth = viper.GetBool("join_after_auth")
+		conf.IRCListenerAltNick = viper.GetString("irc_listener_alt_nick")
+		conf.IRCListenerAccount = viper.GetString("irc_listener_account")
+		conf.IRCListenerPassword = reloadSecret(viper, "irc_listener_password", conf.IRCListenerPassword)
+		conf.Services = setupServices(viper)
+		conf.ServicesRequestOp = viper.GetBool("services_request_op")
+		conf.AutoMap = viper.GetBool("auto_map")
+		conf.AutoMapNamePrefix = viper.GetString("auto_map_name_prefix")
+		conf.AdminDiscordIDs = stringSliceToMap(viper.GetStringSlice("admin_discord_ids"))
+		conf.AdminDiscordRoles = stringSliceToMap(viper.GetStringSlice("admin_discord_roles"))
+		conf.SlashCommands = viper.GetBool("slash_commands")
+		conf.AdminIRCHostmasks = setupHostmaskMatchers(viper.GetStringSlice("admin_irc_hostmasks"))
 
 		rawDiscordAllowed := viper.GetStringSlice("allowed_discord_ids")
 		if rawDiscordAllowed == nil {
-			dib.Config.DiscordAllowed = nil
+			conf.DiscordAllowed = nil
 		} else {
-			dib.Config.DiscordAllowed = stringSliceToMap(rawDiscordAllowed)
+			conf.DiscordAllowed = stringSliceToMap(rawDiscordAllowed)
 		}
+	})
 
-		chans := viper.GetStringMapString("channel_mappings")
-		equalChans := reflect.DeepEqual(chans, channelMappings)
-		if !equalChans {
-			log.Println("Channel mappings updated!")
-			if len(chans) == 0 {
-				log.Println("Channel mappings are missing! Not applying changes in case this was an accident.")
+	chans := viper.GetStringMapString("channel_mappings")
+	equalChans := reflect.DeepEqual(chans, n.channelMappings)
+	if !equalChans {
+		log.Println("Channel mappings updated!")
+		if len(chans) == 0 {
+			log.Println("Channel mappings are missing! Not applying changes in case this was an accident.")
+		} else {
+			if err := n.dib.SetChannelMappings(chans); err != nil {
+				log.WithField("error", err).Errorln("could not set channel mappings")
 			} else {
-				if err := dib.SetChannelMappings(chans); err != nil {
-					log.WithField("error", err).Errorln("could not set channel mappings")
-				} else {
-					channelMappings = chans
-				}
+				n.channelMappings = chans
 			}
 		}
-	})
+	}
+}
 
-	// Watch for a shutdown signal
-	<-sc
+// reloadIRCServer updates how the bridge connects to IRC.
+// Changes only apply once IRC is restarted (with SIGUSR1 or the admin dashboard).
+func (n *network) reloadIRCServer(viper *viper.Viper) {
+	conf := n.dib.Config()
+	server := viper.GetString("irc_server")
+	password := reloadSecret(viper, "irc_pass", conf.IRCServerPass)
+	webIRCPass := reloadSecret(viper, "webirc_pass", conf.WebIRCPass)
+	insecure := viper.GetBool("insecure")
+	noTLS := viper.GetBool("no_tls")
 
-	log.Infoln("Shutting down Go-Discord-IRC...")
+	if server == conf.IRCServer && password == conf.IRCServerPass && webIRCPass == conf.WebIRCPass &&
+		insecure == conf.InsecureSkipVerify && noTLS == conf.NoTLS {
+		return
+	}
 
-	// Cleanly close down the bridge.
-	dib.Close()
+	log.WithField("network", n.name).Println("IRC server settings changed, send SIGUSR1 to reconnect to IRC with them")
+	n.dib.UpdateConfig(func(conf *bridge.Config) {
+		conf.IRCServer = server
+		conf.IRCServerPass = password
+		conf.WebIRCPass = webIRCPass
+		conf.InsecureSkipVerify = insecure
+		conf.NoTLS = noTLS
+	})
 }
 
 func stringSliceToMap(list []string) map[string]struct{} {
@@ -273,7 +793,7 @@ func stringSliceToMap(list []string) map[string]struct{} {
 func setupHostmaskMatchers(hostmasks []string) []glob.Glob {
 	var matchers []glob.Glob
 	for _, mask := range hostmasks {
-		g, err := glob.Compile(mask)
+		g, err := pattern.Compile(mask)
 		if err != nil {
 			log.WithField("error", err).WithField("hostmask", mask).Errorln("Failed to compile hostmask ban!")
 			continue
@@ -285,26 +805,293 @@ func setupHostmaskMatchers(hostmasks []string) []glob.Glob {
 	return matchers
 }
 
-func setupFilter(filters []string) []glob.Glob {
-	var matchers []glob.Glob
+// setupJoinQuitEvents returns the kinds of join and quit event to show, or nil if the option isn't set
+func setupJoinQuitEvents(events []string) map[string]struct{} {
+	if events == nil {
+		return nil
+	}
+	return stringSliceToMap(events)
+}
+
+// setupJoinQuitChannels returns the kinds of join and quit event to show for each IRC channel
+func setupJoinQuitChannels(channels map[string][]string) map[string]map[string]struct{} {
+	if len(channels) == 0 {
+		return nil
+	}
+	m := make(map[string]map[string]struct{}, len(channels))
+	for channel, events := range channels {
+		m[channel] = stringSliceToMap(events)
+	}
+	return m
+}
+
+// setupChannelRoles returns the Discord roles for each Discord channel
+func setupChannelRoles(channels map[string][]string) map[string]map[string]struct{} {
+	m := make(map[string]map[string]struct{}, len(channels))
+	for channel, roles := range channels {
+		m[channel] = stringSliceToMap(roles)
+	}
+	return m
+}
+
+// setupChannelWebhooks reads the webhook URL for each Discord channel, which may be secrets
+func setupChannelWebhooks(webhooks map[string]string) map[string]string {
+	m := make(map[string]string, len(webhooks))
+	for channel, raw := range webhooks {
+		webhookURL, err := configfile.Expand(raw)
+		if err != nil {
+			log.WithField("error", err).WithField("channel", channel).Errorln("Could not read channel webhook!")
+			continue
+		}
+		m[channel] = webhookURL
+	}
+	return m
+}
+
+// setupRelayWindows parses the relay windows of each IRC channel, leaving out channels with invalid windows
+func setupRelayWindows(windows map[string][]string) map[string]schedule.Schedule {
+	m := make(map[string]schedule.Schedule, len(windows))
+	for channel, specs := range windows {
+		s, err := schedule.ParseSchedule(specs)
+		if err != nil {
+			log.WithField("error", err).WithField("channel", channel).Errorln("Could not parse relay window!")
+			continue
+		}
+		m[channel] = s
+	}
+	return m
+}
+
+// setupRehost returns where Discord attachments are copied to, or nil if rehost_target isn't set
+func setupRehost(viper *viper.Viper, password string) *rehost.Rehoster {
+	kind := viper.GetString("rehost_target")
+	if kind == "" {
+		return nil
+	}
+
+	r, err := rehost.New(kind, viper.GetString("rehost_location"), viper.GetString("rehost_username"),
+		password, viper.GetString("rehost_region"), viper.GetString("rehost_public_url"))
+	if err != nil {
+		log.WithField("error", err).Errorln("Could not set up rehosting attachments!")
+		return nil
+	}
+	return r
+}
+
+// setupServices reads the commands sent to services
+func setupServices(viper *viper.Viper) bridge.ServicesCommands {
+	return bridge.ServicesCommands{
+		Identify: viper.GetString("services_identify"),
+		Regain:   viper.GetString("services_regain"),
+		Ghost:    viper.GetString("services_ghost"),
+		Release:  viper.GetString("services_release"),
+		Invite:   viper.GetString("services_invite"),
+		Op:       viper.GetString("services_op"),
+	}
+}
+
+func setupPuppetAccounts(accounts map[string]string) map[string]bridge.PuppetAccount {
+	m := make(map[string]bridge.PuppetAccount, len(accounts))
+	for discordID, credentials := range accounts {
+		parts := strings.SplitN(credentials, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.WithField("discord", discordID).Errorln("Puppet account must be in the form account:password!")
+			continue
+		}
+
+		password, err := configfile.Expand(parts[1])
+		if err != nil {
+			log.WithField("error", err).WithField("discord", discordID).Errorln("Could not read puppet account password!")
+			continue
+		}
+
+		m[discordID] = bridge.PuppetAccount{Account: parts[0], Password: password}
+	}
+	return m
+}
+
+// readSecret reads an option that can reference an environment variable or file, see configfile.Expand
+func readSecret(viper *viper.Viper, key string) (string, error) {
+	value, err := configfile.Expand(viper.GetString(key))
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// readGuildIDs reads guild_id, which is one guild or a list of them
+func readGuildIDs(viper *viper.Viper) []string {
+	list, ok := viper.Get("guild_id").([]interface{})
+	if !ok {
+		return []string{viper.GetString("guild_id")}
+	}
+
+	ids := make([]string, len(list))
+	for i, id := range list {
+		ids[i] = fmt.Sprint(id)
+	}
+	return ids
+}
+
+// getSecret is readSecret for starting up, exiting if the option can't be read
+func getSecret(viper *viper.Viper, key string) string {
+	value, err := readSecret(viper, key)
+	if err != nil {
+		log.WithField("error", err).Fatalln("could not read config")
+	}
+	return value
+}
+
+// reloadSecret is readSecret for reloads, keeping old if the option can't be read
+// so that a broken reference doesn't stop a running bridge
+func reloadSecret(viper *viper.Viper, key, old string) string {
+	value, err := readSecret(viper, key)
+	if err != nil {
+		log.WithField("error", err).Errorln("Keeping the old value after reloading config")
+		return old
+	}
+	return value
+}
+
+// messageFilter is an entry of a message filter option, before it is compiled
+type messageFilter struct {
+	match  string
+	action string
+}
+
+// messageFilters reads a message filter option. Each entry is a pattern of lines to drop,
+// or has a pattern to match and an action.
+func messageFilters(viper *viper.Viper, key string) []messageFilter {
+	raw, ok := viper.Get(key).([]interface{})
+	if !ok {
+		// Not a list, or a list of strings from a flag or environment variable
+		var filters []messageFilter
+		for _, match := range viper.GetStringSlice(key) {
+			filters = append(filters, messageFilter{match: match})
+		}
+		return filters
+	}
+
+	filters := make([]messageFilter, 0, len(raw))
+	for _, entry := range raw {
+		fields := make(map[string]interface{})
+		switch entry := entry.(type) {
+		case map[string]interface{}:
+			fields = entry
+		case map[interface{}]interface{}:
+			for k, v := range entry {
+				fields[fmt.Sprint(k)] = v
+			}
+		default:
+			fields["match"] = entry
+		}
+
+		var filter messageFilter
+		if match, ok := fields["match"]; ok {
+			filter.match = fmt.Sprint(match)
+		}
+		if action, ok := fields["action"]; ok {
+			filter.action = fmt.Sprint(action)
+		}
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+func setupFilter(filters []messageFilter) []bridge.MessageFilter {
+	var matchers []bridge.MessageFilter
 	for _, filter := range filters {
-		g, err := glob.Compile(filter)
+		g, err := pattern.Compile(filter.match)
 		if err != nil {
-			log.WithField("error", err).WithField("filter", filter).Errorln("Failed to compile message filter!")
+			log.WithField("error", err).WithField("filter", filter.match).Errorln("Failed to compile message filter!")
 			continue
 		}
 
-		matchers = append(matchers, g)
+		matchers = append(matchers, bridge.MessageFilter{Glob: g, Action: filter.action})
 	}
 
 	return matchers
 }
 
+// setupRewrites compiles the rewrites, each with a regexp to match, its replacement and
+// which way it applies (to_irc, to_discord or both, the default)
+func setupRewrites(viper *viper.Viper) []bridge.Rewrite {
+	var raw []struct {
+		Match     string
+		Replace   string
+		Direction string
+	}
+	if err := viper.UnmarshalKey("rewrites", &raw); err != nil {
+		log.WithField("error", err).Errorln("Failed to read rewrites!")
+		return nil
+	}
+
+	var rewrites []bridge.Rewrite
+	for _, r := range raw {
+		pattern, err := regexp.Compile(r.Match)
+		if err != nil {
+			log.WithField("error", err).WithField("rewrite", r.Match).Errorln("Failed to compile rewrite!")
+			continue
+		}
+
+		rewrite := bridge.Rewrite{Pattern: pattern, Replacement: r.Replace}
+		switch r.Direction {
+		case bridge.RewriteToIRC:
+			rewrite.ToIRC = true
+		case bridge.RewriteToDiscord:
+			rewrite.ToDiscord = true
+		case bridge.RewriteBoth, "":
+			rewrite.ToIRC, rewrite.ToDiscord = true, true
+		default:
+			log.WithField("rewrite", r.Match).Errorf("Unknown rewrite direction %q!", r.Direction)
+			continue
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+
+	return rewrites
+}
+
+// logLevel is the log_level from the config, used when debug mode is off
+var logLevel = log.InfoLevel
+
+// setupLogging applies the logging options, which are shared by every network
+func setupLogging(viper *viper.Viper, debug bool) error {
+	viper.SetDefault("log_level", "info")
+	level, err := log.ParseLevel(viper.GetString("log_level"))
+	if err != nil {
+		return errors.Wrap(err, "invalid log_level")
+	}
+
+	levels := make(map[string]log.Level)
+	for subsystem, name := range viper.GetStringMapString("log_levels") {
+		if levels[subsystem], err = log.ParseLevel(name); err != nil {
+			return errors.Wrapf(err, "invalid log level for %s", subsystem)
+		}
+	}
+
+	viper.SetDefault("log_file_max_size", 10)
+	viper.SetDefault("log_file_max_backups", 3)
+	opts := logging.Options{
+		Level:      level,
+		Levels:     levels,
+		JSON:       viper.GetString("log_format") == "json",
+		File:       viper.GetString("log_file"),
+		MaxSize:    viper.GetInt64("log_file_max_size") * 1024 * 1024,
+		MaxBackups: viper.GetInt("log_file_max_backups"),
+	}
+
+	logLevel = level
+	if debug {
+		opts.Level = log.DebugLevel
+	}
+	return logging.Configure(opts)
+}
+
 func SetLogDebug(debug bool) {
-	logger := log.StandardLogger()
 	if debug {
-		logger.SetLevel(log.DebugLevel)
+		logging.SetLevel(log.DebugLevel)
 	} else {
-		logger.SetLevel(log.InfoLevel)
+		logging.SetLevel(logLevel)
 	}
 }
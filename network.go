@@ -0,0 +1,174 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/qaisjp/go-discord-irc/bridge"
+	"github.com/qaisjp/go-discord-irc/chanlog"
+	ircnick "github.com/qaisjp/go-discord-irc/irc/nick"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// flags are the command line flags that apply to every network
+type flags struct {
+	simple        *bool
+	debugMode     *bool
+	notls         *bool
+	insecure      *bool
+	debugPresence *bool
+	dryRun        *bool
+}
+
+// network is a bridge to one IRC network, and the config it was last loaded with.
+//
+// The top level of the config file is the default network, with a blank name.
+// More networks can be added under "networks", each overriding top level options,
+// and their channels are mapped in "channel_mappings" as "network/#channel".
+type network struct {
+	name string
+	dib  *bridge.Bridge
+
+	ircUsername     string
+	channelMappings map[string]string
+	ircMonitorNicks []string
+}
+
+// networkNames returns the blank default network name followed by the configured networks
+func networkNames(v *viper.Viper) []string {
+	names := []string{""}
+	var others []string
+	for name := range v.GetStringMap("networks") {
+		others = append(others, name)
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// networkViper returns the config for a network: the top level options,
+// overridden by the network's own, with only the network's channel mappings.
+func networkViper(v *viper.Viper, name string) *viper.Viper {
+	settings := v.AllSettings()
+	delete(settings, "networks")
+
+	nv := viper.New()
+	setDefaults(nv)
+	if err := nv.MergeConfigMap(settings); err != nil {
+		log.WithField("error", err).Errorln("could not copy config")
+	}
+
+	if name != "" {
+		overrides := v.GetStringMap("networks." + name)
+		if err := nv.MergeConfigMap(overrides); err != nil {
+			log.WithField("error", err).WithField("network", name).Errorln("could not apply network config")
+		}
+
+		// Keep state for each network apart, unless the network has its own file
+		if _, ok := overrides["storage_path"]; !ok {
+			if path := nv.GetString("storage_path"); path != "" {
+				ext := filepath.Ext(path)
+				nv.Set("storage_path", strings.TrimSuffix(path, ext)+"."+name+ext)
+			}
+		}
+	}
+
+	nv.Set("channel_mappings", networkMappings(v.GetStringMapString("channel_mappings"), name))
+	return nv
+}
+
+// setDefaults sets the defaults for options that aren't in the config file.
+// These are set on each network's config, so that reloads see them too.
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("irc_puppet_prejoin_commands", []string{"MODE ${NICK} +D"})
+	v.SetDefault("avatar_url", "https://robohash.org/${USERNAME}.png?set=set4")
+	v.SetDefault("webhook_rotation", 1)
+	v.SetDefault("avatar_cache_ttl", 600)
+	v.SetDefault("avatar_command", bridge.AvatarCommandOn)
+	v.SetDefault("resync_interval", 600)
+	v.SetDefault("status_interval", 60)
+	v.SetDefault("irc_listener_name", "~d")
+	v.SetDefault("puppet_username", "")
+	v.SetDefault("puppet_realname", "${USERNAME}")
+	v.SetDefault("irc_listener_username", "discord")
+	v.SetDefault("suffix", "~d")
+	v.SetDefault("separator", "~")
+	v.SetDefault("simple", false)
+	v.SetDefault("cooldown_duration", int64((time.Hour * 24).Seconds()))
+	v.SetDefault("puppet_idle_timeout", 0)
+	v.SetDefault("show_joinquit", false)
+	v.SetDefault("irc_moderation_action", bridge.ModerationActionNone)
+	v.SetDefault("irc_invite_request", bridge.InviteRequestNone)
+	v.SetDefault("services_identify", "PRIVMSG NickServ :IDENTIFY ${ACCOUNT} ${PASSWORD}")
+	v.SetDefault("services_ghost", "PRIVMSG NickServ :GHOST ${NICK}")
+	v.SetDefault("services_release", "PRIVMSG NickServ :RELEASE ${NICK}")
+	v.SetDefault("services_invite", "PRIVMSG ChanServ :INVITE ${CHANNEL}")
+	v.SetDefault("services_op", "PRIVMSG ChanServ :OP ${CHANNEL} ${NICK}")
+	v.SetDefault("irc_moderation_timeout", 3600)
+	v.SetDefault("discord_bans_to_irc", false)
+	v.SetDefault("relay_discord_bots", true)
+	v.SetDefault("relay_discord_webhooks", true)
+	v.SetDefault("relay_discord_crossposts", true)
+	v.SetDefault("throttle_messages", 0)
+	v.SetDefault("throttle_repeats", 0)
+	v.SetDefault("throttle_interval", 10)
+	v.SetDefault("throttle_action", bridge.ThrottleActionDrop)
+	v.SetDefault("throttle_mute_duration", 300)
+	v.SetDefault("stats_template", "IRC: ${IRC} · Discord: ${DISCORD} online")
+	v.SetDefault("joinquit_batch_delay", 5)
+	v.SetDefault("joinquit_spoke_within", 0)
+	v.SetDefault("irc_chathistory_limit", 0)
+	v.SetDefault("irc_delivery_timeout", 0)
+	v.SetDefault("delivery_failed_emoji", "⚠️")
+	v.SetDefault("irc_ping_interval", 60)
+	v.SetDefault("irc_ping_timeout", 180)
+	v.SetDefault("discord_zombie_timeout", 180)
+	v.SetDefault("relay_window_action", bridge.PauseDrop)
+	v.SetDefault("log_dir_format", chanlog.FormatZNC)
+	v.SetDefault("discord_link_quotes", true)
+	v.SetDefault("rehost_max_size", 25)
+	v.SetDefault("irc_image_max_size", 8)
+	v.SetDefault("irc_down_notice", 300)
+	v.SetDefault("irc_offline_buffer", 100)
+	v.SetDefault("discord_offline_buffer", 100)
+	v.SetDefault("discord_offline_batch", true)
+	v.SetDefault("max_nick_length", ircnick.MAXLENGTH)
+	v.SetDefault("puppet_nick_source", bridge.PuppetNickSourceNickname)
+	v.SetDefault("storage_path", "")
+	v.SetDefault("auto_map", false)
+	v.SetDefault("slash_commands", false)
+	v.SetDefault("ctcp_version", "go-discord-irc")
+	v.SetDefault("webirc_gateway", "discord")
+	v.SetDefault("webirc_hostname", "${ID}.${KIND}.discord")
+	v.SetDefault("irc_send_rate", 2)
+	v.SetDefault("irc_send_burst", 5)
+	v.SetDefault("relay_queue_size", 100)
+	v.SetDefault("relay_overflow_policy", bridge.OverflowBlock)
+	v.SetDefault("shutdown_timeout", 10)
+	v.SetDefault("irc_quit_message", "")
+}
+
+// networkMappings returns the channel mappings for a network, without the "network/" prefix.
+// Mappings without a prefix belong to the default network.
+func networkMappings(mappings map[string]string, name string) map[string]string {
+	m := make(map[string]string)
+	for irc, discord := range mappings {
+		network, channel := splitNetworkChannel(irc)
+		if network == name {
+			m[channel] = discord
+		}
+	}
+	return m
+}
+
+// splitNetworkChannel splits "network/#channel" into its network and channel.
+// Channels can contain slashes, so only text before a slash that isn't part of the channel is a network.
+func splitNetworkChannel(irc string) (network, channel string) {
+	i := strings.IndexByte(irc, '/')
+	if i <= 0 || strings.ContainsAny(irc[:1], "#&!+") {
+		return "", irc
+	}
+	return irc[:i], irc[i+1:]
+}
@@ -0,0 +1,37 @@
+// Package pattern compiles the patterns used in the config to match hostmasks and messages,
+// which are globs, or regular expressions if they start with RegexPrefix.
+package pattern
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// RegexPrefix marks a pattern as a regular expression, like "regex:(?i)\bfoo\b"
+const RegexPrefix = "regex:"
+
+// Regexp is a regular expression that can be used as a glob.Glob.
+// Unlike a glob, it matches anywhere in a string unless it is anchored.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+// Match returns true if the regular expression matches s
+func (r Regexp) Match(s string) bool {
+	return r.MatchString(s)
+}
+
+// Compile compiles a glob (see https://github.com/gobwas/glob),
+// or a Regexp if it starts with RegexPrefix
+func Compile(pattern string) (glob.Glob, error) {
+	if strings.HasPrefix(pattern, RegexPrefix) {
+		r, err := regexp.Compile(strings.TrimPrefix(pattern, RegexPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return Regexp{r}, nil
+	}
+	return glob.Compile(pattern)
+}
@@ -0,0 +1,53 @@
+package pattern
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		pattern string
+		text    string
+		match   bool
+	}{
+		{"*!*@*.example.com", "nick!user@host.example.com", true},
+		{"*!*@*.example.com", "nick!user@example.org", false},
+		{"*spam*", "some spam here", true},
+		{"spam", "some spam here", false},
+		{`regex:\bspam\b`, "some spam here", true},
+		{`regex:\bspam\b`, "spammer", false},
+		{`regex:(?i)^(foo|bar)!`, "BAR!user@host", true},
+		{`regex:^(foo|bar)!`, "baz!user@host", false},
+	}
+
+	for _, tt := range tests {
+		g, err := Compile(tt.pattern)
+		if assert.NoError(t, err, tt.pattern) {
+			assert.Equal(t, tt.match, g.Match(tt.text), "%s matching %q", tt.pattern, tt.text)
+		}
+	}
+}
+
+func TestCompileInvalid(t *testing.T) {
+	_, err := Compile("[abc")
+	assert.Error(t, err)
+
+	_, err = Compile("regex:(abc")
+	assert.Error(t, err)
+
+	// Without the prefix, it's a glob
+	_, err = Compile("(abc")
+	assert.NoError(t, err)
+}
+
+func TestRegexpIsGlob(t *testing.T) {
+	g, err := Compile(`regex:a+`)
+	if assert.NoError(t, err) {
+		r, ok := g.(Regexp)
+		if assert.True(t, ok) {
+			assert.Equal(t, "x-x", r.ReplaceAllString("xaax", "-"))
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Package rehost copies files, such as Discord attachments whose URLs expire, to storage
+// the bridge controls, returning a URL that keeps working.
+package rehost
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of target
+const (
+	// TargetDir writes files to a local directory, served by a web server at the public URL
+	TargetDir = "dir"
+	// TargetWebDAV uploads files with PUT, with basic auth if a username is given
+	TargetWebDAV = "webdav"
+	// TargetS3 uploads files to an S3 (compatible) bucket, at a location like
+	// "https://s3.eu-west-1.amazonaws.com/bucket", with an access key and secret key
+	TargetS3 = "s3"
+)
+
+// DefaultTimeout is how long a file can take to download or upload
+const DefaultTimeout = time.Minute
+
+// errTooLarge is returned when a file is bigger than the size limit
+var errTooLarge = errors.New("the file is too large")
+
+// unsafeName matches characters that aren't kept in file names
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Name returns a file name for a file from a chat message, unique by id, made safe for any target
+func Name(id, filename string) string {
+	filename = strings.Trim(unsafeName.ReplaceAllString(filename, "_"), "._")
+	if filename == "" {
+		return id
+	}
+	return id + "-" + filename
+}
+
+// Rehoster copies files to a target
+type Rehoster struct {
+	kind     string
+	location string
+	username string
+	password string
+	region   string
+	// public is where uploaded files can be downloaded from
+	public string
+
+	client *http.Client
+}
+
+// New returns a Rehoster for a target of kind at location (a directory or a URL). username and password
+// are used for basic auth with TargetWebDAV, or are the access key and secret key with TargetS3.
+// region is the S3 region ("us-east-1" if empty). Files are linked to under publicURL, which defaults to
+// location for targets other than TargetDir.
+func New(kind, location, username, password, region, publicURL string) (*Rehoster, error) {
+	if location == "" {
+		return nil, errors.New("the location to copy files to is not set")
+	}
+	switch kind {
+	case TargetDir:
+		if publicURL == "" {
+			return nil, errors.New("the public URL of the directory is not set")
+		}
+	case TargetWebDAV, TargetS3:
+		if _, err := url.Parse(location); err != nil {
+			return nil, err
+		}
+		if publicURL == "" {
+			publicURL = location
+		}
+	default:
+		return nil, fmt.Errorf("the target must be %s, %s or %s, not %q", TargetDir, TargetWebDAV, TargetS3, kind)
+	}
+	if kind == TargetS3 && region == "" {
+		region = "us-east-1"
+	}
+
+	return &Rehoster{
+		kind:     kind,
+		location: strings.TrimSuffix(location, "/"),
+		username: username,
+		password: password,
+		region:   region,
+		public:   strings.TrimSuffix(publicURL, "/"),
+		client:   &http.Client{Timeout: DefaultTimeout},
+	}, nil
+}
+
+// Rehost downloads the file at source, if it is no bigger than maxSize bytes, and copies it to the
+// target as name (see Name). Returns the URL the copy can be downloaded from.
+func (r *Rehoster) Rehost(source, name string, maxSize int64) (string, error) {
+	resp, err := r.client.Get(source)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading gave %s", resp.Status)
+	}
+	if resp.ContentLength > maxSize {
+		return "", errTooLarge
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > maxSize {
+		return "", errTooLarge
+	}
+
+	if err := r.put(name, resp.Header.Get("Content-Type"), data); err != nil {
+		return "", err
+	}
+	return r.public + "/" + url.PathEscape(name), nil
+}
+
+// put stores a file on the target
+func (r *Rehoster) put(name, contentType string, data []byte) error {
+	if r.kind == TargetDir {
+		return writeFile(filepath.Join(r.location, name), data)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, r.location+"/"+url.PathEscape(name), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if r.kind == TargetS3 {
+		sum := sha256.Sum256(data)
+		signS3(req, r.username, r.password, r.region, hex.EncodeToString(sum[:]), time.Now())
+	} else if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("uploading gave %s", resp.Status)
+	}
+	return nil
+}
+
+// writeFile writes a file so that it is never seen half written
+func writeFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// signS3 signs a request with AWS Signature Version 4, for the s3 service.
+// Every header already set on the request is signed, along with the host.
+func signS3(req *http.Request, accessKey, secretKey, region, payloadHash string, at time.Time) {
+	stamp := at.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,168 @@
+// Package schedule parses the weekly windows used in the config to limit when something happens,
+// like "mon-fri 09:00-17:00 Europe/London".
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dayNames are the names of the days of the week in windows, in time.Weekday order
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Window is a range of times of day on some days of the week, in a time zone.
+// A window that ends before it starts runs past midnight, into the next day.
+type Window struct {
+	days [7]bool
+	// start and end are minutes after midnight
+	start, end int
+	location   *time.Location
+}
+
+// Parse parses a window: the days it is on, like "mon-fri" or "sat,sun" (every day if left out),
+// a range of times like "09:00-17:00", and a time zone like "Europe/London" (UTC if left out).
+func Parse(spec string) (*Window, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 3 {
+		return nil, fmt.Errorf("expected [days] HH:MM-HH:MM [time zone], not %q", spec)
+	}
+
+	w := &Window{location: time.UTC}
+	i := 0
+	if !strings.Contains(fields[0], ":") {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		w.days = days
+		i++
+	} else {
+		for day := range w.days {
+			w.days[day] = true
+		}
+	}
+
+	if i >= len(fields) {
+		return nil, fmt.Errorf("%q has no times", spec)
+	}
+	times := strings.SplitN(fields[i], "-", 2)
+	if len(times) != 2 {
+		return nil, fmt.Errorf("expected a range of times like 09:00-17:00, not %q", fields[i])
+	}
+	var err error
+	if w.start, err = parseTime(times[0]); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseTime(times[1]); err != nil {
+		return nil, err
+	}
+	i++
+
+	if i < len(fields) {
+		if w.location, err = time.LoadLocation(fields[i]); err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", fields[i])
+		}
+		i++
+	}
+	if i < len(fields) {
+		return nil, fmt.Errorf("unexpected %q after the time zone", fields[i])
+	}
+	return w, nil
+}
+
+// parseDays parses a list of days and ranges of days, like "mon,wed-fri"
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := dayIndex(bounds[0])
+		if !ok {
+			return days, fmt.Errorf("unknown day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = dayIndex(bounds[1]); !ok {
+				return days, fmt.Errorf("unknown day %q", bounds[1])
+			}
+		}
+		// Ranges can wrap around the end of the week, like fri-mon
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func dayIndex(name string) (int, bool) {
+	for i, day := range dayNames {
+		if name == day {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseTime parses a time of day like "09:30", returning minutes after midnight.
+// "24:00" is the end of the day.
+func parseTime(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 2 {
+		hours, err1 := strconv.Atoi(parts[0])
+		minutes, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil && hours >= 0 && minutes >= 0 && minutes < 60 &&
+			(hours < 24 || (hours == 24 && minutes == 0)) {
+			return hours*60 + minutes, nil
+		}
+	}
+	return 0, fmt.Errorf("expected a time like 09:00, not %q", s)
+}
+
+// Contains returns true if t is in the window
+func (w *Window) Contains(t time.Time) bool {
+	t = t.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+
+	if w.start <= w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// Past midnight, the window is on if it started the day before
+	if minute >= w.start {
+		return w.days[day]
+	}
+	return minute < w.end && w.days[(day+6)%7]
+}
+
+// Schedule is any number of windows. Times in any of them are in the schedule.
+type Schedule []*Window
+
+// ParseSchedule parses each window of a schedule, see Parse
+func ParseSchedule(specs []string) (Schedule, error) {
+	s := make(Schedule, 0, len(specs))
+	for _, spec := range specs {
+		w, err := Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, w)
+	}
+	return s, nil
+}
+
+// Contains returns true if t is in one of the windows, or if there aren't any
+func (s Schedule) Contains(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, w := range s {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
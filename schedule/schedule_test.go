@@ -0,0 +1,85 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"09:00-17:00", true},
+		{"mon-fri 09:00-17:00", true},
+		{"sat,sun 10:00-12:00 UTC", true},
+		{"mon,wed-fri 22:00-06:00 Europe/London", true},
+		{"00:00-24:00", true},
+		{"", false},
+		{"mon-fri", false},
+		{"someday 09:00-17:00", false},
+		{"09:00", false},
+		{"09:00-25:00", false},
+		{"9-17", false},
+		{"09:00-17:00 Nowhere/Special", false},
+		{"mon 09:00-17:00 UTC extra", false},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.spec)
+		assert.Equal(t, tt.ok, err == nil, tt.spec)
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	// 2021-03-01 was a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		spec string
+		t    time.Time
+		in   bool
+	}{
+		{"mon-fri 09:00-17:00", at(1, 9, 0), true},
+		{"mon-fri 09:00-17:00", at(1, 16, 59), true},
+		{"mon-fri 09:00-17:00", at(1, 17, 0), false},
+		{"mon-fri 09:00-17:00", at(1, 8, 59), false},
+		{"mon-fri 09:00-17:00", at(6, 12, 0), false}, // Saturday
+		{"fri-mon 09:00-17:00", at(7, 12, 0), true},  // Sunday
+		{"fri-mon 09:00-17:00", at(2, 12, 0), false}, // Tuesday
+		{"09:00-17:00", at(7, 12, 0), true},
+		{"fri 22:00-02:00", at(5, 23, 0), true},
+		{"fri 22:00-02:00", at(6, 1, 0), true},  // Saturday morning, still Friday night
+		{"fri 22:00-02:00", at(5, 1, 0), false}, // Friday morning is Thursday night
+		{"00:00-24:00", at(3, 23, 59), true},
+		{"mon 09:00-17:00 America/New_York", at(1, 15, 0), true}, // 10:00 in New York
+		{"mon 09:00-17:00 America/New_York", at(1, 23, 0), false},
+	}
+
+	for _, tt := range tests {
+		w, err := Parse(tt.spec)
+		if !assert.NoError(t, err, tt.spec) {
+			continue
+		}
+		assert.Equal(t, tt.in, w.Contains(tt.t), "%s at %s", tt.spec, tt.t)
+	}
+}
+
+func TestScheduleContains(t *testing.T) {
+	s, err := ParseSchedule([]string{"mon 09:00-12:00", "mon 13:00-17:00"})
+	assert.NoError(t, err)
+
+	monday := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	assert.True(t, s.Contains(monday.Add(10*time.Hour)))
+	assert.False(t, s.Contains(monday.Add(12*time.Hour+30*time.Minute)))
+	assert.True(t, s.Contains(monday.Add(14*time.Hour)))
+
+	assert.True(t, Schedule(nil).Contains(monday), "no windows means always")
+
+	_, err = ParseSchedule([]string{"mon 09:00-12:00", "nope"})
+	assert.Error(t, err)
+}
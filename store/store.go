@@ -0,0 +1,272 @@
+// Package store is a small JSON file backed database for bridge state that should survive restarts.
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// flushInterval is how long writes with SetCapped wait before being saved, so that
+// a busy channel doesn't rewrite the file for every message
+var flushInterval = 5 * time.Second
+
+// version is the version of the file format, which is the number of migrations
+var version = len(migrations)
+
+// migrations upgrade the file's buckets from the version at their index to the next one.
+// Add new migrations to the end, as files record the version they were saved with.
+var migrations = []func(buckets map[string]map[string]string){
+	// 0: files were only the buckets, which Open handles, so there is nothing to change
+	func(map[string]map[string]string) {},
+}
+
+// file is what is saved to disk
+type file struct {
+	Version int                          `json:"version"`
+	Buckets map[string]map[string]string `json:"buckets"`
+}
+
+// Store holds string values grouped into buckets.
+// Writes are saved to disk straight away, apart from SetCapped (see flushInterval),
+// unless the store is in-memory only. Close saves anything that is left.
+type Store struct {
+	mu      sync.RWMutex
+	path    string
+	buckets map[string]map[string]string
+
+	// capped are the keys of buckets written with SetCapped, oldest first
+	capped map[string][]string
+	// dirty is true if there are writes that haven't been saved, which flushTimer will save
+	dirty      bool
+	flushTimer *time.Timer
+}
+
+// Open loads the store at path, creating it if it does not exist.
+// A blank path gives an in-memory store that is lost on restart.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, buckets: make(map[string]map[string]string), capped: make(map[string][]string)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read store: %w", err)
+	}
+
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil || f.Buckets == nil {
+		// Stores without a version are just the buckets
+		f = file{Version: 0}
+		if err := json.Unmarshal(data, &f.Buckets); err != nil {
+			return nil, fmt.Errorf("could not parse store %s: %w", path, err)
+		}
+	}
+	if f.Version > version {
+		return nil, fmt.Errorf("store %s is from a newer version (%d, we support up to %d)", path, f.Version, version)
+	}
+	if f.Buckets != nil {
+		s.buckets = f.Buckets
+	}
+
+	if f.Version < version {
+		for _, migrate := range migrations[f.Version:] {
+			migrate(s.buckets)
+		}
+		if err := s.save(); err != nil {
+			return nil, fmt.Errorf("could not save migrated store %s: %w", path, err)
+		}
+	}
+	return s, nil
+}
+
+// Get returns the value of key in bucket.
+func (s *Store) Get(bucket, key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.buckets[bucket][key]
+	return value, ok
+}
+
+// Has returns true if key is in bucket.
+func (s *Store) Has(bucket, key string) bool {
+	_, ok := s.Get(bucket, key)
+	return ok
+}
+
+// Keys returns the sorted keys in bucket.
+func (s *Store) Keys(bucket string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Set stores value under key in bucket.
+func (s *Store) Set(bucket, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucket]
+	if !ok {
+		b = make(map[string]string)
+		s.buckets[bucket] = b
+	}
+	b[key] = value
+	return s.save()
+}
+
+// SetCapped stores value under key in bucket, removing the oldest keys so that at most keep are left.
+// Keys must sort by age when compared as numbers, like Discord snowflakes. It is for buckets written
+// often, like message IDs, so it is saved within flushInterval rather than straight away.
+func (s *Store) SetCapped(bucket, key, value string, keep int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucket]
+	if !ok {
+		b = make(map[string]string)
+		s.buckets[bucket] = b
+	}
+
+	order := s.cappedOrder(bucket)
+	if _, ok := b[key]; !ok {
+		i := sort.Search(len(order), func(i int) bool { return !numericLess(order[i], key) })
+		order = append(order, "")
+		copy(order[i+1:], order[i:])
+		order[i] = key
+	}
+	b[key] = value
+
+	for len(order) > keep {
+		delete(b, order[0])
+		order = order[1:]
+	}
+	s.capped[bucket] = order
+
+	s.saveLater()
+	return nil
+}
+
+// cappedOrder returns the keys of bucket oldest first, for SetCapped. They are only
+// sorted the first time, and kept in order after that. It must be called with mu held.
+func (s *Store) cappedOrder(bucket string) []string {
+	if order, ok := s.capped[bucket]; ok {
+		return order
+	}
+
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return numericLess(keys[i], keys[j]) })
+	return keys
+}
+
+// numericLess compares keys that are numbers without leading zeros
+func numericLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// Delete removes key from bucket.
+func (s *Store) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket][key]; !ok {
+		return nil
+	}
+	delete(s.buckets[bucket], key)
+	if len(s.buckets[bucket]) == 0 {
+		delete(s.buckets, bucket)
+	}
+	if order, ok := s.capped[bucket]; ok {
+		for i, k := range order {
+			if k == key {
+				s.capped[bucket] = append(order[:i:i], order[i+1:]...)
+				break
+			}
+		}
+	}
+	return s.save()
+}
+
+// Close saves writes that are waiting for flushInterval.
+// The store can still be used afterwards, but writes with SetCapped may not be saved.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// saveLater saves the store within flushInterval. It must be called with mu held.
+func (s *Store) saveLater() {
+	if s.path == "" {
+		return
+	}
+	s.dirty = true
+	if s.flushTimer == nil {
+		s.flushTimer = time.AfterFunc(flushInterval, s.flush)
+	}
+}
+
+// flush saves writes waiting for flushInterval, trying again later if that fails
+func (s *Store) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushTimer = nil
+	if s.dirty && s.save() != nil {
+		s.saveLater()
+	}
+}
+
+// save writes the store to a temporary file and renames it over the old one,
+// so that a crash never leaves a half written store behind.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(file{Version: version, Buckets: s.buckets}, "", "\t")
+	if err != nil {
+		return fmt.Errorf("could not encode store: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not save store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("could not save store: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
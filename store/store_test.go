@@ -0,0 +1,121 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	s, err := Open("")
+	assert.NoError(t, err)
+
+	_, ok := s.Get("a", "b")
+	assert.False(t, ok)
+
+	assert.NoError(t, s.Set("a", "b", "c"))
+	assert.NoError(t, s.Set("a", "a", ""))
+	value, ok := s.Get("a", "b")
+	assert.True(t, ok)
+	assert.Equal(t, "c", value)
+	assert.True(t, s.Has("a", "a"))
+	assert.Equal(t, []string{"a", "b"}, s.Keys("a"))
+
+	assert.NoError(t, s.Delete("a", "b"))
+	assert.False(t, s.Has("a", "b"))
+	assert.Equal(t, []string{}, s.Keys("missing"))
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := Open(path)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set("optout", "123", ""))
+	assert.NoError(t, s.Set("optout", "456", ""))
+	assert.NoError(t, s.Delete("optout", "456"))
+
+	s, err = Open(path)
+	assert.NoError(t, err)
+	assert.True(t, s.Has("optout", "123"))
+	assert.False(t, s.Has("optout", "456"))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = Open(path)
+	assert.Error(t, err)
+}
+
+func TestMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	// Stores used to be saved without a version
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"optout": {"123": ""}}`), 0600))
+	s, err := Open(path)
+	assert.NoError(t, err)
+	assert.True(t, s.Has("optout", "123"))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"version": 1`)
+
+	s, err = Open(path)
+	assert.NoError(t, err)
+	assert.True(t, s.Has("optout", "123"))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"version": 99, "buckets": {}}`), 0600))
+	_, err = Open(path)
+	assert.Error(t, err)
+}
+
+func TestSetCapped(t *testing.T) {
+	s, err := Open("")
+	assert.NoError(t, err)
+
+	for _, key := range []string{"9", "10", "11", "8", "12"} {
+		assert.NoError(t, s.SetCapped("ids", key, "v"+key, 3))
+	}
+	assert.Equal(t, []string{"10", "11", "12"}, s.Keys("ids"))
+
+	value, _ := s.Get("ids", "12")
+	assert.Equal(t, "v12", value)
+
+	assert.NoError(t, s.Delete("ids", "11"))
+	assert.NoError(t, s.SetCapped("ids", "13", "v13", 3))
+	assert.Equal(t, []string{"10", "12", "13"}, s.Keys("ids"))
+}
+
+func TestSetCappedFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := Open(path)
+	assert.NoError(t, err)
+	assert.NoError(t, s.SetCapped("ids", "1", "a", 2))
+
+	// Not saved until the flush, or Close
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, s.Close())
+
+	s, err = Open(path)
+	assert.NoError(t, err)
+	value, ok := s.Get("ids", "1")
+	assert.True(t, ok)
+	assert.Equal(t, "a", value)
+
+	// Capping carries on from the keys that were loaded
+	assert.NoError(t, s.SetCapped("ids", "3", "c", 2))
+	assert.NoError(t, s.SetCapped("ids", "2", "b", 2))
+	assert.Equal(t, []string{"2", "3"}, s.Keys("ids"))
+}
@@ -0,0 +1,103 @@
+package transmitter
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ThreadsBucket is the Cache bucket threads sent to are saved in, so they can be recreated if deleted
+const ThreadsBucket = "webhook_threads"
+
+// errCodeArchivedThread is the error Discord gives for sending to an archived thread
+const errCodeArchivedThread = 50083
+
+// ErrThreadNotFound is returned when sending to a thread that has been deleted
+var ErrThreadNotFound = errors.New("thread does not exist")
+
+// Thread describes a channel messages were sent to. ParentID is blank if it isn't a thread.
+type Thread struct {
+	ParentID string
+	Name     string
+}
+
+// ThreadInfo returns the parent channel and name of a thread sent to before, even if it was deleted
+func (t *Transmitter) ThreadInfo(threadID string) (Thread, bool) {
+	t.mu.Lock()
+	th, ok := t.threads[threadID]
+	t.mu.Unlock()
+	if ok && th.ParentID != "" {
+		return th, true
+	}
+
+	if t.Cache == nil {
+		return Thread{}, false
+	}
+	value, ok := t.Cache.Get(ThreadsBucket, threadID)
+	if !ok {
+		return Thread{}, false
+	}
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 {
+		return Thread{}, false
+	}
+	return Thread{ParentID: parts[0], Name: parts[1]}, true
+}
+
+// target returns the channel to use a webhook in to send to channelID, and the thread
+// to send in, if channelID is a thread
+func (t *Transmitter) target(channelID string) (parentID, threadID string, err error) {
+	t.mu.Lock()
+	th, ok := t.threads[channelID]
+	t.mu.Unlock()
+
+	if !ok {
+		ch, err := t.session.State.Channel(channelID)
+		if err != nil {
+			ch, err = t.session.Channel(channelID)
+		}
+		if err != nil {
+			if _, saved := t.ThreadInfo(channelID); saved && isRESTError(err, discordgo.ErrCodeUnknownChannel) {
+				return "", "", ErrThreadNotFound
+			}
+			// Try it as a channel, which will fail if it is a problem
+			return channelID, "", nil
+		}
+
+		th = Thread{Name: ch.Name}
+		if ch.IsThread() {
+			th.ParentID = ch.ParentID
+			t.saveThread(channelID, th)
+		}
+		t.mu.Lock()
+		t.threads[channelID] = th
+		t.mu.Unlock()
+	}
+
+	if th.ParentID == "" {
+		return channelID, "", nil
+	}
+	return th.ParentID, channelID, nil
+}
+
+// unarchive unarchives a thread, so that messages can be sent to it
+func (t *Transmitter) unarchive(threadID string) error {
+	// ChannelEdit would also send position 0, so only archived is sent
+	endpoint := discordgo.EndpointChannel(threadID)
+	_, err := t.session.RequestWithBucketID("PATCH", endpoint, map[string]bool{"archived": false}, endpoint)
+	if err != nil {
+		t.Log.WithError(err).WithField("thread", threadID).Warnln("could not unarchive thread")
+	}
+	return err
+}
+
+// saveThread saves a thread's parent and name to Cache
+func (t *Transmitter) saveThread(threadID string, th Thread) {
+	if t.Cache == nil {
+		return
+	}
+	if err := t.Cache.Set(ThreadsBucket, threadID, th.ParentID+" "+th.Name); err != nil {
+		t.Log.WithError(err).WithField("thread", threadID).Warnln("could not save thread")
+	}
+}
@@ -0,0 +1,404 @@
+// Package transmitter sends messages to Discord channels through webhooks, creating them as needed.
+//
+// It started out as matterbridge's transmitter, and also saves the webhooks it uses, makes new
+// ones when they are deleted, and can take turns between several webhooks in each channel.
+package transmitter
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheBucket is the Cache bucket webhooks are saved in, by channel ID
+const CacheBucket = "webhooks"
+
+// ErrWebhookNotFound is returned when a channel has no webhook, and it can't be created
+var ErrWebhookNotFound = errors.New("webhook for this channel and message does not exist")
+
+// ErrPermissionDenied is returned when the bot is not allowed to look up or create webhooks
+var ErrPermissionDenied = errors.New("missing 'Manage Webhooks' permission")
+
+// Cache saves the webhooks used in each channel, so they don't need looking up on restart
+type Cache interface {
+	Get(bucket, key string) (string, bool)
+	Keys(bucket string) []string
+	Set(bucket, key, value string) error
+	Delete(bucket, key string) error
+}
+
+// Transmitter sends messages to Discord channels through webhooks
+type Transmitter struct {
+	session    *discordgo.Session
+	guilds     []string
+	title      string
+	autoCreate bool
+
+	// Log is where problems are logged
+	Log *log.Entry
+	// Cache saves the webhooks used, if set
+	Cache Cache
+
+	mu       sync.Mutex
+	rotate   int
+	channels map[string]*channel
+	// given are webhooks to use as they are, by channel, see SetWebhooks
+	given map[string]*discordgo.Webhook
+	// threads are the channels sent to so far, by ID, and which of them are threads
+	threads map[string]Thread
+}
+
+// channel holds the webhooks used in one Discord channel
+type channel struct {
+	webhooks []*discordgo.Webhook
+	// current is the webhook last sent with, by lastUsername
+	current      int
+	lastUsername string
+}
+
+// New returns a Transmitter for guilds that uses webhooks named title. If autoCreate is set,
+// webhooks are created in channels without one.
+func New(session *discordgo.Session, guilds []string, title string, autoCreate bool) *Transmitter {
+	return &Transmitter{
+		session:    session,
+		guilds:     guilds,
+		title:      title,
+		autoCreate: autoCreate,
+		Log:        log.NewEntry(log.StandardLogger()),
+		rotate:     1,
+		channels:   make(map[string]*channel),
+		threads:    make(map[string]Thread),
+	}
+}
+
+// SetRotate sets how many webhooks to take turns between in each channel. With more than one,
+// a message from someone other than the last person is sent with the next webhook, so that
+// Discord doesn't show it as part of the last person's messages. Extra webhooks are created
+// in each channel as it is next sent to.
+func (t *Transmitter) SetRotate(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate = n
+}
+
+// SetWebhooks sets webhooks to always use in some channels, by channel ID, instead of finding or
+// creating them. They are never rotated or replaced.
+func (t *Transmitter) SetWebhooks(webhooks map[string]*discordgo.Webhook) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.given = webhooks
+}
+
+// Send sends a message to channelID, making a new webhook if the one it had was deleted.
+// If channelID is a thread, the message is sent with a webhook in its parent channel, and
+// the thread is unarchived if needed. Returns ErrThreadNotFound if the thread was deleted.
+func (t *Transmitter) Send(channelID string, params *discordgo.WebhookParams) (*discordgo.Message, error) {
+	parentID, threadID, err := t.target(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	if wh, ok := t.givenWebhook(channelID); ok {
+		return t.execute(wh, threadID, params)
+	} else if wh, ok := t.givenWebhook(parentID); ok {
+		return t.execute(wh, threadID, params)
+	}
+
+	wh, err := t.webhookFor(parentID, params.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := t.execute(wh, threadID, params)
+	if isUnknownWebhook(err) {
+		t.Log.WithField("channel", parentID).WithField("webhook", wh.ID).Warnln("webhook was deleted, making a new one")
+		t.forget(parentID, wh.ID)
+
+		if wh, err = t.webhookFor(parentID, params.Username); err != nil {
+			return nil, err
+		}
+		msg, err = t.execute(wh, threadID, params)
+	}
+	return msg, err
+}
+
+// execute sends a message with a webhook, in threadID if it isn't blank
+func (t *Transmitter) execute(wh *discordgo.Webhook, threadID string, params *discordgo.WebhookParams) (*discordgo.Message, error) {
+	if threadID == "" {
+		return t.session.WebhookExecute(wh.ID, wh.Token, true, params)
+	}
+
+	msg, err := t.session.WebhookThreadExecute(wh.ID, wh.Token, true, threadID, params)
+	if isRESTError(err, errCodeArchivedThread) {
+		if err := t.unarchive(threadID); err != nil {
+			return nil, err
+		}
+		msg, err = t.session.WebhookThreadExecute(wh.ID, wh.Token, true, threadID, params)
+	}
+	if isRESTError(err, discordgo.ErrCodeUnknownChannel) {
+		return nil, ErrThreadNotFound
+	}
+	return msg, err
+}
+
+// HasWebhook returns true if id is one of the webhooks messages are sent with
+func (t *Transmitter) HasWebhook(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, wh := range t.given {
+		if wh.ID == id {
+			return true
+		}
+	}
+	for _, c := range t.channels {
+		for _, wh := range c.webhooks {
+			if wh.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LoadCache loads the webhooks saved in Cache, returning false if there were none
+func (t *Transmitter) LoadCache() bool {
+	if t.Cache == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	found := false
+	for _, channelID := range t.Cache.Keys(CacheBucket) {
+		value, _ := t.Cache.Get(CacheBucket, channelID)
+		if webhooks := decodeWebhooks(channelID, value); len(webhooks) > 0 {
+			t.channels[channelID] = &channel{webhooks: webhooks}
+			found = true
+		}
+	}
+	return found
+}
+
+// RefreshGuildWebhooks forgets the webhooks in use, and finds those named after the
+// transmitter in the guilds again. If wantChannels is not empty, only those channels are refreshed.
+func (t *Transmitter) RefreshGuildWebhooks(wantChannels []string) error {
+	var webhooks []*discordgo.Webhook
+	for _, guild := range t.guilds {
+		guildWebhooks, err := t.session.GuildWebhooks(guild)
+		if err != nil {
+			if isForbidden(err) {
+				return ErrPermissionDenied
+			}
+			return err
+		}
+		webhooks = append(webhooks, guildWebhooks...)
+	}
+
+	want := make(map[string]bool, len(wantChannels))
+	for _, channelID := range wantChannels {
+		want[channelID] = true
+	}
+
+	found := make(map[string]*channel)
+	for _, wh := range webhooks {
+		// Webhooks made by other bots don't come with a token
+		if wh.Name != t.title || wh.Token == "" || (len(want) > 0 && !want[wh.ChannelID]) {
+			continue
+		}
+		if found[wh.ChannelID] == nil {
+			found[wh.ChannelID] = &channel{}
+		}
+		found[wh.ChannelID].webhooks = append(found[wh.ChannelID].webhooks, wh)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for channelID := range t.channels {
+		if len(want) == 0 || want[channelID] {
+			delete(t.channels, channelID)
+			t.save(channelID)
+		}
+	}
+	for channelID, c := range found {
+		t.channels[channelID] = c
+		t.save(channelID)
+	}
+	return nil
+}
+
+// givenWebhook returns the webhook set for channelID with SetWebhooks, if there is one
+func (t *Transmitter) givenWebhook(channelID string) (*discordgo.Webhook, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	wh, ok := t.given[channelID]
+	return wh, ok
+}
+
+// webhookFor returns the webhook to send a message from username to channelID with,
+// creating webhooks until the channel has as many as it should
+func (t *Transmitter) webhookFor(channelID, username string) (*discordgo.Webhook, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.channels[channelID]
+	if c == nil {
+		c = &channel{}
+		t.channels[channelID] = c
+	}
+
+	if len(c.webhooks) < t.rotate && t.autoCreate {
+		for len(c.webhooks) < t.rotate {
+			wh, err := t.session.WebhookCreate(channelID, t.title, "")
+			if err != nil {
+				if len(c.webhooks) > 0 {
+					// Make do with the ones we have
+					t.Log.WithError(err).WithField("channel", channelID).Warnln("could not create another webhook")
+					break
+				}
+				if isForbidden(err) {
+					return nil, ErrPermissionDenied
+				}
+				return nil, err
+			}
+			c.webhooks = append(c.webhooks, wh)
+		}
+		t.save(channelID)
+	}
+
+	if len(c.webhooks) == 0 {
+		return nil, ErrWebhookNotFound
+	}
+	return c.webhooks[c.pick(username, t.rotate)], nil
+}
+
+// pick returns the index of the webhook to send a message from username with, out of the first
+// rotate webhooks. It moves on to the next webhook whenever someone else is sending.
+func (c *channel) pick(username string, rotate int) int {
+	n := len(c.webhooks)
+	if rotate < n {
+		n = rotate
+	}
+
+	if username != c.lastUsername {
+		c.current++
+		c.lastUsername = username
+	}
+	if c.current >= n {
+		c.current = 0
+	}
+	return c.current
+}
+
+// forget stops using a webhook that no longer exists
+func (t *Transmitter) forget(channelID, webhookID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.channels[channelID]
+	if c == nil {
+		return
+	}
+	for i, wh := range c.webhooks {
+		if wh.ID == webhookID {
+			c.webhooks = append(c.webhooks[:i], c.webhooks[i+1:]...)
+			break
+		}
+	}
+	t.save(channelID)
+}
+
+// save writes the webhooks of a channel to Cache. It must be called with mu held.
+func (t *Transmitter) save(channelID string) {
+	if t.Cache == nil {
+		return
+	}
+
+	var err error
+	if c := t.channels[channelID]; c != nil && len(c.webhooks) > 0 {
+		err = t.Cache.Set(CacheBucket, channelID, encodeWebhooks(c.webhooks))
+	} else {
+		err = t.Cache.Delete(CacheBucket, channelID)
+	}
+	if err != nil {
+		t.Log.WithError(err).WithField("channel", channelID).Warnln("could not save webhooks")
+	}
+}
+
+// encodeWebhooks and decodeWebhooks turn webhooks into "id:token,id:token" and back
+func encodeWebhooks(webhooks []*discordgo.Webhook) string {
+	pairs := make([]string, len(webhooks))
+	for i, wh := range webhooks {
+		pairs[i] = wh.ID + ":" + wh.Token
+	}
+	return strings.Join(pairs, ",")
+}
+
+func decodeWebhooks(channelID, value string) []*discordgo.Webhook {
+	var webhooks []*discordgo.Webhook
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		webhooks = append(webhooks, &discordgo.Webhook{ID: parts[0], Token: parts[1], ChannelID: channelID})
+	}
+	return webhooks
+}
+
+// ParseWebhookURL returns the webhook in a URL like https://discord.com/api/webhooks/<id>/<token>
+func ParseWebhookURL(webhookURL string) (*discordgo.Webhook, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || !(u.Host == "discord.com" || strings.HasSuffix(u.Host, ".discord.com") ||
+		u.Host == "discordapp.com" || strings.HasSuffix(u.Host, ".discordapp.com")) {
+		return nil, fmt.Errorf("%q is not a Discord webhook URL", webhookURL)
+	}
+
+	// The API version is optional, as in /api/v10/webhooks/<id>/<token>
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+2 < len(parts); i++ {
+		if parts[i] == "webhooks" && parts[i+1] != "" && parts[i+2] != "" {
+			return &discordgo.Webhook{ID: parts[i+1], Token: parts[i+2]}, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not a Discord webhook URL", webhookURL)
+}
+
+// isUnknownWebhook returns true if err says the webhook doesn't exist any more
+func isUnknownWebhook(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) {
+		return false
+	}
+	if restErr.Message != nil && restErr.Message.Code != 0 {
+		return restErr.Message.Code == discordgo.ErrCodeUnknownWebhook
+	}
+	return restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound
+}
+
+// isRESTError returns true if err is a Discord error with code
+func isRESTError(err error, code int) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == code
+}
+
+// isForbidden returns true if err says the bot isn't allowed to do something
+func isForbidden(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusForbidden
+}
@@ -0,0 +1,79 @@
+package transmitter
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPick(t *testing.T) {
+	c := &channel{webhooks: []*discordgo.Webhook{{ID: "1"}, {ID: "2"}}}
+
+	tests := []struct {
+		username string
+		rotate   int
+		want     int
+	}{
+		{"alice", 2, 1},
+		{"alice", 2, 1},
+		{"bob", 2, 0},
+		{"alice", 2, 1},
+		{"carol", 1, 0},
+		{"dave", 1, 0},
+		// More than there are webhooks
+		{"erin", 3, 1},
+		{"frank", 3, 0},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, c.pick(tt.username, tt.rotate), "%s with rotate %d", tt.username, tt.rotate)
+	}
+}
+
+func TestEncodeWebhooks(t *testing.T) {
+	webhooks := []*discordgo.Webhook{
+		{ID: "1", Token: "abc", ChannelID: "42"},
+		{ID: "2", Token: "d-e_f", ChannelID: "42"},
+	}
+
+	value := encodeWebhooks(webhooks)
+	assert.Equal(t, "1:abc,2:d-e_f", value)
+	assert.Equal(t, webhooks, decodeWebhooks("42", value))
+
+	assert.Empty(t, decodeWebhooks("42", ""))
+	assert.Equal(t, webhooks[:1], decodeWebhooks("42", "1:abc,broken,:x"))
+}
+
+func TestParseWebhookURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		id    string
+		token string
+	}{
+		{"https://discord.com/api/webhooks/123/abc-DEF_1", "123", "abc-DEF_1"},
+		{"https://discordapp.com/api/webhooks/123/abc/", "123", "abc"},
+		{"https://canary.discord.com/api/v10/webhooks/123/abc", "123", "abc"},
+		{"https://discord.com/api/webhooks/123/abc?wait=true", "123", "abc"},
+	}
+
+	for _, tt := range tests {
+		wh, err := ParseWebhookURL(tt.url)
+		if assert.NoError(t, err, tt.url) {
+			assert.Equal(t, tt.id, wh.ID, tt.url)
+			assert.Equal(t, tt.token, wh.Token, tt.url)
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"http://discord.com/api/webhooks/123/abc",
+		"https://example.com/api/webhooks/123/abc",
+		"https://discord.com.example.com/api/webhooks/123/abc",
+		"https://discord.com/api/webhooks/123",
+		"https://discord.com/api/channels/123/abc",
+	} {
+		_, err := ParseWebhookURL(bad)
+		assert.Error(t, err, bad)
+	}
+}
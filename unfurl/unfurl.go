@@ -0,0 +1,299 @@
+// Package unfurl fetches the titles of web pages and images linked to, for people whose chat client
+// doesn't show link previews.
+// Only public addresses are fetched, so that links can't be used to reach services on the bridge's network.
+package unfurl
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Defaults for an Unfurler's limits
+const (
+	DefaultTimeout   = 5 * time.Second
+	DefaultMaxBytes  = 512 * 1024
+	DefaultMaxLength = 200
+	DefaultCacheTTL  = time.Hour
+	DefaultCacheSize = 500
+)
+
+// errNotPublic is returned when a URL's host resolves to an address that isn't public,
+// and errTooLarge when an image is bigger than the limit
+var (
+	errNotPublic = errors.New("not a public address")
+	errTooLarge  = errors.New("the image is too large")
+)
+
+var (
+	urlPattern   = regexp.MustCompile(`https?://[^\s<>"]+`)
+	titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	// ogTitlePattern matches <meta property="og:title" content="...">, for pages without a <title>
+	ogTitlePattern = regexp.MustCompile(`(?is)<meta[^>]+property=["']og:title["'][^>]+content=["']([^"']*)["']`)
+)
+
+// URLs returns the http and https URLs in text, without trailing punctuation
+func URLs(text string) []string {
+	var urls []string
+	for _, u := range urlPattern.FindAllString(text, -1) {
+		for u != "" {
+			last := u[len(u)-1]
+			// Closing brackets are kept if they close one in the URL, like Wikipedia's
+			if !strings.ContainsRune(".,:;!?'*_|", rune(last)) &&
+				(last != ')' || strings.Count(u, "(") >= strings.Count(u, ")")) {
+				break
+			}
+			u = u[:len(u)-1]
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// imageExtensions are the types of image downloaded by Image, by extension
+var imageExtensions = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// IsImageURL returns true if a URL looks like it links to an image, going by its extension
+func IsImageURL(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return false
+	}
+	_, ok := imageExtensions[strings.ToLower(path.Ext(parsed.Path))]
+	return ok
+}
+
+// ParseTitle returns the title of an HTML page, on one line, or "" if it doesn't have one
+func ParseTitle(page string) string {
+	match := titlePattern.FindStringSubmatch(page)
+	if match == nil || strings.TrimSpace(match[1]) == "" {
+		match = ogTitlePattern.FindStringSubmatch(page)
+	}
+	if match == nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(match[1])), " ")
+}
+
+// Unfurler fetches and caches page titles. It is safe to use from multiple goroutines.
+type Unfurler struct {
+	// MaxBytes is how much of a page is read looking for its title,
+	// and MaxLength how long a title can be before it is cut short
+	MaxBytes  int64
+	MaxLength int
+
+	client *http.Client
+
+	mu    sync.Mutex
+	ttl   time.Duration
+	size  int
+	cache map[string]cached
+}
+
+type cached struct {
+	title   string
+	expires time.Time
+}
+
+// New returns an Unfurler with the default limits
+func New() *Unfurler {
+	dialer := &net.Dialer{Timeout: DefaultTimeout, Control: dialPublic}
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   DefaultTimeout,
+		ResponseHeaderTimeout: DefaultTimeout,
+	}
+	return &Unfurler{
+		MaxBytes:  DefaultMaxBytes,
+		MaxLength: DefaultMaxLength,
+		client:    &http.Client{Transport: transport, Timeout: DefaultTimeout},
+		ttl:       DefaultCacheTTL,
+		size:      DefaultCacheSize,
+		cache:     make(map[string]cached),
+	}
+}
+
+// Title returns the title of the page at rawURL, or "" if it isn't an HTML page with a title.
+// Titles (including there not being one) are remembered for a while, but errors aren't.
+func (u *Unfurler) Title(rawURL string) (string, error) {
+	u.mu.Lock()
+	c, ok := u.cache[rawURL]
+	u.mu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.title, nil
+	}
+
+	title, err := u.fetch(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.MaxLength > 0 && len(title) > u.MaxLength {
+		title = strings.TrimSpace(truncate(title, u.MaxLength-len("…"))) + "…"
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	if len(u.cache) >= u.size {
+		for key, c := range u.cache {
+			if now.After(c.expires) || len(u.cache) >= u.size {
+				delete(u.cache, key)
+			}
+		}
+	}
+	u.cache[rawURL] = cached{title: title, expires: now.Add(u.ttl)}
+	return title, nil
+}
+
+// Image downloads the image at rawURL, if it is a PNG, JPEG, GIF or WebP no bigger than maxBytes.
+// Returns the image, and a file name for it. Images aren't cached.
+func (u *Unfurler) Image(rawURL string, maxBytes int64) ([]byte, string, error) {
+	resp, err := u.get(rawURL, "image/*")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("downloading gave %s", resp.Status)
+	}
+	contentType := strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+	ext := strings.ToLower(path.Ext(resp.Request.URL.Path))
+	if imageExtensions[ext] != contentType {
+		ext = ""
+		for e, t := range imageExtensions {
+			if t == contentType && (ext == "" || len(e) < len(ext)) {
+				ext = e
+			}
+		}
+	}
+	if ext == "" {
+		return nil, "", fmt.Errorf("%q is not an image type that can be downloaded", contentType)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, "", errTooLarge
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, "", errTooLarge
+	}
+
+	name := strings.TrimSuffix(path.Base(resp.Request.URL.Path), path.Ext(resp.Request.URL.Path))
+	if name == "" || name == "/" || name == "." {
+		name = "image"
+	}
+	return data, name + ext, nil
+}
+
+// get sends a GET request for rawURL, accepting the type accept
+func (u *Unfurler) get(rawURL, accept string) (*http.Response, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("can't fetch %s URLs", parsed.Scheme)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "go-discord-irc (link previews)")
+	return u.client.Do(req)
+}
+
+// fetch gets the title of the page at rawURL
+func (u *Unfurler) fetch(rawURL string) (string, error) {
+	resp, err := u.get(rawURL, "text/html")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return "", nil
+	}
+	page, err := ioutil.ReadAll(io.LimitReader(resp.Body, u.MaxBytes))
+	if err != nil {
+		return "", err
+	}
+	return ParseTitle(string(page)), nil
+}
+
+// dialPublic refuses to connect to addresses that aren't public, once the host has been resolved
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !IsPublic(ip) {
+		return errNotPublic
+	}
+	return nil
+}
+
+// privateNets are the address ranges that aren't reachable from the internet
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// IsPublic returns true if ip is reachable from the internet
+func IsPublic(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// truncate cuts s to at most length bytes, without splitting a character
+func truncate(s string, length int) string {
+	if length <= 0 {
+		return ""
+	}
+	if len(s) <= length {
+		return s
+	}
+	for length > 0 && !utf8.RuneStart(s[length]) {
+		length--
+	}
+	return s[:length]
+}
@@ -0,0 +1,145 @@
+package unfurl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestURLs(t *testing.T) {
+	tests := []struct {
+		text string
+		urls []string
+	}{
+		{"no links here", nil},
+		{"see https://example.com.", []string{"https://example.com"}},
+		{"(https://example.com/a) and http://example.org/b?c=d!", []string{"https://example.com/a", "http://example.org/b?c=d"}},
+		{"https://en.wikipedia.org/wiki/Go_(programming_language)", []string{"https://en.wikipedia.org/wiki/Go_(programming_language)"}},
+		{"<https://example.com/no-embed>", []string{"https://example.com/no-embed"}},
+		{"ftp://example.com", nil},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.urls, URLs(tt.text), tt.text)
+	}
+}
+
+func TestParseTitle(t *testing.T) {
+	tests := []struct {
+		page  string
+		title string
+	}{
+		{"<html><head><title>Example Domain</title></head></html>", "Example Domain"},
+		{"<TITLE lang=\"en\">\n  Fish &amp; Chips\n</TITLE>", "Fish & Chips"},
+		{`<title></title><meta property="og:title" content="From Open Graph">`, "From Open Graph"},
+		{"<p>no title</p>", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.title, ParseTitle(tt.page), tt.page)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00::1", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.public, IsPublic(net.ParseIP(tt.ip)), tt.ip)
+	}
+}
+
+func TestTitle(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, "<title>A very long title</title>")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, "<title>not html</title>")
+		}
+	}))
+	defer server.Close()
+
+	// The test server is on a private address, which New's client won't connect to
+	u := New()
+	_, err := u.Title(server.URL + "/page")
+	assert.Error(t, err)
+
+	u.client = server.Client()
+	u.MaxLength = 10
+	title, err := u.Title(server.URL + "/page")
+	assert.NoError(t, err)
+	assert.Equal(t, "A very…", title)
+
+	// Titles are cached
+	before := requests
+	title, err = u.Title(server.URL + "/page")
+	assert.NoError(t, err)
+	assert.Equal(t, "A very…", title)
+	assert.Equal(t, before, requests)
+
+	title, err = u.Title(server.URL + "/image")
+	assert.NoError(t, err)
+	assert.Equal(t, "", title)
+}
+
+func TestIsImageURL(t *testing.T) {
+	assert.True(t, IsImageURL("https://example.com/cat.PNG"))
+	assert.True(t, IsImageURL("http://example.com/a/b.jpeg?size=large"))
+	assert.False(t, IsImageURL("https://example.com/cat.png.html"))
+	assert.False(t, IsImageURL("https://example.com/"))
+	assert.False(t, IsImageURL("ftp://example.com/cat.png"))
+}
+
+func TestImage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cat.png":
+			w.Header().Set("Content-Type", "image/png")
+		case "/photo":
+			w.Header().Set("Content-Type", "image/jpeg")
+		case "/page.png":
+			w.Header().Set("Content-Type", "text/html")
+		}
+		fmt.Fprint(w, "0123456789")
+	}))
+	defer server.Close()
+
+	u := New()
+	u.client = server.Client()
+
+	data, name, err := u.Image(server.URL+"/cat.png", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+	assert.Equal(t, "cat.png", name)
+
+	_, name, err = u.Image(server.URL+"/photo", 100)
+	assert.NoError(t, err)
+	assert.Equal(t, "photo.jpg", name)
+
+	_, _, err = u.Image(server.URL+"/page.png", 100)
+	assert.Error(t, err)
+
+	_, _, err = u.Image(server.URL+"/cat.png", 5)
+	assert.Equal(t, errTooLarge, err)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/qaisjp/go-discord-irc/bridge"
+	"github.com/qaisjp/go-discord-irc/chanlog"
+	"github.com/qaisjp/go-discord-irc/configfile"
+	"github.com/qaisjp/go-discord-irc/rehost"
+	"github.com/qaisjp/go-discord-irc/schedule"
+	"github.com/qaisjp/go-discord-irc/transmitter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// options are the options that can be set at the top level, or for each network
+var options = []string{
+	"admin_discord_ids", "admin_discord_roles", "admin_irc_hostmasks", "allowed_discord_ids", "auto_map",
+	"auto_map_name_prefix", "avatar_cache_ttl", "avatar_command", "avatar_gravatar", "avatar_overrides",
+	"avatar_url", "away_status_channel", "connection_limit", "cooldown_duration", "ctcp_version",
+	"dead_letter_path", "debug", "delivery_failed_dm", "delivery_failed_emoji", "discord_bans_to_irc",
+	"discord_bots_allowed", "discord_bots_denied", "discord_link_quotes", "discord_message_filter",
+	"discord_offline_batch", "discord_offline_buffer", "discord_token", "discord_zombie_timeout",
+	"filter_channel", "guild_id", "ignored_discord_ids", "ignored_irc_hostmasks", "insecure",
+	"irc_chathistory_limit", "irc_delivery_timeout", "irc_down_notice", "irc_image_max_size",
+	"irc_image_uploads", "irc_invite_request", "irc_listener_account", "irc_listener_alt_nick",
+	"irc_listener_name", "irc_listener_password", "irc_listener_prejoin_commands", "irc_listener_realname",
+	"irc_listener_username", "irc_message_filter", "irc_moderation_action", "irc_moderation_role",
+	"irc_moderation_timeout", "irc_monitor_channel", "irc_monitor_nicks", "irc_offline_buffer", "irc_pass",
+	"irc_ping_interval", "irc_ping_timeout", "irc_puppet_prejoin_commands", "irc_quit_message",
+	"irc_send_burst", "irc_send_rate", "irc_server", "irc_server_name", "join_after_auth",
+	"joinquit_batch_delay", "joinquit_events", "joinquit_spoke_within", "log_dir", "log_dir_channels",
+	"log_dir_format", "log_dir_unrelayed", "max_nick_length", "max_puppets", "mod_channel",
+	"nickserv_identify", "no_tls", "publish_announcements", "puppet_idle_timeout", "puppet_nick_source",
+	"puppet_realname", "puppet_username", "rehost_location", "rehost_max_size", "rehost_password",
+	"rehost_public_url", "rehost_region", "rehost_target", "rehost_username", "relay_discord_bots",
+	"relay_discord_crossposts", "relay_discord_webhooks", "relay_excluded_roles", "relay_overflow_policy",
+	"relay_queue_size", "relay_roles", "relay_window_action", "resync_interval", "rewrites", "separator",
+	"services_ghost", "services_identify", "services_invite", "services_op", "services_regain",
+	"services_release", "services_request_op", "show_joinquit", "shutdown_timeout", "simple",
+	"slash_commands", "stats_discord_channel", "stats_interval", "stats_irc_topics", "stats_template",
+	"status_channel", "status_interval", "statusmsg_roles", "storage_path", "suffix", "throttle_action",
+	"throttle_channel", "throttle_interval", "throttle_messages", "throttle_mute_duration",
+	"throttle_repeats", "url_titles", "url_titles_allowed", "url_titles_denied", "webhook_rotation",
+	"webirc_gateway", "webirc_hostname", "webirc_pass",
+}
+
+// mapOptions are options that are maps with keys chosen by the user
+var mapOptions = []string{
+	"avatar_overrides", "channel_webhooks", "display_name_overrides", "joinquit_channels", "nick_overrides",
+	"nick_script_policies", "puppet_accounts", "relay_channel_roles", "relay_windows",
+}
+
+// globOptions are lists of glob patterns
+var globOptions = []string{"admin_irc_hostmasks", "ignored_irc_hostmasks", "url_titles_allowed", "url_titles_denied"}
+
+// filterOptions are lists of message filters, see messageFilters
+var filterOptions = []string{"discord_message_filter", "irc_message_filter"}
+
+// filterActions are the actions a message filter can have
+var filterActions = []string{bridge.FilterActionDrop, bridge.FilterActionRedact, bridge.FilterActionFlag}
+
+// enumOptions are options that can only be one of a few values
+var enumOptions = map[string][]string{
+	"relay_overflow_policy": {bridge.OverflowBlock, bridge.OverflowDropOldest, bridge.OverflowDropNewest},
+	"irc_moderation_action": {
+		bridge.ModerationActionNone, bridge.ModerationActionTimeout, bridge.ModerationActionKick, bridge.ModerationActionRole,
+	},
+	"throttle_action":     {bridge.ThrottleActionDrop, bridge.ThrottleActionDelay, bridge.ThrottleActionMute},
+	"irc_invite_request":  {bridge.InviteRequestNone, bridge.InviteRequestChanServ, bridge.InviteRequestKnock},
+	"relay_window_action": {bridge.PauseQueue, bridge.PauseDrop},
+	"log_dir_format":      {chanlog.FormatZNC, chanlog.FormatJSONL},
+	"rehost_target":       {rehost.TargetDir, rehost.TargetWebDAV, rehost.TargetS3},
+	"avatar_command":      {bridge.AvatarCommandOff, bridge.AvatarCommandOn, bridge.AvatarCommandReview},
+}
+
+// joinQuitEvents are the values joinquit_events and each channel's joinquit_channels can have
+var joinQuitEvents = []string{
+	bridge.JoinQuitEventJoin, bridge.JoinQuitEventPart, bridge.JoinQuitEventQuit,
+	bridge.JoinQuitEventKick, bridge.JoinQuitEventNick, bridge.JoinQuitEventMode,
+}
+
+// enumListOptions are lists (or maps of lists) that can only contain a few values
+var enumListOptions = map[string][]string{
+	"joinquit_events":   joinQuitEvents,
+	"joinquit_channels": joinQuitEvents,
+	"url_titles":        {bridge.DirectionDiscordToIRC, bridge.DirectionIRCToDiscord},
+}
+
+// configSchema returns the options the config file can have
+func configSchema() configfile.Schema {
+	known := []string{
+		"networks", "watch_config", "http_listen", "http_admin_token", "identd", "identd_port", "channel_mappings",
+		"channel_mappings.**", "log_level", "log_levels", "log_levels.*", "log_format", "log_file", "log_file_max_size",
+		"log_file_max_backups",
+	}
+	for _, option := range options {
+		known = append(known, option, "networks.*."+option)
+	}
+	for _, option := range mapOptions {
+		known = append(known, option, option+".**", "networks.*."+option, "networks.*."+option+".**")
+	}
+
+	return configfile.Schema{
+		Known:    known,
+		Required: []string{"discord_token", "guild_id", "irc_server", "irc_server_name"},
+	}
+}
+
+// validateConfig logs any problems with the config file at path, which viper has read.
+// Returns an error if the config can't be used.
+func validateConfig(v *viper.Viper, path, format string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	lines, err := configfile.Lines(data, format)
+	if err != nil {
+		return err
+	}
+
+	problems := configSchema().Validate(lines)
+	for option, line := range lines {
+		for _, globOption := range globOptions {
+			if option == globOption || (strings.HasPrefix(option, "networks.") && strings.HasSuffix(option, "."+globOption)) {
+				problems = append(problems, configfile.Globs(line, option, v.GetStringSlice(option))...)
+			}
+		}
+		for _, filterOption := range filterOptions {
+			if isOption(option, filterOption) {
+				problems = append(problems, filterProblems(line, option, messageFilters(v, option))...)
+			}
+		}
+		for enumOption, values := range enumOptions {
+			if option == enumOption || (strings.HasPrefix(option, "networks.") && strings.HasSuffix(option, "."+enumOption)) {
+				problems = append(problems, enumProblems(line, option, v.GetString(option), values)...)
+			}
+		}
+		if isOption(parentOption(option), "channel_webhooks") {
+			problems = append(problems, webhookProblems(line, option, v.GetString(option))...)
+		}
+		if isOption(parentOption(option), "relay_windows") {
+			if _, err := schedule.ParseSchedule(v.GetStringSlice(option)); err != nil {
+				problems = append(problems, configfile.Problem{Line: line, Message: fmt.Sprintf("%s: %s", option, err)})
+			}
+		}
+		for enumOption, values := range enumListOptions {
+			if isOption(option, enumOption) || isOption(parentOption(option), enumOption) {
+				for _, value := range v.GetStringSlice(option) {
+					problems = append(problems, enumProblems(line, option, value, values)...)
+				}
+			}
+		}
+	}
+	configfile.Sort(problems)
+
+	errs := 0
+	for _, p := range problems {
+		if p.Warning {
+			log.WithField("file", path).Warnln(p)
+			continue
+		}
+		errs++
+		log.WithField("file", path).Errorln(p)
+	}
+
+	if errs > 0 {
+		return fmt.Errorf("%d problem(s) with %s", errs, path)
+	}
+	return nil
+}
+
+// isOption returns true if option is name, at the top level or for a network
+func isOption(option, name string) bool {
+	return option == name || (strings.HasPrefix(option, "networks.") && strings.HasSuffix(option, "."+name))
+}
+
+// parentOption returns the option that option is in, like "a.b" for "a.b.c"
+func parentOption(option string) string {
+	if i := strings.LastIndexByte(option, '.'); i != -1 {
+		return option[:i]
+	}
+	return ""
+}
+
+// enumProblems returns a problem if value isn't one of values
+func enumProblems(line int, option, value string, values []string) []configfile.Problem {
+	for _, v := range values {
+		if value == v {
+			return nil
+		}
+	}
+	return []configfile.Problem{{
+		Line:    line,
+		Message: fmt.Sprintf("%s must be one of %s, not %q", option, strings.Join(values, ", "), value),
+	}}
+}
+
+// webhookProblems returns a problem if value isn't a webhook URL, or a secret that can't be read
+func webhookProblems(line int, option, value string) []configfile.Problem {
+	value, err := configfile.Expand(value)
+	if err == nil {
+		_, err = transmitter.ParseWebhookURL(value)
+	}
+	if err != nil {
+		return []configfile.Problem{{Line: line, Message: fmt.Sprintf("%s: %s", option, err)}}
+	}
+	return nil
+}
+
+// filterProblems returns the problems with the patterns and actions of message filters
+func filterProblems(line int, option string, filters []messageFilter) []configfile.Problem {
+	var problems []configfile.Problem
+	for _, filter := range filters {
+		problems = append(problems, configfile.Globs(line, option, []string{filter.match})...)
+		if filter.action != "" {
+			problems = append(problems, enumProblems(line, option, filter.action, filterActions)...)
+		}
+	}
+	return problems
+}